@@ -45,6 +45,10 @@ type yamlEnv struct {
 	StripeWebhook     string `yaml:"STRIPE_WEBHOOK_SECRET"`
 	AndroidVersions   string `yaml:"ANDROID_VERSIONS"`
 	IOSVersions       string `yaml:"IOS_VERSIONS"`
+	BusAddr           string `yaml:"BUS_ADDR"`
+	BusPass           string `yaml:"BUS_PASS"`
+	StoreFile         string `yaml:"STORE_FILE"`
+	DatastoreHost     string `yaml:"DATASTORE_HOST"`
 }
 
 func init() {
@@ -74,52 +78,87 @@ func init() {
 // Start does things after each init() but before first call to DispatchToAPIHandler; skipped when running any tests
 func Start() {
 	startDataStore()
+	startBus()
 	startMake()
+	startInsuranceReminders()
+	startServiceReminders()
+	startReferralAwards()
+	startFavoriteAlerts()
+	startSearchMatcher()
+	startDeletedPurge()
 }
 
 // Request is a superset of information that each API handler needs
 type Request struct {
-	Session        *Session            `json:"-" datastore:",omitempty"` // this is set from the Authorization header, not from the POST content
-	Subscription   *subscription       `json:"-" datastore:",omitempty"` // this is nil when called on API, or defined when some other datastore change triggers a subscription update
-	Subscribe      bool                `json:",omitempty" datastore:",omitempty"`
-	SubscriptionID int64               `json:",omitempty" datastore:",omitempty"`
-	QA             bool                `json:",omitempty" datastore:",omitempty"`
-	OrgID          int64               `json:",omitempty" datastore:",omitempty"`
-	UserID         int64               `json:",omitempty" datastore:",omitempty"`
-	BoatID         int64               `json:",omitempty" datastore:",omitempty"`
-	DealID         int64               `json:",omitempty" datastore:",omitempty"`
-	EventID        int64               `json:",omitempty" datastore:",omitempty"`
-	Year           int                 `json:",omitempty" datastore:",omitempty"`
-	MakeID         int                 `json:",omitempty" datastore:",omitempty"`
-	MakeDetailID   int                 `json:",omitempty" datastore:",omitempty"`
-	Location       *appengine.GeoPoint `json:",omitempty" datastore:",omitempty"`
-	KMRadius       int                 `json:",omitempty" datastore:",omitempty"`
-	StartDate      *time.Time          `json:",omitempty" datastore:",omitempty"`
-	EndDate        *time.Time          `json:",omitempty" datastore:",omitempty"`
-	OrgTypes       []string            `json:",omitempty" datastore:",omitempty" enum:"Marketplace, Crew, Dealer, Financer, Insurer, Manufacturer, Servicer, Tax Authority, Transporter"`
-	EventTypes     []string            `json:",omitempty" datastore:",omitempty" enum:"Message, Payment, Rental, Review"`
-	UseMetric      bool                `json:",omitempty" datastore:",omitempty"`
-	Unread         bool                `json:",omitempty" datastore:",omitempty"`
-	Org            *Org                `json:",omitempty" datastore:",omitempty"`
-	User           *User               `json:",omitempty" datastore:",omitempty"`
-	Boat           *Boat               `json:",omitempty" datastore:",omitempty"`
-	Deal           *Deal               `json:",omitempty" datastore:",omitempty"`
-	Event          *Event              `json:",omitempty" datastore:",omitempty"`
-	Image          *Image              `json:",omitempty" datastore:",omitempty"`
-	Crop           *image.Rectangle    `json:",omitempty" datastore:",omitempty"`
-	CleanImage     func(i image.Image) `json:",omitempty" datastore:",omitempty"`
-	Language       string              `json:",omitempty" datastore:",omitempty"`
-	Summary        string              `json:",omitempty" datastore:",omitempty"`
-	Details        string              `json:",omitempty" datastore:",omitempty"`
-	Text           string              `json:",omitempty" datastore:",omitempty"`
+	Session        *Session             `json:"-" datastore:",omitempty"` // this is set from the Authorization header, not from the POST content
+	Subscription   *subscription        `json:"-" datastore:",omitempty"` // this is nil when called on API, or defined when some other datastore change triggers a subscription update
+	Subscribe      bool                 `json:",omitempty" datastore:",omitempty"`
+	SubscriptionID int64                `json:",omitempty" datastore:",omitempty"`
+	APIName        string               `json:",omitempty" datastore:",omitempty"` // of a request sent as an /api/WS frame, i.e., "GetUser"
+	Seq            int64                `json:",omitempty" datastore:",omitempty"` // of a request sent as an /api/WS frame, echoed in its Response
+	Delta          string               `json:",omitempty" datastore:",omitempty"` // how a subscription's updates are sent: "" for whole records, "Patch", or "Merge"
+	IfMatch        int64                `json:",omitempty" datastore:",omitempty"` // the Audit.Version a Set expects to change, or else it's a Conflict; also the If-Match header
+	QA             bool                 `json:",omitempty" datastore:",omitempty"`
+	OrgID          int64                `json:",omitempty" datastore:",omitempty"`
+	OrgIDs         []int64              `json:",omitempty" datastore:",omitempty"` // i.e., the insurers asked by RequestInsurance
+	UserID         int64                `json:",omitempty" datastore:",omitempty"`
+	BoatID         int64                `json:",omitempty" datastore:",omitempty"`
+	DealID         int64                `json:",omitempty" datastore:",omitempty"`
+	EventID        int64                `json:",omitempty" datastore:",omitempty"`
+	Year           int                  `json:",omitempty" datastore:",omitempty"`
+	MakeID         int                  `json:",omitempty" datastore:",omitempty"`
+	MakeDetailID   int                  `json:",omitempty" datastore:",omitempty"`
+	Location       *appengine.GeoPoint  `json:",omitempty" datastore:",omitempty"`
+	KMRadius       int                  `json:",omitempty" datastore:",omitempty"`
+	StartDate      *time.Time           `json:",omitempty" datastore:",omitempty"`
+	EndDate        *time.Time           `json:",omitempty" datastore:",omitempty"`
+	OrgTypes       []string             `json:",omitempty" datastore:",omitempty" enum:"Marketplace, Crew, Dealer, Financer, Insurer, Manufacturer, Servicer, Tax Authority, Transporter"`
+	EventTypes     []string             `json:",omitempty" datastore:",omitempty" enum:"Message, Payment, Rental, Review"`
+	OrgAccess      []string             `json:",omitempty" datastore:",omitempty" enum:"SetOrg, SetUser, SetBoat, SetDeal, SetEvent"`
+	UseMetric      bool                 `json:",omitempty" datastore:",omitempty"`
+	Unread         bool                 `json:",omitempty" datastore:",omitempty"`
+	Org            *Org                 `json:",omitempty" datastore:",omitempty"`
+	User           *User                `json:",omitempty" datastore:",omitempty"`
+	Boat           *Boat                `json:",omitempty" datastore:",omitempty"`
+	Deal           *Deal                `json:",omitempty" datastore:",omitempty"`
+	Event          *Event               `json:",omitempty" datastore:",omitempty"`
+	Image          *Image               `json:",omitempty" datastore:",omitempty"`
+	Crop           *image.Rectangle     `json:",omitempty" datastore:",omitempty"`
+	CleanImage     func(i image.Image)  `json:",omitempty" datastore:",omitempty"`
+	Language       string               `json:",omitempty" datastore:",omitempty"`
+	Summary        string               `json:",omitempty" datastore:",omitempty"`
+	Details        string               `json:",omitempty" datastore:",omitempty"`
+	Text           string               `json:",omitempty" datastore:",omitempty"`
+	URL            string               `json:",omitempty" datastore:",omitempty"`
+	Email          string               `json:",omitempty" datastore:",omitempty"`
+	PromoCode      string               `json:",omitempty" datastore:",omitempty"`
+	ReferralCode   string               `json:",omitempty" datastore:",omitempty"`
+	RedeemRewards  bool                 `json:",omitempty" datastore:",omitempty"`
+	Currency       string               `json:",omitempty" datastore:",omitempty"`
+	Currencies     map[string]*Currency `json:",omitempty" datastore:"-"`
+	Crew           *UserCrew            `json:",omitempty" datastore:",omitempty"`
+	Approval       *UserApproval        `json:",omitempty" datastore:",omitempty"`
+	ShareApprovals []int                `json:",omitempty" datastore:",omitempty"` // indexes of the UserApprovals the owner shares with insurers
+	Offer          *EventSale           `json:",omitempty" datastore:",omitempty"`
+	Finance        *EventFinance        `json:",omitempty" datastore:",omitempty"`
+	Insure         *EventInsure         `json:",omitempty" datastore:",omitempty"`
+	Transport      *EventTransport      `json:",omitempty" datastore:",omitempty"`
+	Service        *EventService        `json:",omitempty" datastore:",omitempty"`
+	Maintenance    []BoatMaintenance    `json:",omitempty" datastore:",omitempty"`
+	Calendar       *BoatCalendar        `json:",omitempty" datastore:",omitempty"`
+	Wishlist       *UserWishlist        `json:",omitempty" datastore:",omitempty"`
+	Search         *UserSearch          `json:",omitempty" datastore:",omitempty"`
+	Dependencies   []Dependency         `json:"-" datastore:"-"` // declared by subscribable handlers with dependOn
 }
 
 // Response is a superset of all API handler responses
 type Response struct {
 	Bearer         string                 `json:",omitempty" datastore:",omitempty"`
 	ExpiresIn      int                    `json:",omitempty" datastore:",omitempty"`
+	Seq            int64                  `json:",omitempty" datastore:",omitempty"`
 	SubscriptionID int64                  `json:",omitempty" datastore:",omitempty"`
 	ID             int64                  `json:",omitempty" datastore:",omitempty"`
+	Version        int64                  `json:",omitempty" datastore:",omitempty"` // the Audit.Version a Set put, also the ETag header
 	Marketplaces   map[int]*Marketplace   `json:",omitempty" datastore:",omitempty"`
 	Makes          map[int]*Make          `json:",omitempty" datastore:",omitempty"`
 	Orgs           map[int64]*Org         `json:",omitempty" datastore:",omitempty"`
@@ -129,6 +168,15 @@ type Response struct {
 	Events         map[int64]*Event       `json:",omitempty" datastore:",omitempty"`
 	Options        map[string]interface{} `json:",omitempty" datastore:",omitempty"`
 	Image          *Image                 `json:",omitempty" datastore:",omitempty"`
+	Calendar       *BoatCalendar          `json:",omitempty" datastore:",omitempty"`
+	Qualification  *RentalQualification   `json:",omitempty" datastore:",omitempty"`
+	Finance        *EventFinance          `json:",omitempty" datastore:",omitempty"`
+	Referral       *Referral              `json:",omitempty" datastore:",omitempty"`
+	Wishlist       *UserWishlist          `json:",omitempty" datastore:",omitempty"`
+	SSEStats       *SSEStats              `json:",omitempty" datastore:",omitempty"`
+	Patch          []PatchOperation       `json:",omitempty" datastore:",omitempty"` // of the last response, for a subscription with Delta "Patch"
+	Merge          map[string]interface{} `json:",omitempty" datastore:",omitempty"` // of the last response, for a subscription with Delta "Merge"
+	Resync         bool                   `json:",omitempty" datastore:",omitempty"` // SSE events were missed, so full responses follow
 	ErrorCode      string                 `json:",omitempty" datastore:",omitempty"`
 	ErrorDetails   map[string]string      `json:",omitempty" datastore:",omitempty"`
 }
@@ -186,12 +234,57 @@ func rollIPAPIActivity() {
 	}
 }
 
+// throttleAPI progressively slows down an IP that makes a lot of requests to an API
+func throttleAPI(ip string, apiName string) {
+	ipAPIActivityMutex.Lock()
+	act, ok := ipAPIActivity[ip+apiName]
+	if !ok {
+		act = &activity{}
+		ipAPIActivity[ip+apiName] = act
+	}
+	ipAPIActivityMutex.Unlock()
+	act.reqCt0to5MinAgo++
+	reqCt := act.reqCt0to5MinAgo + act.reqCt5to10MinAgo
+	if reqCt > alotOfRequests {
+		if !act.logged {
+			act.logged = true
+			log.Printf("throttle %s from %s (%d+%d requests)", apiName, ip, act.reqCt0to5MinAgo, act.reqCt5to10MinAgo)
+		}
+		time.Sleep(time.Duration(reqCt/alotOfRequests) * time.Second) // so it progressively slows down with more requests
+	}
+}
+
+// callAPIHandler calls the specific handler with the request, and gets back the response, subscribing to it if asked
+// and the handler supports it; connection is the /api/WS the request came on, or nil
+func callAPIHandler(req *Request, handler func(req *Request, pub *Publication) *Response, connection chan *Publication) *Response {
+	req.Subscription = nil
+	if !validDelta(req.Delta) {
+		return &Response{ErrorCode: "BadDelta"}
+	}
+	resp := handler(req, nil)
+	if resp.SubscriptionID == -1 {
+		// this means that the handler supports subscriptions
+		resp.SubscriptionID = 0
+		if req.Subscribe {
+			subscribe(req, handler, resp, connection)
+		}
+	}
+	return resp
+}
+
+// ifMatchHeader gets the Audit.Version in an If-Match header like "3" or W/"3", or 0 if there isn't one
+func ifMatchHeader(r *http.Request) int64 {
+	etag := strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+	version, _ := strconv.ParseInt(etag, 10, 64)
+	return version
+}
+
 // DispatchToAPIHandler is the main entry for all API calls
 func DispatchToAPIHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept,Accept-Language,Content-Language,Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept,Accept-Language,Content-Language,Content-Type,If-Match")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 		w.Header().Set("Vary", "Accept-Encoding, Origin")
 		w.Header().Set("Keep-Alive", "timeout=2, max=100 ")
@@ -212,29 +305,20 @@ func DispatchToAPIHandler(w http.ResponseWriter, r *http.Request) {
 	resp := &Response{}
 	if len(apiName) == 0 {
 		resp.ErrorCode = "NeedAPIName"
+	} else if strings.HasPrefix(apiName, "ICS/") {
+		// calendar apps can't sign in, so the .ics feed URL has its own secret
+		serveICS(w, apiName[len("ICS/"):])
+		return
 	} else if apiName != "SignIn" && apiName != "Log" && session.ID == 0 {
 		resp.ErrorCode = "MustSignIn"
 	} else if apiName == "SSE" {
 		handleSSE(w, r, session)
 		return
+	} else if apiName == "WS" {
+		handleWS(w, r, session, ip)
+		return
 	} else if handler, ok := apiHandlers[apiName]; ok {
-		// throttle based on IP and APIName
-		ipAPIActivityMutex.Lock()
-		act, ok := ipAPIActivity[ip+apiName]
-		if !ok {
-			act = &activity{}
-			ipAPIActivity[ip+apiName] = act
-		}
-		ipAPIActivityMutex.Unlock()
-		act.reqCt0to5MinAgo++
-		reqCt := act.reqCt0to5MinAgo + act.reqCt5to10MinAgo
-		if reqCt > alotOfRequests {
-			if !act.logged {
-				act.logged = true
-				log.Printf("throttle %s from %s (%d+%d requests)", apiName, ip, act.reqCt0to5MinAgo, act.reqCt5to10MinAgo)
-			}
-			time.Sleep(time.Duration(reqCt/alotOfRequests) * time.Second) // so it progressively slows down with more requests
-		}
+		throttleAPI(ip, apiName)
 		// get POST JSON content
 		if r.Method != http.MethodPost || r.ContentLength == 0 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 			resp.ErrorCode = "MustPostJSON"
@@ -262,16 +346,10 @@ func DispatchToAPIHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			} else {
 				req.Session = session
-				req.Subscription = nil
-				// call the specific handler with the request, and get back the response
-				resp = handler(req, nil)
-				if resp.SubscriptionID == -1 {
-					// this means that the handler supports subscriptions
-					resp.SubscriptionID = 0
-					if req.Subscribe {
-						subscribe(req, handler, resp)
-					}
+				if req.IfMatch == 0 {
+					req.IfMatch = ifMatchHeader(r)
 				}
+				resp = callAPIHandler(req, handler, nil)
 			}
 		}
 	} else {
@@ -282,11 +360,17 @@ func DispatchToAPIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
+	if resp.Version != 0 {
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		w.Header().Set("ETag", `"`+strconv.FormatInt(resp.Version, 10)+`"`)
+	}
 	if resp.ErrorCode != "" {
 		if resp.ErrorCode == "AccessDenied" || resp.ErrorCode == "NeedPasswordHash" {
 			w.WriteHeader(http.StatusUnauthorized)
 		} else if resp.ErrorCode == "MustWaitToResendCode" {
 			w.WriteHeader(http.StatusTooEarly)
+		} else if resp.ErrorCode == "Conflict" {
+			w.WriteHeader(http.StatusConflict)
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -492,6 +576,7 @@ func search(req *Request, pub *Publication) *Response {
 		if err != nil {
 			return errResponse(err)
 		}
+		dependOnQuery(req, "Org", filters, keys)
 		for index, key := range keys {
 			recs[index].ID = key.ID
 			resp.Orgs[key.ID] = recs[index]
@@ -503,6 +588,7 @@ func search(req *Request, pub *Publication) *Response {
 		if err != nil {
 			return errResponse(err)
 		}
+		dependOnQuery(req, "User", filters, keys)
 		for index, key := range keys {
 			recs[index].ID = key.ID
 			resp.Users[key.ID] = recs[index]
@@ -514,6 +600,7 @@ func search(req *Request, pub *Publication) *Response {
 		if err != nil {
 			return errResponse(err)
 		}
+		dependOnQuery(req, "Boat", filters, keys)
 		for index, key := range keys {
 			recs[index].ID = key.ID
 			resp.Boats[key.ID] = recs[index]
@@ -525,6 +612,7 @@ func search(req *Request, pub *Publication) *Response {
 		if err != nil {
 			return errResponse(err)
 		}
+		dependOnQuery(req, "Deal", filters, keys)
 		for index, key := range keys {
 			recs[index].ID = key.ID
 			resp.Deals[key.ID] = recs[index]
@@ -536,6 +624,7 @@ func search(req *Request, pub *Publication) *Response {
 		if err != nil {
 			return errResponse(err)
 		}
+		dependOnQuery(req, "Event", filters, keys)
 		for index, key := range keys {
 			recs[index].ID = key.ID
 			resp.Events[key.ID] = recs[index]
@@ -40,6 +40,7 @@ func testAPI(t *testing.T, session *Session, pub *Publication, apiName, reqJSON,
 		t:     t,
 		calls: dbCalls,
 	}
+	publicCache.clear()
 	req := &Request{}
 	if err := json.Unmarshal([]byte(reqJSON), &req); err != nil {
 		t.Errorf("Bad request: %s", reqJSON)
@@ -47,6 +48,7 @@ func testAPI(t *testing.T, session *Session, pub *Publication, apiName, reqJSON,
 	req.Session = session
 	req.Subscription = nil
 	if handler, ok := apiHandlers[apiName]; ok {
+		defer forgetNewSessions()()
 		resp := handler(req, pub)
 		actualJSONBytes, _ := json.Marshal(resp)
 		actualJSON := string(actualJSONBytes)
@@ -57,6 +59,26 @@ func testAPI(t *testing.T, session *Session, pub *Publication, apiName, reqJSON,
 	}
 }
 
+// forgetNewSessions makes a func that drops the sessions signed in since, so a later test's publications don't refresh
+// them
+func forgetNewSessions() func() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	old := map[int64]bool{}
+	for id := range sessions {
+		old[id] = true
+	}
+	return func() {
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+		for id := range sessions {
+			if !old[id] {
+				delete(sessions, id)
+			}
+		}
+	}
+}
+
 var slashPattern = regexp.MustCompile(`/[^/]+/`)
 
 func matchString(subject, pattern string) bool {
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BoatRentalApproval is a requirement a renter's approved UserApproval must meet to rent a boat.
+// IDTypes limits the ID Type requirement (if nil, any ID but None); Violation and Claim limit No Violation and No Claim
+// to one type (if "", any); Years is how far back No Violation, No Claim, and Safety Class look (0 is forever, except
+// for Safety Class) or the minimum for Experience; if MinLength is set, only boats at least that many feet long have it
+type BoatRentalApproval struct {
+	Type      string   `json:",omitempty" datastore:",omitempty,noindex" enum:"ID, No Felony, Insured, No Violation, No Claim, Experience, Safety Class"`
+	IDTypes   []string `json:",omitempty" datastore:",omitempty,noindex" enum:"Citizenship, PassportBook, PassportCard, DriverLicense, MerchantMarinerCredential, SIN, SSN"`
+	Violation string   `json:",omitempty" datastore:",omitempty,noindex" enum:"Suspended License, Speeding Over 20, Speeding Under 20, DUI, Reckless Driving, At Fault Accident"`
+	Claim     string   `json:",omitempty" datastore:",omitempty,noindex" enum:"Hurricane Or Storm, Towing Only, Lightning Strike, Dismasting, Hit Something Or Went Aground, Flooding, Theft Of Equipment, Collision With Another Boat, Theft Of Boat, Injury Or Fatality, Other"`
+	Years     int      `json:",omitempty" datastore:",omitempty,noindex"`
+	MinLength float32  `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// RentalQualification is how a renter's current UserApproval scores against a boat's requirements;
+// Score is the percent of requirements met and Failed has the Types of those not met
+type RentalQualification struct {
+	BoatID int64    `json:",omitempty"`
+	UserID int64    `json:",omitempty"`
+	Status string   `json:",omitempty" enum:"Approved, Pending, Denied, Need Approval, Not Qualified"`
+	Score  int      `json:",omitempty"`
+	Failed []string `json:",omitempty"`
+}
+
+func init() {
+	addEnumsFor(BoatRentalApproval{})
+	addEnumsFor(RentalQualification{})
+	apiHandlers["SetApproval"] = SetApproval
+	apiHandlers["GetApprovals"] = GetApprovals
+	apiHandlers["ReviewApproval"] = ReviewApproval
+	apiHandlers["GetQualification"] = GetQualification
+}
+
+// SetApproval submits the signed-in user's Approval for staff review, replacing one still pending
+func SetApproval(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.Approval == nil {
+		return &Response{ErrorCode: "NeedApproval"}
+	}
+	if err := validate(req.Approval); err != nil {
+		return errResponse(err)
+	}
+	for _, violation := range req.Approval.MovingViolations {
+		if err := validate(violation); err != nil {
+			return errResponse(err)
+		}
+	}
+	for _, claim := range req.Approval.InsuranceClaims {
+		if err := validate(claim); err != nil {
+			return errResponse(err)
+		}
+	}
+	if req.Approval.IDType == "" || req.Approval.IDType == "None" || req.Approval.IDNumber == "" {
+		return &Response{ErrorCode: "NeedID"}
+	}
+	approval := *req.Approval
+	approval.Submitted = now()
+	approval.Verification = UserVerification{Status: "Pending"} // only staff set the rest, in ReviewApproval
+	user := &User{}
+	key, err := updateX("User", req.Session.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		if last := len(user.UserApprovals) - 1; last >= 0 && user.UserApprovals[last].Verification.Status == "Pending" {
+			user.UserApprovals[last] = approval
+		} else {
+			user.UserApprovals = append(user.UserApprovals, approval)
+		}
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: user.Audit.Version,
+	}
+}
+
+// GetApprovals gets the staff review queue: users whose latest UserApproval is pending
+func GetApprovals(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	var users []*User
+	filters := map[string]interface{}{"UserApprovals.Verification.Status=": "Pending"}
+	keys, err := getAllUsers(filters, &users)
+	if err != nil {
+		return errResponse(err)
+	}
+	dependOnQuery(req, "User", filters, keys)
+	resp := &Response{SubscriptionID: -1, Users: map[int64]*User{}}
+	for index, key := range keys {
+		user := users[index]
+		user.ID = key.ID
+		user.PasswordHashCrypt = ""
+		user.TOTP = ""
+		getContacts(user.Contacts)
+		resp.Users[key.ID] = user
+	}
+	return resp
+}
+
+// ReviewApproval is how staff approve or deny UserID's pending UserApproval, using Approval.Verification
+func ReviewApproval(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if req.UserID == 0 {
+		return &Response{ErrorCode: "NeedUserID"}
+	}
+	if req.Approval == nil {
+		return &Response{ErrorCode: "NeedApproval"}
+	}
+	verification := req.Approval.Verification
+	if verification.Status != "Approved" && verification.Status != "Denied" {
+		return &Response{ErrorCode: "BadStatus"}
+	}
+	verification.Reviewed = now()
+	verification.ReviewerID = req.Session.UserID
+	user := &User{}
+	key, err := updateX("User", req.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		last := len(user.UserApprovals) - 1
+		if last < 0 || user.UserApprovals[last].Verification.Status != "Pending" {
+			return nil, errors.New("NoPendingApproval")
+		}
+		user.UserApprovals[last].Verification = verification
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	// let the renter know
+	text := "Your renter approval was approved."
+	if verification.Status == "Denied" {
+		text = "Your renter approval was denied."
+		if verification.Details != "" {
+			text += " " + verification.Details
+		}
+	}
+	if _, err := putEvent(&Event{UserID: key.ID, UnreadByIDs: []int64{key.ID}, Notification: &EventNotification{Text: text}, Audit: &Audit{Created: now()}}); err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// GetQualification scores a renter's current UserApproval against BoatID's Rental requirements;
+// the renter is me, or UserID if I'm staff or the boat's owner
+func GetQualification(req *Request, pub *Publication) *Response {
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	userID := req.Session.UserID
+	if req.UserID != 0 && req.UserID != userID {
+		if !isStaff(req) && !isMine(req, boat) {
+			return accessDenied()
+		}
+		userID = req.UserID
+	}
+	if userID == 0 {
+		return &Response{ErrorCode: "NeedUserID"}
+	}
+	renter, err := getUser(userID)
+	if err != nil {
+		return errResponse(err)
+	}
+	q := qualify(renter, boat, "Rental")
+	q.BoatID = req.BoatID
+	q.UserID = userID
+	return &Response{Qualification: q}
+}
+
+// checkQualified makes sure renterID may book a listing of boatID (or of dealID's boat), returning a NotApproved error if not
+func checkQualified(renterID, boatID, dealID int64, listing string) error {
+	if boatID == 0 {
+		if dealID == 0 {
+			return errors.New("NeedBoatID")
+		}
+		deal, err := getDeal(dealID)
+		if err != nil {
+			return err
+		}
+		boatID = deal.BoatID
+	}
+	boat, err := getBoat(boatID)
+	if err != nil {
+		return err
+	}
+	if boat.UserID == renterID {
+		return nil // owners block their own boats
+	}
+	if len(boatRequirements(boat, listing)) == 0 {
+		return nil
+	}
+	renter, err := getUser(renterID)
+	if err != nil {
+		return err
+	}
+	q := qualify(renter, boat, listing)
+	if q.Status != "Approved" {
+		return Err("NotApproved", map[string]string{"Status": q.Status, "Failed": strings.Join(q.Failed, ",")})
+	}
+	return nil
+}
+
+// boatRequirements gets the requirements of a boat's listing that apply to its length
+func boatRequirements(boat *Boat, listing string) []BoatRentalApproval {
+	rental, _ := getDeepField(listing, boat).(*BoatRental)
+	if rental == nil {
+		return nil
+	}
+	requirements := []BoatRentalApproval{}
+	for _, requirement := range rental.Approvals {
+		if requirement.MinLength == 0 || boat.Length >= requirement.MinLength {
+			requirements = append(requirements, requirement)
+		}
+	}
+	return requirements
+}
+
+// currentApproval gets a renter's latest unexpired approved UserApproval, or else the latest one submitted
+func currentApproval(renter *User) *UserApproval {
+	for i := len(renter.UserApprovals) - 1; i >= 0; i-- {
+		approval := &renter.UserApprovals[i]
+		expires := approval.Verification.ExpirDate
+		if approval.Verification.Status == "Approved" && (expires == nil || expires.After(*now())) {
+			return approval
+		}
+	}
+	if last := len(renter.UserApprovals) - 1; last >= 0 {
+		return &renter.UserApprovals[last]
+	}
+	return nil
+}
+
+// qualify scores a renter's current UserApproval against the requirements of a boat's listing;
+// a boat without requirements qualifies everyone
+func qualify(renter *User, boat *Boat, listing string) *RentalQualification {
+	requirements := boatRequirements(boat, listing)
+	q := &RentalQualification{Status: "Approved", Score: 100}
+	if len(requirements) == 0 {
+		return q
+	}
+	approval := currentApproval(renter)
+	if approval == nil {
+		return &RentalQualification{Status: "NeedApproval"}
+	}
+	met := 0
+	for _, requirement := range requirements {
+		if meetsRequirement(approval, requirement) {
+			met++
+		} else if !StringInArray(requirement.Type, q.Failed) {
+			q.Failed = append(q.Failed, requirement.Type)
+		}
+	}
+	q.Score = met * 100 / len(requirements)
+	switch {
+	case approval.Verification.Status == "Pending":
+		q.Status = "Pending"
+	case approval.Verification.Status != "Approved":
+		q.Status = "Denied"
+	case met < len(requirements):
+		q.Status = "NotQualified"
+	}
+	return q
+}
+
+// meetsRequirement checks a single requirement; things the renter didn't answer don't meet it
+func meetsRequirement(approval *UserApproval, requirement BoatRentalApproval) bool {
+	since := func() *time.Time {
+		if requirement.Years <= 0 {
+			return nil
+		}
+		t := now().AddDate(-requirement.Years, 0, 0)
+		return &t
+	}()
+	// an event with no date counts as recent
+	recent := func(date *time.Time) bool {
+		return since == nil || date == nil || !date.Before(*since)
+	}
+	switch requirement.Type {
+	case "ID":
+		if requirement.IDTypes == nil {
+			return approval.IDType != "" && approval.IDType != "None"
+		}
+		return StringInArray(approval.IDType, requirement.IDTypes)
+	case "NoFelony":
+		return approval.FelonyConviction == "No"
+	case "Insured":
+		return approval.NoInsurance == "No"
+	case "NoViolation":
+		for _, violation := range approval.MovingViolations {
+			if (requirement.Violation == "" || violation.Type == requirement.Violation) && recent(violation.Date) {
+				return false
+			}
+		}
+		return true
+	case "NoClaim":
+		for _, claim := range approval.InsuranceClaims {
+			if (requirement.Claim == "" || claim.Type == requirement.Claim) && recent(claim.ClaimDate) {
+				return false
+			}
+		}
+		return true
+	case "Experience":
+		return approval.YearsExperience >= requirement.Years
+	case "SafetyClass":
+		return approval.LastSafetyClass != nil && recent(approval.LastSafetyClass)
+	}
+	return false
+}
+
+// checkApprovalRules makes sure each requirement has what its Type needs
+func checkApprovalRules(rental *BoatRental) error {
+	for i, requirement := range rental.Approvals {
+		field := "Approvals." + strconv.Itoa(i)
+		if err := validate(requirement); err != nil {
+			return err
+		}
+		switch {
+		case requirement.Type == "":
+			return Err("BadApprovalRule", map[string]string{"Field": field + ".Type"})
+		case requirement.Years < 0 || (requirement.Type == "Experience" || requirement.Type == "SafetyClass") && requirement.Years == 0:
+			return Err("BadApprovalRule", map[string]string{"Field": field + ".Years"})
+		case requirement.MinLength < 0:
+			return Err("BadApprovalRule", map[string]string{"Field": field + ".MinLength"})
+		}
+	}
+	return nil
+}
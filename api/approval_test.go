@@ -0,0 +1,107 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestQualify(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	test := func(renter User, boat Boat, expectStatus string, expectScore int, expectFailed string) {
+		q := qualify(&renter, &boat, "Rental")
+		if q.Status != expectStatus || q.Score != expectScore || strings.Join(q.Failed, ",") != expectFailed {
+			t.Errorf("Wrong qualify result %+v, expect %s %d %s", q, expectStatus, expectScore, expectFailed)
+		}
+	}
+	test(User{}, Boat{}, "Approved", 100, "")
+	test(User{}, newApprovalBoat(), "NeedApproval", 0, "")
+	test(newApprovedRenter("Approved"), newApprovalBoat(), "Approved", 100, "")
+	test(newApprovedRenter("Pending"), newApprovalBoat(), "Pending", 100, "")
+	test(newApprovedRenter("Denied"), newApprovalBoat(), "Denied", 100, "")
+	// a recent DUI and too little experience
+	renter := newApprovedRenter("Approved")
+	renter.UserApprovals[0].MovingViolations[0].Date = DateTime(2017, 1, 1, 0, 0, 0)
+	renter.UserApprovals[0].YearsExperience = 1
+	test(renter, newApprovalBoat(), "NotQualified", 33, "NoViolation,Experience")
+	// safety class is only needed for boats 30 feet and longer
+	renter = newApprovedRenter("Approved")
+	renter.UserApprovals[0].LastSafetyClass = nil
+	test(renter, newApprovalBoat(), "NotQualified", 66, "SafetyClass")
+	shortBoat := newApprovalBoat()
+	shortBoat.Length = 24
+	test(renter, shortBoat, "Approved", 100, "")
+	// a later pending approval doesn't replace an approved one, but an expired one doesn't count
+	renter = newApprovedRenter("Approved")
+	renter.UserApprovals = append(renter.UserApprovals, UserApproval{Verification: UserVerification{Status: "Pending"}})
+	test(renter, newApprovalBoat(), "Approved", 100, "")
+	renter.UserApprovals[0].Verification.ExpirDate = DateTime(2020, 1, 1, 0, 0, 0)
+	test(renter, newApprovalBoat(), "Pending", 33, "Experience,SafetyClass")
+}
+
+func TestSetApproval(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	testAPI(t, &Session{UserID: 456}, nil, "SetApproval", `{}`, `{"ErrorCode":"MustVerify"}`, nil)
+	testAPI(t, session, nil, "SetApproval", `{}`, `{"ErrorCode":"NeedApproval"}`, nil)
+	testAPI(t, session, nil, "SetApproval", `{"Approval":{"IDType":"None"}}`, `{"ErrorCode":"NeedID"}`, nil)
+	testAPI(t, session, nil, "SetApproval", `{"Approval":{"IDType":"DriverLicense","IDNumber":"S123","MovingViolations":[{"Type":"Drifting"}]}}`, `{"ErrorCode":"BadEnum","ErrorDetails":{"Field":"Type","Value":"Drifting"}}`, nil)
+	// a renter can't approve themselves, and a new submission replaces a pending one
+	testAPI(t, session, nil, "SetApproval", `{"Approval":{"IDType":"DriverLicense","IDNumber":"S123","YearsExperience":3,"Verification":{"Status":"Approved"}}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{UserApprovals: []UserApproval{{IDType: "DriverLicense", Verification: UserVerification{Status: "Pending"}}}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			srcJSON:   `{"ID":456,"UserApprovals":[{"IDType":"DriverLicense","IDNumber":"S123","YearsExperience":3,"Submitted":"2020-05-05T05:05:05Z","Verification":{"Status":"Pending"}}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestGetApprovals(t *testing.T) {
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	testAPI(t, &Session{UserID: 456}, nil, "GetApprovals", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	testAPI(t, staff, nil, "GetApprovals", `{}`, `{"SubscriptionID":-1,"Users":{"456":{"ID":456,"UserApprovals":[{"IDType":"DriverLicense","Verification":{"Status":"Pending"}}]}}}`, []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("User", map[string]interface{}{"UserApprovals.Verification.Status=": "Pending"}),
+			dst:        []*User{{PasswordHashCrypt: "x", UserApprovals: []UserApproval{{IDType: "DriverLicense", Verification: UserVerification{Status: "Pending"}}}}},
+			keysResult: []*datastore.Key{idKey("User", 456)},
+		},
+	})
+}
+
+func TestReviewApproval(t *testing.T) {
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	testAPI(t, &Session{UserID: 456}, nil, "ReviewApproval", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	testAPI(t, staff, nil, "ReviewApproval", `{"UserID":456,"Approval":{"Verification":{"Status":"Pending"}}}`, `{"ErrorCode":"BadStatus"}`, nil)
+	testAPI(t, staff, nil, "ReviewApproval", `{"UserID":456,"Approval":{"Verification":{"Status":"Approved"}}}`, `{"ErrorCode":"NoPendingApproval"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newApprovedRenter("Approved")},
+	})
+	testAPI(t, staff, nil, "ReviewApproval", `{"UserID":456,"Approval":{"Verification":{"Status":"Denied","Details":"License expired."}}}`, `{"ID":456}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{UserApprovals: []UserApproval{{IDType: "DriverLicense", Verification: UserVerification{Status: "Pending"}}}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			srcJSON:   `{"ID":456,"UserApprovals":[{"IDType":"DriverLicense","Verification":{"Status":"Denied","Reviewed":"2020-05-05T05:05:05Z","ReviewerID":2,"Details":"License expired."}}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"UserID":456,"UnreadByIDs":[456],"Notification":{"Text":"Your renter approval was denied. License expired."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
+
+func TestGetQualification(t *testing.T) {
+	testAPI(t, &Session{UserID: 789}, nil, "GetQualification", `{"BoatID":7,"UserID":456}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newApprovalBoat()},
+	})
+	// the owner can check a renter
+	testAPI(t, &Session{UserID: 123}, nil, "GetQualification", `{"BoatID":7,"UserID":456}`, `{"Qualification":{"BoatID":7,"UserID":456,"Status":"Pending","Score":100}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newApprovalBoat()},
+		{name: "Get", key: idKey("User", 456), dst: newApprovedRenter("Pending")},
+	})
+}
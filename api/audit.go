@@ -12,6 +12,8 @@ type Audit struct {
 	Created   *time.Time `json:",omitempty" datastore:",omitempty"`
 	Updated   *time.Time `json:",omitempty" datastore:",omitempty"`
 	Deleted   *time.Time `json:",omitempty" datastore:",omitempty"`
+	Purged    *time.Time `json:",omitempty" datastore:",omitempty,noindex"` // when personal data was removed, purgeDays after Deleted
+	Version   int64      `json:",omitempty" datastore:",omitempty,noindex"` // goes up by one each time it's set, for IfMatch
 	QANeeded  *time.Time `json:",omitempty" datastore:",omitempty"`
 	QAStarted *time.Time `json:",omitempty" datastore:",omitempty"`
 	QAUserID  int64      `json:",omitempty" datastore:",omitempty"`
@@ -80,6 +82,34 @@ func reflectAudit(ptr interface{}) reflect.Value {
 	return reflectStruct(ptr).FieldByName("Audit")
 }
 
+// auditVersion gets a record's Audit.Version, which is 0 if it has no Audit
+func auditVersion(ptr interface{}) int64 {
+	if audit := reflectAudit(ptr); !audit.IsNil() {
+		return audit.Interface().(*Audit).Version
+	}
+	return 0
+}
+
+// setAuditVersion sets a record's Audit.Version, giving it an Audit if it has none
+func setAuditVersion(ptr interface{}, version int64) {
+	auditOf(ptr).Version = version
+}
+
+// auditOf gets a record's Audit, giving it one if it has none
+func auditOf(ptr interface{}) *Audit {
+	audit := reflectAudit(ptr)
+	if audit.IsNil() {
+		audit.Set(reflect.ValueOf(&Audit{}))
+	}
+	return audit.Interface().(*Audit)
+}
+
+// isDeleted finds out if a record has Audit.Deleted set
+func isDeleted(ptr interface{}) bool {
+	audit := reflectAudit(ptr)
+	return !audit.IsNil() && audit.Interface().(*Audit).Deleted != nil
+}
+
 func reflectID(ptr interface{}) reflect.Value {
 	return reflectStruct(ptr).FieldByName("ID")
 }
@@ -125,19 +155,33 @@ func setDeepField(fieldName string, ptr, value interface{}) {
 
 func isMine(req *Request, ptr interface{}) bool {
 	// find out if this entity is owned by this user or org
+	userID, orgID := owners(ptr)
+	return orgID != 0 && req.Session.OrgID == orgID || userID != 0 && req.Session.UserID == userID
+}
+
+// lacksOrgAccess finds out if an entity is only mine because my org owns it, and I don't have the OrgAccess (i.e.,
+// "SetBoat") to change it; staff and the entity's own user don't need OrgAccess
+func lacksOrgAccess(req *Request, access string, ptr interface{}) bool {
+	if isStaff(req) {
+		return false
+	}
+	userID, orgID := owners(ptr)
+	if userID != 0 && req.Session.UserID == userID {
+		return false
+	}
+	return orgID != 0 && req.Session.OrgID == orgID && !StringInArray(access, req.Session.OrgAccess)
+}
+
+// owners gets the user and org that own an entity
+func owners(ptr interface{}) (int64, int64) {
 	entity := reflectStruct(ptr)
-	var orgID int64
-	var userID int64
-	if entity.Type().Name() == "Org" {
-		orgID = entity.FieldByName("ID").Int()
-	} else if entity.Type().Name() == "User" {
-		userID = entity.FieldByName("ID").Int()
-		orgID = entity.FieldByName("OrgID").Int()
-	} else {
-		userID = entity.FieldByName("UserID").Int()
-		orgID = entity.FieldByName("OrgID").Int()
+	switch entity.Type().Name() {
+	case "Org":
+		return 0, entity.FieldByName("ID").Int()
+	case "User":
+		return entity.FieldByName("ID").Int(), entity.FieldByName("OrgID").Int()
 	}
-	return orgID != 0 && req.Session.OrgID == orgID || userID != 0 && req.Session.UserID == userID
+	return entity.FieldByName("UserID").Int(), entity.FieldByName("OrgID").Int()
 }
 
 func getAudit(req *Request, ptr interface{}) {
@@ -187,6 +231,8 @@ func setAudit(staff bool, newPtr, oldPtr interface{}) {
 			newAudit = &Audit{
 				Created:   oldAudit.Created,
 				Updated:   now(),
+				Deleted:   oldAudit.Deleted,
+				Purged:    oldAudit.Purged,
 				QANeeded:  oldAudit.QANeeded,
 				QAStarted: oldAudit.QAStarted,
 				QAUserID:  oldAudit.QAUserID,
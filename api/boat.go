@@ -1,9 +1,11 @@
 package api
 
 import (
-	"log"
+	"errors"
 	"math"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -51,6 +53,7 @@ type Boat struct {
 	EngineYear         int               `json:",omitempty" datastore:",omitempty,noindex"`
 	EngineMake         string            `json:",omitempty" datastore:",omitempty,noindex"`
 	EngineModel        string            `json:",omitempty" datastore:",omitempty,noindex"`
+	EngineHours        float32           `json:",omitempty" datastore:",omitempty,noindex"`
 	FuelType           string            `json:",omitempty" datastore:",omitempty,noindex" enum:"Unknown, Gas, Diesel, Electric, Other"`
 	FuelCapacity       float32           `json:",omitempty" datastore:",omitempty,noindex"`
 	FuelConsumption    int               `json:",omitempty" datastore:",omitempty,noindex"`
@@ -68,30 +71,35 @@ type Boat struct {
 	MarketValue        float32           `json:",omitempty" datastore:",omitempty,noindex"`
 	Liens              []Lien            `json:",omitempty" datastore:",omitempty,noindex"`
 	InsurancePolicies  []InsurancePolicy `json:",omitempty" datastore:",omitempty"`
+	Maintenance        []BoatMaintenance `json:",omitempty" datastore:",omitempty"`
 	Rental             *BoatRental       `json:",omitempty" datastore:",omitempty,noindex"`
 	Cruise             *BoatRental       `json:",omitempty" datastore:",omitempty,noindex"`
 	Ride               *BoatRental       `json:",omitempty" datastore:",omitempty,noindex"`
 	Sale               *BoatSale         `json:",omitempty" datastore:",omitempty,noindex"`
+	Calendar           *BoatCalendar     `json:",omitempty" datastore:",omitempty,noindex"`
 	Audit              *Audit            `json:",omitempty" datastore:",omitempty"`
 }
 
 // BoatRental is how a boat is available for rental
 type BoatRental struct {
-	ListingTitle       string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
-	ListingDescription string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
-	ListingSummary     string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
-	Rules              string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
-	AllowTwoHalfDays   bool               `json:",omitempty" datastore:",omitempty,noindex"`
-	InstantBook        bool               `json:",omitempty" datastore:",omitempty,noindex"`
-	CancelPolicy       string             `json:",omitempty" datastore:",omitempty,noindex" enum:"Flexible, Moderate, Strict"`
-	ReviewCount        int                `json:",omitempty" datastore:",omitempty,noindex"`
-	ReviewRatingSum    int                `json:",omitempty" datastore:",omitempty,noindex"`
-	Approvals          []UserApproval     `json:",omitempty" datastore:",omitempty"`
-	Seasons            []BoatRentalSeason `json:",omitempty" datastore:",omitempty,noindex"`
-	RentalIfCaptain    *EventRental       `json:",omitempty" datastore:",omitempty,noindex"`
-	RentalIfNoCaptain  *EventRental       `json:",omitempty" datastore:",omitempty,noindex"`
-	NotAvailable       []time.Time        `json:",omitempty" datastore:",omitempty,noindex"`
-	NextAvailable      []time.Time        `json:",omitempty" datastore:",omitempty,noindex"`
+	ListingTitle       string               `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	ListingDescription string               `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	ListingSummary     string               `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	ListingStatus      string               `json:",omitempty" datastore:",omitempty,noindex" enum:"Draft, Pending Review, Published, Paused, Archived"`
+	Rules              string               `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	AllowTwoHalfDays   bool                 `json:",omitempty" datastore:",omitempty,noindex"`
+	InstantBook        bool                 `json:",omitempty" datastore:",omitempty,noindex"`
+	CancelPolicy       string               `json:",omitempty" datastore:",omitempty,noindex" enum:"Flexible, Moderate, Strict"`
+	ReviewCount        int                  `json:",omitempty" datastore:",omitempty,noindex"`
+	ReviewRatingSum    int                  `json:",omitempty" datastore:",omitempty,noindex"`
+	Approvals          []BoatRentalApproval `json:",omitempty" datastore:"Requirements,omitempty,noindex"`
+	OldApprovals       []UserApproval       `json:"-" datastore:"Approvals,omitempty"` // unused, but boats saved before Approvals were requirements have it until saved again
+	Seasons            []BoatRentalSeason   `json:",omitempty" datastore:",omitempty,noindex"`
+	PricingRules       []BoatRentalRule     `json:",omitempty" datastore:",omitempty,noindex"`
+	RentalIfCaptain    *EventRental         `json:",omitempty" datastore:",omitempty,noindex"`
+	RentalIfNoCaptain  *EventRental         `json:",omitempty" datastore:",omitempty,noindex"`
+	NotAvailable       []time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
+	NextAvailable      []time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // BoatRentalSeason is how a boat rental is priced different times of year
@@ -112,11 +120,22 @@ type BoatRentalPricing struct {
 	FuelPayer      string  `json:",omitempty" datastore:",omitempty,noindex" enum:"Renter, Owner"`
 }
 
+// BoatRentalRule is an owner's surcharge or discount on the rental price; see applyPricingRules for how they're applied
+type BoatRentalRule struct {
+	Type    string      `json:",omitempty" datastore:",omitempty,noindex" enum:"Weekend, Holiday, Last Minute, Early Bird, Multi Day, Promo Code"`
+	Percent float32     `json:",omitempty" datastore:",omitempty,noindex"` // surcharge for Weekend and Holiday, discount for others
+	Days    int         `json:",omitempty" datastore:",omitempty,noindex"` // Last Minute if booked less than Days before, Early Bird if at least Days before, Multi Day if at least Days long
+	Dates   []time.Time `json:",omitempty" datastore:",omitempty,noindex"` // Holiday dates
+	Code    string      `json:",omitempty" datastore:",omitempty,noindex"` // Promo Code
+	Expires *time.Time  `json:",omitempty" datastore:",omitempty,noindex"` // Promo Code
+}
+
 // BoatSale is how a boat is available for sale
 type BoatSale struct {
 	ListingTitle       string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 	ListingDescription string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 	ListingSummary     string             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	ListingStatus      string             `json:",omitempty" datastore:",omitempty,noindex" enum:"Draft, Pending Review, Published, Paused, Archived"`
 	Price              float32            `json:",omitempty" datastore:",omitempty,noindex"`
 	Fractions          []BoatSaleFraction `json:",omitempty" datastore:",omitempty,noindex"`
 	SoldDate           *time.Time         `json:",omitempty" datastore:",omitempty,noindex"`
@@ -125,8 +144,9 @@ type BoatSale struct {
 
 // BoatSaleFraction is for fractional ownership
 type BoatSaleFraction struct {
-	Fraction float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	Price    float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Fraction float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	Price    float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	SoldDate *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // BoatTrailer has information about the boat trailer
@@ -145,6 +165,21 @@ type InsurancePolicy struct {
 	IssueDate    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
 	ExpirDate    *time.Time `json:",omitempty" datastore:",omitempty"`
 	InsuredValue float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	DealID       int64      `json:",omitempty" datastore:",omitempty,noindex"`
+	Reminded     *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// BoatMaintenance is a recurring maintenance Task, due every EveryHours engine hours or EveryMonths months, whichever
+// comes first; DueHours and DueDate are set from when it was last done
+type BoatMaintenance struct {
+	Task        string     `json:",omitempty" datastore:",omitempty,noindex"`
+	EveryHours  float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	EveryMonths int        `json:",omitempty" datastore:",omitempty,noindex"`
+	LastHours   float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	LastDate    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	DueHours    float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	DueDate     *time.Time `json:",omitempty" datastore:",omitempty"`
+	Reminded    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // Lien has a boat loan
@@ -159,26 +194,26 @@ func init() {
 	addEnumsFor(Boat{})
 	addEnumsFor(BoatRental{})
 	addEnumsFor(BoatRentalPricing{})
+	addEnumsFor(BoatRentalRule{})
+	addEnumsFor(BoatSale{})
 	apiHandlers["GetBoats"] = GetBoats
 	apiHandlers["SetBoat"] = SetBoat
 }
 
 func getPublicBoat(boatID int64) *Boat {
-	if boatID == 0 {
-		return nil
-	}
-	boat, err := getBoat(boatID)
-	if err != nil {
-		log.Printf("getBoat(%d) => %s", boatID, err.Error())
-		return nil
-	}
+	boat, _ := getPublicX("Boat", boatID).(*Boat)
+	return boat
+}
+
+// publicBoat makes the projection of a boat that anyone may see
+func publicBoat(boat *Boat) *Boat {
 	if boat.Rental == nil {
 		boat.Rental = &BoatRental{}
 	}
 	return &Boat{
 		Rental: &BoatRental{ListingTitle: boat.Rental.ListingTitle},
 		Audit: &Audit{
-			Created: boat.Audit.Created,
+			Created: auditOf(boat).Created,
 		},
 	}
 }
@@ -189,10 +224,25 @@ func GetBoats(req *Request, pub *Publication) *Response {
 	if resp != nil {
 		return resp
 	}
-	if !req.QA && req.OrgID == 0 && (req.UserID == 0 || req.UserID == req.Session.UserID) && req.BoatID == 0 && req.Location == nil {
-		// include favorites in boat list
-		user, err := getUser(req.Session.UserID)
-		if err != nil {
+	// the signed-in user's favorites are included in their own boat list, their RewardPoints are only redeemed if asked,
+	// since they may want to save them, and quotes are in their currency unless another is asked for
+	listingMine := !req.QA && req.OrgID == 0 && (req.UserID == 0 || req.UserID == req.Session.UserID) && req.BoatID == 0 && req.Location == nil
+	var user *User
+	getMe := func() error {
+		if user == nil {
+			user = &User{}
+			if req.Session.UserID != 0 {
+				var err error
+				if user, err = getUser(req.Session.UserID); err != nil {
+					return err
+				}
+				dependOnIDs(req, "User", user.ID)
+			}
+		}
+		return nil
+	}
+	if listingMine {
+		if err := getMe(); err != nil {
 			return errResponse(err)
 		}
 		if user.Favorites != nil {
@@ -213,21 +263,34 @@ func GetBoats(req *Request, pub *Publication) *Response {
 		req.KMRadius = 150
 		return GetBoats(req, pub)
 	}
+	rewardPoints := 0
+	currency := req.Currency
+	if req.RedeemRewards || currency == "" {
+		if err := getMe(); err != nil {
+			return errResponse(err)
+		}
+		if req.RedeemRewards {
+			rewardPoints = user.RewardPoints
+		}
+		if currency == "" {
+			currency = user.Currency
+		}
+	}
+	dependOnQuery(req, "Boat", filters, keys)
+	var userIDs, orgIDs []int64
+	loader := newPublicLoader()
 	// process each boat found
 	for index, key := range keys {
 		boat := boats[index]
 		boat.ID = key.ID
-		// omit pending boats if searching by location
-		if req.Location != nil &&
-			(boat.Rental == nil || boat.Rental.ListingTitle == "") &&
-			(boat.Cruise == nil || boat.Cruise.ListingTitle == "") &&
-			(boat.Ride == nil || boat.Ride.ListingTitle == "") &&
-			(boat.Sale == nil || boat.Sale.ListingTitle == "") {
+		// omit boats without a published listing if searching by location
+		if req.Location != nil && !isPublished(boat) {
 			continue
 		}
-		// add User and Org
-		boat.User = getPublicUser(boat.UserID)
-		boat.Org = getPublicOrg((boat.OrgID))
+		loader.want("User", boat.UserID)
+		loader.want("Org", boat.OrgID)
+		userIDs = append(userIDs, boat.UserID)
+		orgIDs = append(orgIDs, boat.OrgID)
 		// TODO
 		boat.FuelCost = 0
 		// compute rental details
@@ -280,20 +343,38 @@ func GetBoats(req *Request, pub *Publication) *Response {
 				}
 				boat.Rental.NotAvailable = nil // only used by the server
 			}
-			boat.Rental.RentalIfNoCaptain = boatRental(boat, startTime, endTime, 0)
-			boat.Rental.RentalIfCaptain = boatRental(boat, startTime, endTime, 1)
+			boat.Rental.RentalIfNoCaptain = boatRental(boat, startTime, endTime, 0, req.PromoCode, rewardPoints)
+			boat.Rental.RentalIfCaptain = boatRental(boat, startTime, endTime, 1, req.PromoCode, rewardPoints)
+			// quote in the viewer's currency, or else in the boat's, so one boat's currency doesn't fail the search
+			for _, quote := range []*EventRental{boat.Rental.RentalIfNoCaptain, boat.Rental.RentalIfCaptain} {
+				if err := convertRental(quote, currency); err != nil {
+					sessionLog(req, "Error", "GetBoats convertRental boat %d to %s => %s", boat.ID, currency, err.Error())
+				}
+			}
 		}
 		// if it's not my boat and it's not my org's boat, and I'm not staff, sanitize record
 		if boat.UserID != req.Session.UserID && (boat.OrgID == 0 || boat.OrgID != req.Session.OrgID) && !staff {
+			// listings that are drafts, pending review, paused, or archived are only seen by the owner and staff
+			for _, listing := range listingNames {
+				if status := listingStatus(boat, listing); status != "" && status != "Published" {
+					setDeepField(listing, boat, nil)
+				}
+			}
 			boat.HullID = ""
+			boat.Calendar = nil
+			for _, rental := range []*BoatRental{boat.Rental, boat.Cruise, boat.Ride} {
+				if rental != nil {
+					rental.PricingRules = publicPricingRules(rental.PricingRules)
+				}
+			}
 			boat.InsurancePolicies = nil
+			boat.Maintenance = nil
 			boat.Liens = nil
 			if boat.Location != nil {
 				boat.Location = &Contact{City: boat.Location.City, State: boat.Location.State, Country: boat.Location.Country, Location: boat.Location.Location}
 			}
 			boat.URLs = nil
 			if boat.Rental != nil {
-				boat.Rental.Approvals = nil
 				boat.Rental.Seasons = nil
 			}
 			getAudit(req, boat)
@@ -303,10 +384,18 @@ func GetBoats(req *Request, pub *Publication) *Response {
 		}
 		resp.Boats[key.ID] = boat
 	}
+	// add User and Org, with one GetMulti of each kind
+	loader.load()
+	for _, boat := range resp.Boats {
+		boat.User = loader.user(boat.UserID)
+		boat.Org = loader.org(boat.OrgID)
+	}
+	dependOnIDs(req, "User", userIDs...)
+	dependOnIDs(req, "Org", orgIDs...)
 	return resp
 }
 
-func boatRental(boat *Boat, startTime, endTime *time.Time, captain int) *EventRental {
+func boatRental(boat *Boat, startTime, endTime *time.Time, captain int, promoCode string, rewardPoints int) *EventRental {
 	duration := endTime.Sub(*startTime)
 	bigBoat := 0.0
 	if boat.Length >= 20 {
@@ -315,6 +404,8 @@ func boatRental(boat *Boat, startTime, endTime *time.Time, captain int) *EventRe
 	if boat == nil || boat.Rental == nil || boat.Rental.Seasons == nil {
 		return nil
 	}
+	// fees and RewardPoints are in the boat's currency
+	fees := currencyFees(boat.Currency)
 	for _, season := range boat.Rental.Seasons {
 		if season.Pricing == nil {
 			continue
@@ -325,7 +416,7 @@ func boatRental(boat *Boat, startTime, endTime *time.Time, captain int) *EventRe
 				continue
 			}
 			price := float64(pricing.HalfDailyPrice)
-			captainFee := 200.00 + bigBoat*150.00
+			captainFee := float64(fees.CaptainHalfDay) + bigBoat*float64(fees.CaptainHalfDayBigBoat)
 			if price == 0 || duration.Hours() > 5 {
 				numDays := math.Ceil((duration.Hours() + 8) / 24)
 				numWeeks := math.Ceil(numDays / 7)
@@ -338,11 +429,16 @@ func boatRental(boat *Boat, startTime, endTime *time.Time, captain int) *EventRe
 				} else {
 					price = math.Min(priceByDay, priceByWeek)
 				}
-				captainFee = (300.00 + bigBoat*300.00) * numDays
+				captainFee = (float64(fees.CaptainDay) + bigBoat*float64(fees.CaptainDayBigBoat)) * numDays
 			}
 			if pricing.Captain != "CaptainExtra" {
 				captainFee = 0
 			}
+			price, lineItems := applyPricingRules(boat.Rental.PricingRules, price, startTime, endTime, promoCode)
+			rewardsDiscount, points := redeemedRewards(rewardPoints, boat.Currency, price)
+			if rewardsDiscount > 0 {
+				lineItems = append(lineItems, EventRentalLineItem{Type: "Rewards", Amount: float32(-rewardsDiscount)})
+			}
 			percent := func(p int) float32 {
 				return float32(math.Round(price * float64(p) / 100))
 			}
@@ -357,37 +453,170 @@ func boatRental(boat *Boat, startTime, endTime *time.Time, captain int) *EventRe
 				InsureFee:       percent(20),
 				TowFee:          percent(5),
 				TransactionFee:  percent(10),
-				RewardsDiscount: 0,
-				SecurityDeposit: float32(500.00 + bigBoat*500.00),
+				RewardsDiscount: float32(rewardsDiscount),
+				RewardPoints:    points,
+				SecurityDeposit: fees.SecurityDeposit + float32(bigBoat)*fees.SecurityDepositBigBoat,
 				FuelPayer:       pricing.FuelPayer,
+				LineItems:       lineItems,
 			}
-			subtotal := rental.Price + rental.CaptainFee + rental.InsureFee + rental.TowFee + rental.TransactionFee - rental.RewardsDiscount
-			// TODO: hook up with Avalara
-			rental.SalesTax = float32(math.Round(float64(subtotal)*7) / 100)
-			rental.Total = subtotal + rental.SalesTax
-			fullRefund := rental.Total
-			halfRefund := math.Round(float64(fullRefund)/2*100) / 100
-			// Flexible is full refund with 24 hours
-			daysBackFullRefund := 1
-			daysBackHalfRefund := 0
-			switch boat.Rental.CancelPolicy {
-			case "Moderate":
-				daysBackFullRefund = 5
-				daysBackHalfRefund = 2
-			case "Strict":
-				daysBackFullRefund = 30
-				daysBackHalfRefund = 14
+			if len(lineItems) > 0 && promoCode != "" {
+				rental.PromoCode = promoCode
 			}
-			rental.CancelCutOffs = []EventRentalCancel{}
-			if daysBackFullRefund != 0 {
-				cutoff := startTime.AddDate(0, 0, -daysBackFullRefund)
-				rental.CancelCutOffs = append(rental.CancelCutOffs, EventRentalCancel{CutOff: &cutoff, Refund: float32(fullRefund)})
+			setRentalTotal(rental)
+			return rental
+		}
+	}
+	return nil
+}
+
+// setRentalTotal sets SalesTax, Total, and CancelCutOffs from a rental's other amounts, Start, and CancelPolicy
+func setRentalTotal(rental *EventRental) {
+	subtotal := rental.Price + rental.CaptainFee + rental.InsureFee + rental.TowFee + rental.TransactionFee - rental.RewardsDiscount
+	rental.SalesTax = salesTax(subtotal)
+	rental.Total = subtotal + rental.SalesTax
+	fullRefund := rental.Total
+	halfRefund := math.Round(float64(fullRefund)/2*100) / 100
+	// Flexible is full refund with 24 hours
+	daysBackFullRefund := 1
+	daysBackHalfRefund := 0
+	switch rental.CancelPolicy {
+	case "Moderate":
+		daysBackFullRefund = 5
+		daysBackHalfRefund = 2
+	case "Strict":
+		daysBackFullRefund = 30
+		daysBackHalfRefund = 14
+	}
+	rental.CancelCutOffs = []EventRentalCancel{}
+	if daysBackFullRefund != 0 {
+		cutoff := rental.Start.AddDate(0, 0, -daysBackFullRefund)
+		rental.CancelCutOffs = append(rental.CancelCutOffs, EventRentalCancel{CutOff: &cutoff, Refund: float32(fullRefund)})
+	}
+	if daysBackHalfRefund != 0 {
+		cutoff := rental.Start.AddDate(0, 0, -daysBackHalfRefund)
+		rental.CancelCutOffs = append(rental.CancelCutOffs, EventRentalCancel{CutOff: &cutoff, Refund: float32(halfRefund)})
+	}
+}
+
+// salesTax gets the sales tax on a subtotal
+func salesTax(subtotal float32) float32 {
+	// TODO: hook up with Avalara
+	return float32(math.Round(float64(subtotal)*7) / 100)
+}
+
+const rewardPointValue = 0.01
+
+// redeemedRewards is the discount that redeeming rewardPoints takes off price in currency, where they're worth a US
+// cent each, up to the price, and how many of them that takes
+func redeemedRewards(rewardPoints int, currency string, price float64) (float64, int) {
+	rate, err := exchangeRate("USD", currency)
+	if err != nil {
+		rate = 1
+	}
+	discount := math.Min(float64(rewardPoints)*rewardPointValue*rate, price)
+	if discount <= 0 {
+		return 0, 0
+	}
+	return discount, int(math.Round(discount / rewardPointValue / rate))
+}
+
+// applyPricingRules applies the owner's rules to a rental price in this order, each to the price after the ones before it:
+//  1. Weekend and Holiday surcharges, for the share of rental days that are weekend days or holidays
+//  2. Last Minute and Early Bird discounts, by how long before startTime it's booked
+//  3. Multi Day discount, using only the matching rule with the most Days
+//  4. Promo Code discount, if promoCode matches and hasn't expired
+//
+// and returns the new price and a line item for each rule applied
+func applyPricingRules(rules []BoatRentalRule, price float64, startTime, endTime *time.Time, promoCode string) (float64, []EventRentalLineItem) {
+	var lineItems []EventRentalLineItem
+	apply := func(rule BoatRentalRule, percent float64) {
+		amount := math.Round(price*percent) / 100
+		if amount == 0 {
+			return
+		}
+		price += amount
+		lineItems = append(lineItems, EventRentalLineItem{Type: rule.Type, Percent: rule.Percent, Amount: float32(amount)})
+	}
+	// each calendar day that the rental touches
+	days := []time.Time{}
+	for day := time.Date(startTime.Year(), startTime.Month(), startTime.Day(), 0, 0, 0, 0, startTime.Location()); day.Before(*endTime); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	if len(days) == 0 {
+		return price, nil
+	}
+	for _, rule := range rules {
+		matches := 0
+		for _, day := range days {
+			switch rule.Type {
+			case "Weekend":
+				if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+					matches++
+				}
+			case "Holiday":
+				for _, date := range rule.Dates {
+					if date.Year() == day.Year() && date.YearDay() == day.YearDay() {
+						matches++
+						break
+					}
+				}
 			}
-			if daysBackHalfRefund != 0 {
-				cutoff := startTime.AddDate(0, 0, -daysBackHalfRefund)
-				rental.CancelCutOffs = append(rental.CancelCutOffs, EventRentalCancel{CutOff: &cutoff, Refund: float32(halfRefund)})
+		}
+		if matches > 0 {
+			apply(rule, float64(rule.Percent)*float64(matches)/float64(len(days)))
+		}
+	}
+	leadTime := startTime.Sub(*now())
+	for _, rule := range rules {
+		dayCount := time.Duration(rule.Days) * 24 * time.Hour
+		if rule.Type == "LastMinute" && leadTime < dayCount || rule.Type == "EarlyBird" && leadTime >= dayCount {
+			apply(rule, -float64(rule.Percent))
+		}
+	}
+	var multiDay *BoatRentalRule
+	for i, rule := range rules {
+		if rule.Type == "MultiDay" && len(days) >= rule.Days && (multiDay == nil || rule.Days > multiDay.Days) {
+			multiDay = &rules[i]
+		}
+	}
+	if multiDay != nil {
+		apply(*multiDay, -float64(multiDay.Percent))
+	}
+	if promoCode != "" {
+		for _, rule := range rules {
+			if rule.Type == "PromoCode" && strings.EqualFold(rule.Code, promoCode) && (rule.Expires == nil || now().Before(*rule.Expires)) {
+				apply(rule, -float64(rule.Percent))
+				break
 			}
-			return rental
+		}
+	}
+	return math.Max(price, 0), lineItems
+}
+
+// publicPricingRules omits promo codes, which the owner hands out
+func publicPricingRules(rules []BoatRentalRule) []BoatRentalRule {
+	var public []BoatRentalRule
+	for _, rule := range rules {
+		if rule.Type != "PromoCode" {
+			public = append(public, rule)
+		}
+	}
+	return public
+}
+
+// checkPricingRules makes sure each rule has what its Type needs
+func checkPricingRules(rental *BoatRental) error {
+	for i, rule := range rental.PricingRules {
+		field := "PricingRules." + strconv.Itoa(i)
+		switch {
+		case rule.Percent <= 0 || rule.Percent > 100:
+			return Err("BadPricingRule", map[string]string{"Field": field + ".Percent"})
+		case (rule.Type == "LastMinute" || rule.Type == "EarlyBird" || rule.Type == "MultiDay") && rule.Days <= 0:
+			return Err("BadPricingRule", map[string]string{"Field": field + ".Days"})
+		case rule.Type == "Holiday" && len(rule.Dates) == 0:
+			return Err("BadPricingRule", map[string]string{"Field": field + ".Dates"})
+		case rule.Type == "PromoCode" && strings.TrimSpace(rule.Code) == "":
+			return Err("BadPricingRule", map[string]string{"Field": field + ".Code"})
 		}
 	}
 	return nil
@@ -408,58 +637,259 @@ func SetBoat(req *Request, pub *Publication) *Response {
 		return errResponse(err)
 	}
 	staff := isStaff(req)
-	oldBoat, err := getBoat(req.Boat.ID)
+	oldBoat := &Boat{}
+	key, err := updateX("Boat", req.Boat.ID, req.IfMatch, oldBoat, req.Boat, func() (interface{}, error) {
+		// members of the boat's org can change it if they have SetBoat OrgAccess
+		if lacksOrgAccess(req, "SetBoat", oldBoat) {
+			return nil, errors.New("AccessDenied")
+		}
+		orgBoat := req.Session.OrgID != 0 && oldBoat.OrgID == req.Session.OrgID
+		// check UserID and OrgID and omit User and Org
+		if req.Boat.UserID == 0 {
+			req.Boat.UserID = req.Session.UserID
+		}
+		if req.Boat.OrgID == 0 && req.Boat.UserID == req.Session.UserID {
+			req.Boat.OrgID = req.Session.OrgID
+		}
+		if oldBoat != nil && oldBoat.UserID != 0 {
+			// only staff can change UserID or OrgID
+			if (req.Boat.UserID != oldBoat.UserID || req.Boat.OrgID != oldBoat.OrgID) && !staff {
+				return nil, errors.New("StaffOnlyToChangeBoatOwner")
+			}
+		}
+		req.Boat.User = nil
+		req.Boat.Org = nil
+		if (req.Boat.UserID != req.Session.UserID && !orgBoat || req.Boat.OrgID != req.Session.OrgID) && !staff {
+			return nil, errors.New("StaffOnlyToSetBoatOwner")
+		}
+		// check HullID
+		if req.Boat.HullID != "" && !hullIDPattern.MatchString(req.Boat.HullID) {
+			return nil, errors.New("BadHullID")
+		}
+		// check Currency
+		if req.Boat.Currency != "" && (!currencyPattern.MatchString(req.Boat.Currency) || getCurrencies()[req.Boat.Currency] == nil) {
+			return nil, errors.New("BadCurrency")
+		}
+		req.Boat.FuelCost = 0
+		for _, rental := range []*BoatRental{req.Boat.Rental, req.Boat.Cruise, req.Boat.Ride} {
+			if rental != nil {
+				if err := checkPricingRules(rental); err != nil {
+					return nil, err
+				}
+				if err := checkApprovalRules(rental); err != nil {
+					return nil, err
+				}
+				rental.RentalIfCaptain = nil
+				rental.RentalIfNoCaptain = nil
+				rental.NextAvailable = nil
+			}
+		}
+		// Calendar and NotAvailable are only changed by SetCalendar and ImportCalendar
+		req.Boat.Calendar = oldBoat.Calendar
+		// EngineHours and Maintenance are only changed by SetWorkOrder and SetMaintenance
+		req.Boat.EngineHours = oldBoat.EngineHours
+		req.Boat.Maintenance = oldBoat.Maintenance
+		for _, listing := range []string{"Rental", "Cruise", "Ride"} {
+			rental := getDeepField(listing, req.Boat).(*BoatRental)
+			if rental != nil {
+				rental.NotAvailable = nil
+				if oldRental := getDeepField(listing, oldBoat).(*BoatRental); oldRental != nil {
+					rental.NotAvailable = oldRental.NotAvailable
+				}
+			}
+		}
+		// SoldDates are only set by AcceptOffer, and sold fractions can't change, unless I'm staff
+		if req.Boat.Sale != nil && !staff {
+			req.Boat.Sale.SoldDate = nil
+			for i := range req.Boat.Sale.Fractions {
+				req.Boat.Sale.Fractions[i].SoldDate = nil
+			}
+			if oldBoat.Sale != nil {
+				req.Boat.Sale.SoldDate = oldBoat.Sale.SoldDate
+				for _, fraction := range oldBoat.Sale.Fractions {
+					if fraction.SoldDate != nil {
+						req.Boat.Sale.Fractions = oldBoat.Sale.Fractions
+						break
+					}
+				}
+			}
+		}
+		// check ListingStatus of Rental, Cruise, Ride, and Sale
+		submitted, err := setListingStatuses(staff, req.Boat, oldBoat)
+		if err != nil {
+			return nil, err
+		}
+		// finalize and save
+		setAudit(staff, req.Boat, oldBoat)
+		if submitted && !staff {
+			// put it in the staff QA queue
+			req.Boat.Audit.QANeeded = now()
+		}
+		if req.Boat.Location != nil {
+			locations := []Contact{*req.Boat.Location}
+			if err := setContacts(locations, nil, req); err != nil {
+				return nil, err
+			}
+			req.Boat.Location = &locations[0]
+		}
+		return req.Boat, nil
+	})
 	if err != nil {
 		return errResponse(err)
 	}
-	// check UserID and OrgID and omit User and Org
-	if req.Boat.UserID == 0 {
-		req.Boat.UserID = req.Session.UserID
-	}
-	if req.Boat.OrgID == 0 && req.Boat.UserID == req.Session.UserID {
-		req.Boat.OrgID = req.Session.OrgID
-	}
-	if oldBoat != nil && oldBoat.UserID != 0 {
-		// only staff can change UserID or OrgID
-		if (req.Boat.UserID != oldBoat.UserID || req.Boat.OrgID != oldBoat.OrgID) && !staff {
-			return &Response{ErrorCode: "StaffOnlyToChangeBoatOwner"}
-		}
-	}
-	req.Boat.User = nil
-	req.Boat.Org = nil
-	if (req.Boat.UserID != req.Session.UserID || req.Boat.OrgID != req.Session.OrgID) && !staff {
-		return &Response{ErrorCode: "StaffOnlyToSetBoatOwner"}
-	}
-	// check HullID
-	if req.Boat.HullID != "" && !hullIDPattern.MatchString(req.Boat.HullID) {
-		return &Response{ErrorCode: "BadHullID"}
-	}
-	// check Currency
-	if req.Boat.Currency != "" && !currencyPattern.MatchString(req.Boat.Currency) {
-		return &Response{ErrorCode: "BadCurrency"}
-	}
-	req.Boat.FuelCost = 0
-	// TODO: check Rental
-	if req.Boat.Rental != nil {
-		rental := req.Boat.Rental
-		rental.RentalIfCaptain = nil
-		rental.RentalIfNoCaptain = nil
-		rental.NextAvailable = nil
-	}
-	// finalize and save
-	setAudit(staff, req.Boat, oldBoat)
-	if req.Boat.Location != nil {
-		locations := []Contact{*req.Boat.Location}
-		if err := setContacts(locations, nil, req); err != nil {
-			return errResponse(err)
+	return &Response{
+		ID:      key.ID,
+		Version: req.Boat.Audit.Version,
+	}
+}
+
+// listingNames are the fields of a Boat that are each listed, published, paused, etc. on their own
+var listingNames = []string{"Rental", "Cruise", "Ride", "Sale"}
+
+// ownerListingStatuses has the ListingStatus changes an owner may make; staff may make any change
+var ownerListingStatuses = map[string][]string{
+	"Draft":         {"PendingReview", "Archived"},
+	"PendingReview": {"Draft", "Archived"},
+	"Published":     {"Paused", "Archived"},
+	"Paused":        {"Published", "Archived"},
+	"Archived":      {"Draft"},
+}
+
+func listingStatusField(boat *Boat, listing string) *string {
+	if boat == nil {
+		return nil
+	}
+	switch listing {
+	case "Rental", "Cruise", "Ride":
+		rental := getDeepField(listing, boat).(*BoatRental)
+		if rental != nil {
+			return &rental.ListingStatus
+		}
+	case "Sale":
+		if boat.Sale != nil {
+			return &boat.Sale.ListingStatus
 		}
-		req.Boat.Location = &locations[0]
 	}
-	key, err := putBoat(req.Boat)
-	if err != nil {
-		return errResponse(err)
+	return nil
+}
+
+// listingStatus gets the ListingStatus of a boat's listing, or "" if it has none; a listing from before there were
+// listing statuses has none set, and was live if it had a ListingTitle, so it's Published, or else it's a Draft
+func listingStatus(boat *Boat, listing string) string {
+	status := listingStatusField(boat, listing)
+	if status == nil {
+		return ""
 	}
-	return &Response{
-		ID: key.ID,
+	if *status == "" {
+		if listingTitle(boat, listing) == "" {
+			return "Draft"
+		}
+		return "Published"
+	}
+	return *status
+}
+
+// listingTitle gets the ListingTitle of a boat's listing, or "" if it has none
+func listingTitle(boat *Boat, listing string) string {
+	switch listing {
+	case "Rental", "Cruise", "Ride":
+		if rental := getDeepField(listing, boat).(*BoatRental); rental != nil {
+			return rental.ListingTitle
+		}
+	case "Sale":
+		if boat.Sale != nil {
+			return boat.Sale.ListingTitle
+		}
+	}
+	return ""
+}
+
+func isPublished(boat *Boat) bool {
+	for _, listing := range listingNames {
+		if listingStatus(boat, listing) == "Published" {
+			return true
+		}
+	}
+	return false
+}
+
+// setListingStatuses defaults each listing's ListingStatus, checks that the change from oldBoat is allowed and that required fields are there,
+// and returns true if any listing was just submitted for review
+func setListingStatuses(staff bool, boat, oldBoat *Boat) (bool, error) {
+	submitted := false
+	_, statuses := Enums(BoatRental{}, "ListingStatus")
+	for _, listing := range listingNames {
+		newStatus := listingStatusField(boat, listing)
+		if newStatus == nil {
+			continue
+		}
+		oldStatus := "Draft"
+		if status := listingStatus(oldBoat, listing); status != "" {
+			oldStatus = status
+		}
+		if *newStatus == "" {
+			// a client that doesn't know about ListingStatus keeps the listing as it was
+			*newStatus = oldStatus
+		}
+		if _, ok := statuses[*newStatus]; !ok {
+			return false, Err("BadEnum", map[string]string{"Field": listing + ".ListingStatus", "Value": *newStatus})
+		}
+		if *newStatus != oldStatus {
+			if !staff && !StringInArray(*newStatus, ownerListingStatuses[oldStatus]) {
+				return false, Err("BadListingStatus", map[string]string{"Listing": listing, "From": oldStatus, "To": *newStatus})
+			}
+			if *newStatus == "PendingReview" {
+				submitted = true
+			}
+		}
+		// a listing that was live before there were listing statuses is only held to the required fields once it changes
+		if oldField := listingStatusField(oldBoat, listing); oldField != nil && *oldField == "" && *newStatus == oldStatus {
+			continue
+		}
+		if *newStatus == "PendingReview" || *newStatus == "Published" {
+			if err := checkListing(boat, listing); err != nil {
+				return false, err
+			}
+		}
+	}
+	return submitted, nil
+}
+
+// checkListing makes sure a listing has what renters or buyers need to see before it's reviewed or published
+func checkListing(boat *Boat, listing string) error {
+	missing := []string{}
+	if len(boat.Images) == 0 {
+		missing = append(missing, "Images")
+	}
+	if boat.Location == nil || boat.Location.Location == nil {
+		missing = append(missing, "Location")
+	}
+	if listing == "Sale" {
+		if boat.Sale.Price == 0 {
+			missing = append(missing, "Sale.Price")
+		}
+	} else {
+		rental := getDeepField(listing, boat).(*BoatRental)
+		if !hasSeasonPricing(rental) {
+			missing = append(missing, listing+".Seasons")
+		}
+		if rental.CancelPolicy == "" {
+			missing = append(missing, listing+".CancelPolicy")
+		}
+	}
+	if len(missing) > 0 {
+		return Err("IncompleteListing", map[string]string{"Listing": listing, "Fields": strings.Join(missing, ",")})
+	}
+	return nil
+}
+
+func hasSeasonPricing(rental *BoatRental) bool {
+	for _, season := range rental.Seasons {
+		for _, pricing := range season.Pricing {
+			if pricing.BasePrice+pricing.HourlyPrice+pricing.DailyPrice+pricing.HalfDailyPrice+pricing.WeeklyPrice > 0 {
+				return true
+			}
+		}
 	}
+	return false
 }
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/json"
+	"math"
 	"testing"
 	"time"
 
@@ -27,7 +29,7 @@ func TestGetBoats(t *testing.T) {
 			dst:  []*Boat{{Make: "#201"}, {Make: "#202"}},
 		},
 	})
-	testAPI(t, session, nil, "GetBoats", `{"Location":{"Lat":30,"Lng":-90},"StartDate":"2020-01-25T13:00:00.000Z","EndDate":"2020-01-25T17:00:00.000Z"}`, `{"SubscriptionID":-1,"Boats":{"101":{"ID":101,"Make":"#101","Rental":{"ListingTitle":"Super!","RentalIfCaptain":{"Start":"2020-05-07T13:00:00Z","End":"2020-05-07T17:00:00Z","Captain":"CaptainIncluded","Price":700,"InsureFee":140,"TowFee":35,"TransactionFee":70,"SalesTax":66.15,"Total":1011.15,"SecurityDeposit":500,"FuelPayer":"Owner","CancelCutOffs":[{"CutOff":"2020-05-06T13:00:00Z","Refund":1011.15}]},"RentalIfNoCaptain":{"Start":"2020-05-07T13:00:00Z","End":"2020-05-07T17:00:00Z","Captain":"NoCaptain","Price":600,"InsureFee":120,"TowFee":30,"TransactionFee":60,"SalesTax":56.7,"Total":866.7,"SecurityDeposit":500,"FuelPayer":"Renter","CancelCutOffs":[{"CutOff":"2020-05-06T13:00:00Z","Refund":866.7}]},"NextAvailable":["2020-05-07T13:00:00Z","2020-05-07T17:00:00Z"]},"Audit":{}}}}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "GetBoats", `{"Location":{"Lat":30,"Lng":-90},"StartDate":"2020-01-25T13:00:00.000Z","EndDate":"2020-01-25T17:00:00.000Z"}`, `{"SubscriptionID":-1,"Boats":{"101":{"ID":101,"Make":"#101","Rental":{"ListingTitle":"Super!","ListingStatus":"Published","RentalIfCaptain":{"Start":"2020-05-07T13:00:00Z","End":"2020-05-07T17:00:00Z","Captain":"CaptainIncluded","Price":700,"InsureFee":140,"TowFee":35,"TransactionFee":70,"SalesTax":66.15,"Total":1011.15,"SecurityDeposit":500,"FuelPayer":"Owner","CancelCutOffs":[{"CutOff":"2020-05-06T13:00:00Z","Refund":1011.15}]},"RentalIfNoCaptain":{"Start":"2020-05-07T13:00:00Z","End":"2020-05-07T17:00:00Z","Captain":"NoCaptain","Price":600,"InsureFee":120,"TowFee":30,"TransactionFee":60,"SalesTax":56.7,"Total":866.7,"SecurityDeposit":500,"FuelPayer":"Renter","CancelCutOffs":[{"CutOff":"2020-05-06T13:00:00Z","Refund":866.7}]},"NextAvailable":["2020-05-07T13:00:00Z","2020-05-07T17:00:00Z"]},"Cruise":{"ListingStatus":"Published","PricingRules":[{"Type":"Weekend","Percent":20}]},"Audit":{}}}}`, []mockDataStoreCall{
 		{
 			name:       "GetAll",
 			q:          newQuery("Boat", map[string]interface{}{"Location.Loc100KM=": 13320}),
@@ -41,7 +43,8 @@ func TestGetBoats(t *testing.T) {
 				{
 					Make: "#101",
 					Rental: &BoatRental{
-						ListingTitle: "Super!",
+						ListingTitle:  "Super!",
+						ListingStatus: "Published",
 						Seasons: []BoatRentalSeason{
 							{
 								StartDay: DateTime(2000, 1, 1, 0, 0, 0),
@@ -68,6 +71,11 @@ func TestGetBoats(t *testing.T) {
 							*DateTime(2020, 5, 8, 13, 0, 0), *DateTime(2020, 5, 8, 17, 0, 0),
 						},
 					},
+					// promo codes are handed out by the owner, so they're not shown
+					Cruise: &BoatRental{
+						ListingStatus: "Published",
+						PricingRules:  []BoatRentalRule{{Type: "Weekend", Percent: 20}, {Type: "PromoCode", Percent: 10, Code: "CRUISE10"}},
+					},
 				},
 				{
 					Make: "#102",
@@ -75,8 +83,168 @@ func TestGetBoats(t *testing.T) {
 			},
 			keysResult: []*datastore.Key{idKey("Boat", 101), idKey("Boat", 102)},
 		},
+		// quotes are in my own currency, if I have one
+		{
+			name: "Get",
+			key:  idKey("User", 123),
+			dst:  User{},
+		},
 	})
 }
 
 func TestSetBoat(t *testing.T) {
+	testAPI(t, &Session{UserID: 123}, nil, "SetBoat", `{"Boat":{}}`, `{"ErrorCode":"MustVerify"}`, nil)
+	session := &Session{UserID: 123, Verified: true}
+	testAPI(t, session, nil, "SetBoat", `{}`, `{"ErrorCode":"NeedBoat"}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"ListingStatus":"Published"}}}`, `{"ErrorCode":"BadListingStatus","ErrorDetails":{"From":"Draft","Listing":"Rental","To":"Published"}}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"ListingStatus":"PendingReview"}}}`, `{"ErrorCode":"IncompleteListing","ErrorDetails":{"Fields":"Images,Location,Rental.Seasons,Rental.CancelPolicy","Listing":"Rental"}}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Sale":{"ListingStatus":"Sold"}}}`, `{"ErrorCode":"BadEnum","ErrorDetails":{"Field":"Sale.ListingStatus","Value":"Sold"}}`, nil)
+	// a deleted boat can't be changed, only restored
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"ID":7,"Name":"Sea Breeze"}}`, `{"ErrorCode":"NotFound"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Audit: &Audit{Deleted: DateTime(2020, 5, 1, 0, 0, 0)}}},
+	})
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"PricingRules":[{"Type":"Weekend","Percent":20},{"Type":"MultiDay","Percent":10}]}}}`, `{"ErrorCode":"BadPricingRule","ErrorDetails":{"Field":"PricingRules.1.Days"}}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Currency":"XYZ"}}`, `{"ErrorCode":"BadCurrency"}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"PricingRules":[{"Type":"PromoCode","Percent":120,"Code":"X"}]}}}`, `{"ErrorCode":"BadPricingRule","ErrorDetails":{"Field":"PricingRules.0.Percent"}}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"Approvals":[{"Type":"NoViolation","Violation":"DUI"},{"Type":"Experience"}]}}}`, `{"ErrorCode":"BadApprovalRule","ErrorDetails":{"Field":"Approvals.1.Years"}}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"Approvals":[{"Type":"NoViolation","Violation":"Drifting"}]}}}`, `{"ErrorCode":"BadEnum","ErrorDetails":{"Field":"Violation","Value":"Drifting"}}`, nil)
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"Rental":{"ListingTitle":"Fun boat"}}}`, `{"ID":301,"Version":1}`, []mockDataStoreCall{
+		{
+			name:      "Put",
+			key:       idKey("Boat", 0),
+			src:       []*Boat{},
+			srcJSON:   `{"UserID":123,"Trailer":{},"Rental":{"ListingStatus":"Draft"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["Boat.Rental.ListingTitle","Boat.Rental.ListingDescription","Boat.Rental.ListingSummary","Boat.Rental.Rules"],"Boat":{"Trailer":{},"Rental":{"ListingTitle":"Fun boat"}}}}`,
+			keyResult: idKey("Boat", 301),
+		},
+	})
+	listed := `"Images":[{"URL":"/i/1.jpg"}],"Location":{"Type":"Address","Location":{"Lat":30,"Lng":-90}},"Rental":{"CancelPolicy":"Moderate","Seasons":[{"Pricing":[{"Captain":"NoCaptain","DailyPrice":500}]}]`
+	oldBoat := Boat{
+		UserID:   123,
+		Images:   []Image{{URL: "/i/1.jpg"}},
+		Location: &Contact{Type: "Address", Location: LatLng(30, -90)},
+		Rental: &BoatRental{
+			ListingStatus: "Published",
+			CancelPolicy:  "Moderate",
+			Seasons:       []BoatRentalSeason{{Pricing: []BoatRentalPricing{{Captain: "NoCaptain", DailyPrice: 500}}}},
+		},
+		Audit: &Audit{Created: DateTime(2020, 1, 2, 3, 4, 5)},
+	}
+	// submitting a draft for review puts it in the QA queue
+	draftBoat := oldBoat
+	draftBoat.Rental = &BoatRental{ListingStatus: "Draft", CancelPolicy: "Moderate", Seasons: oldBoat.Rental.Seasons}
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"ID":301,`+listed+`,"ListingStatus":"PendingReview"}}}`, `{"ID":301,"Version":1}`, []mockDataStoreCall{
+		{
+			name: "Get",
+			key:  idKey("Boat", 301),
+			dst:  draftBoat,
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 301),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":301,"UserID":123,"Trailer":{},"Images":[{"URL":"/i/1.jpg"}],"Location":{"Type":"Address","Residence":{},"Location":{"Lat":30,"Lng":-90},"Loc100KM":[12919,12920,13319,13320],"Loc300KM":[1369,1370,1502,1503]},"Rental":{"ListingStatus":"PendingReview","CancelPolicy":"Moderate","Seasons":[{"Pricing":[{"Captain":"NoCaptain","DailyPrice":500}]}]},"Audit":{"Created":"2020-01-02T03:04:05Z","Updated":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z"}}`,
+			keyResult: idKey("Boat", 301),
+		},
+	})
+	// owner can pause a published listing, but can't take it back to a draft
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"ID":301,`+listed+`,"ListingStatus":"Paused"}}}`, `{"ID":301,"Version":1}`, []mockDataStoreCall{
+		{
+			name: "Get",
+			key:  idKey("Boat", 301),
+			dst:  oldBoat,
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 301),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":301,"UserID":123,"Trailer":{},"Images":[{"URL":"/i/1.jpg"}],"Location":{"Type":"Address","Residence":{},"Location":{"Lat":30,"Lng":-90},"Loc100KM":[12919,12920,13319,13320],"Loc300KM":[1369,1370,1502,1503]},"Rental":{"ListingStatus":"Paused","CancelPolicy":"Moderate","Seasons":[{"Pricing":[{"Captain":"NoCaptain","DailyPrice":500}]}]},"Audit":{"Created":"2020-01-02T03:04:05Z","Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Boat", 301),
+		},
+	})
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"ID":301,"Rental":{"ListingStatus":"Draft"}}}`, `{"ErrorCode":"BadListingStatus","ErrorDetails":{"From":"Published","Listing":"Rental","To":"Draft"}}`, []mockDataStoreCall{
+		{
+			name: "Get",
+			key:  idKey("Boat", 301),
+			dst:  oldBoat,
+		},
+	})
+	// a listing from before there were listing statuses stays published, even without the fields now required
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"ID":302,"Rental":{"ListingTitle":"Fun boat"}}}`, `{"ID":302,"Version":1}`, []mockDataStoreCall{
+		{
+			name: "Get",
+			key:  idKey("Boat", 302),
+			dst:  Boat{UserID: 123, Rental: &BoatRental{ListingTitle: "Fun boat"}, Audit: &Audit{Created: DateTime(2020, 1, 2, 3, 4, 5)}},
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 302),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":302,"UserID":123,"Trailer":{},"Rental":{"ListingTitle":"Fun boat","ListingStatus":"Published"},"Audit":{"Created":"2020-01-02T03:04:05Z","Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Boat", 302),
+		},
+	})
+	// but one without a ListingTitle was never live, so it's a Draft
+	testAPI(t, session, nil, "SetBoat", `{"Boat":{"ID":303,"Rental":{"AllowTwoHalfDays":true}}}`, `{"ID":303,"Version":1}`, []mockDataStoreCall{
+		{
+			name: "Get",
+			key:  idKey("Boat", 303),
+			dst:  Boat{UserID: 123, Rental: &BoatRental{}, Audit: &Audit{Created: DateTime(2020, 1, 2, 3, 4, 5)}},
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 303),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":303,"UserID":123,"Trailer":{},"Rental":{"ListingStatus":"Draft","AllowTwoHalfDays":true},"Audit":{"Created":"2020-01-02T03:04:05Z","Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Boat", 303),
+		},
+	})
+}
+
+func TestGetBoatsUnconvertible(t *testing.T) {
+	session := &Session{UserID: 123}
+	// a boat in a currency without a rate is quoted in its own, rather than failing the search
+	testAPI(t, session, nil, "GetBoats", `{"Currency":"EUR","StartDate":"2020-05-07T13:00:00Z","EndDate":"2020-05-07T17:00:00Z"}`, `{"SubscriptionID":-1,"Boats":{"301":{"ID":301,"UserID":123,"User":{"GivenName":"Ann","Audit":{}},"Currency":"XYZ","Trailer":{},"Rental":{"ListingStatus":"Published","Seasons":[{"Pricing":[{"Captain":"NoCaptain","HalfDailyPrice":600}]}],"RentalIfNoCaptain":{"Start":"2020-05-07T13:00:00Z","End":"2020-05-07T17:00:00Z","Currency":"XYZ","Captain":"NoCaptain","Price":600,"InsureFee":120,"TowFee":30,"TransactionFee":60,"SalesTax":56.7,"Total":866.7,"SecurityDeposit":500,"CancelCutOffs":[{"CutOff":"2020-05-06T13:00:00Z","Refund":866.7}]}}},"302":{"ID":302,"UserID":123,"User":{"GivenName":"Ann","Audit":{}},"Trailer":{},"Rental":{"ListingStatus":"Published","Seasons":[{"Pricing":[{"Captain":"NoCaptain","HalfDailyPrice":600}]}],"RentalIfNoCaptain":{"Start":"2020-05-07T13:00:00Z","End":"2020-05-07T17:00:00Z","Currency":"EUR","OriginalCurrency":"USD","ExchangeRate":0.92,"Captain":"NoCaptain","Price":552,"InsureFee":110.4,"TowFee":27.6,"TransactionFee":55.2,"SalesTax":52.16,"Total":797.36,"SecurityDeposit":460,"CancelCutOffs":[{"CutOff":"2020-05-06T13:00:00Z","Refund":797.36}]}}}}}`, []mockDataStoreCall{
+		{
+			name: "Get",
+			key:  idKey("User", 123),
+			dst:  User{GivenName: "Ann"},
+		},
+		{
+			name: "GetAll",
+			q:    newQuery("Boat", map[string]interface{}{"UserID=": 123}),
+			dst: []*Boat{
+				{UserID: 123, Currency: "XYZ", Rental: &BoatRental{ListingStatus: "Published", Seasons: []BoatRentalSeason{{Pricing: []BoatRentalPricing{{Captain: "NoCaptain", HalfDailyPrice: 600}}}}}},
+				{UserID: 123, Rental: &BoatRental{ListingStatus: "Published", Seasons: []BoatRentalSeason{{Pricing: []BoatRentalPricing{{Captain: "NoCaptain", HalfDailyPrice: 600}}}}}},
+			},
+			keysResult: []*datastore.Key{idKey("Boat", 301), idKey("Boat", 302)},
+		},
+		{name: "GetMulti", keys: []*datastore.Key{idKey("User", 123)}, dst: []*User{{GivenName: "Ann"}}},
+	})
+}
+
+func TestApplyPricingRules(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	rules := []BoatRentalRule{
+		{Type: "Weekend", Percent: 30},
+		{Type: "Holiday", Percent: 10, Dates: []time.Time{*DateTime(2020, 5, 11, 0, 0, 0)}},
+		{Type: "LastMinute", Percent: 15, Days: 2},
+		{Type: "EarlyBird", Percent: 10, Days: 3},
+		{Type: "MultiDay", Percent: 5, Days: 2},
+		{Type: "MultiDay", Percent: 10, Days: 3},
+		{Type: "PromoCode", Percent: 20, Code: "SUMMER", Expires: DateTime(2020, 6, 1, 0, 0, 0)},
+	}
+	test := func(start, end *time.Time, promoCode string, expectPrice float64, expectJSON string) {
+		price, lineItems := applyPricingRules(rules, 1000, start, end, promoCode)
+		actualJSON, _ := json.Marshal(lineItems)
+		if math.Abs(price-expectPrice) > 0.001 || string(actualJSON) != expectJSON {
+			t.Errorf("Wrong applyPricingRules result\nActual %v %s\nExpect %v %s\n", price, actualJSON, expectPrice, expectJSON)
+		}
+	}
+	// Saturday to Monday holiday, booked early, with promo code
+	test(DateTime(2020, 5, 9, 10, 0, 0), DateTime(2020, 5, 11, 10, 0, 0), "summer", 803.52, `[{"Type":"Weekend","Percent":30,"Amount":200},{"Type":"Holiday","Percent":10,"Amount":40},{"Type":"EarlyBird","Percent":10,"Amount":-124},{"Type":"MultiDay","Percent":10,"Amount":-111.6},{"Type":"PromoCode","Percent":20,"Amount":-200.88}]`)
+	// Wednesday afternoon, booked last minute, with wrong promo code
+	test(DateTime(2020, 5, 6, 13, 0, 0), DateTime(2020, 5, 6, 17, 0, 0), "WINTER", 850, `[{"Type":"LastMinute","Percent":15,"Amount":-150}]`)
+	// expired promo code
+	testTime = DateTime(2020, 6, 2, 0, 0, 0)
+	test(DateTime(2020, 6, 3, 13, 0, 0), DateTime(2020, 6, 3, 17, 0, 0), "SUMMER", 850, `[{"Type":"LastMinute","Percent":15,"Amount":-150}]`)
 }
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bus carries publications to the hub of every instance of the server, including this one
+type Bus interface {
+	// Publish sends a publication to every instance
+	Publish(pub *Publication) error
+	// Subscribe calls receive with every publication from any instance, until Close
+	Subscribe(receive func(pub *Publication)) error
+	Close() error
+}
+
+// bus is what putX publishes to; it's in-process until Start connects to BUS_ADDR
+var bus Bus = &memoryBus{}
+
+// busChannel is the pub/sub channel all instances publish to
+const busChannel = "boatfuji.publications"
+
+func init() {
+	bus.Subscribe(receivePublication)
+}
+
+// startBus switches to a networked bus, if BUS_ADDR is set
+func startBus() {
+	if Config.Env.BusAddr == "" {
+		return
+	}
+	redis := newRedisBus(Config.Env.BusAddr, Config.Env.BusPass, busChannel)
+	redis.Subscribe(receivePublication)
+	bus.Close()
+	bus = redis
+}
+
+// publish sends a publication to every instance, or if the bus fails, at least to this one
+func publish(pub *Publication) {
+	if err := bus.Publish(pub); err != nil {
+		log.Printf("publish %s %d => %s", pub.Kind, pub.ID, err.Error())
+		receivePublication(pub)
+	}
+}
+
+// receivePublication handles a publication from any instance: the record's cached public projection is dropped, the
+// currencies of the marketplace org and the sessions of a user are refreshed, and the hub updates subscriptions; for a
+// Resync, after the bus may have missed some, the whole cache is dropped and every connection refreshed
+func receivePublication(pub *Publication) {
+	if pub.Resync {
+		publicCache.clear()
+		if err := loadCurrencies(); err != nil {
+			log.Printf("Error: loadCurrencies => %s", err.Error())
+		}
+		sse.publish(pub)
+		return
+	}
+	publicCache.forget(pub)
+	reloadCurrencies(pub)
+	refreshSessions(pub)
+	sse.publish(pub)
+}
+
+// memoryBus is a Bus for a single instance
+type memoryBus struct {
+	mutex    sync.RWMutex
+	receives []func(pub *Publication)
+}
+
+func (bus *memoryBus) Publish(pub *Publication) error {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	for _, receive := range bus.receives {
+		receive(pub)
+	}
+	return nil
+}
+
+func (bus *memoryBus) Subscribe(receive func(pub *Publication)) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.receives = append(bus.receives, receive)
+	return nil
+}
+
+func (bus *memoryBus) Close() error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.receives = nil
+	return nil
+}
+
+// redisBus is a Bus over the PUBLISH and SUBSCRIBE commands of a Redis protocol server; it reconnects as needed,
+// publications it can't send only reach this instance, and once its subscription reconnects, this instance resyncs
+type redisBus struct {
+	addr, pass, channel string
+	mutex               sync.Mutex
+	queue               chan redisPublication // for publishQueued, which is alone in sending them
+	receives            []func(pub *Publication)
+	subConn             net.Conn // for SUBSCRIBE
+	closed              bool
+}
+
+// redisPublication is a queued publication, and its JSON
+type redisPublication struct {
+	pub  *Publication
+	data []byte
+}
+
+// redisRetry is how long to wait before reconnecting
+const redisRetry = time.Second
+
+// redisQueueSize is how many publications may wait to be sent before Publish fails
+const redisQueueSize = 1000
+
+func newRedisBus(addr, pass, channel string) *redisBus {
+	bus := &redisBus{addr: addr, pass: pass, channel: channel, queue: make(chan redisPublication, redisQueueSize)}
+	go bus.publishQueued()
+	return bus
+}
+
+// Publish queues a publication to be sent, without waiting on the server
+func (bus *redisBus) Publish(pub *Publication) error {
+	data, err := json.Marshal(pub)
+	if err != nil {
+		return err
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.closed {
+		return errors.New("bus is closed")
+	}
+	select {
+	case bus.queue <- redisPublication{pub, data}:
+		return nil
+	default:
+		return errors.New("bus queue is full")
+	}
+}
+
+// publishQueued sends queued publications on one connection, until Close; it reconnects at most every redisRetry, and
+// a publication it can't send is received by this instance only
+func (bus *redisBus) publishQueued() {
+	var conn net.Conn
+	var reader *bufio.Reader
+	var retry time.Time
+	for queued := range bus.queue {
+		err := errors.New("bus is disconnected")
+		if conn != nil {
+			err = nil
+		} else if time.Now().After(retry) {
+			if conn, reader, err = bus.dial(); err != nil {
+				retry = time.Now().Add(redisRetry)
+			}
+		}
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = redisCommand(conn, reader, "PUBLISH", bus.channel, string(queued.data)); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+		if err != nil {
+			log.Printf("redisBus.Publish(%s) %s %d => %s", bus.addr, queued.pub.Kind, queued.pub.ID, err.Error())
+			bus.mutex.Lock()
+			receives := bus.receives
+			bus.mutex.Unlock()
+			for _, receive := range receives {
+				receive(queued.pub)
+			}
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (bus *redisBus) Subscribe(receive func(pub *Publication)) error {
+	bus.mutex.Lock()
+	bus.receives = append(bus.receives, receive)
+	bus.mutex.Unlock()
+	go func() {
+		// once a subscription fails, the next one starts with a Resync, since publications may have been missed
+		for resync := false; ; resync = true {
+			err := bus.subscribe(receive, resync)
+			bus.mutex.Lock()
+			closed := bus.closed
+			bus.mutex.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("redisBus.subscribe(%s) => %s", bus.addr, err.Error())
+			time.Sleep(redisRetry)
+		}
+	}()
+	return nil
+}
+
+// subscribe receives publications on one connection, until it fails; if resync, a Resync comes first
+func (bus *redisBus) subscribe(receive func(pub *Publication), resync bool) error {
+	conn, reader, err := bus.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	bus.mutex.Lock()
+	if bus.closed {
+		bus.mutex.Unlock()
+		return errors.New("bus is closed")
+	}
+	bus.subConn = conn
+	bus.mutex.Unlock()
+	if _, err := redisCommand(conn, reader, "SUBSCRIBE", bus.channel); err != nil {
+		return err
+	}
+	if resync {
+		receive(&Publication{Resync: true})
+	}
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return err
+		}
+		// a message is ["message", channel, data]
+		message, ok := reply.([]interface{})
+		if !ok || len(message) != 3 || fmt.Sprint(message[0]) != "message" {
+			continue
+		}
+		data, _ := message[2].(string)
+		pub := &Publication{}
+		if err := json.Unmarshal([]byte(data), pub); err != nil {
+			log.Printf("redisBus.subscribe(%s) bad publication %q", bus.addr, data)
+			continue
+		}
+		receive(pub)
+	}
+}
+
+func (bus *redisBus) Close() error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.closed {
+		return nil
+	}
+	bus.closed = true
+	close(bus.queue)
+	if bus.subConn != nil {
+		bus.subConn.Close()
+	}
+	return nil
+}
+
+// dial connects to the server, and authenticates if there's a password
+func (bus *redisBus) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", bus.addr, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if bus.pass != "" {
+		if _, err := redisCommand(conn, reader, "AUTH", bus.pass); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+// redisCommand sends a command as an array of bulk strings, and reads its reply
+func redisCommand(w io.Writer, reader *bufio.Reader, args ...string) (interface{}, error) {
+	command := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		command += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(w, command); err != nil {
+		return nil, err
+	}
+	return readRedisReply(reader)
+}
+
+// readRedisReply reads a simple string, error, integer, bulk string, or array of them; a nil bulk string or array is nil
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("bad reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, errors.New(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, count)
+		for i := range array {
+			if array[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("bad reply %q", line)
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redisStandIn is a local server with just enough of the Redis protocol for redisBus: AUTH, PUBLISH, and SUBSCRIBE
+type redisStandIn struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newRedisStandIn(t *testing.T) *redisStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() => %s", err.Error())
+	}
+	standIn := &redisStandIn{listener: listener, subscribers: map[string][]net.Conn{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go standIn.serve(conn)
+		}
+	}()
+	return standIn
+}
+
+func (standIn *redisStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		switch args[0] {
+		case "AUTH":
+			conn.Write([]byte("+OK\r\n"))
+		case "SUBSCRIBE":
+			channel := args[1].(string)
+			standIn.mutex.Lock()
+			standIn.subscribers[channel] = append(standIn.subscribers[channel], conn)
+			standIn.mutex.Unlock()
+			conn.Write([]byte(redisArray(3, "subscribe", channel) + ":1\r\n"))
+		case "PUBLISH":
+			channel, message := args[1].(string), args[2].(string)
+			standIn.mutex.Lock()
+			subscribers := standIn.subscribers[channel]
+			for _, subscriber := range subscribers {
+				subscriber.Write([]byte(redisArray(3, "message", channel, message)))
+			}
+			standIn.mutex.Unlock()
+			conn.Write([]byte(":" + strconv.Itoa(len(subscribers)) + "\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+// redisArray is the start of an array of count elements, with bulk strings for the first ones
+func redisArray(count int, bulks ...string) string {
+	array := "*" + strconv.Itoa(count) + "\r\n"
+	for _, bulk := range bulks {
+		array += "$" + strconv.Itoa(len(bulk)) + "\r\n" + bulk + "\r\n"
+	}
+	return array
+}
+
+func TestMemoryBus(t *testing.T) {
+	memory := &memoryBus{}
+	var received []*Publication
+	memory.Subscribe(func(pub *Publication) { received = append(received, pub) })
+	pub := &Publication{Kind: "Boat", ID: 7, UserIDs: []int64{123}, BoatIDs: []int64{7}}
+	memory.Publish(pub)
+	memory.Close()
+	memory.Publish(pub)
+	if !reflect.DeepEqual(received, []*Publication{pub}) {
+		t.Errorf("memoryBus received %+v, expected only %+v", received, pub)
+	}
+}
+
+func TestRedisBus(t *testing.T) {
+	standIn := newRedisStandIn(t)
+	defer standIn.listener.Close()
+	// two instances, each with its own bus and what its hub received
+	var mutex sync.Mutex
+	received := map[string][]Publication{}
+	instance := func(name string) *redisBus {
+		redis := newRedisBus(standIn.listener.Addr().String(), "secret", "test")
+		redis.Subscribe(func(pub *Publication) {
+			mutex.Lock()
+			received[name] = append(received[name], *pub)
+			mutex.Unlock()
+		})
+		return redis
+	}
+	a, b := instance("a"), instance("b")
+	defer b.Close()
+	// wait for both to subscribe
+	for i := 0; i < 100; i++ {
+		standIn.mutex.Lock()
+		count := len(standIn.subscribers["test"])
+		standIn.mutex.Unlock()
+		if count == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pub := Publication{Kind: "Boat", ID: 7, UserIDs: []int64{123}, BoatIDs: []int64{7}}
+	if err := a.Publish(&pub); err != nil {
+		t.Fatalf("Publish() => %s", err.Error())
+	}
+	expect := map[string][]Publication{"a": {pub}, "b": {pub}}
+	for i := 0; i < 100; i++ {
+		mutex.Lock()
+		done := reflect.DeepEqual(received, expect)
+		mutex.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if !reflect.DeepEqual(received, expect) {
+		t.Errorf("redisBus received %+v, expected %+v", received, expect)
+	}
+	mutex.Unlock()
+	// a closed bus fails, so publish falls back to this instance
+	a.Close()
+	if err := a.Publish(&pub); err == nil {
+		t.Error("Publish() after Close() => nil, expected an error")
+	}
+}
+
+func TestRedisBusResync(t *testing.T) {
+	standIn := newRedisStandIn(t)
+	defer standIn.listener.Close()
+	received := make(chan Publication, 10)
+	redis := newRedisBus(standIn.listener.Addr().String(), "", "test")
+	defer redis.Close()
+	redis.Subscribe(func(pub *Publication) { received <- *pub })
+	subscribed := func() {
+		for i := 0; i < 300; i++ {
+			standIn.mutex.Lock()
+			count := len(standIn.subscribers["test"])
+			standIn.mutex.Unlock()
+			if count == 1 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("redisBus didn't subscribe")
+	}
+	subscribed()
+	// once the subscription drops and reconnects, this instance resyncs
+	standIn.mutex.Lock()
+	standIn.subscribers["test"][0].Close()
+	standIn.subscribers["test"] = nil
+	standIn.mutex.Unlock()
+	select {
+	case pub := <-received:
+		if !pub.Resync {
+			t.Errorf("redisBus received %+v, expected a Resync", pub)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("redisBus didn't resync")
+	}
+}
+
+func TestRedisBusDown(t *testing.T) {
+	// nothing listens here, so Publish doesn't wait, and the publication reaches only this instance
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	received := make(chan Publication, 10)
+	redis := newRedisBus(addr, "", "test")
+	defer redis.Close()
+	redis.Subscribe(func(pub *Publication) { received <- *pub })
+	pub := Publication{Kind: "Boat", ID: 7}
+	start := time.Now()
+	if err := redis.Publish(&pub); err != nil {
+		t.Fatalf("Publish() => %s", err.Error())
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Publish() took %s", time.Since(start))
+	}
+	select {
+	case got := <-received:
+		if !reflect.DeepEqual(got, pub) {
+			t.Errorf("redisBus received %+v, expected %+v", got, pub)
+		}
+	case <-time.After(6 * time.Second):
+		t.Error("redisBus didn't receive it")
+	}
+}
@@ -0,0 +1,625 @@
+package api
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// BoatCalendar is when a boat is blocked by its owner or by other sites' calendars, and when it's booked
+type BoatCalendar struct {
+	Blocks     []BoatBlock `json:",omitempty" datastore:",omitempty,noindex"`
+	ImportURLs []string    `json:",omitempty" datastore:",omitempty,noindex"`
+	Bookings   []BoatBlock `json:",omitempty" datastore:"-"` // from Deals, so only set by GetCalendar
+	ExportURL  string      `json:",omitempty" datastore:"-"` // secret .ics feed URL, so only set by GetCalendar
+}
+
+// BoatBlock is a range of time when a boat is not available
+type BoatBlock struct {
+	Start   *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	End     *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	Source  string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Owner, Import, Booking"`
+	Feed    string     `json:",omitempty" datastore:",omitempty,noindex"` // ImportURL it came from, or "" if uploaded
+	UID     string     `json:",omitempty" datastore:",omitempty,noindex"`
+	Summary string     `json:",omitempty" datastore:",omitempty,noindex"`
+	DealID  int64      `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+func init() {
+	addEnumsFor(BoatBlock{})
+	apiHandlers["GetCalendar"] = GetCalendar
+	apiHandlers["SetCalendar"] = SetCalendar
+	apiHandlers["ImportCalendar"] = ImportCalendar
+}
+
+// GetCalendar gets a boat's blocks and bookings, optionally between StartDate and EndDate
+func GetCalendar(req *Request, pub *Publication) *Response {
+	boat, err := getCalendarBoat(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	bookings, err := getBookings(boat.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	calendar := &BoatCalendar{
+		Blocks:     blocksBetween(boat.Calendar.Blocks, req.StartDate, req.EndDate),
+		ImportURLs: boat.Calendar.ImportURLs,
+		Bookings:   blocksBetween(bookings, req.StartDate, req.EndDate),
+	}
+	if token := icsToken(boat.ID); token != "" {
+		calendar.ExportURL = "/api/ICS/" + strconv.FormatInt(boat.ID, 10) + "-" + token + ".ics"
+	}
+	return &Response{Calendar: calendar}
+}
+
+// SetCalendar replaces a boat's owner blocks and ImportURLs; blocks imported from a removed ImportURL are removed too
+func SetCalendar(req *Request, pub *Publication) *Response {
+	if req.Calendar == nil {
+		return &Response{ErrorCode: "NeedCalendar"}
+	}
+	return updateCalendarBoat(req, func(boat *Boat) error {
+		importURLs := map[string]bool{}
+		for _, url := range req.Calendar.ImportURLs {
+			if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+				return Err("BadImportURL", map[string]string{"URL": url})
+			}
+			importURLs[url] = true
+		}
+		blocks := []BoatBlock{}
+		for _, block := range req.Calendar.Blocks {
+			if block.Start == nil || block.End == nil || !block.End.After(*block.Start) {
+				return errors.New("BadBlock")
+			}
+			blocks = append(blocks, BoatBlock{Start: block.Start, End: block.End, Source: "Owner", Summary: block.Summary})
+		}
+		for _, block := range boat.Calendar.Blocks {
+			if block.Source == "Import" && (block.Feed == "" || importURLs[block.Feed]) {
+				blocks = append(blocks, block)
+			}
+		}
+		boat.Calendar.Blocks = blocks
+		boat.Calendar.ImportURLs = req.Calendar.ImportURLs
+		return nil
+	})
+}
+
+// ImportCalendar imports iCal events as blocks, from uploaded .ics Text, or from a URL (which is added to ImportURLs),
+// or if neither is given, from all of the boat's ImportURLs again
+func ImportCalendar(req *Request, pub *Publication) *Response {
+	boat, err := getCalendarBoat(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	if lacksOrgAccess(req, "SetBoat", boat) {
+		return accessDenied()
+	}
+	if req.Text != "" {
+		events, err := parseICS(strings.NewReader(req.Text))
+		if err != nil {
+			return errResponse(err)
+		}
+		return updateCalendarBoat(req, func(boat *Boat) error {
+			boat.Calendar.Blocks = mergeImport(boat.Calendar.Blocks, "", events)
+			return nil
+		})
+	}
+	urls := boat.Calendar.ImportURLs
+	if req.URL != "" {
+		if !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+			return errResponse(Err("BadImportURL", map[string]string{"URL": req.URL}))
+		}
+		urls = []string{req.URL}
+	}
+	if len(urls) == 0 {
+		return &Response{ErrorCode: "NeedURLOrText"}
+	}
+	// the feeds are got before the transaction, which may be retried, so a feed removed since isn't imported
+	urlEvents := map[string][]BoatBlock{}
+	for _, url := range urls {
+		events, err := getICS(url)
+		if err != nil {
+			return errResponse(Err("ImportFailed", map[string]string{"URL": url, "Error": err.Error()}))
+		}
+		urlEvents[url] = events
+	}
+	return updateCalendarBoat(req, func(boat *Boat) error {
+		if req.URL != "" && !StringInArray(req.URL, boat.Calendar.ImportURLs) {
+			boat.Calendar.ImportURLs = append(boat.Calendar.ImportURLs, req.URL)
+		}
+		for _, url := range urls {
+			if StringInArray(url, boat.Calendar.ImportURLs) {
+				boat.Calendar.Blocks = mergeImport(boat.Calendar.Blocks, url, urlEvents[url])
+			}
+		}
+		return nil
+	})
+}
+
+// getCalendarBoat gets req.BoatID if the session's user or org owns it, or is staff
+func getCalendarBoat(req *Request) (*Boat, error) {
+	if req.BoatID == 0 {
+		return nil, errors.New("NeedBoatID")
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMine(req, boat) && !isStaff(req) {
+		return nil, errors.New("AccessDenied")
+	}
+	if boat.Calendar == nil {
+		boat.Calendar = &BoatCalendar{}
+	}
+	return boat, nil
+}
+
+// updateCalendarBoat changes the calendar of req.BoatID with change, and sets its NotAvailable, in a transaction so no
+// other change is lost; like getCalendarBoat, only its owner, its org's members with SetBoat OrgAccess, and staff can
+func updateCalendarBoat(req *Request, change func(boat *Boat) error) *Response {
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	boat := &Boat{}
+	key, err := updateX("Boat", req.BoatID, req.IfMatch, boat, nil, func() (interface{}, error) {
+		if !isMine(req, boat) && !isStaff(req) || lacksOrgAccess(req, "SetBoat", boat) {
+			return nil, errors.New("AccessDenied")
+		}
+		if boat.Calendar == nil {
+			boat.Calendar = &BoatCalendar{}
+		}
+		if err := change(boat); err != nil {
+			return nil, err
+		}
+		if err := setNotAvailable(boat, nil); err != nil {
+			return nil, err
+		}
+		return boat, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: boat.Audit.Version,
+	}
+}
+
+// getBookings gets the booked and owner-blocked rentals, cruises and rides of a boat from its deals
+func getBookings(boatID int64) ([]BoatBlock, error) {
+	var deals []*Deal
+	keys, err := getAllDeals(map[string]interface{}{"BoatID=": boatID}, &deals)
+	if err != nil {
+		return nil, err
+	}
+	bookings := []BoatBlock{}
+	for i, deal := range deals {
+		bookings = append(bookings, dealBookings(deal, keys[i].ID)...)
+	}
+	sortBlocks(bookings)
+	return bookings, nil
+}
+
+// dealBookings gets the booked and owner-blocked rentals, cruises and rides of deal dealID
+func dealBookings(deal *Deal, dealID int64) []BoatBlock {
+	bookings := []BoatBlock{}
+	for _, rental := range []*EventRental{deal.Rental, deal.Cruise, deal.Ride} {
+		if rental != nil && rental.Start != nil && rental.End != nil && (rental.Status == "Booked" || rental.Status == "Blocked") {
+			bookings = append(bookings, BoatBlock{Start: rental.Start, End: rental.End, Source: "Booking", Summary: rental.Status, DealID: dealID})
+		}
+	}
+	return bookings
+}
+
+// setNotAvailable sets NotAvailable of the boat's rental listings to the merged future blocks and bookings; changed,
+// if not nil, is a deal of the boat that's being put, so its bookings are as it's put rather than as it was
+func setNotAvailable(boat *Boat, changed *Deal) error {
+	bookings, err := getBookings(boat.ID)
+	if err != nil {
+		return err
+	}
+	if changed != nil {
+		others := []BoatBlock{}
+		for _, booking := range bookings {
+			if changed.ID == 0 || booking.DealID != changed.ID {
+				others = append(others, booking)
+			}
+		}
+		bookings = append(others, dealBookings(changed, changed.ID)...)
+	}
+	blocks := bookings
+	if boat.Calendar != nil {
+		blocks = append(blocks, boat.Calendar.Blocks...)
+	}
+	sortBlocks(blocks)
+	// make start, end, start, end, etc. in ascending order with overlapping ranges merged
+	notAvailable := []time.Time{}
+	for _, block := range blocks {
+		if block.Start == nil || block.End == nil || !block.End.After(*now()) {
+			continue
+		}
+		last := len(notAvailable) - 1
+		if last > 0 && !block.Start.After(notAvailable[last]) {
+			if block.End.After(notAvailable[last]) {
+				notAvailable[last] = *block.End
+			}
+			continue
+		}
+		notAvailable = append(notAvailable, *block.Start, *block.End)
+	}
+	if len(notAvailable) == 0 {
+		notAvailable = nil
+	}
+	for _, rental := range []*BoatRental{boat.Rental, boat.Cruise, boat.Ride} {
+		if rental != nil {
+			rental.NotAvailable = notAvailable
+		}
+	}
+	return nil
+}
+
+// bookingsChanged finds out if a deal or event books or blocks its boat other than it did before, so the boat's
+// NotAvailable has to change
+func bookingsChanged(deal, oldDeal interface{}) bool {
+	for _, listing := range []string{"Rental", "Cruise", "Ride"} {
+		rental, _ := getDeepField(listing, deal).(*EventRental)
+		oldRental, _ := getDeepField(listing, oldDeal).(*EventRental)
+		booked := rental != nil && (rental.Status == "Booked" || rental.Status == "Blocked")
+		oldBooked := oldRental != nil && (oldRental.Status == "Booked" || oldRental.Status == "Blocked")
+		if booked != oldBooked {
+			return true
+		}
+		if booked && (rental.Status != oldRental.Status || !sameTime(rental.Start, oldRental.Start) || !sameTime(rental.End, oldRental.End)) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateNotAvailable sets the NotAvailable of boatID in tx, the transaction of a deal or event that changes its bookings,
+// and returns the boat to publish once the transaction is done, or nil if there's no such boat
+func updateNotAvailable(tx datastorer, boatID int64, changed *Deal) (*Boat, error) {
+	if boatID == 0 {
+		return nil, nil
+	}
+	boat := &Boat{}
+	key := idKey("Boat", boatID)
+	if err := tx.Get(apiContext, key, boat); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	boat.ID = boatID
+	if err := setNotAvailable(boat, changed); err != nil {
+		return nil, err
+	}
+	if err := putXTx(tx, key, boat); err != nil {
+		return nil, err
+	}
+	return boat, nil
+}
+
+func sortBlocks(blocks []BoatBlock) {
+	sort.SliceStable(blocks, func(i, j int) bool {
+		if blocks[i].Start == nil || blocks[j].Start == nil {
+			return blocks[j].Start != nil
+		}
+		return blocks[i].Start.Before(*blocks[j].Start)
+	})
+}
+
+func blocksBetween(blocks []BoatBlock, start, end *time.Time) []BoatBlock {
+	between := []BoatBlock{}
+	for _, block := range blocks {
+		if start != nil && block.End != nil && !block.End.After(*start) || end != nil && block.Start != nil && !block.Start.Before(*end) {
+			continue
+		}
+		between = append(between, block)
+	}
+	return between
+}
+
+// mergeImport replaces the imported blocks from a feed with its current events; for uploads (feed ""), events replace blocks with the same UID
+func mergeImport(blocks []BoatBlock, feed string, events []BoatBlock) []BoatBlock {
+	uids := map[string]bool{}
+	for _, event := range events {
+		uids[event.UID] = true
+	}
+	merged := []BoatBlock{}
+	for _, block := range blocks {
+		if block.Source == "Import" && block.Feed == feed && (feed != "" || uids[block.UID]) {
+			continue
+		}
+		merged = append(merged, block)
+	}
+	for _, event := range events {
+		event.Feed = feed
+		merged = append(merged, event)
+	}
+	sortBlocks(merged)
+	return merged
+}
+
+// icsClient is used to get .ics feeds from other sites; since owners give the URLs, it only connects to public
+// addresses, even when redirected, so it can't reach the metadata server or anything else inside
+var icsClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return errors.New("NotPublicAddress")
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("TooManyRedirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("BadRedirect")
+		}
+		return nil
+	},
+}
+
+// carrierNAT is the shared address space of RFC 6598, which isn't reachable from the internet either
+var carrierNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP finds out if ip is on the internet, i.e., not loopback, link-local (like the metadata server), private,
+// or unspecified
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsPrivate() && !ip.IsUnspecified() && !carrierNAT.Contains(ip)
+}
+
+const maxICSBytes = 4 << 20
+
+func getICS(url string) ([]BoatBlock, error) {
+	resp, err := icsClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return parseICS(io.LimitReader(resp.Body, maxICSBytes))
+}
+
+// parseICS reads the VEVENTs of an iCalendar (RFC 5545) as imported blocks, skipping cancelled and transparent (free) events
+func parseICS(r io.Reader) ([]BoatBlock, error) {
+	// unfold lines, which continue on the next line if it starts with a space or tab
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxICSBytes)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || lines[0] != "BEGIN:VCALENDAR" {
+		return nil, errors.New("BadICS")
+	}
+	blocks := []BoatBlock{}
+	var block *BoatBlock
+	var dateOnly, skip bool
+	var duration time.Duration
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		nameAndParams := strings.Split(line[:colon], ";")
+		name := strings.ToUpper(nameAndParams[0])
+		value := line[colon+1:]
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			block = &BoatBlock{Source: "Import"}
+			dateOnly, skip, duration = false, false, 0
+		case block == nil:
+		case name == "END" && value == "VEVENT":
+			if block.Start != nil && !skip {
+				if block.End == nil {
+					end := block.Start.Add(duration)
+					if duration == 0 && dateOnly {
+						end = block.Start.AddDate(0, 0, 1)
+					}
+					block.End = &end
+				}
+				if block.End.After(*block.Start) {
+					if block.UID == "" {
+						block.UID = block.Start.Format(icsTimeLayout)
+					}
+					blocks = append(blocks, *block)
+				}
+			}
+			block = nil
+		case name == "DTSTART" || name == "DTEND":
+			tm, isDate, err := parseICSTime(value, nameAndParams[1:])
+			if err != nil {
+				return nil, Err("BadICS", map[string]string{"Line": line})
+			}
+			if name == "DTSTART" {
+				block.Start = tm
+				dateOnly = isDate
+			} else {
+				block.End = tm
+			}
+		case name == "DURATION":
+			d, err := parseICSDuration(value)
+			if err != nil {
+				return nil, Err("BadICS", map[string]string{"Line": line})
+			}
+			duration = d
+		case name == "UID":
+			block.UID = value
+		case name == "SUMMARY":
+			block.Summary = unescapeICS(value)
+		case name == "STATUS":
+			skip = skip || strings.ToUpper(value) == "CANCELLED"
+		case name == "TRANSP":
+			skip = skip || strings.ToUpper(value) == "TRANSPARENT"
+		}
+	}
+	return blocks, nil
+}
+
+const icsTimeLayout = "20060102T150405Z"
+
+func parseICSTime(value string, params []string) (*time.Time, bool, error) {
+	location := time.UTC
+	for _, param := range params {
+		if strings.HasPrefix(param, "TZID=") {
+			if loc, err := time.LoadLocation(strings.Trim(param[len("TZID="):], `"`)); err == nil {
+				location = loc
+			}
+		}
+	}
+	var tm time.Time
+	var err error
+	isDate := len(value) == len("20060102")
+	if isDate {
+		tm, err = time.ParseInLocation("20060102", value, location)
+	} else if strings.HasSuffix(value, "Z") {
+		tm, err = time.Parse(icsTimeLayout, value)
+	} else {
+		tm, err = time.ParseInLocation("20060102T150405", value, location)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	tm = tm.UTC()
+	return &tm, isDate, nil
+}
+
+var icsDurationPattern = regexp.MustCompile(`^\+?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+func parseICSDuration(value string) (time.Duration, error) {
+	parts := icsDurationPattern.FindStringSubmatch(value)
+	if parts == nil {
+		return 0, errors.New("BadDuration")
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if n, err := strconv.Atoi(parts[i+1]); err == nil {
+			duration += time.Duration(n) * unit
+		}
+	}
+	return duration, nil
+}
+
+var icsUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+var icsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+
+func unescapeICS(s string) string {
+	return icsUnescaper.Replace(s)
+}
+
+// icsToken is the secret in a boat's .ics feed URL, since calendar apps can't sign in; it's "" without a JWT_KEY to
+// keep it secret, so there's no feed
+func icsToken(boatID int64) string {
+	if Config.Env.JWTKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(Config.Env.JWTKey))
+	mac.Write([]byte("ICS:" + strconv.FormatInt(boatID, 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+var icsPathPattern = regexp.MustCompile(`^(\d+)-([0-9a-f]{16})\.ics$`)
+
+// serveICS writes a boat's blocks and bookings as an iCalendar feed, for path like "123-0123456789abcdef.ics"
+func serveICS(w http.ResponseWriter, path string) {
+	parts := icsPathPattern.FindStringSubmatch(path)
+	if parts == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	boatID, _ := strconv.ParseInt(parts[1], 10, 64)
+	if token := icsToken(boatID); token == "" || !hmac.Equal([]byte(parts[2]), []byte(token)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	boat, err := getBoat(boatID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	bookings, err := getBookings(boatID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	blocks := bookings
+	if boat.Calendar != nil {
+		blocks = append(blocks, boat.Calendar.Blocks...)
+	}
+	sortBlocks(blocks)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(makeICS(boatID, blocks)))
+}
+
+func makeICS(boatID int64, blocks []BoatBlock) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Boat Fuji//Calendar//EN",
+		"CALSCALE:GREGORIAN",
+	}
+	stamp := now().UTC().Format(icsTimeLayout)
+	for _, block := range blocks {
+		if block.Start == nil || block.End == nil {
+			continue
+		}
+		// other sites only need to know it's not available, so don't reveal summaries or renters
+		uid := fmt.Sprintf("%d-%s@boatfuji.com", boatID, block.Start.UTC().Format(icsTimeLayout))
+		summary := "Not available"
+		if block.Source == "Booking" {
+			uid = fmt.Sprintf("deal-%d-%s@boatfuji.com", block.DealID, block.Start.UTC().Format(icsTimeLayout))
+			summary = "Booked"
+		}
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+icsEscaper.Replace(uid),
+			"DTSTAMP:"+stamp,
+			"DTSTART:"+block.Start.UTC().Format(icsTimeLayout),
+			"DTEND:"+block.End.UTC().Format(icsTimeLayout),
+			"SUMMARY:"+summary,
+			"TRANSP:OPAQUE",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR", "")
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestParseICS(t *testing.T) {
+	file, err := os.Open("api/testdata/calendar.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	blocks, err := parseICS(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualJSON, _ := json.Marshal(blocks)
+	expectJSON := `[{"Start":"2020-05-10T14:00:00Z","End":"2020-05-10T18:00:00Z","Source":"Import","UID":"a1@example.com","Summary":"Charter, half day"},{"Start":"2020-05-20T00:00:00Z","End":"2020-05-22T00:00:00Z","Source":"Import","UID":"a2@example.com","Summary":"Maintenance"},{"Start":"2020-06-01T13:00:00Z","End":"2020-06-01T17:00:00Z","Source":"Import","UID":"a3@example.com","Summary":"Fishing trip"}]`
+	if string(actualJSON) != expectJSON {
+		t.Errorf("Wrong parseICS result\nActual %s\nExpect %s\n", actualJSON, expectJSON)
+	}
+	if _, err := parseICS(strings.NewReader("<html></html>")); err == nil || err.Error() != "BadICS" {
+		t.Errorf("parseICS should fail on non-iCalendar, got %v", err)
+	}
+}
+
+var calendarDealsCall = mockDataStoreCall{
+	name: "GetAll",
+	q:    newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+	dst: []*Deal{
+		{BoatID: 7, Rental: &EventRental{Start: DateTime(2020, 5, 10, 16, 0, 0), End: DateTime(2020, 5, 10, 20, 0, 0), Status: "Booked"}},
+		{BoatID: 7, Rental: &EventRental{Start: DateTime(2020, 5, 20, 16, 0, 0), End: DateTime(2020, 5, 20, 20, 0, 0), Status: "Canceled"}},
+	},
+	keysResult: []*datastore.Key{idKey("Deal", 41), idKey("Deal", 42)},
+}
+
+func TestGetCalendar(t *testing.T) {
+	session := &Session{UserID: 123}
+	testAPI(t, session, nil, "GetCalendar", `{}`, `{"ErrorCode":"NeedBoatID"}`, nil)
+	testAPI(t, &Session{UserID: 456}, nil, "GetCalendar", `{"BoatID":7}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+	})
+	// URLs have slashes, so check the response here rather than in testAPI
+	mockDataStoreClient = &mockDataStore{
+		t: t,
+		calls: []mockDataStoreCall{
+			{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+			calendarDealsCall,
+		},
+	}
+	resp := GetCalendar(&Request{Session: session, BoatID: 7, StartDate: DateTime(2020, 5, 5, 0, 0, 0)}, nil)
+	mockDataStoreClient.(*mockDataStore).Done()
+	actualJSON, _ := json.Marshal(resp)
+	expectJSON := `{"Calendar":{"Blocks":[{"Start":"2020-05-11T00:00:00Z","End":"2020-05-12T00:00:00Z","Source":"Owner","Summary":"Haul out"},{"Start":"2020-05-09T00:00:00Z","End":"2020-05-10T00:00:00Z","Source":"Import","Feed":"https://old.example.com/cal.ics","UID":"x@old"}],"ImportURLs":["https://old.example.com/cal.ics"],"Bookings":[{"Start":"2020-05-10T16:00:00Z","End":"2020-05-10T20:00:00Z","Source":"Booking","Summary":"Booked","DealID":41}],"ExportURL":"/api/ICS/7-` + icsToken(7) + `.ics"}}`
+	if string(actualJSON) != expectJSON {
+		t.Errorf("Wrong GetCalendar response\nActual %s\nExpect %s\n", actualJSON, expectJSON)
+	}
+}
+
+func TestSetCalendar(t *testing.T) {
+	session := &Session{UserID: 123}
+	testAPI(t, session, nil, "SetCalendar", `{"BoatID":7}`, `{"ErrorCode":"NeedCalendar"}`, nil)
+	testAPI(t, session, nil, "SetCalendar", `{"BoatID":7,"Calendar":{"Blocks":[{"Start":"2020-06-02T00:00:00Z","End":"2020-06-01T00:00:00Z"}]}}`, `{"ErrorCode":"BadBlock"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+	})
+	testAPI(t, session, nil, "SetCalendar", `{"BoatID":7,"Calendar":{"ImportURLs":["file:///etc/passwd"]}}`, `{"ErrorCode":"BadImportURL","ErrorDetails":/.*/}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+	})
+	// removing the old ImportURL removes its blocks, and owner blocks are replaced
+	testAPI(t, session, nil, "SetCalendar", `{"BoatID":7,"Calendar":{"Blocks":[{"Start":"2020-05-10T18:00:00Z","End":"2020-05-11T00:00:00Z","Source":"Import","Summary":"Family"}]}}`, `{"ID":7,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+		calendarDealsCall,
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Rental":{"ListingStatus":"Published","NotAvailable":["2020-05-10T16:00:00Z","2020-05-11T00:00:00Z"]},"Calendar":{"Blocks":[{"Start":"2020-05-10T18:00:00Z","End":"2020-05-11T00:00:00Z","Source":"Owner","Summary":"Family"}]},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+	})
+}
+
+func TestImportCalendar(t *testing.T) {
+	session := &Session{UserID: 123}
+	icsBytes, err := ioutil.ReadFile("api/testdata/calendar.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uploaded file
+	reqJSON, _ := json.Marshal(map[string]interface{}{"BoatID": 7, "Text": string(icsBytes)})
+	testAPI(t, session, nil, "ImportCalendar", string(reqJSON), `{"ID":7,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+		calendarDealsCall,
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Rental":{"ListingStatus":"Published","NotAvailable":["2020-05-09T00:00:00Z","2020-05-10T00:00:00Z","2020-05-10T14:00:00Z","2020-05-10T20:00:00Z","2020-05-11T00:00:00Z","2020-05-12T00:00:00Z","2020-05-20T00:00:00Z","2020-05-22T00:00:00Z","2020-06-01T13:00:00Z","2020-06-01T17:00:00Z"]},"Calendar":{"Blocks":[{"Start":"2020-05-01T00:00:00Z","End":"2020-05-02T00:00:00Z","Source":"Owner","Summary":"Past"},{"Start":"2020-05-09T00:00:00Z","End":"2020-05-10T00:00:00Z","Source":"Import","Feed":"https://old.example.com/cal.ics","UID":"x@old"},{"Start":"2020-05-10T14:00:00Z","End":"2020-05-10T18:00:00Z","Source":"Import","UID":"a1@example.com","Summary":"Charter, half day"},{"Start":"2020-05-11T00:00:00Z","End":"2020-05-12T00:00:00Z","Source":"Owner","Summary":"Haul out"},{"Start":"2020-05-20T00:00:00Z","End":"2020-05-22T00:00:00Z","Source":"Import","UID":"a2@example.com","Summary":"Maintenance"},{"Start":"2020-06-01T13:00:00Z","End":"2020-06-01T17:00:00Z","Source":"Import","UID":"a3@example.com","Summary":"Fishing trip"}],"ImportURLs":["https://old.example.com/cal.ics"]},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+	})
+	// feed URL replaces what was imported from that URL before, and is added to ImportURLs
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cal.ics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/calendar")
+		w.Write([]byte(strings.Replace(string(icsBytes), "UID:a2@example.com", "UID:x@old", 1)))
+	}))
+	defer server.Close()
+	// feeds on loopback, private, or link-local addresses, like the metadata server, are refused
+	testAPI(t, session, nil, "ImportCalendar", `{"BoatID":7,"URL":"`+server.URL+`/cal.ics"}`, `{"ErrorCode":"ImportFailed","ErrorDetails":/.*NotPublicAddress.*/}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+	})
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "192.168.0.1", "100.64.0.1", "::1", "fd00::1", "0.0.0.0"} {
+		if isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("isPublicIP(%s) should be false", ip)
+		}
+	}
+	if !isPublicIP(net.ParseIP("8.8.8.8")) {
+		t.Errorf("isPublicIP(8.8.8.8) should be true")
+	}
+	defer func(client *http.Client) { icsClient = client }(icsClient)
+	icsClient = server.Client()
+	testAPI(t, session, nil, "ImportCalendar", `{"BoatID":7,"URL":"`+server.URL+`/missing.ics"}`, `{"ErrorCode":"ImportFailed","ErrorDetails":/.*404 Not Found.*/}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+	})
+	testAPI(t, session, nil, "ImportCalendar", `{"BoatID":7,"URL":"`+server.URL+`/cal.ics"}`, `{"ID":7,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Calendar: &BoatCalendar{Blocks: newCalendarBoat().Calendar.Blocks[2:]}}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Calendar: &BoatCalendar{Blocks: newCalendarBoat().Calendar.Blocks[2:]}}},
+		{name: "GetAll", q: newQuery("Deal", map[string]interface{}{"BoatID=": 7}), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Calendar":{"Blocks":[{"Start":"2020-05-09T00:00:00Z","End":"2020-05-10T00:00:00Z","Source":"Import","Feed":"https://old.example.com/cal.ics","UID":"x@old"},{"Start":"2020-05-10T14:00:00Z","End":"2020-05-10T18:00:00Z","Source":"Import","Feed":"` + server.URL + `/cal.ics","UID":"a1@example.com","Summary":"Charter, half day"},{"Start":"2020-05-20T00:00:00Z","End":"2020-05-22T00:00:00Z","Source":"Import","Feed":"` + server.URL + `/cal.ics","UID":"x@old","Summary":"Maintenance"},{"Start":"2020-06-01T13:00:00Z","End":"2020-06-01T17:00:00Z","Source":"Import","Feed":"` + server.URL + `/cal.ics","UID":"a3@example.com","Summary":"Fishing trip"}],"ImportURLs":["` + server.URL + `/cal.ics"]},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+	})
+	testAPI(t, session, nil, "ImportCalendar", `{"BoatID":7}`, `{"ErrorCode":"NeedURLOrText"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+	})
+}
+
+func TestBookingSetsNotAvailable(t *testing.T) {
+	session := &Session{UserID: 123, Verified: true}
+	// blocking a deal's rental makes the boat not available then, in the deal's transaction
+	testAPI(t, session, nil, "SetDeal", `{"Deal":{"ID":42,"BoatID":7,"UserID":456,"Rental":{"Start":"2020-05-20T16:00:00Z","End":"2020-05-20T20:00:00Z","Status":"Blocked"}}}`, `{"ID":42,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 42), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Start: DateTime(2020, 5, 20, 16, 0, 0), End: DateTime(2020, 5, 20, 20, 0, 0), Status: "Canceled"}}},
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+		calendarDealsCall,
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Rental":{"ListingStatus":"Published","NotAvailable":["2020-05-09T00:00:00Z","2020-05-10T00:00:00Z","2020-05-10T16:00:00Z","2020-05-10T20:00:00Z","2020-05-11T00:00:00Z","2020-05-12T00:00:00Z","2020-05-20T16:00:00Z","2020-05-20T20:00:00Z"]},"Calendar":{"Blocks":[{"Start":"2020-05-01T00:00:00Z","End":"2020-05-02T00:00:00Z","Source":"Owner","Summary":"Past"},{"Start":"2020-05-11T00:00:00Z","End":"2020-05-12T00:00:00Z","Source":"Owner","Summary":"Haul out"},{"Start":"2020-05-09T00:00:00Z","End":"2020-05-10T00:00:00Z","Source":"Import","Feed":"https://old.example.com/cal.ics","UID":"x@old"}],"ImportURLs":["https://old.example.com/cal.ics"]},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 42),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":42,"BoatID":7,"UserID":456,"Rental":{"Start":"2020-05-20T16:00:00Z","End":"2020-05-20T20:00:00Z","Status":"Blocked"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 42),
+		},
+	})
+	// changing anything else doesn't touch the boat
+	testAPI(t, session, nil, "SetDeal", `{"Deal":{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Start":"2020-05-10T16:00:00Z","End":"2020-05-10T20:00:00Z","Status":"Blocked","Price":600}}}`, `{"ID":41,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Start: DateTime(2020, 5, 10, 16, 0, 0), End: DateTime(2020, 5, 10, 20, 0, 0), Status: "Blocked"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Start":"2020-05-10T16:00:00Z","End":"2020-05-10T20:00:00Z","Price":600,"Status":"Blocked"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+	})
+	// an event changing its booking refreshes the boat from its deals too
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"ID":51,"DealID":41,"BoatID":7,"Rental":{"Start":"2020-05-10T16:00:00Z","End":"2020-05-10T20:00:00Z","Status":"Canceled"}}}`, `{"ID":51,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: Event{DealID: 41, BoatID: 7, UserID: 123, Rental: &EventRental{Start: DateTime(2020, 5, 10, 16, 0, 0), End: DateTime(2020, 5, 10, 20, 0, 0), Status: "Booked"}}},
+		{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+		calendarDealsCall,
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Rental":{"ListingStatus":"Published","NotAvailable":["2020-05-09T00:00:00Z","2020-05-10T00:00:00Z","2020-05-10T16:00:00Z","2020-05-10T20:00:00Z","2020-05-11T00:00:00Z","2020-05-12T00:00:00Z"]},"Calendar":{"Blocks":[{"Start":"2020-05-01T00:00:00Z","End":"2020-05-02T00:00:00Z","Source":"Owner","Summary":"Past"},{"Start":"2020-05-11T00:00:00Z","End":"2020-05-12T00:00:00Z","Source":"Owner","Summary":"Haul out"},{"Start":"2020-05-09T00:00:00Z","End":"2020-05-10T00:00:00Z","Source":"Import","Feed":"https://old.example.com/cal.ics","UID":"x@old"}],"ImportURLs":["https://old.example.com/cal.ics"]},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			src:       []*Event{},
+			srcJSON:   `{"ID":51,"DealID":41,"BoatID":7,"UserID":123,"Rental":{"Start":"2020-05-10T16:00:00Z","End":"2020-05-10T20:00:00Z","Status":"Canceled"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
+
+func TestServeICS(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	mockDataStoreClient = &mockDataStore{
+		t: t,
+		calls: []mockDataStoreCall{
+			{name: "Get", key: idKey("Boat", 7), dst: newCalendarBoat()},
+			calendarDealsCall,
+		},
+	}
+	w := httptest.NewRecorder()
+	serveICS(w, "7-"+icsToken(7)+".ics")
+	mockDataStoreClient.(*mockDataStore).Done()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Errorf("Wrong serveICS status %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "Haul out") || !strings.Contains(body, "UID:deal-41-20200510T160000Z@boatfuji.com\r\n") || !strings.Contains(body, "DTSTART:20200511T000000Z\r\nDTEND:20200512T000000Z\r\nSUMMARY:Not available\r\n") {
+		t.Errorf("Wrong serveICS body\n%s", body)
+	}
+	// exported feed can be imported again
+	blocks, err := parseICS(strings.NewReader(body))
+	if err != nil || len(blocks) != 4 {
+		t.Errorf("serveICS body should parse as 4 events, got %d %v", len(blocks), err)
+	}
+	mockDataStoreClient = &mockDataStore{t: t}
+	w = httptest.NewRecorder()
+	serveICS(w, "7-0123456789abcdef.ics")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("serveICS should not serve a wrong token, got %d", w.Code)
+	}
+}
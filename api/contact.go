@@ -307,6 +307,9 @@ func verifyCode(maxCode int, emailOrPhone string) (string, error) {
 
 var nonPrintablePattern = regexp.MustCompile(`[\x00-\x1F\x80-\xFF]`)
 
+// sendEmail is SendEmail, unless a test replaces it
+var sendEmail = SendEmail
+
 // SendEmail sends an email message with a given subject, from, to, and html body
 func SendEmail(subject, from string, to []string, htmlBody string) error {
 	host := Config.Env.EmailHost
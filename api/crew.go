@@ -0,0 +1,496 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+// UserCrew is how a captain or other crewmember offers their services to boat owners and renters
+type UserCrew struct {
+	Roles        []string            `json:",omitempty" datastore:",omitempty,noindex" enum:"Captain, Mate"`
+	Published    bool                `json:",omitempty" datastore:",omitempty"`
+	Location     *appengine.GeoPoint `json:",omitempty" datastore:",omitempty,noindex"` // center of service area
+	KMRadius     int                 `json:",omitempty" datastore:",omitempty,noindex"`
+	Loc100KM     []int               `json:",omitempty" datastore:",omitempty"` // geoSquares within KMRadius of Location
+	Currency     string              `json:",omitempty" datastore:",omitempty,noindex"`
+	HourlyRate   float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	HalfDayRate  float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	DayRate      float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	TimeZone     string              `json:",omitempty" datastore:",omitempty,noindex"` // for Weekly, i.e., "America/New_York"
+	Weekly       []UserCrewHours     `json:",omitempty" datastore:",omitempty,noindex"`
+	NotAvailable []time.Time         `json:",omitempty" datastore:",omitempty,noindex"` // start, end, start, end, etc. in ascending order
+	Quote        float32             `json:",omitempty" datastore:"-"`                  // fee for a particular rental, only set by GetCaptains
+}
+
+// UserCrewHours is when a crewmember is usually available each week; if there are none, they're always available
+type UserCrewHours struct {
+	Weekdays  []string `json:",omitempty" datastore:",omitempty,noindex" enum:"Sunday, Monday, Tuesday, Wednesday, Thursday, Friday, Saturday"`
+	StartHour int      `json:",omitempty" datastore:",omitempty,noindex"`
+	EndHour   int      `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+const maxCrewKMRadius = 150
+
+func init() {
+	addEnumsFor(UserCrew{})
+	addEnumsFor(UserCrewHours{})
+	addEnumsFor(EventCrew{})
+	apiHandlers["SetCrew"] = SetCrew
+	apiHandlers["GetCaptains"] = GetCaptains
+	apiHandlers["RequestCrew"] = RequestCrew
+	apiHandlers["AcceptCrew"] = AcceptCrew
+	apiHandlers["DeclineCrew"] = DeclineCrew
+}
+
+// SetCrew sets the signed-in user's crew profile, which is published to boat owners and renters if Published
+func SetCrew(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	crew := req.Crew
+	if crew == nil {
+		return &Response{ErrorCode: "NeedCrew"}
+	}
+	if err := validate(crew); err != nil {
+		return errResponse(err)
+	}
+	for _, hours := range crew.Weekly {
+		if err := validate(hours); err != nil {
+			return errResponse(err)
+		}
+		if hours.StartHour < 0 || hours.EndHour > 24 || hours.StartHour >= hours.EndHour {
+			return &Response{ErrorCode: "BadHours"}
+		}
+	}
+	if crew.TimeZone != "" {
+		if _, err := time.LoadLocation(crew.TimeZone); err != nil {
+			return &Response{ErrorCode: "BadTimeZone"}
+		}
+	}
+	if len(crew.NotAvailable)%2 != 0 {
+		return &Response{ErrorCode: "BadNotAvailable"}
+	}
+	for i := 1; i < len(crew.NotAvailable); i++ {
+		if !crew.NotAvailable[i].After(crew.NotAvailable[i-1]) {
+			return &Response{ErrorCode: "BadNotAvailable"}
+		}
+	}
+	if crew.Currency == "" {
+		crew.Currency = "USD"
+	}
+	if _, err := exchangeRate(crew.Currency, "USD"); err != nil {
+		return errResponse(err)
+	}
+	if crew.KMRadius <= 0 {
+		crew.KMRadius = 50
+	}
+	if crew.KMRadius > maxCrewKMRadius {
+		crew.KMRadius = maxCrewKMRadius
+	}
+	crew.Loc100KM = nil
+	crew.Quote = 0
+	if crew.Published {
+		missing := ""
+		if len(crew.Roles) == 0 {
+			missing = "Roles"
+		} else if crew.Location == nil {
+			missing = "Location"
+		} else if crew.HourlyRate <= 0 && crew.HalfDayRate <= 0 && crew.DayRate <= 0 {
+			missing = "HourlyRate"
+		}
+		if missing != "" {
+			return errResponse(Err("IncompleteCrew", map[string]string{"Field": missing}))
+		}
+	}
+	if crew.Location != nil {
+		loc, err := geoSquare(crew.Location.Lat, crew.Location.Lng, 100, float64(crew.KMRadius))
+		if err != nil {
+			return errResponse(err)
+		}
+		crew.Loc100KM = loc
+	}
+	user := &User{}
+	key, err := updateX("User", req.Session.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		user.Crew = crew
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: user.Audit.Version,
+	}
+}
+
+// GetCaptains gets published captains near the boat of a "Captain Extra" rental deal who are available then, with their Quote in the rental's currency
+func GetCaptains(req *Request, pub *Publication) *Response {
+	deal, boat, err := getCrewDeal(req, req.DealID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if boat.Location == nil || boat.Location.Location == nil {
+		return &Response{ErrorCode: "NeedBoatLocation"}
+	}
+	loc, err := geoSquare(boat.Location.Location.Lat, boat.Location.Location.Lng, 100, 0)
+	if err != nil {
+		return errResponse(err)
+	}
+	var users []*User
+	// only Loc100KM is filtered on so no composite index is needed; captainQuote skips unpublished crew
+	keys, err := getAllUsers(map[string]interface{}{"Crew.Loc100KM=": loc[0]}, &users)
+	if err != nil {
+		return errResponse(err)
+	}
+	resp := &Response{Users: map[int64]*User{}}
+	for index, key := range keys {
+		user := users[index]
+		user.ID = key.ID
+		quote, ok := captainQuote(user, deal, boat)
+		if !ok {
+			continue
+		}
+		resp.Users[key.ID] = &User{
+			GivenName:      user.GivenName,
+			Description:    user.Description,
+			Images:         user.Images,
+			Languages:      user.Languages,
+			ResponseCount:  user.ResponseCount,
+			ResponseSecSum: user.ResponseSecSum,
+			RequestCount:   user.RequestCount,
+			Crew: &UserCrew{
+				Roles:       user.Crew.Roles,
+				Currency:    user.Crew.Currency,
+				HourlyRate:  user.Crew.HourlyRate,
+				HalfDayRate: user.Crew.HalfDayRate,
+				DayRate:     user.Crew.DayRate,
+				Quote:       quote,
+			},
+		}
+	}
+	return resp
+}
+
+// RequestCrew asks captain UserID to crew the "Captain Extra" rental DealID, with Text as notes
+func RequestCrew(req *Request, pub *Publication) *Response {
+	deal, boat, err := getCrewDeal(req, req.DealID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if lacksOrgAccess(req, "SetDeal", deal) || lacksOrgAccess(req, "SetDeal", boat) {
+		return accessDenied()
+	}
+	captain, err := getUser(req.UserID)
+	if err != nil {
+		return errResponse(err)
+	}
+	quote, ok := captainQuote(captain, deal, boat)
+	if !ok {
+		return &Response{ErrorCode: "CaptainNotAvailable"}
+	}
+	event := &Event{
+		DealID:      deal.ID,
+		BoatID:      deal.BoatID,
+		UserID:      captain.ID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: []int64{captain.ID},
+		Crew: &EventCrew{
+			Role:     "Captain",
+			Status:   "Requested",
+			Start:    deal.Rental.Start,
+			End:      deal.Rental.End,
+			Currency: deal.Rental.Currency,
+			Fee:      quote,
+			Notes:    req.Text,
+		},
+		Audit: &Audit{Created: now()},
+	}
+	key, err := putEvent(event)
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// AcceptCrew is when the captain accepts crew request EventID, which sets the deal's captain and fee, cancels other requests,
+// and adds the captain's fee to the ledger as a Payment event for the captain
+func AcceptCrew(req *Request, pub *Publication) *Response {
+	event, deal, err := getCrewRequest(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	// the request, the deal, and the captain are changed together, so only one captain is taken, once
+	var captain *User
+	if _, err := updateXTx("Deal", deal.ID, 0, deal, nil, func(tx datastorer) (interface{}, error) {
+		if deal.Rental == nil || deal.Rental.Status == "Canceled" {
+			return nil, errors.New("CaptainNotNeeded")
+		}
+		if deal.Rental.CaptainUserID != 0 {
+			return nil, errors.New("CaptainTaken")
+		}
+		event = &Event{}
+		if err := tx.Get(apiContext, idKey("Event", req.EventID), event); err != nil {
+			return nil, err
+		}
+		event.ID = req.EventID
+		if event.Crew == nil || event.Crew.Status != "Requested" {
+			return nil, errors.New("CrewNotRequested")
+		}
+		boat := &Boat{}
+		if err := tx.Get(apiContext, idKey("Boat", deal.BoatID), boat); err != nil {
+			return nil, err
+		}
+		captain = &User{}
+		if err := tx.Get(apiContext, idKey("User", event.UserID), captain); err != nil {
+			return nil, err
+		}
+		captain.ID = event.UserID
+		if _, ok := captainQuote(captain, deal, boat); !ok {
+			return nil, errors.New("CaptainNotAvailable")
+		}
+		event.Crew.Status = "Accepted"
+		if err := putXTx(tx, idKey("Event", event.ID), event); err != nil {
+			return nil, err
+		}
+		// captain is no longer available then
+		captain.Crew.NotAvailable = addNotAvailable(captain.Crew.NotAvailable, *deal.Rental.Start, *deal.Rental.End)
+		if err := putXTx(tx, idKey("User", captain.ID), captain); err != nil {
+			return nil, err
+		}
+		// the deal is charged the captain's fee instead of the marketplace's estimate
+		deal.Crew = event.Crew
+		deal.Rental.CaptainUserID = captain.ID
+		deal.Rental.CaptainFee = event.Crew.Fee
+		setRentalTotal(deal.Rental)
+		return deal, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	publish(publicationOf(idKey("Event", event.ID), event))
+	publish(publicationOf(idKey("User", captain.ID), captain))
+	// cancel other requests for this deal
+	var others []*Event
+	keys, err := getAllEvents(map[string]interface{}{"DealID=": deal.ID}, &others)
+	if err != nil {
+		return errResponse(err)
+	}
+	for index, key := range keys {
+		other := others[index]
+		if key.ID != event.ID && other.Crew != nil && other.Crew.Status == "Requested" {
+			other.ID = key.ID
+			other.Crew.Status = "Canceled"
+			if _, err := putEvent(other); err != nil {
+				return errResponse(err)
+			}
+		}
+	}
+	// ledger entry so the captain's fee is paid to the captain, not the boat owner
+	payment := &EventPayment{Purpose: "CaptainFee", Currency: event.Crew.Currency, Amount: event.Crew.Fee}
+	if err := convertPayment(payment); err != nil {
+		return errResponse(err)
+	}
+	key, err := putEvent(&Event{
+		DealID:  deal.ID,
+		BoatID:  deal.BoatID,
+		UserID:  captain.ID,
+		Payment: payment,
+		Audit:   &Audit{Created: now()},
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// DeclineCrew is when the captain declines crew request EventID
+func DeclineCrew(req *Request, pub *Publication) *Response {
+	if _, _, err := getCrewRequest(req); err != nil {
+		return errResponse(err)
+	}
+	event := &Event{}
+	key, err := updateX("Event", req.EventID, 0, event, nil, func() (interface{}, error) {
+		// unless it was accepted in the meantime
+		if event.Crew == nil || event.Crew.Status != "Requested" {
+			return nil, errors.New("CrewNotRequested")
+		}
+		event.Crew.Status = "Declined"
+		return event, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// getCrewDeal gets a "Captain Extra" rental deal and its boat, if the session's user is the renter or the boat's owner, or is staff
+func getCrewDeal(req *Request, dealID int64) (*Deal, *Boat, error) {
+	if !isVerifiedUser(req) {
+		return nil, nil, errors.New("MustVerify")
+	}
+	if dealID == 0 {
+		return nil, nil, errors.New("NeedDealID")
+	}
+	deal, err := getDeal(dealID)
+	if err != nil {
+		return nil, nil, err
+	}
+	boat, err := getBoat(deal.BoatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isMine(req, deal) && !isMine(req, boat) && !isStaff(req) {
+		return nil, nil, errors.New("AccessDenied")
+	}
+	if deal.Rental == nil || deal.Rental.Captain != "CaptainExtra" || deal.Rental.Start == nil || deal.Rental.End == nil {
+		return nil, nil, errors.New("NeedCaptainExtraRental")
+	}
+	if deal.Rental.Status == "Canceled" || deal.Rental.CaptainUserID != 0 {
+		return nil, nil, errors.New("CaptainNotNeeded")
+	}
+	return deal, boat, nil
+}
+
+// getCrewRequest gets a requested crew event and its deal, if it's for the session's user
+func getCrewRequest(req *Request) (*Event, *Deal, error) {
+	if req.EventID == 0 {
+		return nil, nil, errors.New("NeedEventID")
+	}
+	event, err := getEvent(req.EventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if event.Crew == nil || event.UserID != req.Session.UserID {
+		return nil, nil, errors.New("AccessDenied")
+	}
+	if event.Crew.Status != "Requested" {
+		return nil, nil, errors.New("CrewNotRequested")
+	}
+	deal, err := getDeal(event.DealID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deal.Rental == nil || deal.Rental.Status == "Canceled" {
+		return nil, nil, errors.New("CaptainNotNeeded")
+	}
+	return event, deal, nil
+}
+
+// captainQuote is the captain's fee for the deal's rental in the rental's currency, and false if the captain can't do it
+func captainQuote(captain *User, deal *Deal, boat *Boat) (float32, bool) {
+	crew := captain.Crew
+	if crew == nil || !crew.Published || !StringInArray("Captain", crew.Roles) || captain.ID == deal.UserID || crew.Location == nil {
+		return 0, false
+	}
+	if boat.Location == nil || boat.Location.Location == nil || kmBetween(crew.Location, boat.Location.Location) > float64(crew.KMRadius) {
+		return 0, false
+	}
+	start, end := *deal.Rental.Start, *deal.Rental.End
+	if !isCrewAvailable(crew, start, end) {
+		return 0, false
+	}
+	// priced like boatRental: half day up to 5 hours, else by the day
+	hours := end.Sub(start).Hours()
+	fee := 0.0
+	if hours <= 5 && crew.HalfDayRate > 0 {
+		fee = float64(crew.HalfDayRate)
+	} else if hours > 5 && crew.DayRate > 0 {
+		fee = float64(crew.DayRate) * math.Ceil((hours+8)/24)
+	} else {
+		fee = float64(crew.HourlyRate) * math.Ceil(hours)
+	}
+	if fee <= 0 {
+		return 0, false
+	}
+	rate, err := exchangeRate(crew.Currency, deal.Rental.Currency)
+	if err != nil {
+		return 0, false
+	}
+	return roundCents(fee * rate), true
+}
+
+func isCrewAvailable(crew *UserCrew, start, end time.Time) bool {
+	for pos := 0; pos+1 < len(crew.NotAvailable); pos += 2 {
+		if start.Before(crew.NotAvailable[pos+1]) && end.After(crew.NotAvailable[pos]) {
+			return false
+		}
+	}
+	if len(crew.Weekly) == 0 {
+		return true
+	}
+	location := time.UTC
+	if crew.TimeZone != "" {
+		if loc, err := time.LoadLocation(crew.TimeZone); err == nil {
+			location = loc
+		}
+	}
+	start, end = start.In(location), end.In(location)
+	// each day of the rental must be a usual work day, and a single-day rental must be within usual hours
+	singleDay := start.YearDay() == end.YearDay() && start.Year() == end.Year()
+	firstDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, location)
+	lastDay := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, location)
+	if end.Equal(lastDay) && lastDay.After(firstDay) {
+		// ending at midnight doesn't take any of that day
+		lastDay = lastDay.AddDate(0, 0, -1)
+	}
+	for day := firstDay; !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		ok := false
+		for _, hours := range crew.Weekly {
+			if !StringInArray(day.Weekday().String(), hours.Weekdays) {
+				continue
+			}
+			endHour := float64(end.Hour()) + float64(end.Minute())/60
+			if !singleDay || start.Hour() >= hours.StartHour && endHour <= float64(hours.EndHour) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// addNotAvailable adds a start..end range to a NotAvailable list, keeping it in ascending order and merging overlaps
+func addNotAvailable(notAvailable []time.Time, start, end time.Time) []time.Time {
+	ranges := [][2]time.Time{}
+	for pos := 0; pos+1 < len(notAvailable); pos += 2 {
+		ranges = append(ranges, [2]time.Time{notAvailable[pos], notAvailable[pos+1]})
+	}
+	inserted := false
+	result := []time.Time{}
+	add := func(r [2]time.Time) {
+		last := len(result) - 1
+		if last > 0 && !r[0].After(result[last]) {
+			if r[1].After(result[last]) {
+				result[last] = r[1]
+			}
+			return
+		}
+		result = append(result, r[0], r[1])
+	}
+	for _, r := range ranges {
+		if !inserted && start.Before(r[0]) {
+			add([2]time.Time{start, end})
+			inserted = true
+		}
+		add(r)
+	}
+	if !inserted {
+		add([2]time.Time{start, end})
+	}
+	return result
+}
+
+// kmBetween is the great-circle distance between two points
+func kmBetween(a, b *appengine.GeoPoint) float64 {
+	const kmEarthRadius = 6371.0
+	toRadians := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * toRadians
+	dLng := (b.Lng - a.Lng) * toRadians
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(a.Lat*toRadians)*math.Cos(b.Lat*toRadians)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * kmEarthRadius * math.Asin(math.Sqrt(h))
+}
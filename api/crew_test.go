@@ -0,0 +1,185 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestSetCrew(t *testing.T) {
+	session := &Session{UserID: 9, Verified: true}
+	testAPI(t, &Session{UserID: 9}, nil, "SetCrew", `{}`, `{"ErrorCode":"MustVerify"}`, nil)
+	testAPI(t, session, nil, "SetCrew", `{}`, `{"ErrorCode":"NeedCrew"}`, nil)
+	testAPI(t, session, nil, "SetCrew", `{"Crew":{"Roles":["Skipper"]}}`, `{"ErrorCode":"BadEnum","ErrorDetails":{"Field":"Roles","Value":"Skipper"}}`, nil)
+	testAPI(t, session, nil, "SetCrew", `{"Crew":{"Weekly":[{"Weekdays":["Monday"],"StartHour":18,"EndHour":8}]}}`, `{"ErrorCode":"BadHours"}`, nil)
+	testAPI(t, session, nil, "SetCrew", `{"Crew":{"Published":true,"Roles":["Captain"],"Location":{"Lat":25.7467903,"Lng":-80.2113866}}}`, `{"ErrorCode":"IncompleteCrew","ErrorDetails":{"Field":"HourlyRate"}}`, nil)
+	testAPI(t, session, nil, "SetCrew", `{"Crew":{"Published":true,"Roles":["Captain"],"Location":{"Lat":25.7467903,"Lng":-80.2113866},"HalfDayRate":250,"Quote":1}}`, `{"ID":9,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 9), dst: User{GivenName: "Bligh"}},
+		{
+			name:      "Put",
+			key:       idKey("User", 9),
+			srcJSON:   `{"ID":9,"GivenName":"Bligh","Crew":{"Roles":["Captain"],"Published":true,"Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","HalfDayRate":250},"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 9),
+		},
+	})
+}
+
+func TestGetCaptains(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	loc, _ := geoSquare(25.7617, -80.1918, 100, 0)
+	testAPI(t, &Session{UserID: 789, Verified: true}, nil, "GetCaptains", `{"DealID":41}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: newCrewBoat()},
+	})
+	noCaptain := newCrewDeal()
+	noCaptain.Rental.Captain = "NoCaptain"
+	testAPI(t, session, nil, "GetCaptains", `{"DealID":41}`, `{"ErrorCode":"NeedCaptainExtraRental"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: noCaptain},
+		{name: "Get", key: idKey("Boat", 7), dst: newCrewBoat()},
+	})
+	// 9 is near and available, 10 is too far away, 11 is booked then, and 456 is the renter
+	testAPI(t, session, nil, "GetCaptains", `{"DealID":41}`, `{"Users":{"9":{"GivenName":"Bligh","Crew":{"Roles":["Captain"],"Currency":"USD","HalfDayRate":250,"DayRate":400,"Quote":250}}}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: newCrewBoat()},
+		{
+			name: "GetAll",
+			q:    newQuery("User", map[string]interface{}{"Crew.Loc100KM=": loc[0]}),
+			dst: []*User{
+				func() *User { u := newCaptain(25.7467903, -80.2113866); return &u }(),
+				func() *User { u := newCaptain(28.5383, -81.3792); return &u }(),
+				func() *User {
+					u := newCaptain(25.7467903, -80.2113866, *DateTime(2020, 5, 9, 0, 0, 0), *DateTime(2020, 5, 9, 14, 0, 0))
+					return &u
+				}(),
+				func() *User { u := newCaptain(25.7467903, -80.2113866); return &u }(),
+			},
+			keysResult: []*datastore.Key{idKey("User", 9), idKey("User", 10), idKey("User", 11), idKey("User", 456)},
+		},
+	})
+}
+
+func TestRequestCrew(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	testAPI(t, session, nil, "RequestCrew", `{"DealID":41,"UserID":10}`, `{"ErrorCode":"CaptainNotAvailable"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: newCrewBoat()},
+		{name: "Get", key: idKey("User", 10), dst: newCaptain(28.5383, -81.3792)},
+	})
+	testAPI(t, session, nil, "RequestCrew", `{"DealID":41,"UserID":9,"Text":"Sandbar trip"}`, `{"ID":51}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: newCrewBoat()},
+		{name: "Get", key: idKey("User", 9), dst: newCaptain(25.7467903, -80.2113866)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":9,"FromUserID":456,"UnreadByIDs":[9],"Crew":{"Role":"Captain","Status":"Requested","Start":"2020-05-09T13:00:00Z","End":"2020-05-09T17:00:00Z","Currency":"USD","Fee":250,"Notes":"Sandbar trip"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
+
+func TestAcceptCrew(t *testing.T) {
+	session := &Session{UserID: 9, Verified: true}
+	newRequest := func(userID int64, status string) Event {
+		return Event{DealID: 41, BoatID: 7, UserID: userID, Crew: &EventCrew{Role: "Captain", Status: status, Start: DateTime(2020, 5, 9, 13, 0, 0), End: DateTime(2020, 5, 9, 17, 0, 0), Currency: "USD", Fee: 250}}
+	}
+	testAPI(t, &Session{UserID: 10, Verified: true}, nil, "AcceptCrew", `{"EventID":51}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newRequest(9, "Requested")},
+	})
+	testAPI(t, session, nil, "AcceptCrew", `{"EventID":51}`, `{"ErrorCode":"CrewNotRequested"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newRequest(9, "Canceled")},
+	})
+	taken := newCrewDeal()
+	taken.Rental.CaptainUserID = 11
+	testAPI(t, session, nil, "AcceptCrew", `{"EventID":51}`, `{"ErrorCode":"CaptainTaken"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newRequest(9, "Requested")},
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Deal", 41), dst: taken},
+	})
+	testAPI(t, session, nil, "AcceptCrew", `{"EventID":51}`, `{"ID":53}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newRequest(9, "Requested")},
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Deal", 41), dst: newCrewDeal()},
+		{name: "Get", key: idKey("Event", 51), dst: newRequest(9, "Requested")},
+		{name: "Get", key: idKey("Boat", 7), dst: newCrewBoat()},
+		{name: "Get", key: idKey("User", 9), dst: newCaptain(25.7467903, -80.2113866)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"DealID":41,"BoatID":7,"UserID":9,"Crew":{"Role":"Captain","Status":"Accepted","Start":"2020-05-09T13:00:00Z","End":"2020-05-09T17:00:00Z","Currency":"USD","Fee":250},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:      "Put",
+			key:       idKey("User", 9),
+			srcJSON:   `{"ID":9,"GivenName":"Bligh","Crew":{"Roles":["Captain"],"Published":true,"Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Currency":"USD","HalfDayRate":250,"DayRate":400,"TimeZone":"America/New_York","Weekly":[{"Weekdays":["Saturday","Sunday"],"StartHour":8,"EndHour":18}],"NotAvailable":["2020-05-09T13:00:00Z","2020-05-09T17:00:00Z"]},"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 9),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Start":"2020-05-09T13:00:00Z","End":"2020-05-09T17:00:00Z","CancelPolicy":"Flexible","Currency":"USD","Captain":"CaptainExtra","Price":600,"CaptainFee":250,"CaptainUserID":9,"SalesTax":59.5,"Total":909.5,"Status":"Booked","CancelCutOffs":[{"CutOff":"2020-05-08T13:00:00Z","Refund":909.5}]},"Crew":{"Role":"Captain","Status":"Accepted","Start":"2020-05-09T13:00:00Z","End":"2020-05-09T17:00:00Z","Currency":"USD","Fee":250},"Audit":{"Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name: "GetAll",
+			q:    newQuery("Event", map[string]interface{}{"DealID=": 41}),
+			dst: []*Event{
+				func() *Event { e := newRequest(9, "Requested"); return &e }(),
+				func() *Event { e := newRequest(11, "Requested"); return &e }(),
+				func() *Event { e := newRequest(12, "Declined"); return &e }(),
+			},
+			keysResult: []*datastore.Key{idKey("Event", 51), idKey("Event", 52), idKey("Event", 50)},
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 52),
+			srcJSON:   `{"ID":52,"DealID":41,"BoatID":7,"UserID":11,"Crew":{"Role":"Captain","Status":"Canceled","Start":"2020-05-09T13:00:00Z","End":"2020-05-09T17:00:00Z","Currency":"USD","Fee":250},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":9,"Payment":{"Purpose":"CaptainFee","Currency":"USD","Amount":250,"OriginalCurrency":"USD","OriginalAmount":250,"ExchangeRate":1},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 53),
+		},
+	})
+}
+
+func TestIsCrewAvailable(t *testing.T) {
+	captain := newCaptain(25.7617, -80.1918)
+	newYork, _ := time.LoadLocation("America/New_York")
+	test := func(start, end time.Time, expect bool) {
+		if actual := isCrewAvailable(captain.Crew, start, end); actual != expect {
+			t.Errorf("Wrong isCrewAvailable result %v for %s to %s", actual, start, end)
+		}
+	}
+	test(time.Date(2020, 5, 9, 9, 0, 0, 0, newYork), time.Date(2020, 5, 9, 17, 0, 0, 0, newYork), true)
+	test(time.Date(2020, 5, 9, 7, 0, 0, 0, newYork), time.Date(2020, 5, 9, 17, 0, 0, 0, newYork), false)
+	test(time.Date(2020, 5, 9, 18, 0, 0, 0, newYork), time.Date(2020, 5, 10, 10, 0, 0, 0, newYork), true)
+	test(time.Date(2020, 5, 9, 18, 0, 0, 0, newYork), time.Date(2020, 5, 11, 0, 0, 0, 0, newYork), true)
+	// overnight into Monday, which isn't a work day
+	test(time.Date(2020, 5, 10, 20, 0, 0, 0, newYork), time.Date(2020, 5, 11, 10, 0, 0, 0, newYork), false)
+}
+
+func TestAddNotAvailable(t *testing.T) {
+	day := func(d int) time.Time { return *DateTime(2020, 5, d, 0, 0, 0) }
+	test := func(notAvailable []time.Time, start, end time.Time, expect []time.Time) {
+		actual := addNotAvailable(notAvailable, start, end)
+		if len(actual) != len(expect) {
+			t.Errorf("Wrong addNotAvailable result %v, expect %v", actual, expect)
+			return
+		}
+		for i := range actual {
+			if !actual[i].Equal(expect[i]) {
+				t.Errorf("Wrong addNotAvailable result %v, expect %v", actual, expect)
+				return
+			}
+		}
+	}
+	test(nil, day(1), day(2), []time.Time{day(1), day(2)})
+	test([]time.Time{day(5), day(6)}, day(1), day(2), []time.Time{day(1), day(2), day(5), day(6)})
+	test([]time.Time{day(1), day(3), day(7), day(8)}, day(2), day(5), []time.Time{day(1), day(5), day(7), day(8)})
+	test([]time.Time{day(1), day(3), day(4), day(8)}, day(2), day(5), []time.Time{day(1), day(8)})
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Currency has the exchange rate and marketplace fees of a currency
+type Currency struct {
+	Code    string     `json:",omitempty" datastore:",omitempty,noindex"` // only set where it's not a key of the table, i.e., in Org.Currencies
+	Rate    float64    `json:",omitempty" datastore:",omitempty,noindex"` // units of this currency per USD
+	Updated *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	Fees    *Fees      `json:",omitempty" datastore:",omitempty,noindex"` // if nil, USD fees are converted at Rate
+}
+
+// Fees are the marketplace's fixed fees in a currency; the BigBoat ones are added for boats 20 feet or longer
+type Fees struct {
+	CaptainHalfDay         float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	CaptainHalfDayBigBoat  float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	CaptainDay             float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	CaptainDayBigBoat      float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	SecurityDeposit        float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	SecurityDepositBigBoat float32 `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// defaultCurrencies are used until staff set currencies on the marketplace org
+var defaultCurrencies = map[string]*Currency{
+	"USD": {Rate: 1, Fees: &Fees{CaptainHalfDay: 200, CaptainHalfDayBigBoat: 150, CaptainDay: 300, CaptainDayBigBoat: 300, SecurityDeposit: 500, SecurityDepositBigBoat: 500}},
+	"CAD": {Rate: 1.36, Fees: &Fees{CaptainHalfDay: 275, CaptainHalfDayBigBoat: 200, CaptainDay: 400, CaptainDayBigBoat: 400, SecurityDeposit: 700, SecurityDepositBigBoat: 700}},
+	"EUR": {Rate: 0.92, Fees: &Fees{CaptainHalfDay: 180, CaptainHalfDayBigBoat: 140, CaptainDay: 275, CaptainDayBigBoat: 275, SecurityDeposit: 450, SecurityDepositBigBoat: 450}},
+}
+
+// currencies is this instance's copy of the Currencies of the marketplace org; it's replaced, not changed, whenever
+// they're loaded, so it can be read while holding currenciesMutex only long enough to get it
+var currencies = defaultCurrencies
+var currenciesMutex sync.Mutex
+
+// marketplaceOrgID is the ID of the marketplace org, whose Currencies are loaded into currencies
+var marketplaceOrgID int64
+
+func init() {
+	apiHandlers["SetCurrencies"] = SetCurrencies
+}
+
+func getCurrencies() map[string]*Currency {
+	currenciesMutex.Lock()
+	defer currenciesMutex.Unlock()
+	return currencies
+}
+
+// loadCurrencies loads the Currencies of the marketplace org, which each instance does when it starts and whenever
+// that org is published as changed, so staff changes reach them all
+func loadCurrencies() error {
+	var orgs []*Org
+	keys, err := getAllOrgs(map[string]interface{}{"Types=": "Marketplace"}, &orgs)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	currenciesMutex.Lock()
+	defer currenciesMutex.Unlock()
+	marketplaceOrgID = keys[0].ID
+	currencies = currencyTable(orgs[0].Currencies)
+	return nil
+}
+
+// reloadCurrencies loads currencies again if pub is of the marketplace org
+func reloadCurrencies(pub *Publication) {
+	currenciesMutex.Lock()
+	orgID := marketplaceOrgID
+	currenciesMutex.Unlock()
+	if pub.Kind != "Org" || orgID == 0 || pub.ID != orgID {
+		return
+	}
+	if err := loadCurrencies(); err != nil {
+		log.Printf("Error: loadCurrencies => %s", err.Error())
+	}
+}
+
+// currencyTable makes the table of currencies by code from an org's Currencies, or the defaults if it has none
+func currencyTable(list []Currency) map[string]*Currency {
+	if len(list) == 0 {
+		return defaultCurrencies
+	}
+	table := map[string]*Currency{}
+	for index := range list {
+		currency := list[index]
+		code := currency.Code
+		currency.Code = ""
+		table[code] = &currency
+	}
+	return table
+}
+
+// currencyList makes an org's Currencies from a table of currencies, sorted by code
+func currencyList(table map[string]*Currency) []Currency {
+	list := []Currency{}
+	for code, currency := range table {
+		entry := *currency
+		entry.Code = code
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// SetCurrencies sets exchange rates and fees from Currencies, or from an uploaded CSV file in Text with lines like
+// "CAD,1.36" or "CAD,1.36,275,200,400,400,700,700" (with Fees in the order of the Fees struct); currencies not mentioned are unchanged
+func SetCurrencies(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	changes := req.Currencies
+	if req.Text != "" {
+		var err error
+		if changes, err = parseCurrenciesCSV(req.Text); err != nil {
+			return errResponse(err)
+		}
+	}
+	if len(changes) == 0 {
+		return &Response{ErrorCode: "NeedCurrencies"}
+	}
+	// the marketplace org keeps them, so every instance loads them when it's published
+	currenciesMutex.Lock()
+	orgID := marketplaceOrgID
+	currenciesMutex.Unlock()
+	if orgID == 0 {
+		return &Response{ErrorCode: "NeedMarketplaceOrg"}
+	}
+	org := &Org{}
+	var newCurrencies map[string]*Currency
+	_, err := updateX("Org", orgID, 0, org, nil, func() (interface{}, error) {
+		newCurrencies = map[string]*Currency{}
+		for code, currency := range currencyTable(org.Currencies) {
+			newCurrencies[code] = currency
+		}
+		for code, currency := range changes {
+			if !currencyPattern.MatchString(code) {
+				return nil, Err("BadCurrency", map[string]string{"Currency": code})
+			}
+			if currency == nil {
+				delete(newCurrencies, code)
+				continue
+			}
+			if currency.Rate <= 0 || code == "USD" && currency.Rate != 1 {
+				return nil, Err("BadRate", map[string]string{"Currency": code})
+			}
+			changed := *currency
+			changed.Updated = now()
+			newCurrencies[code] = &changed
+		}
+		if usd := newCurrencies["USD"]; usd == nil || usd.Fees == nil {
+			return nil, errors.New("NeedUSDFees")
+		}
+		org.Currencies = currencyList(newCurrencies)
+		auditOf(org).Updated = now()
+		return org, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	// this instance has them now, and the others when they get the org's publication
+	currenciesMutex.Lock()
+	currencies = newCurrencies
+	currenciesMutex.Unlock()
+	return &Response{}
+}
+
+func parseCurrenciesCSV(text string) (map[string]*Currency, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1 // fees are optional
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, Err("BadCSV", map[string]string{"Error": err.Error()})
+	}
+	changes := map[string]*Currency{}
+	for line, record := range records {
+		code := strings.ToUpper(strings.TrimSpace(record[0]))
+		if line == 0 && code == "CODE" {
+			continue // header
+		}
+		numbers := []float64{}
+		for _, field := range record[1:] {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			number, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, Err("BadCSV", map[string]string{"Line": strconv.Itoa(line + 1)})
+			}
+			numbers = append(numbers, number)
+		}
+		if len(numbers) != 1 && len(numbers) != 7 {
+			return nil, Err("BadCSV", map[string]string{"Line": strconv.Itoa(line + 1)})
+		}
+		currency := &Currency{Rate: numbers[0]}
+		if len(numbers) == 7 {
+			currency.Fees = &Fees{
+				CaptainHalfDay:         float32(numbers[1]),
+				CaptainHalfDayBigBoat:  float32(numbers[2]),
+				CaptainDay:             float32(numbers[3]),
+				CaptainDayBigBoat:      float32(numbers[4]),
+				SecurityDeposit:        float32(numbers[5]),
+				SecurityDepositBigBoat: float32(numbers[6]),
+			}
+		} else if old := getCurrencies()[code]; old != nil {
+			currency.Fees = old.Fees // only the rate changed
+		}
+		changes[code] = currency
+	}
+	return changes, nil
+}
+
+// exchangeRate is how many units of currency to are worth one unit of currency from; "" is USD
+func exchangeRate(from, to string) (float64, error) {
+	if from == "" {
+		from = "USD"
+	}
+	if to == "" {
+		to = "USD"
+	}
+	table := getCurrencies()
+	fromCurrency, toCurrency := table[from], table[to]
+	if fromCurrency == nil {
+		return 0, Err("BadCurrency", map[string]string{"Currency": from})
+	}
+	if toCurrency == nil {
+		return 0, Err("BadCurrency", map[string]string{"Currency": to})
+	}
+	return toCurrency.Rate / fromCurrency.Rate, nil
+}
+
+func roundCents(amount float64) float32 {
+	return float32(math.Round(amount*100) / 100)
+}
+
+// currencyFees gets the fees of a currency, converting USD fees if it doesn't have its own
+func currencyFees(code string) Fees {
+	table := getCurrencies()
+	if currency := table[code]; currency != nil && currency.Fees != nil {
+		return *currency.Fees
+	}
+	usd := *table["USD"].Fees
+	rate, err := exchangeRate("USD", code)
+	if err != nil {
+		return usd
+	}
+	return Fees{
+		CaptainHalfDay:         roundCents(float64(usd.CaptainHalfDay) * rate),
+		CaptainHalfDayBigBoat:  roundCents(float64(usd.CaptainHalfDayBigBoat) * rate),
+		CaptainDay:             roundCents(float64(usd.CaptainDay) * rate),
+		CaptainDayBigBoat:      roundCents(float64(usd.CaptainDayBigBoat) * rate),
+		SecurityDeposit:        roundCents(float64(usd.SecurityDeposit) * rate),
+		SecurityDepositBigBoat: roundCents(float64(usd.SecurityDepositBigBoat) * rate),
+	}
+}
+
+// convertRental converts a rental quote's amounts to another currency, keeping the original currency and rate
+func convertRental(rental *EventRental, to string) error {
+	if rental == nil || to == "" || to == rental.Currency || to == "USD" && rental.Currency == "" {
+		return nil
+	}
+	rate, err := exchangeRate(rental.Currency, to)
+	if err != nil {
+		return err
+	}
+	convert := func(amount *float32) {
+		*amount = roundCents(float64(*amount) * rate)
+	}
+	for _, amount := range []*float32{&rental.Price, &rental.CaptainFee, &rental.InsureFee, &rental.TowFee, &rental.TransactionFee, &rental.RewardsDiscount, &rental.SalesTax, &rental.Total, &rental.SecurityDeposit} {
+		convert(amount)
+	}
+	for i := range rental.LineItems {
+		convert(&rental.LineItems[i].Amount)
+	}
+	for i := range rental.CancelCutOffs {
+		convert(&rental.CancelCutOffs[i].Refund)
+	}
+	rental.OriginalCurrency = rental.Currency
+	if rental.OriginalCurrency == "" {
+		rental.OriginalCurrency = "USD"
+	}
+	rental.ExchangeRate = rate
+	rental.Currency = to
+	return nil
+}
+
+// convertPayment sets a payment's Amount from its OriginalAmount, or the other way around if it's in the original currency
+func convertPayment(payment *EventPayment) error {
+	if payment.Currency == "" {
+		payment.Currency = "USD"
+	}
+	if payment.OriginalCurrency == "" || payment.OriginalCurrency == payment.Currency {
+		if _, err := exchangeRate(payment.Currency, payment.Currency); err != nil {
+			return err
+		}
+		if payment.OriginalCurrency == "" {
+			payment.OriginalAmount = payment.Amount
+		}
+		payment.OriginalCurrency = payment.Currency
+		payment.Amount = payment.OriginalAmount
+		payment.ExchangeRate = 1
+		return nil
+	}
+	rate, err := exchangeRate(payment.OriginalCurrency, payment.Currency)
+	if err != nil {
+		return err
+	}
+	payment.Amount = roundCents(float64(payment.OriginalAmount) * rate)
+	payment.ExchangeRate = rate
+	return nil
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestSetCurrencies(t *testing.T) {
+	defer func(orgID int64) { marketplaceOrgID, currencies = orgID, defaultCurrencies }(marketplaceOrgID)
+	marketplaceOrgID = 1
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	marketplace := Org{Types: []string{"Marketplace"}, Audit: &Audit{Version: 4}}
+	testAPI(t, &Session{UserID: 123}, nil, "SetCurrencies", `{"Text":"CAD,1.4"}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	testAPI(t, staff, nil, "SetCurrencies", `{}`, `{"ErrorCode":"NeedCurrencies"}`, nil)
+	testAPI(t, staff, nil, "SetCurrencies", `{"Currencies":{"USD":{"Rate":1.1}}}`, `{"ErrorCode":"BadRate","ErrorDetails":{"Currency":"USD"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 1), dst: marketplace},
+	})
+	testAPI(t, staff, nil, "SetCurrencies", `{"Text":"Code,Rate\nGBP,0.8,1"}`, `{"ErrorCode":"BadCSV","ErrorDetails":{"Line":"2"}}`, nil)
+	afterCSV := `{"ID":1,"Types":["Marketplace"],"Currencies":[{"Code":"CAD","Rate":1.4,"Updated":"2020-05-05T05:05:05Z","Fees":{"CaptainHalfDay":275,"CaptainHalfDayBigBoat":200,"CaptainDay":400,"CaptainDayBigBoat":400,"SecurityDeposit":700,"SecurityDepositBigBoat":700}},{"Code":"EUR","Rate":0.92,"Fees":{"CaptainHalfDay":180,"CaptainHalfDayBigBoat":140,"CaptainDay":275,"CaptainDayBigBoat":275,"SecurityDeposit":450,"SecurityDepositBigBoat":450}},{"Code":"GBP","Rate":0.8,"Updated":"2020-05-05T05:05:05Z","Fees":{"CaptainHalfDay":160,"CaptainHalfDayBigBoat":120,"CaptainDay":240,"CaptainDayBigBoat":240,"SecurityDeposit":400,"SecurityDepositBigBoat":400}},{"Code":"USD","Rate":1,"Fees":{"CaptainHalfDay":200,"CaptainHalfDayBigBoat":150,"CaptainDay":300,"CaptainDayBigBoat":300,"SecurityDeposit":500,"SecurityDepositBigBoat":500}}],"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":5}}`
+	afterJSON := `{"ID":1,"Types":["Marketplace"],"Currencies":[{"Code":"CAD","Rate":1.4,"Updated":"2020-05-05T05:05:05Z","Fees":{"CaptainHalfDay":275,"CaptainHalfDayBigBoat":200,"CaptainDay":400,"CaptainDayBigBoat":400,"SecurityDeposit":700,"SecurityDepositBigBoat":700}},{"Code":"EUR","Rate":0.92,"Fees":{"CaptainHalfDay":180,"CaptainHalfDayBigBoat":140,"CaptainDay":275,"CaptainDayBigBoat":275,"SecurityDeposit":450,"SecurityDepositBigBoat":450}},{"Code":"JPY","Rate":150,"Updated":"2020-05-05T05:05:05Z"},{"Code":"USD","Rate":1,"Fees":{"CaptainHalfDay":200,"CaptainHalfDayBigBoat":150,"CaptainDay":300,"CaptainDayBigBoat":300,"SecurityDeposit":500,"SecurityDepositBigBoat":500}}],"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":6}}`
+	// CSV file changes CAD rate only, and adds GBP with its own fees, which are kept on the marketplace org
+	testAPI(t, staff, nil, "SetCurrencies", `{"Text":"Code,Rate,CaptainHalfDay,CaptainHalfDayBigBoat,CaptainDay,CaptainDayBigBoat,SecurityDeposit,SecurityDepositBigBoat\nCAD,1.4\nGBP,0.8,160,120,240,240,400,400\n"}`, `{}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 1), dst: marketplace},
+		{
+			name:      "Put",
+			key:       idKey("Org", 1),
+			srcJSON:   afterCSV,
+			keyResult: idKey("Org", 1),
+		},
+		// which has every instance load them
+		{name: "GetAll", q: newQuery("Org", map[string]interface{}{"Types=": "Marketplace"}), dst: []*Org{orgOf(afterCSV)}, keysResult: []*datastore.Key{idKey("Org", 1)}},
+	})
+	table := getCurrencies()
+	if table["CAD"].Rate != 1.4 || table["CAD"].Fees.CaptainDay != 400 || table["GBP"].Fees.SecurityDeposit != 400 || table["EUR"].Rate != 0.92 {
+		tableJSON, _ := json.Marshal(table)
+		t.Errorf("Wrong currencies after SetCurrencies %s", tableJSON)
+	}
+	if resp := GetMarketplaces(&Request{Session: &Session{}}, nil); resp.Marketplaces[1].Currencies["GBP"] == nil {
+		t.Errorf("GetMarketplaces should have GBP after SetCurrencies")
+	}
+	// JSON removes GBP
+	saved := Org{Types: []string{"Marketplace"}, Currencies: currencyList(table), Audit: &Audit{Version: 5}}
+	testAPI(t, staff, nil, "SetCurrencies", `{"Currencies":{"GBP":null,"JPY":{"Rate":150}}}`, `{}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 1), dst: saved},
+		{
+			name:      "Put",
+			key:       idKey("Org", 1),
+			srcJSON:   afterJSON,
+			keyResult: idKey("Org", 1),
+		},
+		{name: "GetAll", q: newQuery("Org", map[string]interface{}{"Types=": "Marketplace"}), dst: []*Org{orgOf(afterJSON)}, keysResult: []*datastore.Key{idKey("Org", 1)}},
+	})
+	if getCurrencies()["GBP"] != nil || getCurrencies()["JPY"].Rate != 150 {
+		t.Errorf("SetCurrencies should remove GBP and add JPY")
+	}
+	// JPY has no fees of its own, so they're converted from USD
+	if fees := currencyFees("JPY"); fees.CaptainHalfDay != 30000 || fees.SecurityDepositBigBoat != 75000 {
+		t.Errorf("Wrong converted fees %+v", fees)
+	}
+	// other instances load them when the marketplace org is published
+	currencies = defaultCurrencies
+	mockDataStoreClient = &mockDataStore{t: t, calls: []mockDataStoreCall{
+		{name: "GetAll", q: newQuery("Org", map[string]interface{}{"Types=": "Marketplace"}), dst: []*Org{&saved}, keysResult: []*datastore.Key{idKey("Org", 1)}},
+	}}
+	reloadCurrencies(&Publication{Kind: "Org", ID: 2})
+	reloadCurrencies(&Publication{Kind: "Org", ID: 1})
+	mockDataStoreClient.(*mockDataStore).Done()
+	if getCurrencies()["GBP"] == nil {
+		t.Errorf("reloadCurrencies should load GBP")
+	}
+}
+
+// orgOf makes an org from its JSON
+func orgOf(orgJSON string) *Org {
+	org := &Org{}
+	json.Unmarshal([]byte(orgJSON), org)
+	return org
+}
+
+func TestConvertRental(t *testing.T) {
+	start := time.Date(2020, 5, 7, 13, 0, 0, 0, time.UTC)
+	rental := &EventRental{
+		Start:           &start,
+		Currency:        "USD",
+		Price:           600,
+		InsureFee:       120,
+		TowFee:          30,
+		TransactionFee:  60,
+		SalesTax:        56.7,
+		Total:           866.7,
+		SecurityDeposit: 500,
+		LineItems:       []EventRentalLineItem{{Type: "LastMinute", Percent: 10, Amount: -66.67}},
+		CancelCutOffs:   []EventRentalCancel{{CutOff: &start, Refund: 866.7}},
+	}
+	if err := convertRental(rental, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	actualJSON, _ := json.Marshal(rental)
+	expectJSON := `{"Start":"2020-05-07T13:00:00Z","Currency":"EUR","OriginalCurrency":"USD","ExchangeRate":0.92,"Price":552,"InsureFee":110.4,"TowFee":27.6,"TransactionFee":55.2,"LineItems":[{"Type":"LastMinute","Percent":10,"Amount":-61.34}],"SalesTax":52.16,"Total":797.36,"SecurityDeposit":460,"CancelCutOffs":[{"CutOff":"2020-05-07T13:00:00Z","Refund":797.36}]}`
+	if string(actualJSON) != expectJSON {
+		t.Errorf("Wrong convertRental result\nActual %s\nExpect %s\n", actualJSON, expectJSON)
+	}
+	if err := convertRental(&EventRental{Currency: "USD"}, "XYZ"); err == nil || err.Error() != `BadCurrency{"Currency":"XYZ"}` {
+		t.Errorf("convertRental should fail on unknown currency, got %v", err)
+	}
+}
+
+func TestConvertPayment(t *testing.T) {
+	test := func(payment EventPayment, expectJSON string) {
+		err := convertPayment(&payment)
+		actualJSON, _ := json.Marshal(payment)
+		if err != nil {
+			actualJSON = []byte(err.Error())
+		}
+		if string(actualJSON) != expectJSON {
+			t.Errorf("Wrong convertPayment result\nActual %s\nExpect %s\n", actualJSON, expectJSON)
+		}
+	}
+	test(EventPayment{Currency: "CAD", OriginalCurrency: "USD", OriginalAmount: 866.7}, `{"Currency":"CAD","Amount":1178.71,"OriginalCurrency":"USD","OriginalAmount":866.7,"ExchangeRate":1.36}`)
+	test(EventPayment{Amount: 100}, `{"Currency":"USD","Amount":100,"OriginalCurrency":"USD","OriginalAmount":100,"ExchangeRate":1}`)
+	test(EventPayment{Currency: "CAD", OriginalCurrency: "XYZ", OriginalAmount: 1}, `BadCurrency{"Currency":"XYZ"}`)
+}
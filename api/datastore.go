@@ -1,28 +1,52 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
 	"errors"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/datastore"
 )
 
 var apiContext context.Context
-var datastoreClient *datastore.Client
+
+// dataStore is where records are kept: Cloud Datastore, or an embeddedStore when Config.Env.StoreFile is set
+var dataStore datastorer
+
+// defaultDatastoreHost is where the Cloud Datastore emulator is when Config.Env.DatastoreHost isn't set
+const defaultDatastoreHost = "localhost:8169"
 
 func startDataStore() {
-	os.Setenv("DATASTORE_EMULATOR_HOST", "localhost:8169")
 	apiContext = context.Background()
-	client, err := datastore.NewClient(apiContext, "boatfuji")
-	if err != nil {
-		panic(err)
+	if Config.Env.StoreFile != "" {
+		embedded, err := openEmbeddedStore(Config.Env.StoreFile)
+		if err != nil {
+			panic(err)
+		}
+		dataStore = embedded
+	} else {
+		// only ever the emulator, never the production project
+		host := Config.Env.DatastoreHost
+		if host == "" {
+			host = defaultDatastoreHost
+		}
+		os.Setenv("DATASTORE_EMULATOR_HOST", host)
+		client, err := datastore.NewClient(apiContext, "boatfuji")
+		if err != nil {
+			panic(err)
+		}
+		dataStore = &cloudStore{client}
 	}
-	datastoreClient = client
 	makeStaffFirstTime()
 	makeStandardOrgs()
+	if err := loadCurrencies(); err != nil {
+		panic(err)
+	}
 }
 
 func newQuery(kind string, filters map[string]interface{}) *datastore.Query {
@@ -42,15 +66,89 @@ func newQuery(kind string, filters map[string]interface{}) *datastore.Query {
 	return query
 }
 
+// datastorer is a storage driver; GetAll's filters are like newQuery's, i.e., "Contacts.Email=", "Audit.QANeeded>",
+// "order", "offset", and "limit"
 type datastorer interface {
 	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
-	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error)
+	GetAll(ctx context.Context, kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error)
 	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
 	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	RunInTransaction(ctx context.Context, f func(tx datastorer) error) error
+}
+
+// cloudStore is a datastorer for Cloud Datastore, or its emulator
+type cloudStore struct {
+	client *datastore.Client
+}
+
+func (c *cloudStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return c.client.Get(ctx, key, dst)
+}
+
+func (c *cloudStore) GetAll(ctx context.Context, kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error) {
+	return c.client.GetAll(ctx, newQuery(kind, filters), dst)
+}
+
+func (c *cloudStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return c.client.GetMulti(ctx, keys, dst)
+}
+
+func (c *cloudStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return c.client.Put(ctx, key, src)
+}
+
+// RunInTransaction runs f in a transaction, which Cloud Datastore retries if something else changed what it read
+func (c *cloudStore) RunInTransaction(ctx context.Context, f func(tx datastorer) error) error {
+	_, err := c.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&transaction{tx})
+	})
+	return err
+}
+
+// transaction is a datastorer for a Cloud Datastore transaction, which can't query or put new records
+type transaction struct {
+	tx *datastore.Transaction
+}
+
+func (t *transaction) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return t.tx.Get(key, dst)
+}
+
+func (t *transaction) GetAll(ctx context.Context, kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error) {
+	return nil, errors.New("NoQueryInTransaction")
+}
+
+func (t *transaction) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return t.tx.GetMulti(keys, dst)
+}
+
+func (t *transaction) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if key.Incomplete() {
+		return nil, errors.New("NeedIDInTransaction")
+	}
+	_, err := t.tx.Put(key, src)
+	return key, err
+}
+
+func (t *transaction) RunInTransaction(ctx context.Context, f func(tx datastorer) error) error {
+	return f(t)
+}
+
+// runInTransaction runs f in a transaction, so nothing else can change what it read before it's done
+func runInTransaction(f func(tx datastorer) error) error {
+	return storage().RunInTransaction(apiContext, f)
 }
 
 var mockDataStoreClient datastorer
 
+// storage gets the datastorer to use, which is the mock when testing
+func storage() datastorer {
+	if mockDataStoreClient != nil {
+		return mockDataStoreClient
+	}
+	return dataStore
+}
+
 func getAllX(kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error) {
 	if orFilters, ok := filters["or"]; ok {
 		if len(filters) > 1 {
@@ -90,7 +188,7 @@ func getAllX(kind string, filters map[string]interface{}, dst interface{}) ([]*d
 			if err := getX(kind, idValue, entity.Interface()); err != nil {
 				return nil, err
 			}
-			return []*datastore.Key{idKey(kind, idValue)}, nil
+			return withoutDeleted([]*datastore.Key{idKey(kind, idValue)}, dst), nil
 		case []int64:
 			keys := []*datastore.Key{}
 			for _, i := range idValue {
@@ -98,26 +196,51 @@ func getAllX(kind string, filters map[string]interface{}, dst interface{}) ([]*d
 			}
 			size := len(keys)
 			slice := reflect.MakeSlice(reflect.ValueOf(dst).Type().Elem(), size, size)
-			var err error
-			if mockDataStoreClient != nil {
-				err = mockDataStoreClient.GetMulti(apiContext, keys, slice.Interface())
-			} else {
-				err = datastoreClient.GetMulti(apiContext, keys, slice.Interface())
+			if err := storage().GetMulti(apiContext, keys, slice.Interface()); err != nil {
+				return keys, err
 			}
-			if err == nil {
-				array := reflect.ValueOf(dst).Elem()
-				array.Set(reflect.AppendSlice(array, slice))
-			}
-			return keys, err
+			array := reflect.ValueOf(dst).Elem()
+			array.Set(reflect.AppendSlice(array, slice))
+			return withoutDeleted(keys, dst), nil
 		default:
 			return nil, errors.New("BadIDFilter")
 		}
 	}
-	q := newQuery(kind, filters)
-	if mockDataStoreClient != nil {
-		return mockDataStoreClient.GetAll(apiContext, q, dst)
+	keys, err := storage().GetAll(apiContext, kind, filters, dst)
+	if err != nil || filtersDeleted(filters) {
+		return keys, err
 	}
-	return datastoreClient.GetAll(apiContext, q, dst)
+	return withoutDeleted(keys, dst), nil
+}
+
+// filtersDeleted finds out if filters are on Audit.Deleted, so the deleted records they ask for aren't left out
+func filtersDeleted(filters map[string]interface{}) bool {
+	for filterName := range filters {
+		if strings.HasPrefix(filterName, "Audit.Deleted") {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutDeleted leaves the records with Audit.Deleted, and their keys, out of what getAllX got into dst; Cloud
+// Datastore can't filter on a missing Audit.Deleted, so a page with offset or limit may come back short
+func withoutDeleted(keys []*datastore.Key, dst interface{}) []*datastore.Key {
+	array := reflect.ValueOf(dst).Elem()
+	if array.Len() != len(keys) {
+		return keys
+	}
+	kept := reflect.MakeSlice(array.Type(), 0, array.Len())
+	keptKeys := []*datastore.Key{}
+	for index, key := range keys {
+		entity := array.Index(index)
+		if entity.IsNil() || !isDeleted(entity.Interface()) {
+			kept = reflect.Append(kept, entity)
+			keptKeys = append(keptKeys, key)
+		}
+	}
+	array.Set(kept)
+	return keptKeys
 }
 
 func getAllOrgs(filters map[string]interface{}, dst *[]*Org) ([]*datastore.Key, error) {
@@ -147,20 +270,19 @@ func idKey(kind string, id int64) *datastore.Key {
 	return datastore.IDKey(kind, id, nil)
 }
 
+// getX gets the record of kind and id into dst; one that doesn't exist is AccessDenied, and a deleted one is NotFound
 func getX(kind string, id int64, dst interface{}) error {
 	if id == 0 {
 		return nil
 	}
 	key := idKey(kind, id)
-	var err error
-	if mockDataStoreClient != nil {
-		err = mockDataStoreClient.Get(apiContext, key, dst)
-	} else {
-		err = datastoreClient.Get(apiContext, key, dst)
-	}
+	err := storage().Get(apiContext, key, dst)
 	if err == datastore.ErrNoSuchEntity {
 		return errors.New("AccessDenied")
 	}
+	if err == nil && isDeleted(dst) {
+		return errors.New("NotFound")
+	}
 	if err == nil {
 		reflect.ValueOf(dst).Elem().FieldByName("ID").SetInt(id)
 	}
@@ -189,35 +311,154 @@ func getEvent(id int64) (*Event, error) {
 	return dst, getX("Event", id, dst)
 }
 
-func putX(key *datastore.Key, src interface{}, level int) (*datastore.Key, error) {
-	if mockDataStoreClient != nil {
-		return mockDataStoreClient.Put(apiContext, key, src)
-	}
-	key, err := datastoreClient.Put(apiContext, key, src)
+// putX puts a record without a transaction, with one more Audit.Version, so a client's If-Match for what it replaced is
+// a Conflict; records changed by others in the meantime should be put with updateX instead
+func putX(key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	setAuditVersion(src, auditVersion(src)+1)
+	key, err := storage().Put(apiContext, key, src)
 	// srcJSON, _ := json.Marshal(src)
 	// log.Printf("Info: Put%s %s => %d %v", key.Kind, string(srcJSON), key.ID, err)
-	sseSink <- &Publication{SetLevel: level}
+	if err == nil {
+		afterPut(key, src)
+	}
 	return key, err
 }
 
+// afterPut publishes a record that was put, and queues a boat to be matched against saved searches
+func afterPut(key *datastore.Key, src interface{}) {
+	publish(publicationOf(key, src))
+	if key.Kind == "Boat" {
+		queueSearchMatch(key.ID)
+	}
+}
+
+// updateX gets the record of kind and id into old, calls modify to make what to put in its place, and puts it, all in
+// a transaction so nothing else can change it in between; if ifMatch isn't 0, it has to be the record's Audit.Version
+// or it's a Conflict. The Audit.Version that's put is one more, or 1 for a new record (id 0), which is just put. If
+// modify makes nil, nothing is put. src, if not nil, is the record as it was asked to be, which modify may change; the
+// transaction may be retried, so each time, old is got fresh and src is as it was. A deleted record is NotFound.
+func updateX(kind string, id int64, ifMatch int64, old interface{}, src interface{}, modify func() (interface{}, error)) (*datastore.Key, error) {
+	return updateXTx(kind, id, ifMatch, old, src, func(tx datastorer) (interface{}, error) {
+		return modify()
+	})
+}
+
+// updateXTx is updateX for a modify that gets and puts other records in the same transaction, tx; for a new record,
+// which isn't put in a transaction, neither is what modify puts
+func updateXTx(kind string, id int64, ifMatch int64, old interface{}, src interface{}, modify func(tx datastorer) (interface{}, error)) (*datastore.Key, error) {
+	return updateAnyXTx(kind, id, ifMatch, old, src, false, modify)
+}
+
+// updateDeletedX is updateX for deleting, restoring, and purging a record, which may already be deleted
+func updateDeletedX(kind string, id int64, ifMatch int64, old interface{}, modify func() (interface{}, error)) (*datastore.Key, error) {
+	return updateAnyXTx(kind, id, ifMatch, old, nil, true, func(tx datastorer) (interface{}, error) {
+		return modify()
+	})
+}
+
+// updateAnyXTx is updateXTx, where a deleted record is NotFound unless deleted is true
+func updateAnyXTx(kind string, id int64, ifMatch int64, old interface{}, src interface{}, deleted bool, modify func(tx datastorer) (interface{}, error)) (*datastore.Key, error) {
+	if id == 0 {
+		if ifMatch != 0 {
+			return nil, Err("Conflict", map[string]string{"Version": "0"})
+		}
+		put, err := modify(storage())
+		if err != nil {
+			return nil, err
+		}
+		if put == nil {
+			return nil, nil
+		}
+		// putX makes it 1
+		setAuditVersion(put, 0)
+		return putX(idKey(kind, 0), put)
+	}
+	var asked bytes.Buffer
+	if src != nil {
+		if err := gob.NewEncoder(&asked).Encode(src); err != nil {
+			return nil, err
+		}
+	}
+	var put interface{}
+	key := idKey(kind, id)
+	attempts := 0
+	err := runInTransaction(func(tx datastorer) error {
+		// Get leaves fields that aren't in the record as they were, and modify may have changed src
+		put = nil
+		reflectStruct(old).Set(reflect.Zero(reflectStruct(old).Type()))
+		if attempts++; attempts > 1 && src != nil {
+			reflectStruct(src).Set(reflect.Zero(reflectStruct(src).Type()))
+			if err := gob.NewDecoder(bytes.NewReader(asked.Bytes())).Decode(src); err != nil {
+				return err
+			}
+		}
+		if err := tx.Get(apiContext, key, old); err == datastore.ErrNoSuchEntity {
+			return errors.New("AccessDenied")
+		} else if err != nil {
+			return err
+		}
+		if !deleted && isDeleted(old) {
+			return errors.New("NotFound")
+		}
+		reflectID(old).SetInt(id)
+		version := auditVersion(old)
+		if ifMatch != 0 && ifMatch != version {
+			return Err("Conflict", map[string]string{"Version": strconv.FormatInt(version, 10)})
+		}
+		var err error
+		if put, err = modify(tx); err != nil {
+			return err
+		}
+		if put == nil {
+			return nil
+		}
+		setAuditVersion(put, version+1)
+		_, err = tx.Put(apiContext, key, put)
+		return err
+	})
+	if err != nil || put == nil {
+		return nil, err
+	}
+	afterPut(key, put)
+	return key, nil
+}
+
+// putXTx puts another record in tx, the transaction of an updateXTx modify, with one more Audit.Version; the caller
+// publishes it once the transaction is done
+func putXTx(tx datastorer, key *datastore.Key, src interface{}) error {
+	setAuditVersion(src, auditVersion(src)+1)
+	_, err := tx.Put(apiContext, key, src)
+	return err
+}
+
 func putOrg(src *Org) (*datastore.Key, error) {
-	return putX(idKey("Org", src.ID), src, 1)
+	return putX(idKey("Org", src.ID), src)
 }
 
 func putUser(src *User) (*datastore.Key, error) {
-	return putX(idKey("User", src.ID), src, 2)
+	return putX(idKey("User", src.ID), src)
 }
 
 func putBoat(src *Boat) (*datastore.Key, error) {
-	return putX(idKey("Boat", src.ID), src, 3)
+	return putX(idKey("Boat", src.ID), src)
 }
 
 func putDeal(src *Deal) (*datastore.Key, error) {
-	return putX(idKey("Deal", src.ID), src, 4)
+	return putX(idKey("Deal", src.ID), src)
 }
 
 func putEvent(src *Event) (*datastore.Key, error) {
-	return putX(idKey("Event", src.ID), src, 5)
+	return putX(idKey("Event", src.ID), src)
+}
+
+// putEvents puts each of events, like notifications made in a transaction once it's done
+func putEvents(events []*Event) error {
+	for _, event := range events {
+		if _, err := putEvent(event); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func makeStaffFirstTime() {
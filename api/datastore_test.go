@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"regexp"
 	"testing"
@@ -28,6 +30,7 @@ type mockDataStoreCall struct {
 	dst        interface{}
 	keyResult  *datastore.Key
 	keysResult []*datastore.Key
+	err        error // what Get or Put returns, i.e., datastore.ErrNoSuchEntity or datastore.ErrConcurrentTransaction
 }
 
 func (call *mockDataStoreCall) Serialize() string {
@@ -72,16 +75,19 @@ func (mds *mockDataStore) Get(ctx context.Context, key *datastore.Key, dst inter
 		return datastore.ErrInvalidEntityType
 	}
 	call := mds.Do(&mockDataStoreCall{name: "Get", key: key})
+	if call.err != nil {
+		return call.err
+	}
 	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(call.dst))
 	return nil
 }
 
-func (mds *mockDataStore) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+func (mds *mockDataStore) GetAll(ctx context.Context, kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error) {
 	dv := reflect.ValueOf(dst)
 	if dv.Kind() != reflect.Ptr || dv.IsNil() {
 		return nil, datastore.ErrInvalidEntityType
 	}
-	call := mds.Do(&mockDataStoreCall{name: "GetAll", q: q})
+	call := mds.Do(&mockDataStoreCall{name: "GetAll", q: newQuery(kind, filters)})
 	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(call.dst))
 	return call.keysResult, nil
 }
@@ -99,6 +105,16 @@ func (mds *mockDataStore) GetMulti(ctx context.Context, keys []*datastore.Key, d
 	return nil
 }
 
+// RunInTransaction runs f with the mock itself, so the calls in a transaction are expected like any others; like Cloud
+// Datastore, it tries f up to 3 times while it fails with ErrConcurrentTransaction
+func (mds *mockDataStore) RunInTransaction(ctx context.Context, f func(tx datastorer) error) error {
+	err := datastore.ErrConcurrentTransaction
+	for attempt := 0; attempt < 3 && err == datastore.ErrConcurrentTransaction; attempt++ {
+		err = f(mds)
+	}
+	return err
+}
+
 var redactPassword = regexp.MustCompile(`"PasswordHashCrypt":"[^"]+"`)
 
 func (mds *mockDataStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
@@ -109,7 +125,7 @@ func (mds *mockDataStore) Put(ctx context.Context, key *datastore.Key, src inter
 		src:     src,
 		srcJSON: redactPassword.ReplaceAllString(string(srcJSON), `"PasswordHashCrypt":"REDACTED"`),
 	})
-	return call.keyResult, nil
+	return call.keyResult, call.err
 }
 
 func TestMakeStaffFirstTime(t *testing.T) {
@@ -127,42 +143,42 @@ func TestMakeStaffFirstTime(t *testing.T) {
 				name:      "Put",
 				key:       idKey("Org", 0),
 				src:       []*Org{},
-				srcJSON:   `{"Types":["Marketplace"],"Name":"Boat Fuji Inc.","Description":"The marketplace operator","Contacts":[{"Type":"Address","SubType":"Work","Line1":"3101 South US Highway 1","City":"Fort Pierce","County":"St. Lucie","State":"FL","Postal":"34982-6337","Country":"US","Location":{"Lat":27.4097155,"Lng":-80.329127},"Loc100KM":[11728,11729,12128,12129],"Loc300KM":[1239,1240,1372,1373]},{"Type":"Email","SubType":"Work","Email":"info@boatfuji.com"}],"EIN":"84-4243290","Audit":{"Created":"2020-05-05T05:05:05Z"}}`,
+				srcJSON:   `{"Types":["Marketplace"],"Name":"Boat Fuji Inc.","Description":"The marketplace operator","Contacts":[{"Type":"Address","SubType":"Work","Line1":"3101 South US Highway 1","City":"Fort Pierce","County":"St. Lucie","State":"FL","Postal":"34982-6337","Country":"US","Location":{"Lat":27.4097155,"Lng":-80.329127},"Loc100KM":[11728,11729,12128,12129],"Loc300KM":[1239,1240,1372,1373]},{"Type":"Email","SubType":"Work","Email":"info@boatfuji.com"}],"EIN":"84-4243290","Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
 				keyResult: idKey("Org", 1),
 			},
 			{
 				name:      "Put",
 				key:       idKey("User", 0),
 				src:       []*User{},
-				srcJSON:   `{"OrgID":1,"PasswordHashCrypt":"REDACTED","NameOrder":"GivenFamily","GivenName":"Dave","FamilyName":"Lampert","Gender":"Male","Images":[{"URL":"/i/EDC4B5EAFE5C91AE0614E21AE34137BF.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Email","SubType":"Work","Email":"dave.lampert@boatfuji.com"},{"Type":"Phone","SubType":"Mobile","Phone":"407-834-8834"}],"Audit":{"Created":"2020-05-05T05:05:05Z"}}`,
+				srcJSON:   `{"OrgID":1,"PasswordHashCrypt":"REDACTED","NameOrder":"GivenFamily","GivenName":"Dave","FamilyName":"Lampert","Gender":"Male","Images":[{"URL":"/i/EDC4B5EAFE5C91AE0614E21AE34137BF.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Email","SubType":"Work","Email":"dave.lampert@boatfuji.com"},{"Type":"Phone","SubType":"Mobile","Phone":"407-834-8834"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
 				keyResult: idKey("User", 2),
 			},
 			{
 				name:      "Put",
 				key:       idKey("User", 0),
 				src:       []*User{},
-				srcJSON:   `{"OrgID":1,"PasswordHashCrypt":"REDACTED","NameOrder":"GivenFamily","GivenName":"Erik","FamilyName":"Breckenfelder","Gender":"Male","Images":[{"URL":"/i/78601FF342A85F39AE36B45FF480D19A.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Email","SubType":"Work","Email":"erik.breckenfelder@boatfuji.com"},{"Type":"Phone","SubType":"Mobile","Phone":"630-222-7505"}],"Audit":{"Created":"2020-05-05T05:05:05Z"}}`,
+				srcJSON:   `{"OrgID":1,"PasswordHashCrypt":"REDACTED","NameOrder":"GivenFamily","GivenName":"Erik","FamilyName":"Breckenfelder","Gender":"Male","Images":[{"URL":"/i/78601FF342A85F39AE36B45FF480D19A.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Email","SubType":"Work","Email":"erik.breckenfelder@boatfuji.com"},{"Type":"Phone","SubType":"Mobile","Phone":"630-222-7505"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
 				keyResult: idKey("User", 3),
 			},
 			{
 				name:      "Put",
 				key:       idKey("User", 0),
 				src:       []*User{},
-				srcJSON:   `{"PasswordHashCrypt":"REDACTED","Birthdate":"1988-06-02T00:00:00Z","NameOrder":"FamilyGiven","GivenName":"Jiazhen","FamilyName":"Lin","Description":"Follow your dreams!","Gender":"Female","Languages":["en-us","zh"],"Images":[{"URL":"/i/052DCC6A7CC5117A6122F615E19DCE56.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Address","SubType":"Work","Line1":"123 5th Avenue","City":"New York City","State":"NY","Postal":"10003","Location":{"Lat":40.7391967,"Lng":-73.9930489},"Loc100KM":[17734,17735,18134,18135],"Loc300KM":[1906,1907,2039,2040]},{"Type":"Address","SubType":"Home","Line1":"500 N Sweetzer Avenue","Line2":"Box 123","City":"Los Angeles","State":"CA","Postal":"90048","Location":{"Lat":34.0802574,"Lng":-118.3722444},"Loc100KM":[14893,14894,15294,15295],"Loc300KM":[1626,1627,1760,1761]},{"Type":"Email","SubType":"Work","Email":"info@awkwafina.com"},{"Type":"Email","SubType":"Home","Email":"awkwafina@gmail.com"},{"Type":"Phone","SubType":"Mobile","Phone":"213-555-1212"}],"Notifications":["RentalStartEnd","MessageReceived","SpecialOffers","News","Tips","UpcomingRentals","UserReviews","ReviewReminder","BookingExpired"],"Currency":"USD","BankAccounts":[{"Type":"Checking","Routing":"021000322","Account":"1234567890"}],"CreditCards":[{"NickName":"Gold Card","Last4":"1234","Token":"..."},{"NickName":"Cash Back","Last4":"9876","Token":"..."}],"Audit":{"Created":"2020-01-02T03:04:05Z","Updated":"2020-05-05T05:05:05Z","QANeeded":"2020-02-03T03:04:05Z","QAFields":["User.Description"],"User":{"Description":"Follow your dreams even if the world tells you you can't!"}}}`,
+				srcJSON:   `{"PasswordHashCrypt":"REDACTED","Birthdate":"1988-06-02T00:00:00Z","NameOrder":"FamilyGiven","GivenName":"Jiazhen","FamilyName":"Lin","Description":"Follow your dreams!","Gender":"Female","Languages":["en-us","zh"],"Images":[{"URL":"/i/052DCC6A7CC5117A6122F615E19DCE56.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Address","SubType":"Work","Line1":"123 5th Avenue","City":"New York City","State":"NY","Postal":"10003","Location":{"Lat":40.7391967,"Lng":-73.9930489},"Loc100KM":[17734,17735,18134,18135],"Loc300KM":[1906,1907,2039,2040]},{"Type":"Address","SubType":"Home","Line1":"500 N Sweetzer Avenue","Line2":"Box 123","City":"Los Angeles","State":"CA","Postal":"90048","Location":{"Lat":34.0802574,"Lng":-118.3722444},"Loc100KM":[14893,14894,15294,15295],"Loc300KM":[1626,1627,1760,1761]},{"Type":"Email","SubType":"Work","Email":"info@awkwafina.com"},{"Type":"Email","SubType":"Home","Email":"awkwafina@gmail.com"},{"Type":"Phone","SubType":"Mobile","Phone":"213-555-1212"}],"Notifications":["RentalStartEnd","MessageReceived","SpecialOffers","News","Tips","UpcomingRentals","UserReviews","ReviewReminder","BookingExpired"],"Currency":"USD","BankAccounts":[{"Type":"Checking","Routing":"021000322","Account":"1234567890"}],"CreditCards":[{"NickName":"Gold Card","Last4":"1234","Token":"..."},{"NickName":"Cash Back","Last4":"9876","Token":"..."}],"Audit":{"Created":"2020-01-02T03:04:05Z","Updated":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-02-03T03:04:05Z","QAFields":["User.Description"],"User":{"Description":"Follow your dreams even if the world tells you you can't!"}}}`,
 				keyResult: idKey("User", 4),
 			},
 			{
 				name:      "Put",
 				key:       idKey("Org", 0),
 				src:       []*Org{},
-				srcJSON:   `{"Types":["Crew"],"Name":"Yo Soy Capitan","Description":"Let us captain your boats so renters won't capsize them!","Contacts":[{"Type":"Address","SubType":"Work","Line1":"123 Brickell Ave","City":"Miami","County":"Miami-Dade","State":"FL","Postal":"33129","Country":"US","Location":{"Lat":25.7467903,"Lng":-80.2113866},"Loc100KM":[11328,11329,11728,11729],"Loc300KM":[1239,1240,1372,1373]},{"Type":"Email","SubType":"Work","Email":"captainnotcapsize@gmail.com"}],"EIN":"59-1234567","Audit":{"Created":"2020-05-05T05:05:05Z"}}`,
+				srcJSON:   `{"Types":["Crew"],"Name":"Yo Soy Capitan","Description":"Let us captain your boats so renters won't capsize them!","Contacts":[{"Type":"Address","SubType":"Work","Line1":"123 Brickell Ave","City":"Miami","County":"Miami-Dade","State":"FL","Postal":"33129","Country":"US","Location":{"Lat":25.7467903,"Lng":-80.2113866},"Loc100KM":[11328,11329,11728,11729],"Loc300KM":[1239,1240,1372,1373]},{"Type":"Email","SubType":"Work","Email":"captainnotcapsize@gmail.com"}],"EIN":"59-1234567","Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
 				keyResult: idKey("Org", 5),
 			},
 			{
 				name:      "Put",
 				key:       idKey("User", 0),
 				src:       []*User{},
-				srcJSON:   `{"PasswordHashCrypt":"REDACTED","Birthdate":"1988-06-02T00:00:00Z","NameOrder":"GivenFamily","GivenName":"Bligh","FamilyName":"Blue","Description":"Captain! Not capsize!","Gender":"Male","Languages":["en-us","es"],"Images":[{"URL":"/i/75FF04C131EE08005781A097795AF6AA.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Address","SubType":"Work","Line1":"123 Brickell Ave","City":"Miami","County":"Miami-Dade","State":"FL","Postal":"33129","Country":"US","Location":{"Lat":25.7467903,"Lng":-80.2113866},"Loc100KM":[11328,11329,11728,11729],"Loc300KM":[1239,1240,1372,1373]},{"Type":"Email","SubType":"Work","Email":"captainnotcapsize@gmail.com"},{"Type":"Phone","SubType":"Mobile","Phone":"305-555-1212"}],"Notifications":["RentalStartEnd","MessageReceived","SpecialOffers","News","Tips","UpcomingRentals","UserReviews","ReviewReminder","BookingExpired"],"Currency":"USD","BankAccounts":[{"Type":"Checking","Routing":"021000322","Account":"314159265"}],"Audit":{"Created":"2020-05-05T05:05:05Z"}}`,
+				srcJSON:   `{"PasswordHashCrypt":"REDACTED","Birthdate":"1988-06-02T00:00:00Z","NameOrder":"GivenFamily","GivenName":"Bligh","FamilyName":"Blue","Description":"Captain! Not capsize!","Gender":"Male","Languages":["en-us","es"],"Images":[{"URL":"/i/75FF04C131EE08005781A097795AF6AA.jpg","Width":200,"Height":200}],"Contacts":[{"Type":"Address","SubType":"Work","Line1":"123 Brickell Ave","City":"Miami","County":"Miami-Dade","State":"FL","Postal":"33129","Country":"US","Location":{"Lat":25.7467903,"Lng":-80.2113866},"Loc100KM":[11328,11329,11728,11729],"Loc300KM":[1239,1240,1372,1373]},{"Type":"Email","SubType":"Work","Email":"captainnotcapsize@gmail.com"},{"Type":"Phone","SubType":"Mobile","Phone":"305-555-1212"}],"Notifications":["RentalStartEnd","MessageReceived","SpecialOffers","News","Tips","UpcomingRentals","UserReviews","ReviewReminder","BookingExpired"],"Currency":"USD","BankAccounts":[{"Type":"Checking","Routing":"021000322","Account":"314159265"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
 				keyResult: idKey("User", 6),
 			},
 		},
@@ -171,6 +187,60 @@ func TestMakeStaffFirstTime(t *testing.T) {
 	mockDataStoreClient.(*mockDataStore).Done()
 }
 
+func TestUpdateX(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	test := func(ifMatch int64, expectErr string, calls []mockDataStoreCall) {
+		mockDataStoreClient = &mockDataStore{t: t, calls: calls}
+		old := &Event{}
+		_, err := updateX("Event", 51, ifMatch, old, nil, func() (interface{}, error) {
+			audit := *old.Audit
+			return &Event{ID: old.ID, UserID: 123, Audit: &audit}, nil
+		})
+		if actual := fmt.Sprint(err); actual != expectErr {
+			t.Errorf("updateX(%d) => %s, expected %s", ifMatch, actual, expectErr)
+		}
+		mockDataStoreClient.(*mockDataStore).Done()
+	}
+	getEvent := mockDataStoreCall{name: "Get", key: idKey("Event", 51), dst: Event{UserID: 123, Audit: &Audit{Version: 3}}}
+	// someone else changed it since I got it
+	test(2, `Conflict{"Version":"3"}`, []mockDataStoreCall{getEvent})
+	// nobody did, or I don't care
+	for _, ifMatch := range []int64{3, 0} {
+		test(ifMatch, "<nil>", []mockDataStoreCall{getEvent, {
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"UserID":123,"Audit":{"Version":4}}`,
+			keyResult: idKey("Event", 51),
+		}})
+	}
+	// when the transaction is retried, old is got fresh and what was asked for is as it was, whatever modify did
+	mockDataStoreClient = &mockDataStore{t: t, calls: []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: Event{UserID: 123, UnreadByIDs: []int64{456}, Audit: &Audit{Version: 3}}},
+		{name: "Put", key: idKey("Event", 51), srcJSON: `{"ID":51,"UserID":123,"UnreadByIDs":[456,789],"Audit":{"Version":4}}`, err: datastore.ErrConcurrentTransaction},
+		{name: "Get", key: idKey("Event", 51), dst: Event{UserID: 123, Audit: &Audit{Version: 4}}},
+		{name: "Put", key: idKey("Event", 51), srcJSON: `{"ID":51,"UserID":123,"UnreadByIDs":[789],"Audit":{"Version":5}}`, keyResult: idKey("Event", 51)},
+	}}
+	old, asked := &Event{}, &Event{UnreadByIDs: []int64{789}}
+	if _, err := updateX("Event", 51, 0, old, asked, func() (interface{}, error) {
+		asked.ID, asked.UserID, asked.Audit = old.ID, old.UserID, old.Audit
+		asked.UnreadByIDs = append(old.UnreadByIDs, asked.UnreadByIDs...)
+		return asked, nil
+	}); err != nil {
+		t.Errorf("updateX() retried => %s", err.Error())
+	}
+	mockDataStoreClient.(*mockDataStore).Done()
+}
+
+func TestIfMatchHeader(t *testing.T) {
+	for header, expect := range map[string]int64{`"3"`: 3, `W/"4"`: 4, "": 0, "*": 0} {
+		r := httptest.NewRequest(http.MethodPost, "/api/SetBoat", nil)
+		r.Header.Set("If-Match", header)
+		if actual := ifMatchHeader(r); actual != expect {
+			t.Errorf("ifMatchHeader(%s) => %d, expected %d", header, actual, expect)
+		}
+	}
+}
+
 // func TestInteractiveData(t *testing.T) {
 // 	os.Setenv("DATASTORE_EMULATOR_HOST", "localhost:8169")
 // 	apiContext = context.Background()
@@ -1,6 +1,6 @@
 package api
 
-import "log"
+import "errors"
 
 // Deal is a deal for a boat, such as a rental, sale, etc.
 type Deal struct {
@@ -30,21 +30,19 @@ func init() {
 }
 
 func getPublicDeal(dealID int64) *Deal {
-	if dealID == 0 {
-		return nil
-	}
-	deal, err := getDeal(dealID)
-	if err != nil {
-		log.Printf("getDeal(%d) => %s", dealID, err.Error())
-		return nil
-	}
+	deal, _ := getPublicX("Deal", dealID).(*Deal)
+	return deal
+}
+
+// publicDeal makes the projection of a deal that anyone may see
+func publicDeal(deal *Deal) *Deal {
 	if deal.Rental == nil {
 		deal.Rental = &EventRental{}
 	}
 	return &Deal{
 		Rental: &EventRental{Start: deal.Rental.Start, End: deal.Rental.End},
 		Audit: &Audit{
-			Created: deal.Audit.Created,
+			Created: auditOf(deal).Created,
 		},
 	}
 }
@@ -71,26 +69,95 @@ func SetDeal(req *Request, pub *Publication) *Response {
 	if err != nil {
 		return errResponse(err)
 	}
+	// RewardPoints are redeemed in the deal's transaction, with its ID in the renter's ledger, so a new deal that
+	// redeems them is put first as Interested
+	if rental := req.Deal.Rental; req.Deal.ID == 0 && rental != nil && rental.RewardPoints > 0 && rental.Status != "Interested" {
+		status := rental.Status
+		rental.Status = "Interested"
+		if req.Deal.UserID == 0 {
+			req.Deal.UserID = req.Session.UserID
+		}
+		resp := setDeal(req)
+		if resp.ErrorCode != "" {
+			return resp
+		}
+		req.Deal.ID = resp.ID
+		req.IfMatch = resp.Version
+		rental.Status = status
+	}
+	return setDeal(req)
+}
+
+// setDeal puts req.Deal once it's been validated
+func setDeal(req *Request) *Response {
 	staff := isStaff(req)
-	oldDeal, err := getDeal(req.Deal.ID)
+	oldDeal := &Deal{}
+	var renter *User
+	var boats []*Boat
+	key, err := updateXTx("Deal", req.Deal.ID, req.IfMatch, oldDeal, req.Deal, func(tx datastorer) (interface{}, error) {
+		if lacksOrgAccess(req, "SetDeal", oldDeal) {
+			return nil, errors.New("AccessDenied")
+		}
+		// TODO: check BoatID, UserID, OrgID, CustomerIDs, Rental
+		req.Deal.Boat = nil
+		req.Deal.User = nil
+		req.Deal.Org = nil
+		for _, listing := range []string{"Rental", "Cruise", "Ride"} {
+			rental, _ := getDeepField(listing, req.Deal).(*EventRental)
+			if rental == nil {
+				continue
+			}
+			rental.CaptainUser = nil
+			// renters must be approved for the boat's listing before requesting or booking it
+			if rental.Status == "Requested" || rental.Status == "Booked" {
+				userID := req.Deal.UserID
+				if userID == 0 {
+					userID = req.Session.UserID
+				}
+				if err := checkQualified(userID, req.Deal.BoatID, 0, listing); err != nil {
+					return nil, err
+				}
+			}
+		}
+		var err error
+		if renter, err = redeemRewards(tx, req, oldDeal); err != nil {
+			return nil, err
+		}
+		// booking, blocking, or moving a rental changes when its boat is available
+		boats = nil
+		moved := oldDeal.BoatID != req.Deal.BoatID
+		if moved && bookingsChanged(&Deal{}, oldDeal) {
+			// the deal no longer books its old boat
+			boat, err := updateNotAvailable(tx, oldDeal.BoatID, &Deal{ID: req.Deal.ID})
+			if err != nil {
+				return nil, err
+			}
+			boats = append(boats, boat)
+		}
+		if moved && bookingsChanged(req.Deal, &Deal{}) || !moved && bookingsChanged(req.Deal, oldDeal) {
+			boat, err := updateNotAvailable(tx, req.Deal.BoatID, req.Deal)
+			if err != nil {
+				return nil, err
+			}
+			boats = append(boats, boat)
+		}
+		// finalize and save
+		setAudit(staff, req.Deal, oldDeal)
+		return req.Deal, nil
+	})
 	if err != nil {
 		return errResponse(err)
 	}
-	// TODO: check BoatID, UserID, OrgID, CustomerIDs, Rental
-	req.Deal.Boat = nil
-	req.Deal.User = nil
-	req.Deal.Org = nil
-	if req.Deal.Rental != nil {
-		rental := req.Deal.Rental
-		rental.CaptainUser = nil
+	if renter != nil {
+		publish(publicationOf(idKey("User", renter.ID), renter))
 	}
-	// finalize and save
-	setAudit(staff, req.Deal, oldDeal)
-	key, err := putDeal(req.Deal)
-	if err != nil {
-		return errResponse(err)
+	for _, boat := range boats {
+		if boat != nil {
+			afterPut(idKey("Boat", boat.ID), boat)
+		}
 	}
 	return &Response{
-		ID: key.ID,
+		ID:      key.ID,
+		Version: req.Deal.Audit.Version,
 	}
 }
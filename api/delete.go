@@ -0,0 +1,343 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// purgeDays is how long a deleted record is kept for staff to restore, before its personal data is purged
+const purgeDays = 30
+
+func init() {
+	apiHandlers["DeleteOrg"] = DeleteOrg
+	apiHandlers["DeleteUser"] = DeleteUser
+	apiHandlers["DeleteBoat"] = DeleteBoat
+	apiHandlers["DeleteDeal"] = DeleteDeal
+	apiHandlers["DeleteEvent"] = DeleteEvent
+	apiHandlers["Restore"] = Restore
+	apiHandlers["PurgeDeleted"] = PurgeDeleted
+}
+
+// startDeletedPurge purges deleted records once a day, on one instance
+func startDeletedPurge() {
+	startDailyJob(deletedPurgeJob, "purgeDeleted", "purged", purgeDeleted)
+}
+
+// DeleteOrg deletes OrgID, if it's my org and I have SetOrg OrgAccess, or I'm staff; its boats are deleted, the same
+// as DeleteBoat, and its members' sessions no longer have it
+func DeleteOrg(req *Request, pub *Publication) *Response {
+	resp := deleteX(req, "Org", req.OrgID, &Org{}, "SetOrg", nil)
+	if resp.ErrorCode != "" {
+		return resp
+	}
+	if err := deleteBoatsOf(map[string]interface{}{"OrgID=": req.OrgID}); err != nil {
+		return errResponse(err)
+	}
+	return resp
+}
+
+// DeleteUser deletes UserID, if it's me, or a member of my org and I have SetUser OrgAccess, or I'm staff; their boats
+// that aren't an org's are deleted, the same as DeleteBoat, and their sessions are signed out
+func DeleteUser(req *Request, pub *Publication) *Response {
+	resp := deleteX(req, "User", req.UserID, &User{}, "SetUser", nil)
+	if resp.ErrorCode != "" {
+		return resp
+	}
+	if err := deleteBoatsOf(map[string]interface{}{"UserID=": req.UserID}); err != nil {
+		return errResponse(err)
+	}
+	return resp
+}
+
+// DeleteBoat deletes BoatID, if it's mine, or my org's and I have SetBoat OrgAccess, or I'm staff; its future
+// rentals, cruises, and rides are canceled, which deleting it again retries if that failed
+func DeleteBoat(req *Request, pub *Publication) *Response {
+	boat := &Boat{}
+	resp := deleteX(req, "Boat", req.BoatID, boat, "SetBoat", nil)
+	if resp.ErrorCode != "" && resp.ErrorCode != "Deleted" {
+		return resp
+	}
+	if _, err := cancelFutureDeals(boat); err != nil {
+		return errResponse(err)
+	}
+	return resp
+}
+
+// DeleteDeal deletes DealID, if it's mine, or my org's and I have SetDeal OrgAccess, or I'm staff; a deal that's
+// under way must be canceled, declined, or withdrawn first
+func DeleteDeal(req *Request, pub *Publication) *Response {
+	deal := &Deal{}
+	return deleteX(req, "Deal", req.DealID, deal, "SetDeal", func() error {
+		if part := openDealPart(deal); part != "" {
+			return Err("DealUnderWay", map[string]string{"Field": part})
+		}
+		return nil
+	})
+}
+
+// DeleteEvent deletes EventID, if it's mine, or my org's and I have SetEvent OrgAccess, or I'm staff
+func DeleteEvent(req *Request, pub *Publication) *Response {
+	return deleteX(req, "Event", req.EventID, &Event{}, "SetEvent", nil)
+}
+
+// deleteX sets Audit.Deleted of the record of kind and id, which getAllX then leaves out; check, if any, finds out if
+// old may be deleted
+func deleteX(req *Request, kind string, id int64, old interface{}, access string, check func() error) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if id == 0 {
+		return &Response{ErrorCode: "Need" + kind + "ID"}
+	}
+	key, err := updateDeletedX(kind, id, req.IfMatch, old, func() (interface{}, error) {
+		if !isStaff(req) && (!isMine(req, old) || lacksOrgAccess(req, access, old)) {
+			return nil, errors.New("AccessDenied")
+		}
+		if isDeleted(old) {
+			return nil, errors.New("Deleted")
+		}
+		if check != nil {
+			if err := check(); err != nil {
+				return nil, err
+			}
+		}
+		auditOf(old).Deleted = now()
+		return old, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: auditVersion(old),
+	}
+}
+
+// openDealPart gets the first of a deal's rental, cruise, ride, sale, finance, insurance, transport, service, or crew
+// that's still under way, or "" if none is
+func openDealPart(deal *Deal) string {
+	for i, rental := range []*EventRental{deal.Rental, deal.Cruise, deal.Ride} {
+		ended := rental != nil && rental.Status == "Booked" && rental.End != nil && rental.End.Before(*now())
+		if rental != nil && !ended && !StringInArray(rental.Status, []string{"Interested", "Canceled", "Blocked"}) {
+			return []string{"Rental", "Cruise", "Ride"}[i]
+		}
+	}
+	switch {
+	case deal.Sale != nil && !StringInArray(deal.Sale.Status, []string{"Withdrawn", "Closed"}):
+		return "Sale"
+	case deal.Finance != nil && !StringInArray(deal.Finance.Decision, []string{"Declined", "Funded", "Withdrawn"}):
+		return "Finance"
+	case deal.Insure != nil && !StringInArray(deal.Insure.Status, []string{"Declined", "Bound", "Closed"}):
+		return "Insure"
+	case deal.Transport != nil && !StringInArray(deal.Transport.Status, []string{"Declined", "Canceled", "Delivered"}):
+		return "Transport"
+	case deal.Service != nil && !StringInArray(deal.Service.Status, []string{"Completed", "Canceled"}):
+		return "Service"
+	case deal.Crew != nil && !StringInArray(deal.Crew.Status, []string{"Declined", "Canceled"}) &&
+		!(deal.Crew.Status == "Accepted" && deal.Crew.End != nil && deal.Crew.End.Before(*now())):
+		return "Crew"
+	}
+	return ""
+}
+
+// deleteBoatsOf deletes the boats of a deleted user or org, the same as DeleteBoat; a user's boats that are an org's
+// stay the org's
+func deleteBoatsOf(filters map[string]interface{}) error {
+	var boats []*Boat
+	keys, err := getAllBoats(filters, &boats)
+	if err != nil {
+		return err
+	}
+	_, userBoats := filters["UserID="]
+	for index, key := range keys {
+		if userBoats && boats[index].OrgID != 0 {
+			continue
+		}
+		boat := &Boat{}
+		if _, err := updateDeletedX("Boat", key.ID, 0, boat, func() (interface{}, error) {
+			if isDeleted(boat) {
+				return nil, nil
+			}
+			auditOf(boat).Deleted = now()
+			return boat, nil
+		}); err != nil {
+			return err
+		}
+		if _, err := cancelFutureDeals(boat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelFutureDeals cancels the rentals, cruises, and rides of a deleted boat that haven't started yet, and lets their
+// renters know; each deal is changed in a transaction, so one that was already canceled isn't canceled again
+func cancelFutureDeals(boat *Boat) (int, error) {
+	var deals []*Deal
+	keys, err := getAllDeals(map[string]interface{}{"BoatID=": boat.ID}, &deals)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for index, key := range keys {
+		if len(cancelFutureRentals(deals[index])) == 0 {
+			continue
+		}
+		deal := &Deal{}
+		var canceled []string
+		updated, err := updateX("Deal", key.ID, 0, deal, nil, func() (interface{}, error) {
+			if canceled = cancelFutureRentals(deal); len(canceled) == 0 {
+				return nil, nil
+			}
+			return deal, nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if updated == nil {
+			continue
+		}
+		name := "The boat"
+		if boat.Name != "" {
+			name = boat.Name
+		}
+		if _, err := putEvent(&Event{
+			DealID:       key.ID,
+			BoatID:       boat.ID,
+			UserID:       deal.UserID,
+			UnreadByIDs:  []int64{deal.UserID},
+			Notification: &EventNotification{Text: name + " was removed, so your " + strings.Join(canceled, " and ") + " was canceled."},
+			Audit:        &Audit{Created: now()},
+		}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// cancelFutureRentals cancels a deal's rental, cruise, and ride that haven't started yet, and says which it canceled
+func cancelFutureRentals(deal *Deal) []string {
+	var canceled []string
+	for i, rental := range []*EventRental{deal.Rental, deal.Cruise, deal.Ride} {
+		if rental != nil && rental.Start != nil && rental.Start.After(*now()) && rental.Status != "Canceled" {
+			rental.Status = "Canceled"
+			canceled = append(canceled, []string{"rental", "cruise", "ride"}[i]+" on "+rental.Start.Format("January 2, 2006"))
+		}
+	}
+	return canceled
+}
+
+// Restore lets staff undelete EventID, DealID, BoatID, UserID, or OrgID (the first that's set); boats deleted with a
+// user or org stay deleted, deals canceled when a boat was deleted stay canceled, and personal data that was purged
+// stays gone
+func Restore(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	var kind string
+	var id int64
+	var old interface{}
+	switch {
+	case req.EventID != 0:
+		kind, id, old = "Event", req.EventID, &Event{}
+	case req.DealID != 0:
+		kind, id, old = "Deal", req.DealID, &Deal{}
+	case req.BoatID != 0:
+		kind, id, old = "Boat", req.BoatID, &Boat{}
+	case req.UserID != 0:
+		kind, id, old = "User", req.UserID, &User{}
+	case req.OrgID != 0:
+		kind, id, old = "Org", req.OrgID, &Org{}
+	default:
+		return &Response{ErrorCode: "NeedID"}
+	}
+	key, err := updateDeletedX(kind, id, req.IfMatch, old, func() (interface{}, error) {
+		if !isDeleted(old) {
+			return nil, errors.New("NotDeleted")
+		}
+		auditOf(old).Deleted = nil
+		return old, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: auditVersion(old),
+	}
+}
+
+// PurgeDeleted lets staff purge deleted records now, instead of waiting for the daily run
+func PurgeDeleted(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if _, err := purgeDeleted(); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+// purgeDeleted removes the personal data of records deleted more than purgeDays ago, keeping only what's needed for
+// the records that refer to them: their IDs, the IDs they refer to, and Audit's Created, Deleted, and Purged
+func purgeDeleted() (int, error) {
+	filters := map[string]interface{}{"Audit.Deleted<": now().AddDate(0, 0, -purgeDays)}
+	count := 0
+	for _, kind := range []string{"Org", "User", "Boat", "Deal", "Event"} {
+		var dst interface{}
+		switch kind {
+		case "Org":
+			dst = &[]*Org{}
+		case "User":
+			dst = &[]*User{}
+		case "Boat":
+			dst = &[]*Boat{}
+		case "Deal":
+			dst = &[]*Deal{}
+		case "Event":
+			dst = &[]*Event{}
+		}
+		keys, err := getAllX(kind, filters, dst)
+		if err != nil {
+			return count, err
+		}
+		records := reflect.ValueOf(dst).Elem()
+		for index, key := range keys {
+			if auditOf(records.Index(index).Interface()).Purged != nil {
+				continue
+			}
+			// it's read again in a transaction, in case staff restored it since
+			old := reflect.New(records.Type().Elem().Elem()).Interface()
+			_, err := updateDeletedX(kind, key.ID, 0, old, func() (interface{}, error) {
+				if !isDeleted(old) {
+					return nil, errors.New("NotDeleted")
+				}
+				return purgedCopy(old), nil
+			})
+			if err != nil && err.Error() != "NotDeleted" {
+				return count, err
+			}
+			if err == nil {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// purgedCopy makes a copy of a record with only its int64 ...ID fields, and Audit's Created, Deleted, and Purged now
+func purgedCopy(ptr interface{}) interface{} {
+	record := reflectStruct(ptr)
+	purged := reflect.New(record.Type())
+	for fieldNum := 0; fieldNum < record.NumField(); fieldNum++ {
+		field := record.Type().Field(fieldNum)
+		if strings.HasSuffix(field.Name, "ID") && field.Type.Kind() == reflect.Int64 {
+			purged.Elem().Field(fieldNum).Set(record.Field(fieldNum))
+		}
+	}
+	audit := auditOf(ptr)
+	purged.Elem().FieldByName("Audit").Set(reflect.ValueOf(&Audit{Created: audit.Created, Deleted: audit.Deleted, Purged: now()}))
+	return purged.Interface()
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestDeleteBoat(t *testing.T) {
+	session := &Session{UserID: 123, Verified: true}
+	testAPI(t, session, nil, "DeleteBoat", `{}`, `{"ErrorCode":"NeedBoatID"}`, nil)
+	testAPI(t, session, nil, "DeleteBoat", `{"BoatID":7}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 456}},
+	})
+	// deleting it again cancels any future deals that are left, in case that failed the first time
+	testAPI(t, session, nil, "DeleteBoat", `{"BoatID":7}`, `{"ErrorCode":"Deleted"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Audit: &Audit{Deleted: DateTime(2020, 5, 1, 0, 0, 0)}}},
+		{
+			name:       "GetAll",
+			q:          newQuery("Deal", map[string]interface{}{"BoatID=": int64(7)}),
+			dst:        []*Deal{{BoatID: 7, UserID: 789, Rental: &EventRental{Start: DateTime(2020, 6, 1, 9, 0, 0), Status: "Canceled"}}},
+			keysResult: []*datastore.Key{idKey("Deal", 32)},
+		},
+	})
+	// the future rental is canceled and its renter told, while the past one is left as it was; the rental that was
+	// canceled since it was gotten isn't canceled again
+	testAPI(t, session, nil, "DeleteBoat", `{"BoatID":7}`, `{"ID":7,"Version":3}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Name: "Sea Breeze", Audit: &Audit{Version: 2}}},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":7,"UserID":123,"Name":"Sea Breeze","Trailer":{},"Audit":{"Deleted":"2020-05-05T05:05:05Z","Version":3}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name: "GetAll",
+			q:    newQuery("Deal", map[string]interface{}{"BoatID=": int64(7)}),
+			dst: []*Deal{
+				{BoatID: 7, UserID: 456, Rental: &EventRental{Start: DateTime(2020, 4, 1, 9, 0, 0), Status: "Booked"}},
+				{BoatID: 7, UserID: 789, Rental: &EventRental{Start: DateTime(2020, 6, 1, 9, 0, 0), Status: "Booked"}},
+				{BoatID: 7, UserID: 790, Cruise: &EventRental{Start: DateTime(2020, 6, 2, 9, 0, 0), Status: "Booked"}},
+			},
+			keysResult: []*datastore.Key{idKey("Deal", 31), idKey("Deal", 32), idKey("Deal", 33)},
+		},
+		{name: "Get", key: idKey("Deal", 32), dst: Deal{BoatID: 7, UserID: 789, Rental: &EventRental{Start: DateTime(2020, 6, 1, 9, 0, 0), Status: "Booked"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 32),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":32,"BoatID":7,"UserID":789,"Rental":{"Start":"2020-06-01T09:00:00Z","Status":"Canceled"},"Audit":{"Version":1}}`,
+			keyResult: idKey("Deal", 32),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			src:       []*Event{},
+			srcJSON:   `{"DealID":32,"BoatID":7,"UserID":789,"UnreadByIDs":[789],"Notification":{"Text":"Sea Breeze was removed, so your rental on June 1, 2020 was canceled."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{name: "Get", key: idKey("Deal", 33), dst: Deal{BoatID: 7, UserID: 790, Cruise: &EventRental{Start: DateTime(2020, 6, 2, 9, 0, 0), Status: "Canceled"}}},
+	})
+}
+
+func TestDeleteDeal(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	testAPI(t, session, nil, "DeleteDeal", `{"DealID":32}`, `{"ErrorCode":"DealUnderWay","ErrorDetails":{"Field":"Rental"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 32), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{End: DateTime(2020, 6, 1, 17, 0, 0), Status: "Booked"}}},
+	})
+	// a rental that's over may be deleted
+	testAPI(t, session, nil, "DeleteDeal", `{"DealID":32}`, `{"ID":32,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 32), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{End: DateTime(2020, 5, 1, 17, 0, 0), Status: "Booked"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 32),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":32,"BoatID":7,"UserID":456,"Rental":{"End":"2020-05-01T17:00:00Z","Status":"Booked"},"Audit":{"Deleted":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 32),
+		},
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	admin := &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}, Verified: true}
+	member := &Session{UserID: 456, OrgID: 8, OrgAccess: []string{"SetBoat"}, Verified: true}
+	testAPI(t, member, nil, "DeleteUser", `{"UserID":789}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 789), dst: User{OrgID: 8}},
+	})
+	// her sessions are signed out when the user is published
+	signedOut := &Session{ID: -789, UserID: 789, OrgID: 8, OrgAccess: []string{"SetBoat"}, Verified: true}
+	sessionsMutex.Lock()
+	sessions[-789] = signedOut
+	sessionsMutex.Unlock()
+	testAPI(t, admin, nil, "DeleteUser", `{"UserID":789}`, `{"ID":789,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 789), dst: User{OrgID: 8, GivenName: "Ann"}},
+		{
+			name:      "Put",
+			key:       idKey("User", 789),
+			src:       []*User{},
+			srcJSON:   `{"ID":789,"OrgID":8,"GivenName":"Ann","Audit":{"Deleted":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("User", 789),
+		},
+		{name: "Get", key: idKey("User", 789), dst: User{OrgID: 8, GivenName: "Ann", Audit: &Audit{Deleted: DateTime(2020, 5, 5, 5, 5, 5)}}},
+		// her own boat is deleted, but not the org's
+		{
+			name:       "GetAll",
+			q:          newQuery("Boat", map[string]interface{}{"UserID=": int64(789)}),
+			dst:        []*Boat{{UserID: 789}, {UserID: 789, OrgID: 8}},
+			keysResult: []*datastore.Key{idKey("Boat", 7), idKey("Boat", 9)},
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 789}},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":7,"UserID":789,"Trailer":{},"Audit":{"Deleted":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{name: "GetAll", q: newQuery("Deal", map[string]interface{}{"BoatID=": int64(7)}), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+	})
+	sessionsMutex.Lock()
+	_, ok := sessions[-789]
+	sessionsMutex.Unlock()
+	if ok || signedOut.UserID != 0 || signedOut.OrgID != 0 || signedOut.OrgAccess != nil {
+		t.Errorf("Wrong session after deleting user: %+v", signedOut)
+	}
+}
+
+func TestDeleteOrg(t *testing.T) {
+	admin := &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetOrg"}, Verified: true}
+	// its members' sessions lose it when the org is published
+	sessionsMutex.Lock()
+	sessions[-456] = &Session{ID: -456, UserID: 456, OrgID: 8, OrgTypes: []string{"Dealer"}, OrgAccess: []string{"SetBoat"}}
+	sessionsMutex.Unlock()
+	defer func() {
+		sessionsMutex.Lock()
+		delete(sessions, -456)
+		sessionsMutex.Unlock()
+	}()
+	testAPI(t, admin, nil, "DeleteOrg", `{"OrgID":8}`, `{"ID":8,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: Org{Name: "Acme"}},
+		{
+			name:      "Put",
+			key:       idKey("Org", 8),
+			src:       []*Org{},
+			srcJSON:   `{"ID":8,"Name":"Acme","Audit":{"Deleted":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Org", 8),
+		},
+		{name: "Get", key: idKey("User", 456), dst: User{OrgID: 8, OrgAccess: []string{"SetBoat"}}},
+		{name: "Get", key: idKey("Org", 8), dst: Org{Name: "Acme", Audit: &Audit{Deleted: DateTime(2020, 5, 5, 5, 5, 5)}}},
+		{
+			name:       "GetAll",
+			q:          newQuery("Boat", map[string]interface{}{"OrgID=": int64(8)}),
+			dst:        []*Boat{{UserID: 456, OrgID: 8}},
+			keysResult: []*datastore.Key{idKey("Boat", 9)},
+		},
+		{name: "Get", key: idKey("Boat", 9), dst: Boat{UserID: 456, OrgID: 8}},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 9),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":9,"UserID":456,"OrgID":8,"Trailer":{},"Audit":{"Deleted":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Boat", 9),
+		},
+		{name: "GetAll", q: newQuery("Deal", map[string]interface{}{"BoatID=": int64(9)}), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+	})
+	if member := sessions[-456]; member.UserID != 456 || member.OrgID != 0 || member.OrgTypes != nil || member.OrgAccess != nil {
+		t.Errorf("Wrong member session after deleting org: %+v", member)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	testAPI(t, &Session{UserID: 123, Verified: true}, nil, "Restore", `{"BoatID":7}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	testAPI(t, staff, nil, "Restore", `{}`, `{"ErrorCode":"NeedID"}`, nil)
+	testAPI(t, staff, nil, "Restore", `{"BoatID":7}`, `{"ErrorCode":"NotDeleted"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+	})
+	testAPI(t, staff, nil, "Restore", `{"BoatID":7}`, `{"ID":7,"Version":4}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Audit: &Audit{Deleted: DateTime(2020, 5, 1, 0, 0, 0), Version: 3}}},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Audit":{"Version":4}}`,
+			keyResult: idKey("Boat", 7),
+		},
+	})
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	testAPI(t, &Session{UserID: 123}, nil, "PurgeDeleted", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	filters := map[string]interface{}{"Audit.Deleted<": *DateTime(2020, 4, 5, 5, 5, 5)}
+	deleted := &Audit{Created: DateTime(2020, 1, 2, 3, 4, 5), Deleted: DateTime(2020, 4, 1, 0, 0, 0), Version: 5}
+	testAPI(t, &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}, nil, "PurgeDeleted", `{}`, `{}`, []mockDataStoreCall{
+		{name: "GetAll", q: newQuery("Org", filters), dst: []*Org{}, keysResult: []*datastore.Key{}},
+		// the user that was already purged is skipped
+		{
+			name: "GetAll",
+			q:    newQuery("User", filters),
+			dst: []*User{
+				{OrgID: 8, ReferredByUserID: 9, GivenName: "Ann", UserName: "ann", Audit: deleted},
+				{Audit: &Audit{Deleted: deleted.Deleted, Purged: DateTime(2020, 4, 2, 0, 0, 0)}},
+			},
+			keysResult: []*datastore.Key{idKey("User", 456), idKey("User", 457)},
+		},
+		{name: "Get", key: idKey("User", 456), dst: User{OrgID: 8, ReferredByUserID: 9, GivenName: "Ann", UserName: "ann", Audit: deleted}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"OrgID":8,"ReferredByUserID":9,"Audit":{"Created":"2020-01-02T03:04:05Z","Deleted":"2020-04-01T00:00:00Z","Purged":"2020-05-05T05:05:05Z","Version":6}}`,
+			keyResult: idKey("User", 456),
+		},
+		{name: "GetAll", q: newQuery("Boat", filters), dst: []*Boat{}, keysResult: []*datastore.Key{}},
+		{name: "GetAll", q: newQuery("Deal", filters), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+		{name: "GetAll", q: newQuery("Event", filters), dst: []*Event{}, keysResult: []*datastore.Key{}},
+	})
+}
+
+func TestGetAllWithoutDeleted(t *testing.T) {
+	mockDataStoreClient = &mockDataStore{t: t, calls: []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("Boat", map[string]interface{}{"UserID=": int64(123)}),
+			dst:        []*Boat{{Name: "Sea Breeze"}, {Name: "Wave Runner", Audit: &Audit{Deleted: DateTime(2020, 5, 1, 0, 0, 0)}}},
+			keysResult: []*datastore.Key{idKey("Boat", 7), idKey("Boat", 8)},
+		},
+	}}
+	var boats []*Boat
+	keys, err := getAllBoats(map[string]interface{}{"UserID=": int64(123)}, &boats)
+	if err != nil || len(keys) != 1 || keys[0].ID != 7 || len(boats) != 1 || boats[0].Name != "Sea Breeze" {
+		t.Errorf("getAllBoats() => %v %v %v, expected only boat 7", keys, boats, err)
+	}
+	mockDataStoreClient.(*mockDataStore).Done()
+	mockDataStoreClient = nil
+}
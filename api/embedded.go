@@ -0,0 +1,448 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// embeddedStore is a datastorer that keeps records in memory and saves them to a file, so the app and its tests can
+// run with no Cloud Datastore emulator. Records are kept as the properties Cloud Datastore would save, so its struct
+// tags (omitempty, noindex, "-") apply the same; filters work like Cloud Datastore's, i.e., "Contacts.Email=" matches
+// any of the Contacts, and a record without the property of a filter or order is left out. Unlike Cloud Datastore,
+// noindex properties can be filtered too. Transactions run one at a time, and their puts are only kept if they succeed;
+// a put outside a transaction waits for the one that's running, so it isn't lost when that one's puts are kept.
+type embeddedStore struct {
+	path    string // "" to keep it only in memory
+	mutex   sync.RWMutex
+	records map[string]map[int64][]datastore.Property // by kind and ID
+	lastIDs map[string]int64                          // by kind
+	txMutex sync.Mutex
+}
+
+// embeddedFile is what's saved in an embeddedStore's file
+type embeddedFile struct {
+	Records map[string]map[int64][]datastore.Property
+	LastIDs map[string]int64
+}
+
+func init() {
+	// the types of property values that aren't already known to gob
+	gob.Register(&datastore.Entity{})
+	gob.Register(&datastore.Key{})
+	gob.Register(datastore.GeoPoint{})
+	gob.Register(time.Time{})
+	gob.Register([]interface{}{})
+}
+
+// openEmbeddedStore opens the embeddedStore saved at path, or a new one if there's no file yet
+func openEmbeddedStore(path string) (*embeddedStore, error) {
+	store := &embeddedStore{
+		path:    path,
+		records: map[string]map[int64][]datastore.Property{},
+		lastIDs: map[string]int64{},
+	}
+	if path == "" {
+		return store, nil
+	}
+	fileBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := &embeddedFile{}
+	if err := gob.NewDecoder(bytes.NewReader(fileBytes)).Decode(file); err != nil {
+		return nil, err
+	}
+	if file.Records != nil {
+		store.records = file.Records
+	}
+	if file.LastIDs != nil {
+		store.lastIDs = file.LastIDs
+	}
+	return store, nil
+}
+
+// save writes the whole store to a new file and renames it over the old one, so a crash never leaves half of it;
+// the caller holds mutex
+func (store *embeddedStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&embeddedFile{Records: store.records, LastIDs: store.lastIDs}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(store.path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(store.path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(store.path+".tmp", store.path)
+}
+
+func (store *embeddedStore) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	store.mutex.RLock()
+	props, ok := store.records[key.Kind][key.ID]
+	store.mutex.RUnlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+func (store *embeddedStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return getMulti(ctx, store, keys, dst)
+}
+
+// getMulti gets each of keys into the []*S or []S dst, with a datastore.MultiError if any are missing, like Cloud
+// Datastore
+func getMulti(ctx context.Context, getter datastorer, keys []*datastore.Key, dst interface{}) error {
+	array := reflect.ValueOf(dst)
+	if array.Kind() != reflect.Slice || array.Len() != len(keys) {
+		return datastore.ErrInvalidEntityType
+	}
+	multiErr := make(datastore.MultiError, len(keys))
+	failed := false
+	for index, key := range keys {
+		elem := array.Index(index)
+		if elem.Kind() == reflect.Ptr {
+			if elem.IsNil() {
+				elem.Set(reflect.New(elem.Type().Elem()))
+			}
+		} else {
+			elem = elem.Addr()
+		}
+		if err := getter.Get(ctx, key, elem.Interface()); err != nil {
+			multiErr[index] = err
+			failed = true
+		}
+	}
+	if failed {
+		return multiErr
+	}
+	return nil
+}
+
+func (store *embeddedStore) GetAll(ctx context.Context, kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error) {
+	array := reflect.ValueOf(dst)
+	if array.Kind() != reflect.Ptr || array.Elem().Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	array = array.Elem()
+	order, descending := "", false
+	offset, limit := 0, -1
+	type filter struct {
+		path  string
+		op    string
+		value interface{}
+	}
+	filterList := []filter{}
+	for filterName, filterValue := range filters {
+		switch filterName {
+		case "order":
+			order = filterValue.(string)
+			if strings.HasPrefix(order, "-") {
+				order, descending = order[1:], true
+			}
+		case "offset":
+			offset = filterValue.(int)
+		case "limit":
+			limit = filterValue.(int)
+		default:
+			path, op := splitFilter(filterName)
+			if op == "" {
+				return nil, errors.New("BadFilter")
+			}
+			filterList = append(filterList, filter{path, op, propertyValue(filterValue)})
+		}
+	}
+	type match struct {
+		id      int64
+		props   []datastore.Property
+		orderBy interface{}
+	}
+	matches := []match{}
+	store.mutex.RLock()
+	for id, props := range store.records[kind] {
+		matched := true
+		for _, f := range filterList {
+			if !anyMatches(propertyValues(props, strings.Split(f.path, ".")), f.op, f.value) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		var orderBy interface{}
+		if order != "" {
+			// a multi-valued property sorts by its smallest value, or its largest when descending
+			values := propertyValues(props, strings.Split(order, "."))
+			if len(values) == 0 {
+				continue
+			}
+			orderBy = values[0]
+			for _, value := range values[1:] {
+				if cmp, ok := compareValues(value, orderBy); ok && (cmp < 0) != descending && cmp != 0 {
+					orderBy = value
+				}
+			}
+		}
+		matches = append(matches, match{id, props, orderBy})
+	}
+	store.mutex.RUnlock()
+	sort.Slice(matches, func(i, j int) bool {
+		if order != "" {
+			if cmp, ok := compareValues(matches[i].orderBy, matches[j].orderBy); ok && cmp != 0 {
+				return (cmp < 0) != descending
+			}
+		}
+		return matches[i].id < matches[j].id
+	})
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+	matches = matches[offset:]
+	if limit >= 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	keys := []*datastore.Key{}
+	for _, m := range matches {
+		elem := reflect.New(array.Type().Elem())
+		if elem.Elem().Kind() == reflect.Ptr {
+			elem.Elem().Set(reflect.New(elem.Elem().Type().Elem()))
+			if err := datastore.LoadStruct(elem.Elem().Interface(), m.props); err != nil {
+				return nil, err
+			}
+		} else if err := datastore.LoadStruct(elem.Interface(), m.props); err != nil {
+			return nil, err
+		}
+		array.Set(reflect.Append(array, elem.Elem()))
+		keys = append(keys, datastore.IDKey(kind, m.id, nil))
+	}
+	return keys, nil
+}
+
+func (store *embeddedStore) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+	store.txMutex.Lock()
+	defer store.txMutex.Unlock()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	key = store.put(key, props)
+	return key, store.save()
+}
+
+// put keeps props at key, giving it the next ID of its kind if it has none; the caller holds mutex
+func (store *embeddedStore) put(key *datastore.Key, props []datastore.Property) *datastore.Key {
+	if key.Incomplete() {
+		store.lastIDs[key.Kind]++
+		key = datastore.IDKey(key.Kind, store.lastIDs[key.Kind], nil)
+	} else if key.ID > store.lastIDs[key.Kind] {
+		store.lastIDs[key.Kind] = key.ID
+	}
+	if store.records[key.Kind] == nil {
+		store.records[key.Kind] = map[int64][]datastore.Property{}
+	}
+	store.records[key.Kind][key.ID] = props
+	return key
+}
+
+// RunInTransaction runs f after any other transaction is done, and keeps its puts only if it succeeds
+func (store *embeddedStore) RunInTransaction(ctx context.Context, f func(tx datastorer) error) error {
+	store.txMutex.Lock()
+	defer store.txMutex.Unlock()
+	tx := &embeddedTransaction{store: store, puts: map[datastore.Key][]datastore.Property{}}
+	if err := f(tx); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for key, props := range tx.puts {
+		store.put(&key, props)
+	}
+	return store.save()
+}
+
+// embeddedTransaction is a datastorer for an embeddedStore transaction, which like Cloud Datastore's can't query or
+// put new records
+type embeddedTransaction struct {
+	store *embeddedStore
+	puts  map[datastore.Key][]datastore.Property
+}
+
+func (tx *embeddedTransaction) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if props, ok := tx.puts[*key]; ok {
+		return datastore.LoadStruct(dst, props)
+	}
+	return tx.store.Get(ctx, key, dst)
+}
+
+func (tx *embeddedTransaction) GetAll(ctx context.Context, kind string, filters map[string]interface{}, dst interface{}) ([]*datastore.Key, error) {
+	return nil, errors.New("NoQueryInTransaction")
+}
+
+func (tx *embeddedTransaction) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return getMulti(ctx, tx, keys, dst)
+}
+
+func (tx *embeddedTransaction) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	if key.Incomplete() {
+		return nil, errors.New("NeedIDInTransaction")
+	}
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+	tx.puts[*key] = props
+	return key, nil
+}
+
+func (tx *embeddedTransaction) RunInTransaction(ctx context.Context, f func(tx datastorer) error) error {
+	return f(tx)
+}
+
+// splitFilter splits a filter name like "Audit.QANeeded>" or "Types =" into its property path and operator
+func splitFilter(filterName string) (string, string) {
+	filterName = strings.TrimSpace(filterName)
+	for _, op := range []string{"<=", ">=", "=", "<", ">"} {
+		if strings.HasSuffix(filterName, op) {
+			return strings.TrimSpace(strings.TrimSuffix(filterName, op)), op
+		}
+	}
+	return filterName, ""
+}
+
+// propertyValues gets the values at path in props, with every value of multi-valued properties along the way, i.e.,
+// the Email of each of Contacts
+func propertyValues(props []datastore.Property, path []string) []interface{} {
+	values := []interface{}{}
+	for _, prop := range props {
+		// flattened structs have dotted names, like "Contacts.Email"
+		for length := len(path); length > 0; length-- {
+			if prop.Name != strings.Join(path[:length], ".") {
+				continue
+			}
+			propValues := []interface{}{prop.Value}
+			if list, ok := prop.Value.([]interface{}); ok {
+				propValues = list
+			}
+			for _, value := range propValues {
+				if length == len(path) {
+					values = append(values, value)
+				} else if entity, ok := value.(*datastore.Entity); ok {
+					values = append(values, propertyValues(entity.Properties, path[length:])...)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// propertyValue turns a filter value into the type it's saved as, i.e., int into int64 and *time.Time into time.Time
+func propertyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	return value
+}
+
+// anyMatches finds out if any of values is op value, which is how Cloud Datastore filters multi-valued properties
+func anyMatches(values []interface{}, op string, value interface{}) bool {
+	for _, v := range values {
+		cmp, ok := compareValues(v, value)
+		if !ok {
+			continue
+		}
+		switch op {
+		case "=":
+			ok = cmp == 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares two property values of the same type, or returns false if they can't be compared
+func compareValues(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case nil:
+		return 0, b == nil
+	case int64:
+		if bv, ok := b.(int64); ok {
+			return compareOrdered(av < bv, av > bv), true
+		}
+	case float64:
+		if bv, ok := b.(float64); ok {
+			return compareOrdered(av < bv, av > bv), true
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			return compareOrdered(!av && bv, av && !bv), true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			return compareOrdered(av.Before(bv), av.After(bv)), true
+		}
+	case *datastore.Key:
+		if bv, ok := b.(*datastore.Key); ok && av != nil && bv != nil {
+			if av.Kind != bv.Kind {
+				return strings.Compare(av.Kind, bv.Kind), true
+			}
+			return compareOrdered(av.ID < bv.ID, av.ID > bv.ID), true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
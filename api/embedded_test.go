@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db", "boatfuji.gob")
+	embedded, err := openEmbeddedStore(path)
+	if err != nil {
+		t.Fatalf("openEmbeddedStore() => %s", err.Error())
+	}
+	oldDataStore := dataStore
+	dataStore = embedded
+	defer func() { dataStore = oldDataStore }()
+	ids := map[string]int64{}
+	for _, user := range []*User{
+		{UserName: "ann", Contacts: []Contact{{Type: "Phone", Phone: "+1 555 0100"}, {Type: "Email", Email: "ann@example.org"}}, Audit: &Audit{Created: DateTime(2020, 1, 1, 0, 0, 0)}},
+		{UserName: "bob", Contacts: []Contact{{Type: "Email", Email: "bob@example.org"}}, Audit: &Audit{Created: DateTime(2020, 3, 1, 0, 0, 0), QANeeded: DateTime(2020, 3, 1, 0, 0, 0)}},
+		{UserName: "cat", Audit: &Audit{Created: DateTime(2020, 2, 1, 0, 0, 0)}},
+	} {
+		key, err := putUser(user)
+		if err != nil || key.ID == 0 {
+			t.Fatalf("putUser(%s) => %v %v", user.UserName, key, err)
+		}
+		ids[user.UserName] = key.ID
+	}
+	test := func(filters map[string]interface{}, expect ...string) {
+		t.Helper()
+		var users []*User
+		keys, err := getAllUsers(filters, &users)
+		if err != nil {
+			t.Fatalf("getAllUsers(%v) => %s", filters, err.Error())
+		}
+		actual := []string{}
+		for index, key := range keys {
+			if key.ID != ids[users[index].UserName] {
+				t.Errorf("getAllUsers(%v) got %s with the key of another user", filters, users[index].UserName)
+			}
+			actual = append(actual, users[index].UserName)
+		}
+		if len(actual) != len(expect) {
+			t.Errorf("getAllUsers(%v) => %v, expected %v", filters, actual, expect)
+			return
+		}
+		for index := range actual {
+			if actual[index] != expect[index] {
+				t.Errorf("getAllUsers(%v) => %v, expected %v", filters, actual, expect)
+				return
+			}
+		}
+	}
+	// any of the Contacts can match, and a user without the property never does
+	test(map[string]interface{}{"Contacts.Email=": "ann@example.org"}, "ann")
+	test(map[string]interface{}{"Contacts.Type=": "Email"}, "ann", "bob")
+	test(qaFilter(), "bob")
+	test(map[string]interface{}{"Audit.Created>=": *DateTime(2020, 2, 1, 0, 0, 0)}, "bob", "cat")
+	test(map[string]interface{}{"order": "-Audit.Created"}, "bob", "cat", "ann")
+	test(map[string]interface{}{"order": "Audit.Created", "offset": 1, "limit": 1}, "cat")
+	test(map[string]interface{}{"ID=": []int64{ids["cat"], ids["ann"]}}, "cat", "ann")
+	test(map[string]interface{}{"UserID=": ids["bob"]}, "bob")
+	if _, err := getUser(ids["cat"] + 100); err == nil || err.Error() != "AccessDenied" {
+		t.Errorf("getUser() of a missing user => %v, expected AccessDenied", err)
+	}
+	// a transaction that fails changes nothing, and one that succeeds changes it all
+	old := &User{}
+	if _, err := updateX("User", ids["cat"], 0, old, nil, func() (interface{}, error) {
+		old.UserName = "dog"
+		return nil, errors.New("Oops")
+	}); err == nil {
+		t.Errorf("updateX() with a failing modify => nil, expected Oops")
+	}
+	if _, err := updateX("User", ids["cat"], 2, old, nil, func() (interface{}, error) { return old, nil }); err == nil || err.Error() != `Conflict{"Version":"1"}` {
+		t.Errorf("updateX() with a stale ifMatch => %v, expected a Conflict", err)
+	}
+	if _, err := updateX("User", ids["cat"], 0, old, nil, func() (interface{}, error) {
+		old.UserName = "kit"
+		return old, nil
+	}); err != nil {
+		t.Errorf("updateX() => %s", err.Error())
+	}
+	// everything is still there when it's opened again
+	reopened, err := openEmbeddedStore(path)
+	if err != nil {
+		t.Fatalf("openEmbeddedStore() again => %s", err.Error())
+	}
+	dataStore = reopened
+	user, err := getUser(ids["cat"])
+	if err != nil || user.UserName != "kit" || user.Audit.Version != 2 || !user.Audit.Created.Equal(*DateTime(2020, 2, 1, 0, 0, 0)) {
+		t.Errorf("getUser() after reopening => %+v %v, expected kit at Version 2", user, err)
+	}
+	key, err := putUser(&User{UserName: "eve"})
+	if err != nil || key.ID != ids["cat"]+1 {
+		t.Errorf("putUser() after reopening => %v %v, expected the next ID", key, err)
+	}
+	// a put during a transaction waits for it, so the transaction's put doesn't undo it
+	put := make(chan error)
+	if _, err := updateX("User", key.ID, 0, old, nil, func() (interface{}, error) {
+		go func() {
+			_, err := reopened.Put(apiContext, key, &User{UserName: "fay"})
+			put <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		old.UserName = "gus"
+		return old, nil
+	}); err != nil {
+		t.Errorf("updateX() => %s", err.Error())
+	}
+	if err := <-put; err != nil {
+		t.Errorf("Put() during a transaction => %s", err.Error())
+	}
+	if user, err := getUser(key.ID); err != nil || user.UserName != "fay" {
+		t.Errorf("getUser() after a put during a transaction => %+v %v, expected fay", user, err)
+	}
+}
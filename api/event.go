@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"time"
 )
 
@@ -33,15 +34,19 @@ type Event struct {
 	Ride         *EventRental       `json:",omitempty" datastore:",omitempty,noindex"`
 	Sale         *EventSale         `json:",omitempty" datastore:",omitempty,noindex"`
 	Service      *EventService      `json:",omitempty" datastore:",omitempty,noindex"`
-	Transport    *EventTransport    `json:",omitempty" datastore:",omitempty,noindex"`
+	Transport    *EventTransport    `json:",omitempty" datastore:",omitempty"`
 	Audit        *Audit             `json:",omitempty" datastore:",omitempty"`
 }
 
 // EventCrew is when someone needs a captain or other crewmember for their boat
 type EventCrew struct {
-	Start *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
-	End   *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
-	Notes string     `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Role     string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Captain, Mate"`
+	Status   string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Requested, Accepted, Declined, Canceled"`
+	Start    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	End      *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency string     `json:",omitempty" datastore:",omitempty,noindex"`
+	Fee      float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	Notes    string     `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 }
 
 // EventDelivery is when a renter checks out the boat before rental and an owner checks in the boat after rental
@@ -76,29 +81,41 @@ type EventDeliveryNote struct {
 
 // EventFinance is to finance or re-finance a boat
 type EventFinance struct {
-	Status         string  `json:",omitempty" datastore:",omitempty,noindex" enum:"New, Used, Refinance"`
-	Applicants     []User  `json:",omitempty" datastore:",omitempty,noindex"`
-	UseAsResidence bool    `json:",omitempty" datastore:",omitempty,noindex"`
-	BoatsFinanced  []Boat  `json:",omitempty" datastore:",omitempty,noindex"`
-	BoatsPrevious  []Boat  `json:",omitempty" datastore:",omitempty,noindex"`
-	BoatsTraded    []Boat  `json:",omitempty" datastore:",omitempty,noindex"`
-	Price          float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	Tax            float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	CashDown       float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	TradeAllowance float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	TradePayoffs   float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	AmountFinanced float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	Term           int     `json:",omitempty" datastore:",omitempty,noindex"`
-	APR            float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	Monthly        float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Status         string                `json:",omitempty" datastore:",omitempty,noindex" enum:"New, Used, Refinance"`
+	Applicants     []User                `json:",omitempty" datastore:",omitempty,noindex"`
+	UseAsResidence bool                  `json:",omitempty" datastore:",omitempty,noindex"`
+	BoatsFinanced  []Boat                `json:",omitempty" datastore:",omitempty,noindex"`
+	BoatsPrevious  []Boat                `json:",omitempty" datastore:",omitempty,noindex"`
+	BoatsTraded    []Boat                `json:",omitempty" datastore:",omitempty,noindex"`
+	Price          float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	Tax            float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	CashDown       float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	TradeAllowance float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	TradePayoffs   float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	AmountFinanced float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	Term           int                   `json:",omitempty" datastore:",omitempty,noindex"`
+	APR            float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	Monthly        float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	Schedule       []EventFinancePayment `json:",omitempty" datastore:"-"`
+	Decision       string                `json:",omitempty" datastore:",omitempty,noindex" enum:"Submitted, Reviewing, Approved, Declined, Funded, Withdrawn"`
+	Notes          string                `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 }
 
 // EventInsure is to get insurance on a boat
 type EventInsure struct {
-	Use       string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Pleasure use exclusively, Racing/speed contests, Business/commercial use, Rented or leased to others, Primary residence"`
-	IssueDate *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
-	Boats     []Boat     `json:",omitempty" datastore:",omitempty,noindex"`
-	Users     []User     `json:",omitempty" datastore:",omitempty,noindex"`
+	Status       string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Requested, Quoted, Declined, Bound, Closed"`
+	Use          string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Pleasure use exclusively, Racing/speed contests, Business/commercial use, Rented or leased to others, Primary residence"`
+	Type         string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Personal, Charter, Commercial"`
+	IssueDate    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	ExpirDate    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency     string     `json:",omitempty" datastore:",omitempty,noindex"`
+	Premium      float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	InsuredValue float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	Deductible   float32    `json:",omitempty" datastore:",omitempty,noindex"`
+	Number       string     `json:",omitempty" datastore:",omitempty,noindex"`
+	Notes        string     `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Boats        []Boat     `json:",omitempty" datastore:",omitempty,noindex"`
+	Users        []User     `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // EventMessage is a private message from one user to another
@@ -114,36 +131,45 @@ type EventNotification struct {
 
 // EventPayment is a rental or purchase payment, partial or full, made from the renter/buyer or to the owner/seller or to a tax authority
 type EventPayment struct {
-	IsDeposit bool    `json:",omitempty" datastore:",omitempty,noindex"`
-	Currency  string  `json:",omitempty" datastore:",omitempty,noindex"`
-	Amount    float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	Token     string  `json:",omitempty" datastore:",omitempty,noindex"`
-	Approval  string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Purpose          string  `json:",omitempty" datastore:",omitempty,noindex" enum:"Rental, Security Deposit, Captain Fee, Refund"`
+	IsDeposit        bool    `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency         string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Amount           float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	OriginalCurrency string  `json:",omitempty" datastore:",omitempty,noindex"` // i.e., the boat's currency, if the payer paid in another
+	OriginalAmount   float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	ExchangeRate     float64 `json:",omitempty" datastore:",omitempty,noindex"`
+	Token            string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Approval         string  `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // EventRental is when the renter makes an offer to rent, or changes that offer (i.e., new rental date or cancel), or when owner accepts or counters
 type EventRental struct {
-	Locations       []Contact           `json:",omitempty" datastore:",omitempty,noindex"`
-	Start           *time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
-	End             *time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
-	CancelPolicy    string              `json:",omitempty" datastore:",omitempty,noindex" enum:"Flexible, Moderate, Strict"`
-	Currency        string              `json:",omitempty" datastore:",omitempty,noindex"`
-	Captain         string              `json:",omitempty" datastore:",omitempty,noindex" enum:"No Captain, Captain Included, Captain Extra"`
-	Price           float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	CaptainFee      float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	CaptainUserID   int                 `json:",omitempty" datastore:",omitempty,noindex"`
-	CaptainUser     *User               `json:",omitempty" datastore:",omitempty,noindex"`
-	InsureFee       float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	TowFee          float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	TransactionFee  float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	RewardsDiscount float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	SalesTax        float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	TaxAuthority    string              `json:",omitempty" datastore:",omitempty,noindex"`
-	Total           float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	SecurityDeposit float32             `json:",omitempty" datastore:",omitempty,noindex"`
-	FuelPayer       string              `json:",omitempty" datastore:",omitempty,noindex" enum:"Renter, Owner"`
-	Status          string              `json:",omitempty" datastore:",omitempty,noindex" enum:"Interested, Requested, Booked, Canceled, Blocked"`
-	CancelCutOffs   []EventRentalCancel `json:",omitempty" datastore:",omitempty,noindex"`
+	Locations        []Contact             `json:",omitempty" datastore:",omitempty,noindex"`
+	Start            *time.Time            `json:",omitempty" datastore:",omitempty,noindex"`
+	End              *time.Time            `json:",omitempty" datastore:",omitempty,noindex"`
+	CancelPolicy     string                `json:",omitempty" datastore:",omitempty,noindex" enum:"Flexible, Moderate, Strict"`
+	Currency         string                `json:",omitempty" datastore:",omitempty,noindex"`
+	OriginalCurrency string                `json:",omitempty" datastore:",omitempty,noindex"` // if the quote was converted from the boat's currency
+	ExchangeRate     float64               `json:",omitempty" datastore:",omitempty,noindex"`
+	Captain          string                `json:",omitempty" datastore:",omitempty,noindex" enum:"No Captain, Captain Included, Captain Extra"`
+	Price            float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	CaptainFee       float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	CaptainUserID    int64                 `json:",omitempty" datastore:",omitempty,noindex"`
+	CaptainUser      *User                 `json:",omitempty" datastore:",omitempty,noindex"`
+	InsureFee        float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	TowFee           float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	TransactionFee   float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	RewardsDiscount  float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	RewardPoints     int                   `json:",omitempty" datastore:",omitempty,noindex"`
+	PromoCode        string                `json:",omitempty" datastore:",omitempty,noindex"`
+	LineItems        []EventRentalLineItem `json:",omitempty" datastore:",omitempty,noindex"`
+	SalesTax         float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	TaxAuthority     string                `json:",omitempty" datastore:",omitempty,noindex"`
+	Total            float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	SecurityDeposit  float32               `json:",omitempty" datastore:",omitempty,noindex"`
+	FuelPayer        string                `json:",omitempty" datastore:",omitempty,noindex" enum:"Renter, Owner"`
+	Status           string                `json:",omitempty" datastore:",omitempty,noindex" enum:"Interested, Requested, Booked, Canceled, Blocked"`
+	CancelCutOffs    []EventRentalCancel   `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // EventRentalCancel shows how much is refunded if cancellation occurs before a CutOff date/time
@@ -152,6 +178,13 @@ type EventRentalCancel struct {
 	Refund float32    `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
+// EventRentalLineItem is a pricing rule or reward applied to a rental's Price; Amount is negative for discounts
+type EventRentalLineItem struct {
+	Type    string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Percent float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Amount  float32 `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
 // EventReview is a public review of a rental or sale
 type EventReview struct {
 	Text   string  `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
@@ -161,18 +194,59 @@ type EventReview struct {
 
 // EventSale is when the buyer makes an offer to buy, or changes that offer (i.e., new price or cancel), or when owner accepts or counters
 type EventSale struct {
-	Fraction float32 `json:",omitempty" datastore:",omitempty,noindex"`
-	Price    float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Status       string  `json:",omitempty" datastore:",omitempty,noindex" enum:"Open, Countered, Accepted, Withdrawn, Closed"`
+	Fraction     float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Price        float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency     string  `json:",omitempty" datastore:",omitempty,noindex"`
+	SellerUserID int64   `json:",omitempty" datastore:",omitempty,noindex"`
+	PrevEventID  int64   `json:",omitempty" datastore:",omitempty,noindex"`
+	Notes        string  `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 }
 
-// EventService is to repair, maintain, or get other service for a boat
+// EventService is to repair, maintain, or get other service for a boat; as a work order Deal, it has the Parts and Labor
+// of the work, the EngineHours read when it was done, and Photos and Invoices; Tasks are the boat's Maintenance tasks it
+// completes, and the totals are set from Parts and Labor
 type EventService struct {
-	Notes string `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Status      string              `json:",omitempty" datastore:",omitempty,noindex" enum:"Open, In Progress, Completed, Canceled"`
+	Title       string              `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Tasks       []string            `json:",omitempty" datastore:",omitempty,noindex"`
+	Parts       []EventServicePart  `json:",omitempty" datastore:",omitempty,noindex"`
+	Labor       []EventServiceLabor `json:",omitempty" datastore:",omitempty,noindex"`
+	EngineHours float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	Photos      []Image             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Invoices    []Image             `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Currency    string              `json:",omitempty" datastore:",omitempty,noindex"`
+	PartsTotal  float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	LaborTotal  float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	Total       float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	Completed   *time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
+	Notes       string              `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+}
+
+// EventServicePart is a part used in a work order, with its Price for each
+type EventServicePart struct {
+	Name     string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Number   string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Quantity float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Price    float32 `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
-// EventTransport is when someone wants to transport a boat from one location to another
+// EventServiceLabor is work done in a work order, with its hourly Rate
+type EventServiceLabor struct {
+	Description string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Hours       float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Rate        float32 `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// EventTransport is when someone wants to transport a boat from one location to another.
+// A posted job has Status Open, PickUp (the boat's Location), and Loc100KM so Transporter orgs near PickUp can find it;
+// each bid is an event with Status Bid and JobEventID; the accepted bid becomes a Deal whose Status follows the transport
 type EventTransport struct {
+	Status         string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Open, Bid, Accepted, Declined, Canceled, Picked Up, In Transit, Delivered"`
+	JobEventID     int64      `json:",omitempty" datastore:",omitempty"`
 	Types          []string   `json:",omitempty" datastore:",omitempty,noindex" enum:"Open Transport, Tow-Away Service, Flatbed Transport Service, Enclosed Transport, In-water Delivery Service, Ocean Freight Container Service"`
+	PickUp         *Contact   `json:",omitempty" datastore:",omitempty,noindex"`
+	Loc100KM       []int      `json:",omitempty" datastore:",omitempty"`
 	PickUpAfter    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
 	PickUpBefore   *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
 	DeliverAfter   *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
@@ -180,6 +254,7 @@ type EventTransport struct {
 	Destination    *Contact   `json:",omitempty" datastore:",omitempty,noindex"`
 	Notes          string     `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 	TransportOrgID int        `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency       string     `json:",omitempty" datastore:",omitempty,noindex"`
 	Price          float32    `json:",omitempty" datastore:",omitempty,noindex"`
 	SalesTax       float32    `json:",omitempty" datastore:",omitempty,noindex"`
 	TaxAuthority   string     `json:",omitempty" datastore:",omitempty,noindex"`
@@ -188,6 +263,7 @@ type EventTransport struct {
 
 func init() {
 	addEnumsFor(EventRental{})
+	addEnumsFor(EventPayment{})
 	apiHandlers["GetEvents"] = GetEvents
 	apiHandlers["SetEvent"] = SetEvent
 	apiHandlers["ReadEvent"] = ReadEvent
@@ -205,6 +281,9 @@ func GetEvents(req *Request, pub *Publication) *Response {
 	if err != nil {
 		return errResponse(err)
 	}
+	dependOnQuery(req, "Event", filters, keys)
+	var userIDs, orgIDs, boatIDs, dealIDs []int64
+	loader := newPublicLoader()
 	// process each event found
 	for index, key := range keys {
 		event := events[index]
@@ -213,14 +292,29 @@ func GetEvents(req *Request, pub *Publication) *Response {
 		if req.EventTypes != nil && (!StringInArray(getEventType(event), req.EventTypes)) {
 			continue
 		}
-		// add User, Org, Boat, Deal, and FromUser
-		event.User = getPublicUser(event.UserID)
-		event.Org = getPublicOrg(event.OrgID)
-		event.Boat = getPublicBoat(event.BoatID)
-		event.Deal = getPublicDeal(event.DealID)
-		event.FromUser = getPublicUser(event.FromUserID)
+		loader.want("User", event.UserID, event.FromUserID)
+		loader.want("Org", event.OrgID)
+		loader.want("Boat", event.BoatID)
+		loader.want("Deal", event.DealID)
+		userIDs = append(userIDs, event.UserID, event.FromUserID)
+		orgIDs = append(orgIDs, event.OrgID)
+		boatIDs = append(boatIDs, event.BoatID)
+		dealIDs = append(dealIDs, event.DealID)
 		resp.Events[key.ID] = event
 	}
+	// add User, Org, Boat, Deal, and FromUser, with one GetMulti of each kind
+	loader.load()
+	for _, event := range resp.Events {
+		event.User = loader.user(event.UserID)
+		event.Org = loader.org(event.OrgID)
+		event.Boat = loader.boat(event.BoatID)
+		event.Deal = loader.deal(event.DealID)
+		event.FromUser = loader.user(event.FromUserID)
+	}
+	dependOnIDs(req, "User", userIDs...)
+	dependOnIDs(req, "Org", orgIDs...)
+	dependOnIDs(req, "Boat", boatIDs...)
+	dependOnIDs(req, "Deal", dealIDs...)
 	return resp
 }
 
@@ -267,30 +361,67 @@ func SetEvent(req *Request, pub *Publication) *Response {
 		return mustVerifyResp()
 	}
 	staff := isStaff(req)
-	oldEvent, err := getEvent(e.ID)
-	if err != nil {
-		return errResponse(err)
-	}
-	// TODO: check DealID, BoatID, UserID, OrgID, etc.
-	if e.UserID == 0 {
-		e.UserID = req.Session.UserID // TODO
+	if eventKind == "Sale" && !staff {
+		// offers go through MakeOffer, CounterOffer, AcceptOffer, and WithdrawOffer
+		return &Response{ErrorCode: "UseMakeOffer"}
 	}
-	e.Deal = nil
-	e.Boat = nil
-	e.User = nil
-	e.Org = nil
-	if e.Rental != nil {
-		rental := e.Rental
-		rental.CaptainUser = nil
+	if eventKind == "Transport" && !staff {
+		// transport jobs go through PostTransport, BidTransport, AcceptTransportBid, and UpdateTransport
+		return &Response{ErrorCode: "UsePostTransport"}
 	}
-	// finalize and save
-	setAudit(staff, e, oldEvent)
-	key, err := putEvent(e)
+	oldEvent := &Event{}
+	var boat *Boat
+	key, err := updateXTx("Event", e.ID, req.IfMatch, oldEvent, e, func(tx datastorer) (interface{}, error) {
+		if lacksOrgAccess(req, "SetEvent", oldEvent) {
+			return nil, errors.New("AccessDenied")
+		}
+		// TODO: check DealID, BoatID, UserID, OrgID, etc.
+		if e.UserID == 0 {
+			e.UserID = req.Session.UserID // TODO
+		}
+		e.Deal = nil
+		e.Boat = nil
+		e.User = nil
+		e.Org = nil
+		for _, listing := range []string{"Rental", "Cruise", "Ride"} {
+			rental, _ := getDeepField(listing, e).(*EventRental)
+			if rental == nil {
+				continue
+			}
+			rental.CaptainUser = nil
+			// renters must be approved for the boat's listing before requesting or booking it
+			if rental.Status == "Requested" || rental.Status == "Booked" {
+				if err := checkQualified(e.UserID, e.BoatID, e.DealID, listing); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if e.Payment != nil {
+			if err := convertPayment(e.Payment); err != nil {
+				return nil, err
+			}
+		}
+		// booking, blocking, or moving a rental changes when its boat is available
+		boat = nil
+		if e.BoatID != 0 && bookingsChanged(e, oldEvent) {
+			var err error
+			if boat, err = updateNotAvailable(tx, e.BoatID, nil); err != nil {
+				return nil, err
+			}
+		}
+		// finalize and save
+		setAudit(staff, e, oldEvent)
+		return e, nil
+	})
 	if err != nil {
 		return errResponse(err)
 	}
+	if boat != nil {
+		afterPut(idKey("Boat", boat.ID), boat)
+	}
 	return &Response{
-		ID: key.ID,
+		ID:      key.ID,
+		Version: e.Audit.Version,
 	}
 }
 
@@ -30,4 +30,31 @@ func TestGetEvents(t *testing.T) {
 }
 
 func TestSetEvent(t *testing.T) {
+	session := &Session{UserID: 123, Verified: true}
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"DealID":41,"Payment":{"Currency":"EUR","OriginalCurrency":"XYZ","OriginalAmount":100}}}`, `{"ErrorCode":"BadCurrency","ErrorDetails":{"Currency":"XYZ"}}`, nil)
+	// paying in EUR for a rental quoted in USD records both amounts
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"DealID":41,"Payment":{"Currency":"EUR","Amount":1,"OriginalCurrency":"USD","OriginalAmount":866.7}}}`, `{"ID":51,"Version":1}`, []mockDataStoreCall{
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"UserID":123,"Payment":{"Currency":"EUR","Amount":797.36,"OriginalCurrency":"USD","OriginalAmount":866.7,"ExchangeRate":0.92},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"BoatID":7,"Sale":{"Price":90000}}}`, `{"ErrorCode":"UseMakeOffer"}`, nil)
+	// renters can't book until approved for the boat
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"BoatID":7,"Rental":{"Status":"Requested"}}}`, `{"ErrorCode":"NotApproved","ErrorDetails":{"Failed":"","Status":"Pending"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 456, Rental: &BoatRental{Approvals: []BoatRentalApproval{{Type: "Experience", Years: 2}}}}},
+		{name: "Get", key: idKey("User", 123), dst: User{UserApprovals: []UserApproval{{YearsExperience: 3, Verification: UserVerification{Status: "Pending"}}}}},
+	})
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"DealID":41,"Rental":{"Status":"Booked"}}}`, `{"ErrorCode":"NotApproved","ErrorDetails":{"Failed":"Experience","Status":"NotQualified"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 456, Rental: &BoatRental{Approvals: []BoatRentalApproval{{Type: "Experience", Years: 2}}}}},
+		{name: "Get", key: idKey("User", 123), dst: User{UserApprovals: []UserApproval{{YearsExperience: 1, Verification: UserVerification{Status: "Approved"}}}}},
+	})
+	// a cruise riding along with a rental is still held to the requirements of the boat's Cruise listing
+	testAPI(t, session, nil, "SetEvent", `{"Event":{"BoatID":7,"Rental":{},"Cruise":{"Status":"Requested"}}}`, `{"ErrorCode":"NotApproved","ErrorDetails":{"Failed":"NoFelony","Status":"NotQualified"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 456, Rental: &BoatRental{}, Cruise: &BoatRental{Approvals: []BoatRentalApproval{{Type: "NoFelony"}}}}},
+		{name: "Get", key: idKey("User", 123), dst: User{UserApprovals: []UserApproval{{YearsExperience: 3, Verification: UserVerification{Status: "Approved"}}}}},
+	})
 }
@@ -0,0 +1,469 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UserWishlist is a named list of a user's favorite boats, maybe for saved dates, which can be shared by its ShareCode
+type UserWishlist struct {
+	Name      string         `json:",omitempty" datastore:",omitempty,noindex"`
+	Boats     []UserFavorite `json:",omitempty" datastore:",omitempty,noindex"`
+	StartDate *time.Time     `json:",omitempty" datastore:",omitempty,noindex"`
+	EndDate   *time.Time     `json:",omitempty" datastore:",omitempty,noindex"`
+	Shared    bool           `json:",omitempty" datastore:"-"`
+	ShareCode string         `json:",omitempty" datastore:",omitempty"`
+}
+
+// UserFavorite is a boat in a wishlist, with its lowest daily Price and whether it was Available for the wishlist's dates
+// when it was added or last alerted
+type UserFavorite struct {
+	BoatID    int64   `json:",omitempty" datastore:",omitempty,noindex"`
+	Price     float32 `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency  string  `json:",omitempty" datastore:",omitempty,noindex"`
+	Available bool    `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// defaultWishlist is the wishlist favorites go in if none is named
+const defaultWishlist = "Favorites"
+
+func init() {
+	apiHandlers["AddFavorite"] = AddFavorite
+	apiHandlers["RemoveFavorite"] = RemoveFavorite
+	apiHandlers["SetWishlist"] = SetWishlist
+	apiHandlers["RemoveWishlist"] = RemoveWishlist
+	apiHandlers["GetWishlist"] = GetWishlist
+	apiHandlers["SendFavoriteAlerts"] = SendFavoriteAlerts
+}
+
+// startFavoriteAlerts sends favorite alerts once a day, on one instance
+func startFavoriteAlerts() {
+	startDailyJob(favoriteAlertsJob, "sendFavoriteAlerts", "sent", sendFavoriteAlerts)
+}
+
+// AddFavorite adds BoatID to my Favorites and to Wishlist.Name (or "Favorites"), which is created with Wishlist's dates
+// if it's new
+func AddFavorite(req *Request, pub *Publication) *Response {
+	if req.Session.UserID == 0 {
+		return accessDenied()
+	}
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	return updateFavorites(req, func(user *User) error {
+		wishlist := findWishlist(user, wishlistName(req))
+		if wishlist == nil {
+			user.Wishlists = append(user.Wishlists, UserWishlist{Name: wishlistName(req)})
+			wishlist = &user.Wishlists[len(user.Wishlists)-1]
+			if req.Wishlist != nil {
+				if err := setWishlistDates(wishlist, req.Wishlist); err != nil {
+					return err
+				}
+			}
+		}
+		if findFavorite(wishlist, req.BoatID) == nil {
+			wishlist.Boats = append(wishlist.Boats, UserFavorite{
+				BoatID:    req.BoatID,
+				Price:     lowestDailyPrice(boat),
+				Currency:  boat.Currency,
+				Available: isAvailable(boat, wishlist.StartDate, wishlist.EndDate),
+			})
+		}
+		return nil
+	})
+}
+
+// RemoveFavorite removes BoatID from Wishlist.Name, or from all my wishlists if no Wishlist
+func RemoveFavorite(req *Request, pub *Publication) *Response {
+	if req.Session.UserID == 0 {
+		return accessDenied()
+	}
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	return updateFavorites(req, func(user *User) error {
+		found := false
+		for i := range user.Wishlists {
+			wishlist := &user.Wishlists[i]
+			if req.Wishlist != nil && wishlist.Name != wishlistName(req) {
+				continue
+			}
+			boats := []UserFavorite{}
+			for _, favorite := range wishlist.Boats {
+				if favorite.BoatID == req.BoatID {
+					found = true
+				} else {
+					boats = append(boats, favorite)
+				}
+			}
+			wishlist.Boats = boats
+		}
+		if !found {
+			return errors.New("NotFavorite")
+		}
+		return nil
+	})
+}
+
+// SetWishlist creates or changes my Wishlist.Name with Wishlist's StartDate, EndDate, and Shared; its boats don't change,
+// and sharing it makes a ShareCode for its link
+func SetWishlist(req *Request, pub *Publication) *Response {
+	if req.Session.UserID == 0 {
+		return accessDenied()
+	}
+	if req.Wishlist == nil || strings.TrimSpace(req.Wishlist.Name) == "" {
+		return &Response{ErrorCode: "NeedWishlist"}
+	}
+	var shared UserWishlist
+	resp := updateFavorites(req, func(user *User) error {
+		wishlist := findWishlist(user, wishlistName(req))
+		if wishlist == nil {
+			user.Wishlists = append(user.Wishlists, UserWishlist{Name: wishlistName(req)})
+			wishlist = &user.Wishlists[len(user.Wishlists)-1]
+		}
+		if err := setWishlistDates(wishlist, req.Wishlist); err != nil {
+			return err
+		}
+		if !req.Wishlist.Shared {
+			wishlist.ShareCode = ""
+		} else if wishlist.ShareCode == "" {
+			wishlist.ShareCode = md5Lower("Wishlist:" + Config.Env.JWTKey + ":" + strconv.FormatInt(user.ID, 10) + ":" + wishlist.Name + ":" + now().String())[:16]
+		}
+		// availability is for the new dates, without alerting
+		for i := range wishlist.Boats {
+			boat, err := getBoat(wishlist.Boats[i].BoatID)
+			if err != nil {
+				return err
+			}
+			wishlist.Boats[i].Available = isAvailable(boat, wishlist.StartDate, wishlist.EndDate)
+		}
+		shared = *wishlist
+		return nil
+	})
+	if resp.ErrorCode != "" {
+		return resp
+	}
+	shared.Shared = shared.ShareCode != ""
+	return &Response{Wishlist: &shared}
+}
+
+// RemoveWishlist removes my Wishlist.Name, and its boats from my Favorites unless they're in another wishlist
+func RemoveWishlist(req *Request, pub *Publication) *Response {
+	if req.Session.UserID == 0 {
+		return accessDenied()
+	}
+	if req.Wishlist == nil {
+		return &Response{ErrorCode: "NeedWishlist"}
+	}
+	return updateFavorites(req, func(user *User) error {
+		wishlists := []UserWishlist{}
+		for _, wishlist := range user.Wishlists {
+			if wishlist.Name != wishlistName(req) {
+				wishlists = append(wishlists, wishlist)
+			}
+		}
+		if len(wishlists) == len(user.Wishlists) {
+			return errors.New("NoWishlist")
+		}
+		user.Wishlists = wishlists
+		return nil
+	})
+}
+
+// updateFavorites changes my wishlists with change, after moving any favorites from before wishlists into them, and
+// sets my Favorites from them
+func updateFavorites(req *Request, change func(user *User) error) *Response {
+	user := &User{}
+	key, err := updateX("User", req.Session.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		moveLegacyFavorites(user)
+		if err := change(user); err != nil {
+			return nil, err
+		}
+		setFavorites(user)
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: user.Audit.Version,
+	}
+}
+
+// GetWishlist gets a shared wishlist by its Wishlist.ShareCode, with its boats; anyone with the link can see it
+func GetWishlist(req *Request, pub *Publication) *Response {
+	if req.Wishlist == nil || req.Wishlist.ShareCode == "" {
+		return &Response{ErrorCode: "NeedShareCode"}
+	}
+	var users []*User
+	keys, err := getAllUsers(map[string]interface{}{"Wishlists.ShareCode=": req.Wishlist.ShareCode}, &users)
+	if err != nil {
+		return errResponse(err)
+	}
+	// ShareCodes are unique, so only the user whose wishlist it is can change it
+	for _, key := range keys {
+		dependOnIDs(req, "User", key.ID)
+	}
+	for _, user := range users {
+		for _, wishlist := range user.Wishlists {
+			if wishlist.ShareCode != req.Wishlist.ShareCode {
+				continue
+			}
+			resp := &Response{SubscriptionID: -1, Wishlist: &UserWishlist{Name: wishlist.Name, StartDate: wishlist.StartDate, EndDate: wishlist.EndDate, Shared: true}, Boats: map[int64]*Boat{}}
+			for _, favorite := range wishlist.Boats {
+				resp.Wishlist.Boats = append(resp.Wishlist.Boats, UserFavorite{BoatID: favorite.BoatID})
+				dependOnIDs(req, "Boat", favorite.BoatID)
+				if boat := getPublicBoat(favorite.BoatID); boat != nil {
+					resp.Boats[favorite.BoatID] = boat
+				}
+			}
+			return resp
+		}
+	}
+	return &Response{ErrorCode: "NoWishlist"}
+}
+
+// SendFavoriteAlerts lets staff send favorite alerts now, instead of waiting for the daily run
+func SendFavoriteAlerts(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if _, err := sendFavoriteAlerts(); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+// sendFavoriteAlerts alerts users whose favorite boats dropped in price, or became available for their wishlist's dates
+func sendFavoriteAlerts() (int, error) {
+	var users []*User
+	keys, err := getAllUsers(map[string]interface{}{"Favorites>": int64(0)}, &users)
+	if err != nil {
+		return 0, err
+	}
+	boats := map[int64]*Boat{}
+	count := 0
+	for index, key := range keys {
+		// the user is changed in a transaction, so nothing else they change is lost, if what was gotten needs it; the
+		// alerts are only made once they are
+		users[index].ID = key.ID
+		if !refreshWishlists(users[index], boats) {
+			continue
+		}
+		user := &User{}
+		var alerts []*Event
+		updated, err := updateX("User", key.ID, 0, user, nil, func() (interface{}, error) {
+			moved := moveLegacyFavorites(user)
+			alerts = nil
+			for i := range user.Wishlists {
+				alerts = append(alerts, refreshFavorites(user, &user.Wishlists[i], boats)...)
+			}
+			if len(alerts) == 0 && !moved {
+				return nil, nil
+			}
+			return user, nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if updated == nil {
+			continue
+		}
+		if err := putEvents(alerts); err != nil {
+			return count, err
+		}
+		count += len(alerts)
+	}
+	return count, nil
+}
+
+// refreshWishlists refreshes all of a user's wishlists, finding out if there's anything to alert them about, or legacy
+// favorites to move
+func refreshWishlists(user *User, boats map[int64]*Boat) bool {
+	moved := moveLegacyFavorites(user)
+	alerted := false
+	for i := range user.Wishlists {
+		alerted = len(refreshFavorites(user, &user.Wishlists[i], boats)) > 0 || alerted
+	}
+	return alerted || moved
+}
+
+// refreshFavorites makes alerts for user about the boats in wishlist whose price dropped, or that became available for
+// its dates, and updates their Price and Available; boats caches the boats already gotten
+func refreshFavorites(user *User, wishlist *UserWishlist, boats map[int64]*Boat) []*Event {
+	alerts := []*Event{}
+	for i := range wishlist.Boats {
+		favorite := &wishlist.Boats[i]
+		boat := boats[favorite.BoatID]
+		if boat == nil {
+			var err error
+			if boat, err = getBoat(favorite.BoatID); err != nil {
+				// one boat that can't be gotten doesn't keep anyone else from being alerted
+				log.Printf("refreshFavorites(%d) getBoat(%d) => %s", user.ID, favorite.BoatID, err.Error())
+				continue
+			}
+			boats[favorite.BoatID] = boat
+		}
+		title := "A boat"
+		if boat.Rental != nil && boat.Rental.ListingTitle != "" {
+			title = boat.Rental.ListingTitle
+		}
+		var texts []string
+		price := lowestDailyPrice(boat)
+		if price > 0 && favorite.Price > 0 && price < favorite.Price && boat.Currency == favorite.Currency {
+			texts = append(texts, title+" in your "+wishlist.Name+" dropped from "+formatPrice(favorite.Price)+" to "+formatPrice(price)+" "+boat.Currency+" a day.")
+		}
+		available := isAvailable(boat, wishlist.StartDate, wishlist.EndDate)
+		if available && !favorite.Available && wishlist.StartDate != nil {
+			texts = append(texts, title+" in your "+wishlist.Name+" is now available "+wishlist.StartDate.Format("January 2")+" to "+wishlist.EndDate.Format("January 2, 2006")+".")
+		}
+		favorite.Price = price
+		favorite.Currency = boat.Currency
+		favorite.Available = available
+		if texts == nil {
+			continue
+		}
+		alerts = append(alerts, &Event{
+			BoatID:       favorite.BoatID,
+			UserID:       user.ID,
+			UnreadByIDs:  []int64{user.ID},
+			Notification: &EventNotification{Text: strings.Join(texts, " ")},
+			Audit:        &Audit{Created: now()},
+		})
+	}
+	return alerts
+}
+
+// wishlistName is the trimmed Wishlist.Name of a request, or "Favorites"
+func wishlistName(req *Request) string {
+	if req.Wishlist == nil || strings.TrimSpace(req.Wishlist.Name) == "" {
+		return defaultWishlist
+	}
+	return strings.TrimSpace(req.Wishlist.Name)
+}
+
+// findWishlist finds a user's wishlist by name
+func findWishlist(user *User, name string) *UserWishlist {
+	for i := range user.Wishlists {
+		if user.Wishlists[i].Name == name {
+			return &user.Wishlists[i]
+		}
+	}
+	return nil
+}
+
+// findFavorite finds a boat in a wishlist
+func findFavorite(wishlist *UserWishlist, boatID int64) *UserFavorite {
+	for i := range wishlist.Boats {
+		if wishlist.Boats[i].BoatID == boatID {
+			return &wishlist.Boats[i]
+		}
+	}
+	return nil
+}
+
+// setWishlistDates sets a wishlist's StartDate and EndDate, which must both be given or both not
+func setWishlistDates(wishlist, dates *UserWishlist) error {
+	if (dates.StartDate == nil) != (dates.EndDate == nil) || dates.StartDate != nil && !dates.EndDate.After(*dates.StartDate) {
+		return Err("BadDates", nil)
+	}
+	wishlist.StartDate = dates.StartDate
+	wishlist.EndDate = dates.EndDate
+	return nil
+}
+
+// moveLegacyFavorites moves a user's Favorites that aren't in any wishlist, from before there were wishlists, into the
+// default wishlist, so setFavorites keeps them; it finds out if any were moved
+func moveLegacyFavorites(user *User) bool {
+	moved := false
+	for _, boatID := range user.Favorites {
+		found := false
+		for i := range user.Wishlists {
+			if findFavorite(&user.Wishlists[i], boatID) != nil {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		wishlist := findWishlist(user, defaultWishlist)
+		if wishlist == nil {
+			user.Wishlists = append(user.Wishlists, UserWishlist{Name: defaultWishlist})
+			wishlist = &user.Wishlists[len(user.Wishlists)-1]
+		}
+		wishlist.Boats = append(wishlist.Boats, UserFavorite{BoatID: boatID})
+		moved = true
+	}
+	return moved
+}
+
+// setFavorites sets a user's Favorites to the boats in all of its wishlists, once moveLegacyFavorites has moved any
+// from before there were wishlists into one
+func setFavorites(user *User) {
+	user.Favorites = nil
+	for _, wishlist := range user.Wishlists {
+		for _, favorite := range wishlist.Boats {
+			if !int64InArray(favorite.BoatID, user.Favorites) {
+				user.Favorites = append(user.Favorites, favorite.BoatID)
+			}
+		}
+	}
+}
+
+// lowestDailyPrice is the lowest DailyPrice in any season of a boat's rental listing, or 0 if it has none
+func lowestDailyPrice(boat *Boat) float32 {
+	var lowest float32
+	if boat.Rental == nil {
+		return 0
+	}
+	for _, season := range boat.Rental.Seasons {
+		for _, pricing := range season.Pricing {
+			if pricing.DailyPrice > 0 && (lowest == 0 || pricing.DailyPrice < lowest) {
+				lowest = pricing.DailyPrice
+			}
+		}
+	}
+	return lowest
+}
+
+// isAvailable finds out if a boat's rental listing is available between start and end, by its NotAvailable ranges;
+// without dates, it's available if it's published
+func isAvailable(boat *Boat, start, end *time.Time) bool {
+	if listingStatus(boat, "Rental") != "Published" {
+		return false
+	}
+	if start == nil || end == nil {
+		return true
+	}
+	notAvailable := boat.Rental.NotAvailable
+	for i := 0; i+1 < len(notAvailable); i += 2 {
+		if notAvailable[i].Before(*end) && notAvailable[i+1].After(*start) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatPrice formats a price without cents if it's whole
+func formatPrice(price float32) string {
+	return strconv.FormatFloat(float64(price), 'f', -1, 32)
+}
+
+// int64InArray finds out if an int64 is in an array
+func int64InArray(i int64, array []int64) bool {
+	for _, a := range array {
+		if a == i {
+			return true
+		}
+	}
+	return false
+}
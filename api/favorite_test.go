@@ -0,0 +1,219 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestAddFavorite(t *testing.T) {
+	session := &Session{UserID: 456}
+	testAPI(t, &Session{}, nil, "AddFavorite", `{"BoatID":9}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	testAPI(t, session, nil, "AddFavorite", `{}`, `{"ErrorCode":"NeedBoatID"}`, nil)
+	testAPI(t, session, nil, "AddFavorite", `{"BoatID":9,"Wishlist":{"Name":"July trip","StartDate":"2020-07-10T00:00:00Z"}}`, `{"ErrorCode":"BadDates"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 9), dst: newFavoriteBoat(350)},
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+	})
+	// a new wishlist with dates the boat is booked for
+	testAPI(t, session, nil, "AddFavorite", `{"BoatID":9,"Wishlist":{"Name":"July trip","StartDate":"2020-06-01T00:00:00Z","EndDate":"2020-06-03T00:00:00Z"}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 9), dst: newFavoriteBoat(350, 2)},
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7,8,9],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true}]},{"Name":"June trip","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","ShareCode":"0123456789abcdef"},{"Name":"July trip","Boats":[{"BoatID":9,"Price":350,"Currency":"USD"}],"StartDate":"2020-06-01T00:00:00Z","EndDate":"2020-06-03T00:00:00Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// no wishlist means "Favorites", and adding a boat twice doesn't duplicate it
+	testAPI(t, session, nil, "AddFavorite", `{"BoatID":7}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newFavoriteBoat(400)},
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7,8],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true}]},{"Name":"June trip","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","ShareCode":"0123456789abcdef"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestRemoveFavorite(t *testing.T) {
+	session := &Session{UserID: 456}
+	testAPI(t, session, nil, "RemoveFavorite", `{"BoatID":9}`, `{"ErrorCode":"NotFavorite"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+	})
+	// boat 7 stays a favorite since it's still in "June trip"
+	testAPI(t, session, nil, "RemoveFavorite", `{"BoatID":7,"Wishlist":{"Name":"Favorites"}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7,8],"Wishlists":[{"Name":"Favorites"},{"Name":"June trip","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","ShareCode":"0123456789abcdef"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// favorites from before there were wishlists are moved into "Favorites" first, so they aren't lost
+	testAPI(t, session, nil, "RemoveFavorite", `{"BoatID":7}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann", Favorites: []int64{5, 7}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[5],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":5}]}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	testAPI(t, session, nil, "RemoveFavorite", `{"BoatID":7}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[8],"Wishlists":[{"Name":"Favorites"},{"Name":"June trip","Boats":[{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","ShareCode":"0123456789abcdef"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestSetWishlist(t *testing.T) {
+	session := &Session{UserID: 456}
+	testAPI(t, session, nil, "SetWishlist", `{"Wishlist":{}}`, `{"ErrorCode":"NeedWishlist"}`, nil)
+	// sharing "Favorites" with dates makes a ShareCode, and boat 7 isn't available then
+	testAPI(t, session, nil, "SetWishlist", `{"Wishlist":{"Name":"Favorites","StartDate":"2020-06-01T00:00:00Z","EndDate":"2020-06-03T00:00:00Z","Shared":true}}`, `{"Wishlist":{"Name":"Favorites","Boats":[{"BoatID":7,"Price":400,"Currency":"USD"}],"StartDate":"2020-06-01T00:00:00Z","EndDate":"2020-06-03T00:00:00Z","Shared":true,"ShareCode":/"[0-9a-f]{16}"/}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{name: "Get", key: idKey("Boat", 7), dst: newFavoriteBoat(400, 2)},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7,8],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":7,"Price":400,"Currency":"USD"}],"StartDate":"2020-06-01T00:00:00Z","EndDate":"2020-06-03T00:00:00Z","ShareCode":"10b3b01b5c322e1f"},{"Name":"June trip","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","ShareCode":"0123456789abcdef"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// unsharing "June trip"
+	testAPI(t, session, nil, "SetWishlist", `{"Wishlist":{"Name":"June trip","StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z"}}`, `{"Wishlist":{"Name":"June trip","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{name: "Get", key: idKey("Boat", 7), dst: newFavoriteBoat(400)},
+		{name: "Get", key: idKey("Boat", 8), dst: newFavoriteBoat(300, 11)},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7,8],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true}]},{"Name":"June trip","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD"}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestRemoveWishlist(t *testing.T) {
+	session := &Session{UserID: 456}
+	testAPI(t, session, nil, "RemoveWishlist", `{"Wishlist":{"Name":"July trip"}}`, `{"ErrorCode":"NoWishlist"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+	})
+	testAPI(t, session, nil, "RemoveWishlist", `{"Wishlist":{"Name":"June trip"}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":7,"Price":400,"Currency":"USD","Available":true}]}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestGetWishlist(t *testing.T) {
+	byShareCode := func(code string) mockDataStoreCall {
+		call := mockDataStoreCall{
+			name: "GetAll",
+			q:    newQuery("User", map[string]interface{}{"Wishlists.ShareCode=": code}),
+			dst:  []*User{},
+		}
+		if code == "0123456789abcdef" {
+			user := newWishlistUser()
+			call.dst = []*User{&user}
+			call.keysResult = []*datastore.Key{idKey("User", 456)}
+		}
+		return call
+	}
+	testAPI(t, nil, nil, "GetWishlist", `{}`, `{"ErrorCode":"NeedShareCode"}`, nil)
+	testAPI(t, nil, nil, "GetWishlist", `{"Wishlist":{"ShareCode":"fedcba9876543210"}}`, `{"ErrorCode":"NoWishlist"}`, []mockDataStoreCall{byShareCode("fedcba9876543210")})
+	testAPI(t, nil, nil, "GetWishlist", `{"Wishlist":{"ShareCode":"0123456789abcdef"}}`, `{"SubscriptionID":-1,"Boats":{"7":{"Trailer":{},"Rental":{"ListingTitle":"Sea Breeze"},"Audit":{}},"8":{"Trailer":{},"Rental":{"ListingTitle":"Sea Breeze"},"Audit":{}}},"Wishlist":{"Name":"June trip","Boats":[{"BoatID":7},{"BoatID":8}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","Shared":true}}`, []mockDataStoreCall{
+		byShareCode("0123456789abcdef"),
+		{name: "Get", key: idKey("Boat", 7), dst: func() Boat { b := newFavoriteBoat(400); b.Audit = &Audit{}; return b }()},
+		{name: "Get", key: idKey("Boat", 8), dst: func() Boat { b := newFavoriteBoat(300); b.Audit = &Audit{}; return b }()},
+	})
+	// a deleted boat is left out of the shared view
+	deleted := newFavoriteBoat(300)
+	deleted.Audit = &Audit{Deleted: DateTime(2020, 5, 1, 0, 0, 0)}
+	testAPI(t, nil, nil, "GetWishlist", `{"Wishlist":{"ShareCode":"0123456789abcdef"}}`, `{"SubscriptionID":-1,"Boats":{"7":{"Trailer":{},"Rental":{"ListingTitle":"Sea Breeze"},"Audit":{}}},"Wishlist":{"Name":"June trip","Boats":[{"BoatID":7},{"BoatID":8}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","Shared":true}}`, []mockDataStoreCall{
+		byShareCode("0123456789abcdef"),
+		{name: "Get", key: idKey("Boat", 7), dst: func() Boat { b := newFavoriteBoat(400); b.Audit = &Audit{}; return b }()},
+		{name: "Get", key: idKey("Boat", 8), dst: deleted},
+	})
+}
+
+func TestSendFavoriteAlerts(t *testing.T) {
+	testAPI(t, &Session{UserID: 123}, nil, "SendFavoriteAlerts", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	// boat 7 dropped from 400 to 350, and boat 8 is now available June 10-12; boat 7 is only gotten once; Cal's boat 9
+	// is gone, so it's tried again in his transaction, which doesn't keep his favorites from before there were
+	// wishlists from being moved and alerted
+	testAPI(t, staff, nil, "SendFavoriteAlerts", `{}`, `{}`, []mockDataStoreCall{
+		{
+			name: "GetAll",
+			q:    newQuery("User", map[string]interface{}{"Favorites>": int64(0)}),
+			dst: []*User{
+				func() *User { u := newWishlistUser(); return &u }(),
+				{GivenName: "Bob", Favorites: []int64{8}, Wishlists: []UserWishlist{{Name: "Favorites", Boats: []UserFavorite{{BoatID: 8, Price: 300, Currency: "USD", Available: true}}}}},
+				{GivenName: "Cal", Favorites: []int64{9, 8}},
+			},
+			keysResult: []*datastore.Key{idKey("User", 456), idKey("User", 457), idKey("User", 458)},
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: newFavoriteBoat(350)},
+		{name: "Get", key: idKey("Boat", 8), dst: newFavoriteBoat(300)},
+		{name: "Get", key: idKey("User", 456), dst: newWishlistUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Favorites":[7,8],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":7,"Price":350,"Currency":"USD","Available":true}]},{"Name":"June trip","Boats":[{"BoatID":7,"Price":350,"Currency":"USD","Available":true},{"BoatID":8,"Price":300,"Currency":"USD","Available":true}],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","ShareCode":"0123456789abcdef"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			src:       []*Event{},
+			srcJSON:   `{"BoatID":7,"UserID":456,"UnreadByIDs":[456],"Notification":{"Text":"Sea Breeze in your Favorites dropped from 400 to 350 USD a day."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			src:       []*Event{},
+			srcJSON:   `{"BoatID":7,"UserID":456,"UnreadByIDs":[456],"Notification":{"Text":"Sea Breeze in your June trip dropped from 400 to 350 USD a day."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			src:       []*Event{},
+			srcJSON:   `{"BoatID":8,"UserID":456,"UnreadByIDs":[456],"Notification":{"Text":"Sea Breeze in your June trip is now available June 10 to June 12, 2020."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 53),
+		},
+		{name: "Get", key: idKey("Boat", 9), err: datastore.ErrNoSuchEntity},
+		{name: "Get", key: idKey("User", 458), dst: User{GivenName: "Cal", Favorites: []int64{9, 8}}},
+		{name: "Get", key: idKey("Boat", 9), err: datastore.ErrNoSuchEntity},
+		{
+			name:      "Put",
+			key:       idKey("User", 458),
+			src:       []*User{},
+			srcJSON:   `{"ID":458,"GivenName":"Cal","Favorites":[9,8],"Wishlists":[{"Name":"Favorites","Boats":[{"BoatID":9},{"BoatID":8,"Price":300,"Currency":"USD","Available":true}]}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 458),
+		},
+	})
+}
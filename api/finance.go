@@ -0,0 +1,318 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// EventFinancePayment is one month of a loan's amortization schedule
+type EventFinancePayment struct {
+	Month     int     `json:",omitempty"`
+	Payment   float32 `json:",omitempty"`
+	Principal float32 `json:",omitempty"`
+	Interest  float32 `json:",omitempty"`
+	Balance   float32 `json:",omitempty"`
+}
+
+// financerDecisions has the Decision changes a financer may make; applicants may only withdraw
+var financerDecisions = map[string][]string{
+	"Submitted": {"Reviewing", "Approved", "Declined"},
+	"Reviewing": {"Approved", "Declined"},
+	"Approved":  {"Declined", "Funded"},
+}
+
+func init() {
+	addEnumsFor(EventFinance{})
+	apiHandlers["GetFinanceQuote"] = GetFinanceQuote
+	apiHandlers["ApplyFinance"] = ApplyFinance
+	apiHandlers["SetFinanceDecision"] = SetFinanceDecision
+}
+
+// GetFinanceQuote computes AmountFinanced, Monthly, and the amortization Schedule of Finance
+func GetFinanceQuote(req *Request, pub *Publication) *Response {
+	if req.Finance == nil {
+		return &Response{ErrorCode: "NeedFinance"}
+	}
+	finance := *req.Finance
+	if err := amortize(&finance, true); err != nil {
+		return errResponse(err)
+	}
+	return &Response{Finance: &finance}
+}
+
+// ApplyFinance sends my application to finance BoatID (or the boats in Finance.BoatsFinanced) to Financer OrgID, or to all
+// Financer orgs, as a Deal for each; I'm the first applicant, and any co-applicants are in Finance.Applicants
+func ApplyFinance(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.Finance == nil {
+		return &Response{ErrorCode: "NeedFinance"}
+	}
+	if err := validate(req.Finance); err != nil {
+		return errResponse(err)
+	}
+	finance := *req.Finance
+	if err := amortize(&finance, false); err != nil {
+		return errResponse(err)
+	}
+	// check that all applicants' jobs and residences are complete
+	user, err := getUser(req.Session.UserID)
+	if err != nil {
+		return errResponse(err)
+	}
+	finance.Applicants = append([]User{financeApplicant(user)}, finance.Applicants...)
+	for i := range finance.Applicants {
+		if err := checkApplicant(&finance.Applicants[i], i); err != nil {
+			return errResponse(err)
+		}
+	}
+	// find financers
+	var orgIDs []int64
+	if req.OrgID != 0 {
+		org, err := getOrg(req.OrgID)
+		if err != nil {
+			return errResponse(err)
+		}
+		if !StringInArray("Financer", org.Types) {
+			return &Response{ErrorCode: "NotFinancer"}
+		}
+		orgIDs = []int64{req.OrgID}
+	} else {
+		var orgs []*Org
+		keys, err := getAllOrgs(map[string]interface{}{"Types=": "Financer"}, &orgs)
+		if err != nil {
+			return errResponse(err)
+		}
+		for _, key := range keys {
+			orgIDs = append(orgIDs, key.ID)
+		}
+	}
+	if len(orgIDs) == 0 {
+		return &Response{ErrorCode: "NoFinancers"}
+	}
+	// a deal for each financer, and an event so each one knows
+	resp := &Response{Deals: map[int64]*Deal{}}
+	for _, orgID := range orgIDs {
+		application := finance
+		application.Decision = "Submitted"
+		deal := &Deal{BoatID: req.BoatID, UserID: req.Session.UserID, OrgID: orgID, Finance: &application, Audit: &Audit{Created: now()}}
+		key, err := putDeal(deal)
+		if err != nil {
+			return errResponse(err)
+		}
+		deal.ID = key.ID
+		if _, err := putEvent(&Event{
+			DealID:     key.ID,
+			BoatID:     req.BoatID,
+			UserID:     req.Session.UserID,
+			OrgID:      orgID,
+			FromUserID: req.Session.UserID,
+			OrgIDs:     []int64{orgID},
+			Finance:    &EventFinance{Decision: "Submitted", AmountFinanced: application.AmountFinanced, Term: application.Term, APR: application.APR, Monthly: application.Monthly},
+			Audit:      &Audit{Created: now()},
+		}); err != nil {
+			return errResponse(err)
+		}
+		resp.Deals[key.ID] = deal
+	}
+	return resp
+}
+
+// SetFinanceDecision is when financer DealID's org changes its Finance.Decision, maybe with a new Term or APR, or when
+// the applicant withdraws; the other side gets the update as an event
+func SetFinanceDecision(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.DealID == 0 {
+		return &Response{ErrorCode: "NeedDealID"}
+	}
+	if req.Finance == nil {
+		return &Response{ErrorCode: "NeedFinance"}
+	}
+	if err := validate(req.Finance); err != nil {
+		return errResponse(err)
+	}
+	deal := &Deal{}
+	var decision string
+	var unreadByIDs []int64
+	_, err := updateX("Deal", req.DealID, req.IfMatch, deal, nil, func() (interface{}, error) {
+		if deal.Finance == nil {
+			return nil, errors.New("NeedFinanceDeal")
+		}
+		applicant := deal.UserID == req.Session.UserID
+		financer := deal.OrgID != 0 && deal.OrgID == req.Session.OrgID && !lacksOrgAccess(req, "SetDeal", deal) || isStaff(req)
+		decision = req.Finance.Decision
+		old := deal.Finance.Decision
+		switch {
+		case !applicant && !financer:
+			return nil, errors.New("AccessDenied")
+		case decision == "Withdrawn" && applicant && old != "Funded" && old != "Declined" && old != "Withdrawn":
+		case financer && StringInArray(decision, financerDecisions[old]):
+		default:
+			return nil, Err("BadDecision", map[string]string{"From": old, "To": decision})
+		}
+		deal.Finance.Decision = decision
+		deal.Finance.Notes = req.Finance.Notes
+		unreadByIDs = []int64{deal.UserID}
+		if applicant {
+			unreadByIDs = nil
+		} else if decision == "Approved" && (req.Finance.Term != 0 || req.Finance.APR != 0) {
+			// financer's terms
+			if req.Finance.Term != 0 {
+				deal.Finance.Term = req.Finance.Term
+			}
+			if req.Finance.APR != 0 {
+				deal.Finance.APR = req.Finance.APR
+			}
+			if err := amortize(deal.Finance, false); err != nil {
+				return nil, err
+			}
+		}
+		auditOf(deal).Updated = now()
+		return deal, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	key, err := putEvent(&Event{
+		DealID:      deal.ID,
+		BoatID:      deal.BoatID,
+		UserID:      deal.UserID,
+		OrgID:       deal.OrgID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: unreadByIDs,
+		OrgIDs:      []int64{deal.OrgID},
+		Finance:     &EventFinance{Decision: decision, AmountFinanced: deal.Finance.AmountFinanced, Term: deal.Finance.Term, APR: deal.Finance.APR, Monthly: deal.Finance.Monthly, Notes: deal.Finance.Notes},
+		Audit:       &Audit{Created: now()},
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// amortize sets AmountFinanced from Price, Tax, CashDown, TradeAllowance, and TradePayoffs, then Monthly from Term and APR,
+// and if withSchedule, the amortization Schedule
+func amortize(finance *EventFinance, withSchedule bool) error {
+	switch {
+	case finance.Price <= 0:
+		return errors.New("NeedPrice")
+	case finance.Tax < 0 || finance.CashDown < 0 || finance.TradeAllowance < 0 || finance.TradePayoffs < 0:
+		return errors.New("BadAmount")
+	case finance.Term <= 0 || finance.Term > 480:
+		return errors.New("BadTerm")
+	case finance.APR < 0 || finance.APR > 50:
+		return errors.New("BadAPR")
+	}
+	principal := float64(finance.Price) + float64(finance.Tax) - float64(finance.CashDown) - float64(finance.TradeAllowance) + float64(finance.TradePayoffs)
+	principal = math.Round(principal*100) / 100
+	if principal <= 0 {
+		return errors.New("NothingToFinance")
+	}
+	rate := float64(finance.APR) / 100 / 12
+	monthly := principal / float64(finance.Term)
+	if rate > 0 {
+		monthly = principal * rate / (1 - math.Pow(1+rate, -float64(finance.Term)))
+	}
+	monthly = math.Round(monthly*100) / 100
+	finance.AmountFinanced = float32(principal)
+	finance.Monthly = float32(monthly)
+	finance.Schedule = nil
+	if !withSchedule {
+		return nil
+	}
+	balance := principal
+	for month := 1; month <= finance.Term; month++ {
+		interest := math.Round(balance*rate*100) / 100
+		payment := monthly
+		if month == finance.Term || payment > balance+interest {
+			// last payment takes up the rounding
+			payment = balance + interest
+		}
+		balance = math.Round((balance+interest-payment)*100) / 100
+		finance.Schedule = append(finance.Schedule, EventFinancePayment{
+			Month:     month,
+			Payment:   roundCents(payment),
+			Principal: roundCents(payment - interest),
+			Interest:  float32(interest),
+			Balance:   float32(balance),
+		})
+	}
+	return nil
+}
+
+// financeApplicant copies what financers need to know about a user
+func financeApplicant(user *User) User {
+	applicant := User{
+		ID:            user.ID,
+		Prefix:        user.Prefix,
+		GivenName:     user.GivenName,
+		FamilyName:    user.FamilyName,
+		Suffix:        user.Suffix,
+		Birthdate:     user.Birthdate,
+		MaritalStatus: user.MaritalStatus,
+		Jobs:          user.Jobs,
+	}
+	for _, contact := range user.Contacts {
+		if contact.Type == "Address" || contact.Type == "Email" || contact.Type == "Phone" {
+			contact.Loc100KM = nil
+			contact.Loc300KM = nil
+			contact.VerifyCode = ""
+			contact.Verifying = nil
+			applicant.Contacts = append(applicant.Contacts, contact)
+		}
+	}
+	return applicant
+}
+
+// checkApplicant makes sure an applicant has a name, a current job or retirement income, and a home address
+// with its Residence filled in
+func checkApplicant(applicant *User, index int) error {
+	incomplete := func(field string) error {
+		return Err("IncompleteApplicant", map[string]string{"Applicant": strconv.Itoa(index), "Field": field})
+	}
+	if applicant.GivenName == "" || applicant.FamilyName == "" {
+		return incomplete("Name")
+	}
+	currentJob := false
+	for i, job := range applicant.Jobs {
+		field := "Jobs." + strconv.Itoa(i)
+		switch {
+		case job.Status == "":
+			return incomplete(field + ".Status")
+		case job.Status != "Retired" && (job.Employer == nil || job.Employer.Name == ""):
+			return incomplete(field + ".Employer")
+		case job.Status != "Retired" && job.Position == "":
+			return incomplete(field + ".Position")
+		case job.Since == nil:
+			return incomplete(field + ".Since")
+		case job.Until == nil && job.Monthly <= 0:
+			return incomplete(field + ".Monthly")
+		}
+		currentJob = currentJob || job.Until == nil
+	}
+	if !currentJob {
+		return incomplete("Jobs")
+	}
+	for i, contact := range applicant.Contacts {
+		if contact.Type != "Address" || contact.SubType != "Home" && contact.SubType != "" {
+			continue
+		}
+		field := "Contacts." + strconv.Itoa(i) + ".Residence"
+		switch residence := contact.Residence; {
+		case contact.Line1 == "" || contact.City == "" || contact.Country == "":
+			return incomplete("Contacts." + strconv.Itoa(i))
+		case residence.Status == "":
+			return incomplete(field + ".Status")
+		case residence.Since == nil:
+			return incomplete(field + ".Since")
+		case residence.Status == "Own" && residence.Value <= 0:
+			return incomplete(field + ".Value")
+		}
+		return nil
+	}
+	return incomplete("Residence")
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestAmortize(t *testing.T) {
+	finance := &EventFinance{Price: 12000, Tax: 840, CashDown: 2000, TradeAllowance: 1500, TradePayoffs: 660, Term: 12, APR: 12}
+	if err := amortize(finance, true); err != nil {
+		t.Fatal(err)
+	}
+	if finance.AmountFinanced != 10000 || finance.Monthly != 888.49 || len(finance.Schedule) != 12 {
+		t.Fatalf("Wrong amortize result %+v", finance)
+	}
+	first, last := finance.Schedule[0], finance.Schedule[11]
+	if first.Interest != 100 || first.Principal != 788.49 || first.Balance != 9211.51 {
+		t.Errorf("Wrong first payment %+v", first)
+	}
+	if last.Balance != 0 || last.Payment < 888 || last.Payment > 889 {
+		t.Errorf("Wrong last payment %+v", last)
+	}
+	var sum float64
+	for _, payment := range finance.Schedule {
+		sum += float64(payment.Principal)
+	}
+	if sum < 9999.99 || sum > 10000.01 {
+		t.Errorf("Wrong principal sum %f", sum)
+	}
+	// no interest
+	finance = &EventFinance{Price: 1000, Term: 4}
+	if err := amortize(finance, true); err != nil || finance.Monthly != 250 || finance.Schedule[3].Payment != 250 || finance.Schedule[3].Balance != 0 {
+		t.Errorf("Wrong amortize result %+v %v", finance, err)
+	}
+	for _, bad := range []struct {
+		finance EventFinance
+		expect  string
+	}{
+		{EventFinance{Term: 12}, "NeedPrice"},
+		{EventFinance{Price: 1000}, "BadTerm"},
+		{EventFinance{Price: 1000, Term: 12, APR: 60}, "BadAPR"},
+		{EventFinance{Price: 1000, Term: 12, CashDown: 1000}, "NothingToFinance"},
+	} {
+		if err := amortize(&bad.finance, false); err == nil || err.Error() != bad.expect {
+			t.Errorf("Wrong amortize error %v, expect %s", err, bad.expect)
+		}
+	}
+}
+
+func TestCheckApplicant(t *testing.T) {
+	test := func(applicant User, expect string) {
+		actual := ""
+		if err := checkApplicant(&applicant, 0); err != nil {
+			actual = err.Error()
+		}
+		if actual != expect {
+			t.Errorf("Wrong checkApplicant result %s, expect %s", actual, expect)
+		}
+	}
+	test(newApplicant(), "")
+	applicant := newApplicant()
+	applicant.Jobs = applicant.Jobs[:1]
+	test(applicant, `IncompleteApplicant{"Applicant":"0","Field":"Jobs"}`)
+	applicant = newApplicant()
+	applicant.Jobs[1].Monthly = 0
+	test(applicant, `IncompleteApplicant{"Applicant":"0","Field":"Jobs.1.Monthly"}`)
+	applicant = newApplicant()
+	applicant.Jobs[1] = UserJob{Status: "Retired", Monthly: 3000, Since: DateTime(2019, 1, 1, 0, 0, 0)}
+	test(applicant, "")
+	applicant = newApplicant()
+	applicant.Contacts[1].Residence.Value = 0
+	test(applicant, `IncompleteApplicant{"Applicant":"0","Field":"Contacts.1.Residence.Value"}`)
+	applicant = newApplicant()
+	applicant.Contacts = applicant.Contacts[:1]
+	test(applicant, `IncompleteApplicant{"Applicant":"0","Field":"Residence"}`)
+}
+
+func TestGetFinanceQuote(t *testing.T) {
+	testAPI(t, &Session{}, nil, "GetFinanceQuote", `{"Finance":{"Price":1000,"Term":2,"APR":12}}`, `{"Finance":{"Price":1000,"AmountFinanced":1000,"Term":2,"APR":12,"Monthly":507.51,"Schedule":[{"Month":1,"Payment":507.51,"Principal":497.51,"Interest":10,"Balance":502.49},{"Month":2,"Payment":507.51,"Principal":502.49,"Interest":5.02}]}}`, nil)
+}
+
+func TestApplyFinance(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	testAPI(t, session, nil, "ApplyFinance", `{"Finance":{"Price":50000,"Term":120,"APR":6}}`, `{"ErrorCode":"IncompleteApplicant","ErrorDetails":{"Applicant":"0","Field":"Jobs"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Pat", FamilyName: "Doe"}},
+	})
+	testAPI(t, session, nil, "ApplyFinance", `{"OrgID":8,"Finance":{"Price":50000,"Term":120,"APR":6}}`, `{"ErrorCode":"NotFinancer"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newApplicant()},
+		{name: "Get", key: idKey("Org", 8), dst: Org{Types: []string{"Insurer"}}},
+	})
+	testAPI(t, session, nil, "ApplyFinance", `{"BoatID":7,"OrgID":8,"Finance":{"Status":"Used","Price":50000,"Tax":3500,"CashDown":10000,"Term":120,"APR":6}}`, `{"Deals":{"41":{"ID":41,"BoatID":7,"UserID":456,"OrgID":8,"Finance":{"Status":"Used","Applicants":[/.*/],"Price":50000,"Tax":3500,"CashDown":10000,"AmountFinanced":43500,"Term":120,"APR":6,"Monthly":482.94,"Decision":"Submitted"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newApplicant()},
+		{name: "Get", key: idKey("Org", 8), dst: Org{Types: []string{"Financer"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":456,"OrgID":8,"Finance":{"Status":"Used","Applicants":[{"ID":456,"GivenName":"Pat","FamilyName":"Doe","Jobs":[{"Status":"Employed","Employer":{"Name":"Old Co"},"Position":"Clerk","Since":"2010-01-01T00:00:00Z","Until":"2015-01-01T00:00:00Z"},{"Status":"Employed","Employer":{"Name":"Acme"},"Position":"Engineer","Monthly":8000,"Since":"2015-02-01T00:00:00Z"}],"Contacts":[{"Type":"Email","Residence":{},"Email":"pat@example.com"},{"Type":"Address","SubType":"Home","Line1":"1 Main St","City":"Stuart","State":"FL","Country":"US","Residence":{"Status":"Own","Since":"2012-01-01T00:00:00Z","Value":300000}}]}],"Price":50000,"Tax":3500,"CashDown":10000,"AmountFinanced":43500,"Term":120,"APR":6,"Monthly":482.94,"Decision":"Submitted"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":456,"OrgID":8,"FromUserID":456,"OrgIDs":[8],"Finance":{"AmountFinanced":43500,"Term":120,"APR":6,"Monthly":482.94,"Decision":"Submitted"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
+
+func TestSetFinanceDecision(t *testing.T) {
+	newFinanceDeal := func(decision string) Deal {
+		return Deal{BoatID: 7, UserID: 456, OrgID: 8, Finance: &EventFinance{Price: 50000, Tax: 3500, CashDown: 10000, AmountFinanced: 43500, Term: 120, APR: 6, Monthly: 482.94, Decision: decision}}
+	}
+	financer := &Session{UserID: 800, OrgID: 8, OrgAccess: []string{"SetDeal"}, Verified: true}
+	testAPI(t, &Session{UserID: 789, Verified: true}, nil, "SetFinanceDecision", `{"DealID":41,"Finance":{"Decision":"Approved"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newFinanceDeal("Submitted")},
+	})
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "SetFinanceDecision", `{"DealID":41,"Finance":{"Decision":"Approved"}}`, `{"ErrorCode":"BadDecision","ErrorDetails":{"From":"Submitted","To":"Approved"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newFinanceDeal("Submitted")},
+	})
+	// financer's members need SetDeal OrgAccess
+	testAPI(t, &Session{UserID: 801, OrgID: 8, Verified: true}, nil, "SetFinanceDecision", `{"DealID":41,"Finance":{"Decision":"Approved"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newFinanceDeal("Submitted")},
+	})
+	testAPI(t, financer, nil, "SetFinanceDecision", `{"DealID":41,"Finance":{"Decision":"Funded"}}`, `{"ErrorCode":"BadDecision","ErrorDetails":{"From":"Submitted","To":"Funded"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newFinanceDeal("Submitted")},
+	})
+	// the financer approves at a higher rate, which changes the monthly payment
+	testAPI(t, financer, nil, "SetFinanceDecision", `{"DealID":41,"Finance":{"Decision":"Approved","APR":7.5,"Notes":"Rate for used boats"}}`, `{"ID":52}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newFinanceDeal("Submitted")},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"OrgID":8,"Finance":{"Price":50000,"Tax":3500,"CashDown":10000,"AmountFinanced":43500,"Term":120,"APR":7.5,"Monthly":516.35,"Decision":"Approved","Notes":"Rate for used boats"},"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":456,"OrgID":8,"FromUserID":800,"UnreadByIDs":[456],"OrgIDs":[8],"Finance":{"AmountFinanced":43500,"Term":120,"APR":7.5,"Monthly":516.35,"Decision":"Approved","Notes":"Rate for used boats"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+	})
+}
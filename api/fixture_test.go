@@ -0,0 +1,208 @@
+package api
+
+import (
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+// These make the records that the tests share; each call makes a new one, since handlers change what they're given
+
+func newApprovalBoat() Boat {
+	return Boat{UserID: 123, Length: 32, Rental: &BoatRental{Approvals: []BoatRentalApproval{
+		{Type: "NoViolation", Violation: "DUI", Years: 5},
+		{Type: "Experience", Years: 2},
+		{Type: "SafetyClass", Years: 5, MinLength: 30},
+	}}}
+}
+
+func newCalendarBoat() Boat {
+	return Boat{
+		UserID: 123,
+		Rental: &BoatRental{ListingStatus: "Published"},
+		Calendar: &BoatCalendar{
+			Blocks: []BoatBlock{
+				{Start: DateTime(2020, 5, 1, 0, 0, 0), End: DateTime(2020, 5, 2, 0, 0, 0), Source: "Owner", Summary: "Past"},
+				{Start: DateTime(2020, 5, 11, 0, 0, 0), End: DateTime(2020, 5, 12, 0, 0, 0), Source: "Owner", Summary: "Haul out"},
+				{Start: DateTime(2020, 5, 9, 0, 0, 0), End: DateTime(2020, 5, 10, 0, 0, 0), Source: "Import", Feed: "https://old.example.com/cal.ics", UID: "x@old"},
+			},
+			ImportURLs: []string{"https://old.example.com/cal.ics"},
+		},
+	}
+}
+
+func newCrewBoat() Boat {
+	return Boat{UserID: 123, Location: &Contact{City: "Miami", Location: LatLng(25.7617, -80.1918)}}
+}
+
+func newFavoriteBoat(dailyPrice float32, notAvailable ...int) Boat {
+	boat := Boat{UserID: 123, Currency: "USD", Rental: &BoatRental{ListingTitle: "Sea Breeze", ListingStatus: "Published", Seasons: []BoatRentalSeason{
+		{Pricing: []BoatRentalPricing{{Captain: "NoCaptain", DailyPrice: dailyPrice + 100}, {Captain: "CaptainIncluded", DailyPrice: dailyPrice}}},
+	}}}
+	for _, day := range notAvailable {
+		boat.Rental.NotAvailable = append(boat.Rental.NotAvailable, *DateTime(2020, 6, day, 0, 0, 0), *DateTime(2020, 6, day+1, 0, 0, 0))
+	}
+	return boat
+}
+
+func newImpellerDueBoat() Boat {
+	boat := newServiceBoat()
+	boat.Maintenance[1].DueDate = DateTime(2020, 5, 15, 0, 0, 0)
+	boat.Maintenance[1].Reminded = nil
+	return boat
+}
+
+func newSaleBoat() Boat {
+	return Boat{UserID: 123, Currency: "USD", Sale: &BoatSale{
+		ListingStatus: "Published",
+		Price:         100000,
+		Fractions:     []BoatSaleFraction{{Fraction: 0.25, Price: 30000}, {Fraction: 0.25, Price: 30000}, {Fraction: 0.5, Price: 55000}},
+	}}
+}
+
+func newSearchBoat(dailyPrice float32) Boat {
+	boat := newFavoriteBoat(dailyPrice)
+	boat.Location = &Contact{City: "Miami", Location: &appengine.GeoPoint{Lat: 25.7617, Lng: -80.1918}}
+	return boat
+}
+
+func newServiceBoat() Boat {
+	return Boat{UserID: 123, Currency: "USD", EngineHours: 180, Maintenance: []BoatMaintenance{
+		{Task: "Oil Change", EveryHours: 100, EveryMonths: 12, LastHours: 100, LastDate: DateTime(2019, 8, 1, 0, 0, 0), DueHours: 200, DueDate: DateTime(2020, 8, 1, 0, 0, 0)},
+		{Task: "Impeller", EveryMonths: 24, LastHours: 50, LastDate: DateTime(2018, 6, 1, 0, 0, 0), DueDate: DateTime(2020, 6, 1, 0, 0, 0), Reminded: DateTime(2020, 5, 20, 0, 0, 0)},
+	}}
+}
+
+func newTransportBoat() Boat {
+	return Boat{UserID: 123, Currency: "USD", Location: &Contact{Type: "Address", City: "Miami", State: "FL", Country: "US", Location: &appengine.GeoPoint{Lat: 25.7467903, Lng: -80.2113866}, Loc100KM: []int{11328}}}
+}
+
+func newCrewDeal() Deal {
+	return Deal{
+		BoatID: 7,
+		UserID: 456,
+		Rental: &EventRental{
+			Start:        DateTime(2020, 5, 9, 13, 0, 0),
+			End:          DateTime(2020, 5, 9, 17, 0, 0),
+			CancelPolicy: "Flexible",
+			Currency:     "USD",
+			Captain:      "CaptainExtra",
+			Price:        600,
+			CaptainFee:   200,
+			Status:       "Booked",
+		},
+	}
+}
+
+func newInsureDeal(status string) Deal {
+	return Deal{BoatID: 7, UserID: 123, OrgID: 9, Insure: &EventInsure{Status: status, Use: "Pleasureuseexclusively", IssueDate: DateTime(2020, 6, 1, 0, 0, 0)}}
+}
+
+func newQuotedInsureDeal() Deal {
+	deal := newInsureDeal("Quoted")
+	deal.Insure.Type = "Personal"
+	deal.Insure.ExpirDate = DateTime(2021, 6, 1, 0, 0, 0)
+	deal.Insure.Premium = 800
+	deal.Insure.InsuredValue = 40000
+	return deal
+}
+
+func newWorkOrder(status string) Deal {
+	return Deal{BoatID: 7, UserID: 123, OrgID: 9, Service: &EventService{Status: status, Title: "Oil change", Currency: "USD"}, Audit: &Audit{Created: DateTime(2020, 5, 1, 0, 0, 0)}}
+}
+
+func newOffer(buyerID, fromUserID int64, fraction, price float32) Event {
+	return Event{BoatID: 7, UserID: buyerID, FromUserID: fromUserID, Sale: &EventSale{Status: "Open", Fraction: fraction, Price: price, Currency: "USD", SellerUserID: 123}}
+}
+
+func newTransportBid(status string, orgID int64) Event {
+	return Event{BoatID: 7, UserID: 123, OrgID: orgID, FromUserID: 900, OrgIDs: []int64{orgID}, Transport: &EventTransport{
+		Status:        status,
+		JobEventID:    61,
+		Types:         []string{"OpenTransport"},
+		PickUp:        &Contact{Type: "Address", City: "Miami", State: "FL", Country: "US"},
+		DeliverBefore: DateTime(2020, 6, 1, 0, 0, 0),
+		Destination:   &Contact{Type: "Address", City: "Tampa", State: "FL", Country: "US"},
+		Currency:      "USD",
+		Price:         1200,
+	}}
+}
+
+func newTransportJob(status string) Event {
+	return Event{BoatID: 7, UserID: 123, FromUserID: 123, Transport: &EventTransport{
+		Status:        status,
+		Types:         []string{"OpenTransport"},
+		PickUp:        &Contact{Type: "Address", City: "Miami", State: "FL", Country: "US"},
+		Loc100KM:      []int{11328, 11329, 11728, 11729},
+		DeliverBefore: DateTime(2020, 6, 1, 0, 0, 0),
+		Destination:   &Contact{Type: "Address", City: "Tampa", State: "FL", Country: "US"},
+		Currency:      "USD",
+	}}
+}
+
+func newMemberOrg() Org {
+	return Org{Types: []string{"Dealer"}, Name: "Acme", Invites: []OrgInvite{
+		{Email: "old@example.org", OrgAccess: []string{"SetBoat"}, InvitedByID: 123, Invited: DateTime(2020, 5, 1, 0, 0, 0)},
+	}}
+}
+
+func newApplicant() User {
+	return User{
+		GivenName:  "Pat",
+		FamilyName: "Doe",
+		Jobs: []UserJob{
+			{Status: "Employed", Employer: &Org{Name: "Old Co"}, Position: "Clerk", Since: DateTime(2010, 1, 1, 0, 0, 0), Until: DateTime(2015, 1, 1, 0, 0, 0)},
+			{Status: "Employed", Employer: &Org{Name: "Acme"}, Position: "Engineer", Monthly: 8000, Since: DateTime(2015, 2, 1, 0, 0, 0)},
+		},
+		Contacts: []Contact{
+			{Type: "Email", Email: "pat@example.com"},
+			{Type: "Address", SubType: "Home", Line1: "1 Main St", City: "Stuart", State: "FL", Country: "US", Residence: Residence{Status: "Own", Since: DateTime(2012, 1, 1, 0, 0, 0), Value: 300000}},
+		},
+	}
+}
+
+func newApprovedRenter(status string) User {
+	return User{UserApprovals: []UserApproval{{
+		IDType:           "DriverLicense",
+		IDNumber:         "S123",
+		MovingViolations: []Violation{{Type: "DUI", Date: DateTime(2012, 1, 1, 0, 0, 0)}, {Type: "SpeedingUnder20", Date: DateTime(2019, 1, 1, 0, 0, 0)}},
+		YearsExperience:  3,
+		LastSafetyClass:  DateTime(2018, 6, 1, 0, 0, 0),
+		Verification:     UserVerification{Status: status},
+	}}}
+}
+
+func newCaptain(lat, lng float64, notAvailable ...time.Time) User {
+	return User{
+		GivenName: "Bligh",
+		Crew: &UserCrew{
+			Published:    true,
+			Roles:        []string{"Captain"},
+			Location:     LatLng(lat, lng),
+			KMRadius:     50,
+			Currency:     "USD",
+			HalfDayRate:  250,
+			DayRate:      400,
+			TimeZone:     "America/New_York",
+			Weekly:       []UserCrewHours{{Weekdays: []string{"Saturday", "Sunday"}, StartHour: 8, EndHour: 18}},
+			NotAvailable: notAvailable,
+		},
+	}
+}
+
+func newSearchUser() User {
+	return User{GivenName: "Ann", Notifications: []string{"News"}, Searches: []UserSearch{
+		{Name: "Miami", Location: &appengine.GeoPoint{Lat: 25.7467903, Lng: -80.2113866}, KMRadius: 50, Loc100KM: []int{11328, 11329, 11728, 11729}, Currency: "USD", Notified: []int64{6}},
+		{Name: "Miami cheap", Location: &appengine.GeoPoint{Lat: 25.7467903, Lng: -80.2113866}, KMRadius: 50, Loc100KM: []int{11328, 11329, 11728, 11729}, MaxDailyPrice: 300, Currency: "USD"},
+	}}
+}
+
+func newWishlistUser() User {
+	return User{GivenName: "Ann", Favorites: []int64{7, 8}, Wishlists: []UserWishlist{
+		{Name: "Favorites", Boats: []UserFavorite{{BoatID: 7, Price: 400, Currency: "USD", Available: true}}},
+		{Name: "June trip", StartDate: DateTime(2020, 6, 10, 0, 0, 0), EndDate: DateTime(2020, 6, 12, 0, 0, 0), ShareCode: "0123456789abcdef", Boats: []UserFavorite{
+			{BoatID: 7, Price: 400, Currency: "USD", Available: true},
+			{BoatID: 8, Price: 300, Currency: "USD"},
+		}},
+	}}
+}
@@ -0,0 +1,405 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// insuranceReminderDays is how many days before a policy's ExpirDate the owner is reminded
+const insuranceReminderDays = 30
+
+func init() {
+	addEnumsFor(EventInsure{})
+	apiHandlers["RequestInsurance"] = RequestInsurance
+	apiHandlers["QuoteInsurance"] = QuoteInsurance
+	apiHandlers["BindInsurance"] = BindInsurance
+	apiHandlers["SendInsuranceReminders"] = SendInsuranceReminders
+}
+
+// startInsuranceReminders sends insurance expiration reminders once a day, on one instance
+func startInsuranceReminders() {
+	startDailyJob(insuranceRemindersJob, "sendInsuranceReminders", "sent", sendInsuranceReminders)
+}
+
+// RequestInsurance is when an owner asks the Insurer orgs they pick in OrgID or OrgIDs to quote insurance for BoatID with
+// Insure's Use and IssueDate, as a Deal for each; insurers only see the owner's UserApprovals picked in ShareApprovals
+func RequestInsurance(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	if req.Insure == nil || req.Insure.Use == "" {
+		return &Response{ErrorCode: "NeedUse"}
+	}
+	if err := validate(req.Insure); err != nil {
+		return errResponse(err)
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if !isMine(req, boat) && !isStaff(req) || lacksOrgAccess(req, "SetBoat", boat) {
+		return accessDenied()
+	}
+	owner, err := getUser(boat.UserID)
+	if err != nil {
+		return errResponse(err)
+	}
+	issueDate := req.Insure.IssueDate
+	if issueDate == nil {
+		issueDate = now()
+	}
+	// check the insurers picked
+	orgIDs := req.OrgIDs
+	if req.OrgID != 0 && !int64InArray(req.OrgID, orgIDs) {
+		orgIDs = append([]int64{req.OrgID}, orgIDs...)
+	}
+	if len(orgIDs) == 0 {
+		return &Response{ErrorCode: "NeedOrgIDs"}
+	}
+	for _, orgID := range orgIDs {
+		org, err := getOrg(orgID)
+		if err != nil {
+			return errResponse(err)
+		}
+		if !StringInArray("Insurer", org.Types) {
+			return &Response{ErrorCode: "NotInsurer", ErrorDetails: map[string]string{"OrgID": strconv.FormatInt(orgID, 10)}}
+		}
+	}
+	// and the approvals shared
+	var approvals []UserApproval
+	for _, index := range req.ShareApprovals {
+		if index < 0 || index >= len(owner.UserApprovals) {
+			return &Response{ErrorCode: "BadShareApprovals", ErrorDetails: map[string]string{"Index": strconv.Itoa(index)}}
+		}
+		approvals = append(approvals, owner.UserApprovals[index])
+	}
+	// what insurers need to know to quote
+	insuredBoat := Boat{
+		ID:           boat.ID,
+		HullID:       boat.HullID,
+		Year:         boat.Year,
+		Make:         boat.Make,
+		Model:        boat.Model,
+		Category:     boat.Category,
+		Length:       boat.Length,
+		Location:     boat.Location,
+		LocationType: boat.LocationType,
+	}
+	insuredUser := User{ID: owner.ID, GivenName: owner.GivenName, FamilyName: owner.FamilyName, Birthdate: owner.Birthdate, UserApprovals: approvals}
+	resp := &Response{Deals: map[int64]*Deal{}}
+	for _, orgID := range orgIDs {
+		deal := &Deal{
+			BoatID: boat.ID,
+			UserID: boat.UserID,
+			OrgID:  orgID,
+			Insure: &EventInsure{Status: "Requested", Use: req.Insure.Use, IssueDate: issueDate},
+			Audit:  &Audit{Created: now()},
+		}
+		key, err := putDeal(deal)
+		if err != nil {
+			return errResponse(err)
+		}
+		deal.ID = key.ID
+		if _, err := putEvent(&Event{
+			DealID:     key.ID,
+			BoatID:     boat.ID,
+			UserID:     boat.UserID,
+			OrgID:      orgID,
+			FromUserID: req.Session.UserID,
+			OrgIDs:     []int64{orgID},
+			Insure:     &EventInsure{Status: "Requested", Use: req.Insure.Use, IssueDate: issueDate, Boats: []Boat{insuredBoat}, Users: []User{insuredUser}},
+			Audit:      &Audit{Created: now()},
+		}); err != nil {
+			return errResponse(err)
+		}
+		resp.Deals[key.ID] = deal
+	}
+	return resp
+}
+
+// QuoteInsurance is when an insurer quotes requested DealID with Insure's Type, Premium, InsuredValue, Deductible, and maybe
+// ExpirDate (a year after IssueDate if not set), or declines it with Status "Declined"
+func QuoteInsurance(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.Insure == nil {
+		return &Response{ErrorCode: "NeedInsure"}
+	}
+	if err := validate(req.Insure); err != nil {
+		return errResponse(err)
+	}
+	deal, err := getInsureDeal(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	if deal.OrgID != req.Session.OrgID && !isStaff(req) {
+		return accessDenied()
+	}
+	quote := req.Insure
+	// the deal is read again in the transaction, so a quote can't undo a bind
+	if _, err := updateX("Deal", deal.ID, 0, deal, nil, func() (interface{}, error) {
+		if deal.Insure == nil || deal.Insure.Status != "Requested" && deal.Insure.Status != "Quoted" {
+			return nil, errors.New("QuoteClosed")
+		}
+		if quote.Status == "Declined" {
+			deal.Insure.Status = "Declined"
+		} else {
+			switch {
+			case quote.Type == "":
+				return nil, errors.New("NeedType")
+			case quote.Premium <= 0:
+				return nil, errors.New("NeedPremium")
+			case quote.InsuredValue <= 0:
+				return nil, errors.New("NeedInsuredValue")
+			case quote.Deductible < 0:
+				return nil, errors.New("BadDeductible")
+			}
+			expirDate := quote.ExpirDate
+			if expirDate == nil {
+				d := deal.Insure.IssueDate.AddDate(1, 0, 0)
+				expirDate = &d
+			} else if !expirDate.After(*deal.Insure.IssueDate) {
+				return nil, errors.New("BadExpirDate")
+			}
+			deal.Insure.Status = "Quoted"
+			deal.Insure.Type = quote.Type
+			deal.Insure.Currency = quote.Currency
+			deal.Insure.Premium = quote.Premium
+			deal.Insure.InsuredValue = quote.InsuredValue
+			deal.Insure.Deductible = quote.Deductible
+			deal.Insure.ExpirDate = expirDate
+		}
+		deal.Insure.Notes = quote.Notes
+		auditOf(deal).Updated = now()
+		return deal, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	key, err := putEvent(&Event{
+		DealID:      deal.ID,
+		BoatID:      deal.BoatID,
+		UserID:      deal.UserID,
+		OrgID:       deal.OrgID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: []int64{deal.UserID},
+		Insure:      insureSummary(deal.Insure),
+		Audit:       &Audit{Created: now()},
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// BindInsurance is when the owner binds quoted DealID, with Insure.Number if the insurer gave one; this adds the policy
+// to the boat's InsurancePolicies and closes the boat's other open insurance quotes
+func BindInsurance(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	deal, err := getInsureDeal(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	boat, err := getBoat(deal.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	// it's the owner's to bind, not the insurer's
+	if !isMine(req, boat) && !isStaff(req) || lacksOrgAccess(req, "SetBoat", boat) {
+		return accessDenied()
+	}
+	if deal.Insure.Status != "Quoted" {
+		return &Response{ErrorCode: "NeedQuote"}
+	}
+	insurer := getPublicOrg(deal.OrgID)
+	if insurer == nil {
+		return &Response{ErrorCode: "BadOrgID"}
+	}
+	// the deal and the boat are changed together, so a deal is only bound once, and no other change to the boat is lost
+	if _, err := updateXTx("Boat", boat.ID, 0, boat, nil, func(tx datastorer) (interface{}, error) {
+		deal = &Deal{}
+		if err := tx.Get(apiContext, idKey("Deal", req.DealID), deal); err != nil {
+			return nil, err
+		}
+		deal.ID = req.DealID
+		if deal.Insure == nil || deal.Insure.Status != "Quoted" {
+			return nil, errors.New("NeedQuote")
+		}
+		if req.Insure != nil {
+			deal.Insure.Number = req.Insure.Number
+		}
+		deal.Insure.Status = "Bound"
+		auditOf(deal).Updated = now()
+		if err := putXTx(tx, idKey("Deal", deal.ID), deal); err != nil {
+			return nil, err
+		}
+		boat.InsurancePolicies = append(boat.InsurancePolicies, InsurancePolicy{
+			Insurer:      insurer,
+			Number:       deal.Insure.Number,
+			Type:         deal.Insure.Type,
+			IssueDate:    deal.Insure.IssueDate,
+			ExpirDate:    deal.Insure.ExpirDate,
+			InsuredValue: deal.Insure.InsuredValue,
+			DealID:       deal.ID,
+		})
+		return boat, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	publish(publicationOf(idKey("Deal", deal.ID), deal))
+	if _, err := putEvent(&Event{
+		DealID:     deal.ID,
+		BoatID:     deal.BoatID,
+		UserID:     deal.UserID,
+		OrgID:      deal.OrgID,
+		FromUserID: req.Session.UserID,
+		OrgIDs:     []int64{deal.OrgID},
+		Insure:     insureSummary(deal.Insure),
+		Audit:      &Audit{Created: now()},
+	}); err != nil {
+		return errResponse(err)
+	}
+	// close the other quotes
+	var others []*Deal
+	keys, err := getAllDeals(map[string]interface{}{"BoatID=": deal.BoatID}, &others)
+	if err != nil {
+		return errResponse(err)
+	}
+	for index, key := range keys {
+		other := others[index]
+		if key.ID == deal.ID || other.Insure == nil || other.Insure.Status != "Requested" && other.Insure.Status != "Quoted" {
+			continue
+		}
+		closed := &Deal{}
+		if _, err := updateX("Deal", key.ID, 0, closed, nil, func() (interface{}, error) {
+			if closed.Insure == nil || closed.Insure.Status != "Requested" && closed.Insure.Status != "Quoted" {
+				return nil, nil
+			}
+			closed.Insure.Status = "Closed"
+			auditOf(closed).Updated = now()
+			return closed, nil
+		}); err != nil {
+			return errResponse(err)
+		}
+	}
+	return &Response{ID: deal.ID}
+}
+
+// SendInsuranceReminders lets staff send insurance expiration reminders now, instead of waiting for the daily run
+func SendInsuranceReminders(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if _, err := sendInsuranceReminders(); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+// sendInsuranceReminders notifies owners of boats with policies expiring within insuranceReminderDays, once per policy
+func sendInsuranceReminders() (int, error) {
+	cutOff := now().AddDate(0, 0, insuranceReminderDays)
+	var boats []*Boat
+	keys, err := getAllBoats(map[string]interface{}{"InsurancePolicies.ExpirDate<": cutOff}, &boats)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for index, key := range keys {
+		if !needsInsuranceReminder(boats[index], cutOff) {
+			continue
+		}
+		// the boat is read again in the transaction, so no change made to it since the query is lost
+		boat := &Boat{}
+		var reminders []*Event
+		if _, err := updateX("Boat", key.ID, 0, boat, nil, func() (interface{}, error) {
+			reminders = nil
+			for i := range boat.InsurancePolicies {
+				policy := &boat.InsurancePolicies[i]
+				if !needsPolicyReminder(policy, cutOff) {
+					continue
+				}
+				text := "Your boat's insurance policy"
+				if policy.Insurer != nil && policy.Insurer.Name != "" {
+					text += " with " + policy.Insurer.Name
+				}
+				if policy.Number != "" {
+					text += " (" + policy.Number + ")"
+				}
+				text += " expires " + policy.ExpirDate.Format("January 2, 2006") + "."
+				reminders = append(reminders, &Event{
+					BoatID:       boat.ID,
+					UserID:       boat.UserID,
+					UnreadByIDs:  []int64{boat.UserID},
+					Notification: &EventNotification{Text: text},
+					Audit:        &Audit{Created: now()},
+				})
+				policy.Reminded = now()
+			}
+			if len(reminders) == 0 {
+				return nil, nil
+			}
+			return boat, nil
+		}); err != nil {
+			return count, err
+		}
+		if err := putEvents(reminders); err != nil {
+			return count, err
+		}
+		count += len(reminders)
+	}
+	return count, nil
+}
+
+// needsInsuranceReminder is if any of a boat's policies needs a reminder
+func needsInsuranceReminder(boat *Boat, cutOff time.Time) bool {
+	for i := range boat.InsurancePolicies {
+		if needsPolicyReminder(&boat.InsurancePolicies[i], cutOff) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsPolicyReminder is if a policy expires by cutOff, and hasn't expired or been reminded yet
+func needsPolicyReminder(policy *InsurancePolicy, cutOff time.Time) bool {
+	return policy.ExpirDate != nil && !policy.ExpirDate.After(cutOff) && !policy.ExpirDate.Before(*now()) && policy.Reminded == nil
+}
+
+// getInsureDeal gets insurance DealID
+func getInsureDeal(req *Request) (*Deal, error) {
+	if req.DealID == 0 {
+		return nil, errors.New("NeedDealID")
+	}
+	deal, err := getDeal(req.DealID)
+	if err != nil {
+		return nil, err
+	}
+	if deal.Insure == nil {
+		return nil, errors.New("NeedInsureDeal")
+	}
+	return deal, nil
+}
+
+// insureSummary copies an insurance deal's status and quote for an event
+func insureSummary(insure *EventInsure) *EventInsure {
+	return &EventInsure{
+		Status:       insure.Status,
+		Use:          insure.Use,
+		Type:         insure.Type,
+		IssueDate:    insure.IssueDate,
+		ExpirDate:    insure.ExpirDate,
+		Currency:     insure.Currency,
+		Premium:      insure.Premium,
+		InsuredValue: insure.InsuredValue,
+		Deductible:   insure.Deductible,
+		Number:       insure.Number,
+		Notes:        insure.Notes,
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRequestInsurance(t *testing.T) {
+	owner := &Session{UserID: 123, Verified: true}
+	testAPI(t, owner, nil, "RequestInsurance", `{"BoatID":7}`, `{"ErrorCode":"NeedUse"}`, nil)
+	testAPI(t, owner, nil, "RequestInsurance", `{"BoatID":7,"Insure":{"Use":"Joyriding"}}`, `{"ErrorCode":"BadEnum","ErrorDetails":{"Field":"Use","Value":"Joyriding"}}`, nil)
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "RequestInsurance", `{"BoatID":7,"Insure":{"Use":"Pleasureuseexclusively"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+	})
+	// the owner picks the insurers asked
+	testAPI(t, owner, nil, "RequestInsurance", `{"BoatID":7,"Insure":{"Use":"Pleasureuseexclusively"}}`, `{"ErrorCode":"NeedOrgIDs"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("User", 123), dst: User{}},
+	})
+	testAPI(t, owner, nil, "RequestInsurance", `{"BoatID":7,"OrgIDs":[8],"Insure":{"Use":"Pleasureuseexclusively"}}`, `{"ErrorCode":"NotInsurer","ErrorDetails":{"OrgID":"8"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("User", 123), dst: User{}},
+		{name: "Get", key: idKey("Org", 8), dst: Org{Types: []string{"Dealer"}}},
+	})
+	testAPI(t, owner, nil, "RequestInsurance", `{"BoatID":7,"OrgIDs":[9],"ShareApprovals":[2],"Insure":{"Use":"Pleasureuseexclusively"}}`, `{"ErrorCode":"BadShareApprovals","ErrorDetails":{"Index":"2"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("User", 123), dst: User{UserApprovals: []UserApproval{{YearsExperience: 1}}}},
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Insurer"}}},
+	})
+	// and which of their approvals insurers see
+	testAPI(t, owner, nil, "RequestInsurance", `{"BoatID":7,"OrgIDs":[9,10],"ShareApprovals":[1],"Insure":{"Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z"}}`, `{"Deals":{"41":{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Insure":{"Status":"Requested","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}},"42":{"ID":42,"BoatID":7,"UserID":123,"OrgID":10,"Insure":{"Status":"Requested","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Year: 2015, Make: "Boston Whaler", Length: 23, Rental: &BoatRental{ListingTitle: "Not for insurers"}}},
+		{name: "Get", key: idKey("User", 123), dst: User{GivenName: "Jo", FamilyName: "Owner", RewardPoints: 100, UserApprovals: []UserApproval{{YearsExperience: 1}, {YearsExperience: 5}}}},
+		{name: "Get", key: idKey("Org", 9), dst: Org{Name: "Geico", Types: []string{"Insurer"}}},
+		{name: "Get", key: idKey("Org", 10), dst: Org{Name: "Progressive", Types: []string{"Insurer"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"OrgID":9,"Insure":{"Status":"Requested","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":123,"OrgIDs":[9],"Insure":{"Status":"Requested","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z","Boats":[{"ID":7,"Year":2015,"Make":"Boston Whaler","Length":23,"Trailer":{}}],"Users":[{"ID":123,"GivenName":"Jo","FamilyName":"Owner","UserApprovals":[{"YearsExperience":5,"Verification":{}}]}]},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"OrgID":10,"Insure":{"Status":"Requested","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 42),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":42,"BoatID":7,"UserID":123,"OrgID":10,"FromUserID":123,"OrgIDs":[10],"Insure":{"Status":"Requested","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z","Boats":[{"ID":7,"Year":2015,"Make":"Boston Whaler","Length":23,"Trailer":{}}],"Users":[{"ID":123,"GivenName":"Jo","FamilyName":"Owner","UserApprovals":[{"YearsExperience":5,"Verification":{}}]}]},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+	})
+}
+
+func TestQuoteInsurance(t *testing.T) {
+	insurer := &Session{UserID: 900, OrgID: 9, Verified: true}
+	testAPI(t, &Session{UserID: 901, OrgID: 10, Verified: true}, nil, "QuoteInsurance", `{"DealID":41,"Insure":{"Type":"Personal","Premium":800,"InsuredValue":40000}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Requested")},
+	})
+	testAPI(t, insurer, nil, "QuoteInsurance", `{"DealID":41,"Insure":{"Type":"Personal","InsuredValue":40000}}`, `{"ErrorCode":"NeedPremium"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Requested")},
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Requested")},
+	})
+	testAPI(t, insurer, nil, "QuoteInsurance", `{"DealID":41,"Insure":{"Type":"Personal","Premium":800,"InsuredValue":40000}}`, `{"ErrorCode":"QuoteClosed"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Bound")},
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Bound")},
+	})
+	testAPI(t, insurer, nil, "QuoteInsurance", `{"DealID":41,"Insure":{"Type":"Personal","Currency":"USD","Premium":800,"InsuredValue":40000,"Deductible":500}}`, `{"ID":53}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Requested")},
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Requested")},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Insure":{"Status":"Quoted","Use":"Pleasureuseexclusively","Type":"Personal","IssueDate":"2020-06-01T00:00:00Z","ExpirDate":"2021-06-01T00:00:00Z","Currency":"USD","Premium":800,"InsuredValue":40000,"Deductible":500},"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":900,"UnreadByIDs":[123],"Insure":{"Status":"Quoted","Use":"Pleasureuseexclusively","Type":"Personal","IssueDate":"2020-06-01T00:00:00Z","ExpirDate":"2021-06-01T00:00:00Z","Currency":"USD","Premium":800,"InsuredValue":40000,"Deductible":500},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 53),
+		},
+	})
+}
+
+func TestBindInsurance(t *testing.T) {
+	owner := &Session{UserID: 123, Verified: true}
+	// it's the owner's to bind, not the insurer's, nor an owner org member's without SetBoat OrgAccess
+	testAPI(t, &Session{UserID: 900, OrgID: 9, OrgAccess: []string{"SetDeal"}, Verified: true}, nil, "BindInsurance", `{"DealID":41}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newQuotedInsureDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+	})
+	testAPI(t, &Session{UserID: 124, OrgID: 8, OrgAccess: []string{"SetDeal"}, Verified: true}, nil, "BindInsurance", `{"DealID":41}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newQuotedInsureDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, OrgID: 8}},
+	})
+	testAPI(t, owner, nil, "BindInsurance", `{"DealID":41}`, `{"ErrorCode":"NeedQuote"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newInsureDeal("Requested")},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+	})
+	testAPI(t, owner, nil, "BindInsurance", `{"DealID":41,"Insure":{"Number":"P-1"}}`, `{"ID":41}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newQuotedInsureDeal()},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("Org", 9), dst: Org{Name: "Geico", Types: []string{"Insurer"}, EIN: "secret"}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("Deal", 41), dst: newQuotedInsureDeal()},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Insure":{"Status":"Bound","Use":"Pleasureuseexclusively","Type":"Personal","IssueDate":"2020-06-01T00:00:00Z","ExpirDate":"2021-06-01T00:00:00Z","Premium":800,"InsuredValue":40000,"Number":"P-1"},"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"InsurancePolicies":[{"Insurer":{"Types":["Insurer"],"Name":"Geico"},"Number":"P-1","Type":"Personal","IssueDate":"2020-06-01T00:00:00Z","ExpirDate":"2021-06-01T00:00:00Z","InsuredValue":40000,"DealID":41}],"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":123,"OrgIDs":[9],"Insure":{"Status":"Bound","Use":"Pleasureuseexclusively","Type":"Personal","IssueDate":"2020-06-01T00:00:00Z","ExpirDate":"2021-06-01T00:00:00Z","Premium":800,"InsuredValue":40000,"Number":"P-1"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 54),
+		},
+		{
+			name: "GetAll",
+			q:    newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+			dst: []*Deal{
+				func() *Deal { d := newQuotedInsureDeal(); return &d }(),
+				func() *Deal { d := newInsureDeal("Requested"); d.OrgID = 10; return &d }(),
+				func() *Deal { d := newInsureDeal("Declined"); d.OrgID = 11; return &d }(),
+				{BoatID: 7, UserID: 456, Rental: &EventRental{Status: "Booked"}},
+			},
+			keysResult: []*datastore.Key{idKey("Deal", 41), idKey("Deal", 42), idKey("Deal", 43), idKey("Deal", 44)},
+		},
+		{name: "Get", key: idKey("Deal", 42), dst: func() Deal { d := newInsureDeal("Requested"); d.OrgID = 10; return d }()},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 42),
+			srcJSON:   `{"ID":42,"BoatID":7,"UserID":123,"OrgID":10,"Insure":{"Status":"Closed","Use":"Pleasureuseexclusively","IssueDate":"2020-06-01T00:00:00Z"},"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 42),
+		},
+	})
+}
+
+func TestSendInsuranceReminders(t *testing.T) {
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	testAPI(t, &Session{UserID: 123}, nil, "SendInsuranceReminders", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	newPolicyBoat := func() Boat {
+		return Boat{UserID: 123, InsurancePolicies: []InsurancePolicy{
+			{Insurer: &Org{Name: "Geico"}, Number: "P-1", ExpirDate: DateTime(2020, 5, 1, 0, 0, 0)},
+			{Insurer: &Org{Name: "Geico"}, Number: "P-2", ExpirDate: DateTime(2020, 5, 20, 0, 0, 0)},
+		}}
+	}
+	// one policy expires soon, one already expired, and one was already reminded
+	testAPI(t, staff, nil, "SendInsuranceReminders", `{}`, `{}`, []mockDataStoreCall{
+		{
+			name: "GetAll",
+			q:    newQuery("Boat", map[string]interface{}{"InsurancePolicies.ExpirDate<": DateTime(2020, 6, 4, 5, 5, 5).UTC()}),
+			dst: []*Boat{
+				func() *Boat { b := newPolicyBoat(); return &b }(),
+				{UserID: 456, InsurancePolicies: []InsurancePolicy{{Number: "P-3", ExpirDate: DateTime(2020, 5, 25, 0, 0, 0), Reminded: DateTime(2020, 4, 25, 0, 0, 0)}}},
+			},
+			keysResult: []*datastore.Key{idKey("Boat", 7), idKey("Boat", 8)},
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: newPolicyBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"InsurancePolicies":[{"Insurer":{"Name":"Geico"},"Number":"P-1","ExpirDate":"2020-05-01T00:00:00Z"},{"Insurer":{"Name":"Geico"},"Number":"P-2","ExpirDate":"2020-05-20T00:00:00Z","Reminded":"2020-05-05T05:05:05Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"UnreadByIDs":[123],"Notification":{"Text":"Your boat's insurance policy with Geico (P-2) expires May 20, 2020."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 55),
+		},
+	})
+	// nothing's put if the boat was reminded since the query
+	testAPI(t, staff, nil, "SendInsuranceReminders", `{}`, `{}`, []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("Boat", map[string]interface{}{"InsurancePolicies.ExpirDate<": DateTime(2020, 6, 4, 5, 5, 5).UTC()}),
+			dst:        []*Boat{func() *Boat { b := newPolicyBoat(); return &b }()},
+			keysResult: []*datastore.Key{idKey("Boat", 7)},
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: func() Boat {
+			b := newPolicyBoat()
+			b.InsurancePolicies[1].Reminded = DateTime(2020, 5, 5, 0, 0, 0)
+			return b
+		}()},
+	})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Job is when a daily job is next due; the first instance of the server to find it due moves NextRun a day ahead and
+// runs it, so only one instance does
+type Job struct {
+	ID      int64      `json:",omitempty" datastore:"-"`
+	Name    string     `json:",omitempty" datastore:",omitempty,noindex"`
+	NextRun *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// the IDs of the daily jobs' records
+const (
+	insuranceRemindersJob = iota + 1
+	serviceRemindersJob
+	referralAwardsJob
+	favoriteAlertsJob
+	searchDigestsJob
+	deletedPurgeJob
+)
+
+// jobCheck is how often each instance checks if a daily job is due
+const jobCheck = 10 * time.Minute
+
+// startDailyJob runs job once a day on whichever instance finds it due first, and logs how many it did
+func startDailyJob(id int64, name, did string, job func() (int, error)) {
+	go func() {
+		for {
+			if due, err := claimJob(id, name); err != nil {
+				log.Printf("claimJob(%s) => %s", name, err.Error())
+			} else if due {
+				if count, err := job(); err != nil {
+					log.Printf("%s() => %s", name, err.Error())
+				} else if count > 0 {
+					log.Printf("%s() %s %d", name, did, count)
+				}
+			}
+			time.Sleep(jobCheck)
+		}
+	}()
+}
+
+// claimJob finds out if a daily job is due, and if so, moves its NextRun a day ahead in a transaction, so no other
+// instance finds it due too
+func claimJob(id int64, name string) (bool, error) {
+	due := false
+	err := runInTransaction(func(tx datastorer) error {
+		due = false
+		job := &Job{}
+		key := idKey("Job", id)
+		if err := tx.Get(apiContext, key, job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if job.NextRun != nil && job.NextRun.After(*now()) {
+			return nil
+		}
+		nextRun := now().Add(24 * time.Hour)
+		job.Name = name
+		job.NextRun = &nextRun
+		due = true
+		_, err := tx.Put(apiContext, key, job)
+		return err
+	})
+	return due && err == nil, err
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClaimJob(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	test := func(expect bool, calls []mockDataStoreCall) {
+		mockDataStoreClient = &mockDataStore{t: t, calls: calls}
+		due, err := claimJob(favoriteAlertsJob, "sendFavoriteAlerts")
+		mockDataStoreClient.(*mockDataStore).Done()
+		if due != expect || err != nil {
+			t.Errorf("claimJob() => %v, %v, expected %v", due, err, expect)
+		}
+	}
+	// the first time, it's due, and it's next due a day later
+	test(true, []mockDataStoreCall{
+		{name: "Get", key: idKey("Job", favoriteAlertsJob), err: datastore.ErrNoSuchEntity},
+		{name: "Put", key: idKey("Job", favoriteAlertsJob), src: []*Job{}, srcJSON: `{"Name":"sendFavoriteAlerts","NextRun":"2020-05-06T05:05:05Z"}`, keyResult: idKey("Job", favoriteAlertsJob)},
+	})
+	// so it isn't due again on any instance until then
+	test(false, []mockDataStoreCall{
+		{name: "Get", key: idKey("Job", favoriteAlertsJob), dst: Job{Name: "sendFavoriteAlerts", NextRun: DateTime(2020, 5, 6, 5, 5, 5)}},
+	})
+	test(true, []mockDataStoreCall{
+		{name: "Get", key: idKey("Job", favoriteAlertsJob), dst: Job{Name: "sendFavoriteAlerts", NextRun: DateTime(2020, 5, 5, 5, 0, 0)}},
+		{name: "Put", key: idKey("Job", favoriteAlertsJob), src: []*Job{}, srcJSON: `{"Name":"sendFavoriteAlerts","NextRun":"2020-05-06T05:05:05Z"}`, keyResult: idKey("Job", favoriteAlertsJob)},
+	})
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// publicCacheTTL is how long the public projection of a record is reused, unless it's published as changed first
+const publicCacheTTL = 30 * time.Second
+
+// publicCacheSize is how many projections the cache may hold before expired ones are swept out
+const publicCacheSize = 10000
+
+// publicKinds are the kinds with public projections, in the order publicLoader loads them
+var publicKinds = []string{"User", "Org", "Boat", "Deal"}
+
+type publicKey struct {
+	kind string
+	id   int64
+}
+
+type publicEntry struct {
+	public  interface{}
+	expires time.Time
+}
+
+// publicCacheMap keeps the public projections of users, orgs, boats, and deals for publicCacheTTL; they're shared by
+// every request, so they must never be changed
+type publicCacheMap struct {
+	mutex   sync.Mutex
+	entries map[publicKey]publicEntry
+}
+
+// publicCache is the cache of public projections of this server
+var publicCache = &publicCacheMap{entries: map[publicKey]publicEntry{}}
+
+func (cache *publicCacheMap) get(kind string, id int64) (interface{}, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[publicKey{kind, id}]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.public, true
+}
+
+func (cache *publicCacheMap) put(kind string, id int64, public interface{}) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if len(cache.entries) >= publicCacheSize {
+		for key, entry := range cache.entries {
+			if time.Now().After(entry.expires) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	cache.entries[publicKey{kind, id}] = publicEntry{public, time.Now().Add(publicCacheTTL)}
+}
+
+// forget drops the projection of a published record, so subscriptions updated for it don't get the old one
+func (cache *publicCacheMap) forget(pub *Publication) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, publicKey{pub.Kind, pub.ID})
+}
+
+func (cache *publicCacheMap) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = map[publicKey]publicEntry{}
+}
+
+// getPublicX gets the public projection of the record of kind and id from the cache, or else reads it with one Get;
+// it's nil if id is 0 or the record can't be read
+func getPublicX(kind string, id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	if public, ok := publicCache.get(kind, id); ok {
+		return public
+	}
+	record := reflect.New(reflect.TypeOf(newPublicRecords(kind, 0)).Elem().Elem()).Interface()
+	if err := getX(kind, id, record); err != nil {
+		log.Printf("get%s(%d) => %s", kind, id, err.Error())
+		return nil
+	}
+	public := publicOf(kind, record)
+	publicCache.put(kind, id, public)
+	return public
+}
+
+// publicLoader gets the public projections of the users, orgs, boats, and deals a request refers to, with one
+// GetMulti per kind for all of them that aren't cached, instead of a Get for each
+type publicLoader struct {
+	wanted map[string][]int64
+	loaded map[publicKey]interface{}
+}
+
+func newPublicLoader() *publicLoader {
+	return &publicLoader{
+		wanted: map[string][]int64{},
+		loaded: map[publicKey]interface{}{},
+	}
+}
+
+// want adds ids of kind to the next load, skipping 0s and those already wanted or loaded
+func (loader *publicLoader) want(kind string, ids ...int64) {
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		if _, ok := loader.loaded[publicKey{kind, id}]; ok {
+			continue
+		}
+		loader.loaded[publicKey{kind, id}] = nil
+		loader.wanted[kind] = append(loader.wanted[kind], id)
+	}
+}
+
+// load gets everything wanted since the last load; records that can't be read are logged and left nil
+func (loader *publicLoader) load() {
+	for _, kind := range publicKinds {
+		keys := []*datastore.Key{}
+		for _, id := range loader.wanted[kind] {
+			if public, ok := publicCache.get(kind, id); ok {
+				loader.loaded[publicKey{kind, id}] = public
+			} else {
+				keys = append(keys, idKey(kind, id))
+			}
+		}
+		delete(loader.wanted, kind)
+		if len(keys) == 0 {
+			continue
+		}
+		records := newPublicRecords(kind, len(keys))
+		err := storage().GetMulti(apiContext, keys, records)
+		multiErr, _ := err.(datastore.MultiError)
+		if err != nil && multiErr == nil {
+			log.Printf("GetMulti %s %d => %s", kind, len(keys), err.Error())
+			continue
+		}
+		for index, key := range keys {
+			if multiErr != nil && multiErr[index] != nil {
+				log.Printf("get%s(%d) => %s", kind, key.ID, multiErr[index].Error())
+				continue
+			}
+			record := reflect.ValueOf(records).Index(index).Interface()
+			if isDeleted(record) {
+				continue
+			}
+			public := publicOf(kind, record)
+			loader.loaded[publicKey{kind, key.ID}] = public
+			publicCache.put(kind, key.ID, public)
+		}
+	}
+}
+
+func (loader *publicLoader) user(id int64) *User {
+	user, _ := loader.loaded[publicKey{"User", id}].(*User)
+	return user
+}
+
+func (loader *publicLoader) org(id int64) *Org {
+	org, _ := loader.loaded[publicKey{"Org", id}].(*Org)
+	return org
+}
+
+func (loader *publicLoader) boat(id int64) *Boat {
+	boat, _ := loader.loaded[publicKey{"Boat", id}].(*Boat)
+	return boat
+}
+
+func (loader *publicLoader) deal(id int64) *Deal {
+	deal, _ := loader.loaded[publicKey{"Deal", id}].(*Deal)
+	return deal
+}
+
+// newPublicRecords makes a []*User, []*Org, []*Boat, or []*Deal of size for GetMulti
+func newPublicRecords(kind string, size int) interface{} {
+	switch kind {
+	case "User":
+		return make([]*User, size)
+	case "Org":
+		return make([]*Org, size)
+	case "Boat":
+		return make([]*Boat, size)
+	case "Deal":
+		return make([]*Deal, size)
+	}
+	panic("NoPublic" + kind)
+}
+
+// publicOf makes the public projection of a record
+func publicOf(kind string, record interface{}) interface{} {
+	switch kind {
+	case "User":
+		return publicUser(record.(*User))
+	case "Org":
+		return publicOrg(record.(*Org))
+	case "Boat":
+		return publicBoat(record.(*Boat))
+	case "Deal":
+		return publicDeal(record.(*Deal))
+	}
+	panic("NoPublic" + kind)
+}
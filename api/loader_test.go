@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestGetEventsLoader(t *testing.T) {
+	session := &Session{UserID: 123}
+	// three messages about the same boat and deal make one GetMulti of each kind, not a Get for each reference
+	eventsCall := mockDataStoreCall{
+		name: "GetAll",
+		q:    newQuery("Event", map[string]interface{}{"UserID=": int64(123)}),
+		dst: []*Event{
+			{DealID: 41, BoatID: 7, UserID: 123, FromUserID: 456, Message: &EventMessage{Text: "Hi"}},
+			{DealID: 41, BoatID: 7, UserID: 123, FromUserID: 123, Message: &EventMessage{Text: "Hello"}},
+			{DealID: 41, BoatID: 7, UserID: 123, OrgID: 8, FromUserID: 789, Message: &EventMessage{Text: "Welcome"}},
+		},
+		keysResult: []*datastore.Key{idKey("Event", 51), idKey("Event", 52), idKey("Event", 53)},
+	}
+	created := DateTime(2020, 1, 2, 3, 4, 5)
+	respJSON := `{"SubscriptionID":-1,"Events":{` +
+		`"51":{"ID":51,"DealID":41,"Deal":{"Rental":{"Start":"2020-06-01T09:00:00Z"},"Audit":{}},"BoatID":7,"Boat":{"Trailer":{},"Rental":{"ListingTitle":"Sea Breeze"},"Audit":{"Created":"2020-01-02T03:04:05Z"}},"UserID":123,"User":{"GivenName":"Ann","Audit":{"Created":"2020-01-02T03:04:05Z"}},"FromUserID":456,"FromUser":{"GivenName":"Bob","Audit":{}},"Message":{"Text":"Hi"}},` +
+		`"52":{"ID":52,"DealID":41,"Deal":{"Rental":{"Start":"2020-06-01T09:00:00Z"},"Audit":{}},"BoatID":7,"Boat":{"Trailer":{},"Rental":{"ListingTitle":"Sea Breeze"},"Audit":{"Created":"2020-01-02T03:04:05Z"}},"UserID":123,"User":{"GivenName":"Ann","Audit":{"Created":"2020-01-02T03:04:05Z"}},"FromUserID":123,"FromUser":{"GivenName":"Ann","Audit":{"Created":"2020-01-02T03:04:05Z"}},"Message":{"Text":"Hello"}},` +
+		`"53":{"ID":53,"DealID":41,"Deal":{"Rental":{"Start":"2020-06-01T09:00:00Z"},"Audit":{}},"BoatID":7,"Boat":{"Trailer":{},"Rental":{"ListingTitle":"Sea Breeze"},"Audit":{"Created":"2020-01-02T03:04:05Z"}},"UserID":123,"User":{"GivenName":"Ann","Audit":{"Created":"2020-01-02T03:04:05Z"}},"OrgID":8,"Org":{"Types":["Dealer"],"Name":"Acme"},"FromUserID":789,"FromUser":{"GivenName":"Cy","Audit":{}},"Message":{"Text":"Welcome"}}}}`
+	calls := []mockDataStoreCall{
+		eventsCall,
+		{
+			name: "GetMulti",
+			keys: []*datastore.Key{idKey("User", 123), idKey("User", 456), idKey("User", 789)},
+			dst:  []*User{{GivenName: "Ann", Audit: &Audit{Created: created}}, {GivenName: "Bob"}, {GivenName: "Cy"}},
+		},
+		{name: "GetMulti", keys: []*datastore.Key{idKey("Org", 8)}, dst: []*Org{{Types: []string{"Dealer"}, Name: "Acme"}}},
+		{name: "GetMulti", keys: []*datastore.Key{idKey("Boat", 7)}, dst: []*Boat{{Name: "Sea Breeze", Rental: &BoatRental{ListingTitle: "Sea Breeze"}, Audit: &Audit{Created: created}}}},
+		{name: "GetMulti", keys: []*datastore.Key{idKey("Deal", 41)}, dst: []*Deal{{Rental: &EventRental{Start: DateTime(2020, 6, 1, 9, 0, 0), Status: "Booked"}}}},
+	}
+	testAPI(t, session, nil, "GetEvents", `{}`, respJSON, calls)
+	if mds := mockDataStoreClient.(*mockDataStore); mds.pos != 5 {
+		t.Errorf("GetEvents made %d datastore calls, expected 5", mds.pos)
+	}
+	// the projections are cached, so the same inbox again only needs the events, except for the user that was
+	// published as changed since
+	publicCache.forget(&Publication{Kind: "User", ID: 456})
+	mockDataStoreClient = &mockDataStore{t: t, calls: []mockDataStoreCall{
+		eventsCall,
+		{name: "GetMulti", keys: []*datastore.Key{idKey("User", 456)}, dst: []*User{{GivenName: "Bob"}}},
+	}}
+	resp := GetEvents(&Request{Session: session}, nil)
+	mockDataStoreClient.(*mockDataStore).Done()
+	if actualJSON, _ := json.Marshal(resp); string(actualJSON) != respJSON {
+		t.Errorf("Wrong cached GetEvents response\nActual %s\nExpect %s\n", actualJSON, respJSON)
+	}
+	mockDataStoreClient = nil
+}
+
+func TestGetBoatsLoader(t *testing.T) {
+	session := &Session{UserID: 123}
+	// three boats of the user, two of them also of one org, make one GetMulti of users and one of orgs
+	testAPI(t, session, nil, "GetBoats", `{"UserID":123}`, `{"SubscriptionID":-1,"Boats":{`+
+		`"301":{"ID":301,"UserID":123,"User":{"GivenName":"Ann","Audit":{}},"Make":"#301","Trailer":{}},`+
+		`"302":{"ID":302,"UserID":123,"User":{"GivenName":"Ann","Audit":{}},"OrgID":8,"Org":{"Types":["Dealer"],"Name":"Acme"},"Make":"#302","Trailer":{}},`+
+		`"303":{"ID":303,"UserID":123,"User":{"GivenName":"Ann","Audit":{}},"OrgID":8,"Org":{"Types":["Dealer"],"Name":"Acme"},"Make":"#303","Trailer":{}}}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 123), dst: User{GivenName: "Ann"}},
+		{
+			name:       "GetAll",
+			q:          newQuery("Boat", map[string]interface{}{"UserID=": int64(123)}),
+			dst:        []*Boat{{UserID: 123, Make: "#301"}, {UserID: 123, OrgID: 8, Make: "#302"}, {UserID: 123, OrgID: 8, Make: "#303"}},
+			keysResult: []*datastore.Key{idKey("Boat", 301), idKey("Boat", 302), idKey("Boat", 303)},
+		},
+		{name: "GetMulti", keys: []*datastore.Key{idKey("User", 123)}, dst: []*User{{GivenName: "Ann"}}},
+		{name: "GetMulti", keys: []*datastore.Key{idKey("Org", 8)}, dst: []*Org{{Types: []string{"Dealer"}, Name: "Acme"}}},
+	})
+}
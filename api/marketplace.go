@@ -13,6 +13,7 @@ type Marketplace struct {
 	IOs             MobileApp
 	Android         MobileApp
 	APIKeys         map[string]string
+	Currencies      map[string]*Currency
 }
 
 // MobileApp has information about the iOS or Android mobile app
@@ -58,10 +59,13 @@ func mobileApp(versionsString string) MobileApp {
 	panic(errors.New("app-local.yaml must have ANDROID_VERSIONS and IOS_VERSIONS each with three versions; i.e., 1.0,1.7,1.71"))
 }
 
-// GetMarketplaces gets marketplaces
+// GetMarketplaces gets marketplaces, with the currencies this instance has now
 func GetMarketplaces(req *Request, pub *Publication) *Response {
-	return &Response{
-		SubscriptionID: -1,
-		Marketplaces:   marketplaces,
+	resp := &Response{SubscriptionID: -1, Marketplaces: map[int]*Marketplace{}}
+	for id, marketplace := range marketplaces {
+		copied := *marketplace
+		copied.Currencies = getCurrencies()
+		resp.Marketplaces[id] = &copied
 	}
+	return resp
 }
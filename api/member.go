@@ -0,0 +1,275 @@
+package api
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"time"
+)
+
+// OrgInvite is an invitation for whoever verifies Email to join an org with OrgAccess
+type OrgInvite struct {
+	Email       string     `json:",omitempty" datastore:",omitempty,noindex"`
+	OrgAccess   []string   `json:",omitempty" datastore:",omitempty,noindex" enum:"SetOrg, SetUser, SetBoat, SetDeal, SetEvent"`
+	InvitedByID int64      `json:",omitempty" datastore:",omitempty,noindex"`
+	Invited     *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+func init() {
+	addEnumsFor(OrgInvite{})
+	apiHandlers["GetOrgMembers"] = GetOrgMembers
+	apiHandlers["InviteOrgMember"] = InviteOrgMember
+	apiHandlers["AcceptOrgInvite"] = AcceptOrgInvite
+	apiHandlers["SetOrgAccess"] = SetOrgAccess
+	apiHandlers["RemoveOrgMember"] = RemoveOrgMember
+}
+
+// GetOrgMembers gets the members of my org (or OrgID if I'm staff) with their OrgAccess; org admins (with SetUser
+// OrgAccess) and staff also get the org's pending Invites
+func GetOrgMembers(req *Request, pub *Publication) *Response {
+	orgID := req.Session.OrgID
+	if req.OrgID != 0 && req.OrgID != orgID {
+		if !isStaff(req) {
+			return accessDenied()
+		}
+		orgID = req.OrgID
+	}
+	if orgID == 0 {
+		return &Response{ErrorCode: "NeedOrgID"}
+	}
+	var users []*User
+	filters := map[string]interface{}{"OrgID=": orgID}
+	keys, err := getAllUsers(filters, &users)
+	if err != nil {
+		return errResponse(err)
+	}
+	dependOnQuery(req, "User", filters, keys)
+	dependOnIDs(req, "Org", orgID)
+	resp := &Response{SubscriptionID: -1, Users: map[int64]*User{}}
+	for index, key := range keys {
+		user := users[index]
+		member := &User{ID: key.ID, OrgID: orgID, OrgAccess: user.OrgAccess, GivenName: user.GivenName, FamilyName: user.FamilyName, Images: user.Images}
+		for _, contact := range user.Contacts {
+			if contact.Type == "Email" {
+				member.Contacts = append(member.Contacts, Contact{Type: "Email", Email: contact.Email})
+			}
+		}
+		resp.Users[key.ID] = member
+	}
+	if isOrgAdmin(req, orgID) {
+		org, err := getOrg(orgID)
+		if err != nil {
+			return errResponse(err)
+		}
+		resp.Orgs = map[int64]*Org{orgID: {ID: orgID, Name: org.Name, Invites: org.Invites}}
+	}
+	return resp
+}
+
+// InviteOrgMember is when an admin of my org invites Email to join it with OrgAccess, replacing any invite to Email
+func InviteOrgMember(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	orgID := req.Session.OrgID
+	if !isOrgAdmin(req, orgID) {
+		return accessDenied()
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !emailPattern.MatchString(email) {
+		return &Response{ErrorCode: "BadEmail"}
+	}
+	invite := OrgInvite{Email: email, OrgAccess: req.OrgAccess, InvitedByID: req.Session.UserID, Invited: now()}
+	if err := validate(invite); err != nil {
+		return errResponse(err)
+	}
+	org := &Org{}
+	key, err := updateX("Org", orgID, 0, org, nil, func() (interface{}, error) {
+		invites := []OrgInvite{invite}
+		for _, other := range org.Invites {
+			if other.Email != email {
+				invites = append(invites, other)
+			}
+		}
+		org.Invites = invites
+		return org, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	if err := sendEmail("[Boat Fuji]You're invited to join "+org.Name, "support@boatfuji.com", []string{email},
+		`<div style='background:#0f233d;color:#fff;padding:40px 40px;font:bold 18px sans-serif'>
+<img src='https://www.boatfuji.com/img/email-logo.png'>
+<p>You're invited to join `+html.EscapeString(org.Name)+` on Boat Fuji. To accept, sign in at
+<a style='color:#ff0' href='https://www.boatfuji.com/'>boatfuji.com</a> after verifying this email address.</p>
+</div>`); err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// AcceptOrgInvite is when I join OrgID, which must have invited one of my verified emails
+func AcceptOrgInvite(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.OrgID == 0 {
+		return &Response{ErrorCode: "NeedOrgID"}
+	}
+	// the invite is used up as I join, so it can't be accepted twice, and I can't join two orgs at once
+	org := &Org{}
+	var user *User
+	key, err := updateXTx("Org", req.OrgID, 0, org, nil, func(tx datastorer) (interface{}, error) {
+		user = &User{}
+		if err := tx.Get(apiContext, idKey("User", req.Session.UserID), user); err != nil {
+			return nil, err
+		}
+		user.ID = req.Session.UserID
+		if user.OrgID != 0 {
+			return nil, errors.New("AlreadyInOrg")
+		}
+		var invite *OrgInvite
+		invites := []OrgInvite{}
+		for i, other := range org.Invites {
+			if invite == nil && hasVerifiedEmail(user, other.Email) {
+				invite = &org.Invites[i]
+			} else {
+				invites = append(invites, other)
+			}
+		}
+		if invite == nil {
+			return nil, errors.New("NoInvite")
+		}
+		user.OrgID = req.OrgID
+		user.OrgAccess = invite.OrgAccess
+		if err := putXTx(tx, idKey("User", user.ID), user); err != nil {
+			return nil, err
+		}
+		org.Invites = invites
+		return org, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	publish(publicationOf(idKey("User", user.ID), user))
+	req.Session.OrgID = key.ID
+	req.Session.OrgTypes = org.Types
+	req.Session.OrgAccess = user.OrgAccess
+	return &Response{ID: key.ID}
+}
+
+// SetOrgAccess is when an admin of my org grants or revokes OrgAccess of member UserID, which is replaced by OrgAccess
+func SetOrgAccess(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if err := validate(OrgInvite{OrgAccess: req.OrgAccess}); err != nil {
+		return errResponse(err)
+	}
+	if req.UserID == 0 {
+		return &Response{ErrorCode: "NeedUserID"}
+	}
+	if !isOrgAdmin(req, req.Session.OrgID) {
+		return accessDenied()
+	}
+	// an org always keeps an admin
+	if req.UserID == req.Session.UserID && !StringInArray("SetUser", req.OrgAccess) && !isStaff(req) {
+		return &Response{ErrorCode: "OwnOrgAccess"}
+	}
+	user := &User{}
+	key, err := updateX("User", req.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		if user.OrgID == 0 || user.OrgID != req.Session.OrgID {
+			return nil, errors.New("NotOrgMember")
+		}
+		user.OrgAccess = req.OrgAccess
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	if key.ID == req.Session.UserID {
+		req.Session.OrgAccess = user.OrgAccess
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: user.Audit.Version,
+	}
+}
+
+// RemoveOrgMember is when an admin of my org removes member UserID or cancels the invite to Email, or when I leave my org
+func RemoveOrgMember(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.Email != "" {
+		if !isOrgAdmin(req, req.Session.OrgID) {
+			return accessDenied()
+		}
+		org := &Org{}
+		key, err := updateX("Org", req.Session.OrgID, 0, org, nil, func() (interface{}, error) {
+			invites := []OrgInvite{}
+			for _, invite := range org.Invites {
+				if invite.Email != strings.ToLower(req.Email) {
+					invites = append(invites, invite)
+				}
+			}
+			if len(invites) == len(org.Invites) {
+				return nil, errors.New("NoInvite")
+			}
+			org.Invites = invites
+			return org, nil
+		})
+		if err != nil {
+			return errResponse(err)
+		}
+		return &Response{ID: key.ID}
+	}
+	leaving := req.UserID != 0 && req.UserID == req.Session.UserID
+	// members may leave on their own
+	admin := !leaving || isOrgAdmin(req, req.Session.OrgID)
+	if admin {
+		if req.UserID == 0 {
+			return &Response{ErrorCode: "NeedUserID"}
+		}
+		if !isOrgAdmin(req, req.Session.OrgID) {
+			return accessDenied()
+		}
+	}
+	user := &User{}
+	key, err := updateX("User", req.UserID, 0, user, nil, func() (interface{}, error) {
+		if admin && (user.OrgID == 0 || user.OrgID != req.Session.OrgID) {
+			return nil, errors.New("NotOrgMember")
+		}
+		if leaving && StringInArray("SetUser", user.OrgAccess) {
+			// an org always keeps an admin
+			return nil, errors.New("OwnOrgAccess")
+		}
+		user.OrgID = 0
+		user.OrgAccess = nil
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	if leaving {
+		req.Session.OrgID = 0
+		req.Session.OrgTypes = nil
+		req.Session.OrgAccess = nil
+	}
+	return &Response{ID: key.ID}
+}
+
+// isOrgAdmin finds out if I may manage orgID's members, because I'm staff or have its SetUser OrgAccess
+func isOrgAdmin(req *Request, orgID int64) bool {
+	return isStaff(req) || orgID != 0 && req.Session.OrgID == orgID && StringInArray("SetUser", req.Session.OrgAccess)
+}
+
+// hasVerifiedEmail finds out if a user has verified an email
+func hasVerifiedEmail(user *User, email string) bool {
+	for _, contact := range user.Contacts {
+		if contact.Type == "Email" && contact.Verified != nil && contact.Email == email {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestInviteOrgMember(t *testing.T) {
+	var sent []string
+	sendEmail = func(subject, from string, to []string, htmlBody string) error {
+		sent = append(sent, to...)
+		return nil
+	}
+	defer func() { sendEmail = SendEmail }()
+	admin := &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}, Verified: true}
+	testAPI(t, &Session{UserID: 456, OrgID: 8, OrgAccess: []string{"SetBoat"}, Verified: true}, nil, "InviteOrgMember", `{"Email":"new@example.org"}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	testAPI(t, admin, nil, "InviteOrgMember", `{"Email":"new"}`, `{"ErrorCode":"BadEmail"}`, nil)
+	testAPI(t, admin, nil, "InviteOrgMember", `{"Email":"new@example.org","OrgAccess":["SetAll"]}`, `{"ErrorCode":"BadEnum","ErrorDetails":{"Field":"OrgAccess","Value":"SetAll"}}`, nil)
+	// inviting old@ again replaces its invite
+	testAPI(t, admin, nil, "InviteOrgMember", `{"Email":" Old@Example.org","OrgAccess":["SetBoat","SetDeal"]}`, `{"ID":8}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+		{
+			name:      "Put",
+			key:       idKey("Org", 8),
+			src:       []*Org{},
+			srcJSON:   `{"ID":8,"Types":["Dealer"],"Name":"Acme","Invites":[{"Email":"old@example.org","OrgAccess":["SetBoat","SetDeal"],"InvitedByID":123,"Invited":"2020-05-05T05:05:05Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("Org", 8),
+		},
+	})
+	if len(sent) != 1 || sent[0] != "old@example.org" {
+		t.Errorf("Wrong invite emails %v", sent)
+	}
+}
+
+func TestAcceptOrgInvite(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	newUser := func(email string) User {
+		return User{GivenName: "Ann", Contacts: []Contact{{Type: "Email", Email: email, Verified: DateTime(2020, 1, 1, 0, 0, 0)}}}
+	}
+	testAPI(t, session, nil, "AcceptOrgInvite", `{}`, `{"ErrorCode":"NeedOrgID"}`, nil)
+	testAPI(t, session, nil, "AcceptOrgInvite", `{"OrgID":8}`, `{"ErrorCode":"AlreadyInOrg"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+		{name: "Get", key: idKey("User", 456), dst: User{OrgID: 9}},
+	})
+	testAPI(t, session, nil, "AcceptOrgInvite", `{"OrgID":8}`, `{"ErrorCode":"NoInvite"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+		{name: "Get", key: idKey("User", 456), dst: newUser("other@example.org")},
+	})
+	testAPI(t, session, nil, "AcceptOrgInvite", `{"OrgID":8}`, `{"ID":8}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+		{name: "Get", key: idKey("User", 456), dst: newUser("old@example.org")},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"OrgID":8,"OrgAccess":["SetBoat"],"GivenName":"Ann","Contacts":[{"Type":"Email","Residence":{},"Email":"old@example.org","Verified":"2020-01-01T00:00:00Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Org", 8),
+			src:       []*Org{},
+			srcJSON:   `{"ID":8,"Types":["Dealer"],"Name":"Acme","Audit":{"Version":1}}`,
+			keyResult: idKey("Org", 8),
+		},
+	})
+	if session.OrgID != 8 || len(session.OrgAccess) != 1 || session.OrgAccess[0] != "SetBoat" {
+		t.Errorf("Wrong session after accepting invite: %+v", session)
+	}
+}
+
+func TestSetOrgAccess(t *testing.T) {
+	admin := &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}, Verified: true}
+	testAPI(t, admin, nil, "SetOrgAccess", `{"OrgAccess":["SetBoat"]}`, `{"ErrorCode":"NeedUserID"}`, nil)
+	testAPI(t, &Session{UserID: 456, OrgID: 8, Verified: true}, nil, "SetOrgAccess", `{"UserID":456,"OrgAccess":["SetUser"]}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	testAPI(t, admin, nil, "SetOrgAccess", `{"UserID":789,"OrgAccess":["SetBoat"]}`, `{"ErrorCode":"NotOrgMember"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 789), dst: User{OrgID: 9}},
+	})
+	testAPI(t, admin, nil, "SetOrgAccess", `{"UserID":123,"OrgAccess":["SetBoat"]}`, `{"ErrorCode":"OwnOrgAccess"}`, nil)
+	testAPI(t, admin, nil, "SetOrgAccess", `{"UserID":456,"OrgAccess":["SetBoat","SetDeal"]}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{OrgID: 8, OrgAccess: []string{"SetBoat"}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"OrgID":8,"OrgAccess":["SetBoat","SetDeal"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestRemoveOrgMember(t *testing.T) {
+	admin := &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}, Verified: true}
+	testAPI(t, admin, nil, "RemoveOrgMember", `{"UserID":123}`, `{"ErrorCode":"OwnOrgAccess"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 123), dst: User{OrgID: 8, OrgAccess: []string{"SetUser"}}},
+	})
+	member := &Session{UserID: 456, OrgID: 8, OrgAccess: []string{"SetBoat"}, Verified: true}
+	testAPI(t, member, nil, "RemoveOrgMember", `{"UserID":789}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	// a removed member's other sessions lose the org when the user is published
+	sessionsMutex.Lock()
+	sessions[-456] = &Session{ID: -456, UserID: 456, OrgID: 8, OrgTypes: []string{"Dealer"}, OrgAccess: []string{"SetBoat"}}
+	sessionsMutex.Unlock()
+	defer func() {
+		sessionsMutex.Lock()
+		delete(sessions, -456)
+		sessionsMutex.Unlock()
+	}()
+	testAPI(t, admin, nil, "RemoveOrgMember", `{"UserID":456}`, `{"ID":456}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann", OrgID: 8, OrgAccess: []string{"SetBoat"}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann"}},
+	})
+	// a member leaves
+	testAPI(t, member, nil, "RemoveOrgMember", `{"UserID":456}`, `{"ID":456}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann", OrgID: 8, OrgAccess: []string{"SetBoat"}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann"}},
+	})
+	if member.OrgID != 0 || member.OrgAccess != nil {
+		t.Errorf("Wrong session after leaving org: %+v", member)
+	}
+	if other := sessions[-456]; other.OrgID != 0 || other.OrgTypes != nil || other.OrgAccess != nil {
+		t.Errorf("Wrong other session after removal from org: %+v", other)
+	}
+	// cancel an invite
+	testAPI(t, admin, nil, "RemoveOrgMember", `{"Email":"nobody@example.org"}`, `{"ErrorCode":"NoInvite"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+	})
+	testAPI(t, admin, nil, "RemoveOrgMember", `{"Email":"old@example.org"}`, `{"ID":8}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+		{
+			name:      "Put",
+			key:       idKey("Org", 8),
+			src:       []*Org{},
+			srcJSON:   `{"ID":8,"Types":["Dealer"],"Name":"Acme","Audit":{"Version":1}}`,
+			keyResult: idKey("Org", 8),
+		},
+	})
+}
+
+func TestGetOrgMembers(t *testing.T) {
+	members := []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("User", map[string]interface{}{"OrgID=": 8}),
+			dst:        []*User{{GivenName: "Tom", FamilyName: "Smith", OrgID: 8, OrgAccess: []string{"SetUser"}, Contacts: []Contact{{Type: "Email", Email: "tom@example.org"}, {Type: "Phone", Phone: "555-1212"}}}, {GivenName: "Ann", OrgID: 8}},
+			keysResult: []*datastore.Key{idKey("User", 123), idKey("User", 456)},
+		},
+	}
+	testAPI(t, &Session{UserID: 456}, nil, "GetOrgMembers", `{}`, `{"ErrorCode":"NeedOrgID"}`, nil)
+	testAPI(t, &Session{UserID: 456, OrgID: 8}, nil, "GetOrgMembers", `{"OrgID":9}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	testAPI(t, &Session{UserID: 456, OrgID: 8}, nil, "GetOrgMembers", `{}`, `{"SubscriptionID":-1,"Users":{"123":{"ID":123,"OrgID":8,"OrgAccess":["SetUser"],"GivenName":"Tom","FamilyName":"Smith","Contacts":[{"Type":"Email","Residence":{},"Email":"tom@example.org"}]},"456":{"ID":456,"OrgID":8,"GivenName":"Ann"}}}`, members)
+	// admins see pending invites
+	testAPI(t, &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}}, nil, "GetOrgMembers", `{}`, `{"SubscriptionID":-1,"Orgs":{"8":{"ID":8,"Name":"Acme","Invites":[{"Email":"old@example.org","OrgAccess":["SetBoat"],"InvitedByID":123,"Invited":"2020-05-01T00:00:00Z"}]}},"Users":{"123":{"ID":123,"OrgID":8,"OrgAccess":["SetUser"],"GivenName":"Tom","FamilyName":"Smith","Contacts":[{"Type":"Email","Residence":{},"Email":"tom@example.org"}]},"456":{"ID":456,"OrgID":8,"GivenName":"Ann"}}}`, append(members,
+		mockDataStoreCall{name: "Get", key: idKey("Org", 8), dst: newMemberOrg()},
+	))
+}
+
+func TestOrgAccess(t *testing.T) {
+	// a member without SetBoat OrgAccess can't change the org's boat, but one with it can
+	boat := Boat{UserID: 123, OrgID: 8, Name: "Sea Breeze"}
+	testAPI(t, &Session{UserID: 456, OrgID: 8, Verified: true}, nil, "SetBoat", `{"Boat":{"ID":7,"UserID":123,"OrgID":8,"Name":"Sea Breeze 2"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: boat},
+	})
+	testAPI(t, &Session{UserID: 456, OrgID: 8, OrgAccess: []string{"SetBoat"}, Verified: true}, nil, "SetBoat", `{"Boat":{"ID":7,"UserID":123,"OrgID":8,"Name":"Sea Breeze 2"}}`, `{"ID":7,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: boat},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			src:       []*Boat{},
+			srcJSON:   `{"ID":7,"UserID":123,"OrgID":8,"Name":"Sea Breeze 2","Trailer":{},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+	})
+	testAPI(t, &Session{UserID: 456, OrgID: 8, OrgAccess: []string{"SetBoat"}, Verified: true}, nil, "SetDeal", `{"Deal":{"ID":41,"BoatID":7,"UserID":123,"OrgID":8,"Rental":{"Status":"Canceled"}}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 123, OrgID: 8}},
+	})
+	testAPI(t, &Session{UserID: 456, OrgID: 8, Verified: true}, nil, "SetEvent", `{"Event":{"ID":51,"UserID":123,"OrgID":8,"Message":{"Text":"Hi"}}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: Event{UserID: 123, OrgID: 8, Message: &EventMessage{Text: "Hello"}}},
+	})
+	// nor act for the org's boats and deals
+	member := &Session{UserID: 456, OrgID: 8, OrgAccess: []string{"SetEvent"}, Verified: true}
+	orgBoat := Boat{UserID: 123, OrgID: 8, Sale: &BoatSale{ListingStatus: "Published", Price: 100000}}
+	testAPI(t, member, nil, "AcceptOffer", `{"EventID":51}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: Event{BoatID: 7, UserID: 789, FromUserID: 789, Sale: &EventSale{Status: "Open", Price: 90000, SellerUserID: 123}}},
+		{name: "Get", key: idKey("Boat", 7), dst: orgBoat},
+	})
+	testAPI(t, member, nil, "RequestInsurance", `{"BoatID":7,"OrgIDs":[9],"Insure":{"Use":"Pleasureuseexclusively"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: orgBoat},
+	})
+	testAPI(t, member, nil, "PostTransport", `{"BoatID":7,"Transport":{"Destination":{"City":"Miami"}}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: orgBoat},
+		{name: "GetAll", q: newQuery("Deal", map[string]interface{}{"BoatID=": 7}), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+	})
+	testAPI(t, member, nil, "AcceptTransportBid", `{"EventID":62}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 62), dst: Event{BoatID: 7, UserID: 900, OrgID: 9, Transport: &EventTransport{Status: "Bid", JobEventID: 61}}},
+		{name: "Get", key: idKey("Event", 61), dst: Event{BoatID: 7, UserID: 123, OrgID: 8, Transport: &EventTransport{Status: "Open"}}},
+	})
+	testAPI(t, member, nil, "RequestCrew", `{"DealID":41,"UserID":700}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 789, Rental: &EventRental{Captain: "CaptainExtra", Status: "Booked", Start: DateTime(2020, 5, 9, 13, 0, 0), End: DateTime(2020, 5, 9, 17, 0, 0)}}},
+		{name: "Get", key: idKey("Boat", 7), dst: orgBoat},
+	})
+	testAPI(t, member, nil, "SetWorkOrder", `{"BoatID":7,"Service":{}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: orgBoat},
+	})
+	// an org admin can edit a member's user, but not its OrgAccess, contacts, or password
+	testAPI(t, &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}, Verified: true}, nil, "SetUser", `{"User":{"ID":789,"GivenName":"Zed"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 789), dst: User{OrgID: 9}},
+	})
+	testAPI(t, &Session{UserID: 123, OrgID: 8, OrgAccess: []string{"SetUser"}, Verified: true}, nil, "SetUser", `{"User":{"ID":456,"OrgID":8,"GivenName":"Anne","OrgAccess":["SetOrg"],"PasswordHash":"abc","Contacts":[{"Type":"Email","Email":"admin@example.org"}]}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann", OrgID: 8, OrgAccess: []string{"SetBoat"}, UserName: "ann@example.org", PasswordHashCrypt: "old", Contacts: []Contact{{Type: "Email", Email: "ann@example.org"}}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"OrgID":8,"OrgAccess":["SetBoat"],"UserName":"ann@example.org","PasswordHashCrypt":"REDACTED","GivenName":"Ann","Contacts":[{"Type":"Email","Residence":{},"Email":"ann@example.org"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Anne"}}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
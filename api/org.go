@@ -1,19 +1,17 @@
 package api
 
-import (
-	"log"
-)
-
 // Org is a manufacturer or other organization type
 type Org struct {
-	ID          int64     `json:",omitempty" datastore:"-"`
-	Types       []string  `json:",omitempty" datastore:",omitempty" enum:"Marketplace, Club, Crew, Dealer, Financer, Insurer, Manufacturer, Rideshare, Servicer, Tax Authority, Transporter"`
-	Name        string    `json:",omitempty" datastore:",omitempty" qa:"-"`
-	Description string    `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
-	Contacts    []Contact `json:",omitempty" datastore:",omitempty"`
-	EIN         string    `json:",omitempty" datastore:",omitempty,noindex"`
-	Images      []Image   `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
-	Audit       *Audit    `json:",omitempty" datastore:",omitempty"`
+	ID          int64       `json:",omitempty" datastore:"-"`
+	Types       []string    `json:",omitempty" datastore:",omitempty" enum:"Marketplace, Club, Crew, Dealer, Financer, Insurer, Manufacturer, Rideshare, Servicer, Tax Authority, Transporter"`
+	Name        string      `json:",omitempty" datastore:",omitempty" qa:"-"`
+	Description string      `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Contacts    []Contact   `json:",omitempty" datastore:",omitempty"`
+	EIN         string      `json:",omitempty" datastore:",omitempty,noindex"`
+	Images      []Image     `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
+	Invites     []OrgInvite `json:",omitempty" datastore:",omitempty,noindex"`
+	Currencies  []Currency  `json:",omitempty" datastore:",omitempty,noindex"` // of the marketplace org, set by SetCurrencies
+	Audit       *Audit      `json:",omitempty" datastore:",omitempty"`
 }
 
 func init() {
@@ -23,14 +21,12 @@ func init() {
 }
 
 func getPublicOrg(orgID int64) *Org {
-	if orgID == 0 {
-		return nil
-	}
-	org, err := getOrg(orgID)
-	if err != nil {
-		log.Printf("getOrg(%d) => %s", orgID, err.Error())
-		return nil
-	}
+	org, _ := getPublicX("Org", orgID).(*Org)
+	return org
+}
+
+// publicOrg makes the projection of an org that anyone may see
+func publicOrg(org *Org) *Org {
 	return &Org{
 		Name:  org.Name,
 		Types: org.Types,
@@ -79,9 +75,12 @@ func GetOrgs(req *Request, pub *Publication) *Response {
 		}
 	}
 	// sanitize before returning
-	for _, org := range resp.Orgs {
+	for orgID, org := range resp.Orgs {
 		getAudit(req, org)
 		getContacts(org.Contacts)
+		if !isOrgAdmin(req, orgID) {
+			org.Invites = nil
+		}
 	}
 	resp.SubscriptionID = -1
 	return resp
@@ -109,19 +108,21 @@ func SetOrg(req *Request, pub *Publication) *Response {
 	}
 	// can only add new Org if I'm staff or I have no Org yet; can only edit Org if I'm staff or it's my Org
 	addMyNewOrg := req.Org.ID == 0 && req.Session.OrgID == 0
-	if !(staff || req.Org.ID == req.Session.OrgID || addMyNewOrg) {
+	if !(staff || req.Org.ID == req.Session.OrgID || addMyNewOrg) || lacksOrgAccess(req, "SetOrg", req.Org) {
 		return accessDenied()
 	}
-	oldOrg, err := getOrg(req.Org.ID)
-	if err != nil {
-		return errResponse(err)
-	}
-	// finalize and save
-	setAudit(staff, req.Org, oldOrg)
-	if err := setContacts(req.Org.Contacts, oldOrg.Contacts, req); err != nil {
-		return errResponse(err)
-	}
-	key, err := putOrg(req.Org)
+	oldOrg := &Org{}
+	key, err := updateX("Org", req.Org.ID, req.IfMatch, oldOrg, req.Org, func() (interface{}, error) {
+		// Invites are only changed by InviteOrgMember, AcceptOrgInvite, and RemoveOrgMember, and Currencies by SetCurrencies
+		req.Org.Invites = oldOrg.Invites
+		req.Org.Currencies = oldOrg.Currencies
+		// finalize and save
+		setAudit(staff, req.Org, oldOrg)
+		if err := setContacts(req.Org.Contacts, oldOrg.Contacts, req); err != nil {
+			return nil, err
+		}
+		return req.Org, nil
+	})
 	if err != nil {
 		return errResponse(err)
 	}
@@ -129,7 +130,20 @@ func SetOrg(req *Request, pub *Publication) *Response {
 		req.Session.OrgID = key.ID
 		req.Session.OrgTypes = req.Org.Types
 	}
+	if addMyNewOrg && req.Session.UserID != 0 {
+		// I'm the new org's first member, with all OrgAccess
+		user := &User{}
+		if _, err := updateX("User", req.Session.UserID, 0, user, nil, func() (interface{}, error) {
+			user.OrgID = key.ID
+			user.OrgAccess, _ = Enums(User{}, "OrgAccess")
+			return user, nil
+		}); err != nil {
+			return errResponse(err)
+		}
+		req.Session.OrgAccess = user.OrgAccess
+	}
 	return &Response{
-		ID: key.ID,
+		ID:      key.ID,
+		Version: req.Org.Audit.Version,
 	}
 }
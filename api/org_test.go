@@ -12,17 +12,34 @@ func TestSetOrg(t *testing.T) {
 	testAPI(t, session, nil, "SetOrg", `{"Org":{"Types":[]}}`, `{"ErrorCode":"NeedOrgTypes"}`, nil)
 	testAPI(t, session, nil, "SetOrg", `{"Org":{"Types":["Crew","Marketplace"]}}`, `{"ErrorCode":"BadOrgTypes"}`, nil)
 	testAPI(t, session, nil, "SetOrg", `{"Org":{"Types":["Insurer"]}}`, `{"ErrorCode":"BadOrgTypes"}`, nil)
-	testAPI(t, session, nil, "SetOrg", `{"Org":{"Types":["Crew"],"Name":"Acme"}}`, `{"ID":124}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "SetOrg", `{"Org":{"Types":["Crew"],"Name":"Acme"}}`, `{"ID":124,"Version":1}`, []mockDataStoreCall{
 		{
 			name:      "Put",
 			key:       idKey("Org", 0),
 			src:       []*Org{},
-			srcJSON:   `{"Types":["Crew"],"Audit":{"Created":"2020-05-05T05:05:05Z","QANeeded":"2020-05-05T05:05:05Z","QAFields":["Org.Name"],"Org":{"Name":"Acme"}}}`,
+			srcJSON:   `{"Types":["Crew"],"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["Org.Name"],"Org":{"Name":"Acme"}}}`,
 			keyResult: idKey("Org", 124),
 		},
+		{
+			name: "Get",
+			key:  idKey("User", 123),
+			dst:  User{GivenName: "Tom"},
+		},
+		{
+			name:      "Put",
+			key:       idKey("User", 123),
+			src:       []*User{},
+			srcJSON:   `{"ID":123,"OrgID":124,"OrgAccess":["SetOrg","SetUser","SetBoat","SetDeal","SetEvent"],"GivenName":"Tom","Audit":{"Version":1}}`,
+			keyResult: idKey("User", 123),
+		},
 	})
+	if session.OrgID != 124 || len(session.OrgAccess) != 5 {
+		t.Errorf("Wrong session after adding org: %+v", session)
+	}
+	// members need SetOrg OrgAccess
+	testAPI(t, &Session{UserID: 456, OrgID: 124, OrgAccess: []string{"SetBoat"}, Verified: true}, nil, "SetOrg", `{"Org":{"ID":124,"Types":["Crew"],"Name":"Acme 2"}}`, `{"ErrorCode":"AccessDenied"}`, nil)
 	testAPI(t, session, nil, "SetOrg", `{"Org":{"ID":125,"Types":["Crew"],"Name":"Acme 2"}}`, `{"ErrorCode":"AccessDenied"}`, nil)
-	testAPI(t, session, nil, "SetOrg", `{"Org":{"ID":124,"Types":["Crew"],"Name":"Acme 2"}}`, `{"ID":124}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "SetOrg", `{"Org":{"ID":124,"Types":["Crew"],"Name":"Acme 2"}}`, `{"ID":124,"Version":1}`, []mockDataStoreCall{
 		{
 			name: "Get",
 			key:  idKey("Org", 124),
@@ -32,7 +49,7 @@ func TestSetOrg(t *testing.T) {
 			name:      "Put",
 			key:       idKey("Org", 124),
 			src:       []*Org{},
-			srcJSON:   `{"ID":124,"Types":["Crew"],"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","QANeeded":"2020-05-05T05:05:05Z","QAFields":["Org.Name"],"Org":{"Name":"Acme 2"}}}`,
+			srcJSON:   `{"ID":124,"Types":["Crew"],"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["Org.Name"],"Org":{"Name":"Acme 2"}}}`,
 			keyResult: idKey("Org", 124),
 		},
 	})
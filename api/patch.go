@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the ways a subscription's Request.Delta can ask for its updates, besides "" for each changed record in full
+const (
+	deltaPatch = "Patch" // an RFC 6902 JSON Patch of the last response, in Response.Patch
+	deltaMerge = "Merge" // an RFC 7396 JSON Merge Patch of the last response, in Response.Merge
+)
+
+// PatchOperation is an RFC 6902 JSON Patch operation; only add, remove, and replace are used
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// validDelta finds out if a Request.Delta is one we know
+func validDelta(delta string) bool {
+	return delta == "" || delta == deltaPatch || delta == deltaMerge
+}
+
+// patchDelta turns a delta of whole records into a Patch or Merge of only the fields that changed since lastResp, or
+// nil if nothing that's sent changed
+func patchDelta(mode string, deltaResp *Response, lastResp *Response) *Response {
+	delta, last := reflect.ValueOf(deltaResp).Elem(), reflect.ValueOf(lastResp).Elem()
+	patchResp := &Response{}
+	if mode == deltaMerge {
+		patchResp.Merge = map[string]interface{}{}
+	}
+	for _, field := range deltaFields {
+		deltaMap, lastMap := delta.FieldByName(field), last.FieldByName(field)
+		if deltaMap.Len() == 0 {
+			continue
+		}
+		keys := deltaMap.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+		merge := map[string]interface{}{}
+		if lastMap.Len() == 0 {
+			// the last response had no such map to add records to, so it's added whole
+			for _, key := range keys {
+				if nextValue := deltaMap.MapIndex(key); !nextValue.IsNil() {
+					merge[strconv.FormatInt(key.Int(), 10)] = nextValue.Interface()
+				}
+			}
+			if len(merge) > 0 {
+				patchResp.Patch = append(patchResp.Patch, PatchOperation{Op: "add", Path: "/" + field, Value: merge})
+				if mode == deltaMerge {
+					patchResp.Merge[field] = merge
+				}
+			}
+			continue
+		}
+		for _, key := range keys {
+			id := strconv.FormatInt(key.Int(), 10)
+			path := "/" + field + "/" + id
+			nextValue, lastValue := deltaMap.MapIndex(key), lastMap.MapIndex(key)
+			switch {
+			case nextValue.IsNil():
+				patchResp.Patch = append(patchResp.Patch, PatchOperation{Op: "remove", Path: path})
+				merge[id] = nil
+			case !lastValue.IsValid():
+				patchResp.Patch = append(patchResp.Patch, PatchOperation{Op: "add", Path: path, Value: nextValue.Interface()})
+				merge[id] = nextValue.Interface()
+			default:
+				// fields that aren't sent, like json:"-", may be all that changed
+				last, next := jsonTree(lastValue.Interface()), jsonTree(nextValue.Interface())
+				if ops := jsonPatch(path, last, next); len(ops) > 0 {
+					patchResp.Patch = append(patchResp.Patch, ops...)
+					merge[id] = mergePatch(last, next)
+				}
+			}
+		}
+		if mode == deltaMerge && len(merge) > 0 {
+			patchResp.Merge[field] = merge
+		}
+	}
+	if len(patchResp.Patch) == 0 {
+		return nil
+	}
+	if mode == deltaMerge {
+		patchResp.Patch = nil
+	}
+	return patchResp
+}
+
+// jsonTree is how a value looks as JSON: maps, slices, strings, float64s, bools, and nils
+func jsonTree(value interface{}) interface{} {
+	valueJSON, _ := json.Marshal(value)
+	var tree interface{}
+	json.Unmarshal(valueJSON, &tree)
+	return tree
+}
+
+// jsonPatch makes the operations that change last into next at path; arrays that differ are replaced whole
+func jsonPatch(path string, last, next interface{}) []PatchOperation {
+	lastObject, lastOK := last.(map[string]interface{})
+	nextObject, nextOK := next.(map[string]interface{})
+	if !lastOK || !nextOK {
+		if reflect.DeepEqual(last, next) {
+			return nil
+		}
+		return []PatchOperation{{Op: "replace", Path: path, Value: next}}
+	}
+	ops := []PatchOperation{}
+	for _, name := range sortedNames(lastObject, nextObject) {
+		namePath := path + "/" + jsonPointerEscaper.Replace(name)
+		// a null member is the same as a missing one
+		lastValue, nextValue := lastObject[name], nextObject[name]
+		inLast, inNext := lastValue != nil, nextValue != nil
+		switch {
+		case !inLast && !inNext:
+		case !inNext:
+			ops = append(ops, PatchOperation{Op: "remove", Path: namePath})
+		case !inLast:
+			ops = append(ops, PatchOperation{Op: "add", Path: namePath, Value: nextValue})
+		default:
+			ops = append(ops, jsonPatch(namePath, lastValue, nextValue)...)
+		}
+	}
+	return ops
+}
+
+// mergePatch makes the merge patch that changes last into next: only the names that changed, with null for removed
+func mergePatch(last, next interface{}) interface{} {
+	lastObject, lastOK := last.(map[string]interface{})
+	nextObject, nextOK := next.(map[string]interface{})
+	if !lastOK || !nextOK {
+		return next
+	}
+	merge := map[string]interface{}{}
+	for _, name := range sortedNames(lastObject, nextObject) {
+		lastValue, nextValue := lastObject[name], nextObject[name]
+		if nextValue == nil {
+			if lastValue != nil {
+				merge[name] = nil
+			}
+		} else if !reflect.DeepEqual(lastValue, nextValue) {
+			merge[name] = mergePatch(lastValue, nextValue)
+		}
+	}
+	return merge
+}
+
+// jsonPointerEscaper escapes a name for an RFC 6901 JSON Pointer
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// sortedNames gets the names in either object, in order, so patches come out the same every time
+func sortedNames(lastObject, nextObject map[string]interface{}) []string {
+	names := []string{}
+	for name := range lastObject {
+		names = append(names, name)
+	}
+	for name := range nextObject {
+		if _, ok := lastObject[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDelta(t *testing.T) {
+	lastResp := &Response{
+		Boats: map[int64]*Boat{7: {Name: "Sea Breeze"}, 8: {Name: "Wave Runner"}},
+		Users: map[int64]*User{123: {UserName: "john"}},
+	}
+	test := func(nextResp *Response, expect string) {
+		actualJSON, _ := json.Marshal(delta(nextResp, lastResp))
+		if string(actualJSON) != expect {
+			t.Errorf("delta() wrong result\n  actual:%s\n  expect:%s\n", actualJSON, expect)
+		}
+	}
+	test(&Response{Boats: map[int64]*Boat{7: {Name: "Sea Breeze"}, 8: {Name: "Wave Runner"}}, Users: map[int64]*User{123: {UserName: "john"}}}, `null`)
+	// Boat 7 is updated, 8 deleted, and 9 inserted, while Users is left out so it isn't compared
+	test(&Response{Boats: map[int64]*Boat{7: {Name: "Sea Breeze 2"}, 9: {Name: "Blue Moon"}}},
+		`{"Boats":{"7":{"Name":"Sea Breeze 2","Trailer":{}},"8":null,"9":{"Name":"Blue Moon","Trailer":{}}}}`)
+}
+
+func TestPatchDelta(t *testing.T) {
+	available := []time.Time{time.Date(2020, 5, 6, 0, 0, 0, 0, time.UTC), time.Date(2020, 5, 9, 0, 0, 0, 0, time.UTC)}
+	lastResp := &Response{Boats: map[int64]*Boat{
+		7: {Name: "Sea Breeze", Rental: &BoatRental{ListingTitle: "Sea Breeze", NextAvailable: available}},
+		8: {Name: "Wave Runner"},
+	}}
+	nextResp := &Response{Boats: map[int64]*Boat{
+		7: {Name: "Sea Breeze", Rental: &BoatRental{ListingTitle: "Sea Breeze", NextAvailable: available[1:]}},
+		9: {Name: "Blue/Moon~"},
+	}}
+	test := func(mode string, expect string) {
+		actualJSON, _ := json.Marshal(patchDelta(mode, delta(nextResp, lastResp), lastResp))
+		if string(actualJSON) != expect {
+			t.Errorf("patchDelta(%s) wrong result\n  actual:%s\n  expect:%s\n", mode, actualJSON, expect)
+		}
+	}
+	// only NextAvailable is sent for boat 7
+	test(deltaPatch, `{"Patch":[`+
+		`{"op":"replace","path":"/Boats/7/Rental/NextAvailable","value":["2020-05-09T00:00:00Z"]},`+
+		`{"op":"remove","path":"/Boats/8"},`+
+		`{"op":"add","path":"/Boats/9","value":{"Name":"Blue/Moon~","Trailer":{}}}]}`)
+	test(deltaMerge, `{"Merge":{"Boats":{"7":{"Rental":{"NextAvailable":["2020-05-09T00:00:00Z"]}},"8":null,"9":{"Name":"Blue/Moon~","Trailer":{}}}}}`)
+	// a field removed from a record
+	nextResp.Boats[7].Rental = nil
+	test(deltaPatch, `{"Patch":[{"op":"remove","path":"/Boats/7/Rental"},{"op":"remove","path":"/Boats/8"},{"op":"add","path":"/Boats/9","value":{"Name":"Blue/Moon~","Trailer":{}}}]}`)
+	test(deltaMerge, `{"Merge":{"Boats":{"7":{"Rental":null},"8":null,"9":{"Name":"Blue/Moon~","Trailer":{}}}}}`)
+	// when the last response had no boats, there's no /Boats to add to, so it's added whole
+	lastResp.Boats = map[int64]*Boat{}
+	test(deltaPatch, `{"Patch":[{"op":"add","path":"/Boats","value":{"7":{"Name":"Sea Breeze","Trailer":{}},"9":{"Name":"Blue/Moon~","Trailer":{}}}}]}`)
+	test(deltaMerge, `{"Merge":{"Boats":{"7":{"Name":"Sea Breeze","Trailer":{}},"9":{"Name":"Blue/Moon~","Trailer":{}}}}}`)
+	// names are escaped in paths
+	if ops := jsonPatch("/Boats/9", map[string]interface{}{"a/b~": 1.0}, map[string]interface{}{"a/b~": 2.0}); len(ops) != 1 || ops[0].Path != "/Boats/9/a~1b~0" {
+		t.Errorf("jsonPatch() => %+v, expected path /Boats/9/a~1b~0", ops)
+	}
+}
@@ -0,0 +1,350 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Referral is a user's or org's referral code and link, and how many users signed up and were awarded with it
+type Referral struct {
+	Code     string `json:",omitempty"`
+	URL      string `json:",omitempty"`
+	Referred int    `json:",omitempty"`
+	Awarded  int    `json:",omitempty"`
+}
+
+// UserReferral is how a user was referred; the referrer is ReferredByUserID or ReferredByOrgID
+type UserReferral struct {
+	Code     string     `json:",omitempty" datastore:",omitempty,noindex"`
+	Status   string     `json:",omitempty" datastore:",omitempty" enum:"Pending, Awarded, Rejected"`
+	Reason   string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Same IP, Same Payment Method"`
+	IP       string     `json:",omitempty" datastore:",omitempty"`
+	Referred *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	Awarded  *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// UserReward is an entry in a user's RewardPoints ledger; Points are negative when redeemed
+type UserReward struct {
+	Date   *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	Points int        `json:",omitempty" datastore:",omitempty,noindex"`
+	Reason string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Referral, Referred, Redeemed, Refunded"`
+	DealID int64      `json:",omitempty" datastore:",omitempty,noindex"`
+	UserID int64      `json:",omitempty" datastore:",omitempty,noindex"` // the referred user, for Referral
+}
+
+// referrerPoints are awarded to the referring user, and refereePoints to the referred user, after the referred user's
+// first completed rental
+const (
+	referrerPoints = 2500
+	refereePoints  = 1000
+)
+
+func init() {
+	addEnumsFor(UserReferral{})
+	addEnumsFor(UserReward{})
+	apiHandlers["GetReferral"] = GetReferral
+	apiHandlers["AwardReferrals"] = AwardReferrals
+}
+
+// startReferralAwards awards referrals once a day, on one instance
+func startReferralAwards() {
+	startDailyJob(referralAwardsJob, "awardReferrals", "awarded", awardReferrals)
+}
+
+// GetReferral gets my referral code and link, or my org's if OrgID, with how many users it referred and was awarded for
+func GetReferral(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	code := referralCode("U", req.Session.UserID)
+	filter := map[string]interface{}{"ReferredByUserID=": req.Session.UserID}
+	if req.OrgID != 0 {
+		if req.OrgID != req.Session.OrgID && !isStaff(req) {
+			return accessDenied()
+		}
+		code = referralCode("O", req.OrgID)
+		filter = map[string]interface{}{"ReferredByOrgID=": req.OrgID}
+	}
+	var users []*User
+	if _, err := getAllUsers(filter, &users); err != nil {
+		return errResponse(err)
+	}
+	referral := &Referral{Code: code, URL: "https://www.boatfuji.com/?ref=" + code, Referred: len(users)}
+	for _, user := range users {
+		if user.Referral != nil && user.Referral.Status == "Awarded" {
+			referral.Awarded++
+		}
+	}
+	return &Response{Referral: referral}
+}
+
+// AwardReferrals lets staff award referrals now, instead of waiting for the daily run
+func AwardReferrals(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if _, err := awardReferrals(); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+// referralCode is a user's ("U") or org's ("O") ID in base 36
+func referralCode(prefix string, id int64) string {
+	return prefix + strings.ToUpper(strconv.FormatInt(id, 36))
+}
+
+// setReferral attributes a new user to the user or org whose referral code is code, and rejects the referral if the
+// referrer is signed in from the same IP, or another user referred by code signed up from it
+func setReferral(req *Request, user *User, code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	badCode := Err("BadReferralCode", map[string]string{"Code": code})
+	if len(code) < 2 {
+		return badCode
+	}
+	id, err := strconv.ParseInt(code[1:], 36, 64)
+	if err != nil || id <= 0 {
+		return badCode
+	}
+	switch code[0] {
+	case 'U':
+		if _, err := getUser(id); err != nil {
+			return badCode
+		}
+		user.ReferredByUserID = id
+	case 'O':
+		if _, err := getOrg(id); err != nil {
+			return badCode
+		}
+		user.ReferredByOrgID = id
+	default:
+		return badCode
+	}
+	user.Referral = &UserReferral{Code: code, Status: "Pending", IP: req.Session.IP, Referred: now()}
+	if req.Session.IP == "" {
+		return nil
+	}
+	if user.ReferredByUserID != 0 {
+		sessionsMutex.Lock()
+		for _, session := range sessions {
+			if session.UserID == user.ReferredByUserID && session.IP == req.Session.IP {
+				user.Referral.Status = "Rejected"
+				user.Referral.Reason = "SameIP"
+			}
+		}
+		sessionsMutex.Unlock()
+		if user.Referral.Status == "Rejected" {
+			return nil
+		}
+	}
+	var others []*User
+	if _, err := getAllUsers(map[string]interface{}{"Referral.IP=": req.Session.IP}, &others); err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Referral.Code == code {
+			user.Referral.Status = "Rejected"
+			user.Referral.Reason = "SameIP"
+		}
+	}
+	return nil
+}
+
+// awardReferrals awards RewardPoints to Pending referred users whose first rental is complete, and to the users who
+// referred them, unless both have the same payment method
+func awardReferrals() (int, error) {
+	var referees []*User
+	keys, err := getAllUsers(map[string]interface{}{"Referral.Status=": "Pending"}, &referees)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range keys {
+		dealID, err := completedRental(key.ID)
+		if err != nil {
+			return count, err
+		}
+		if dealID == 0 {
+			continue
+		}
+		// the referee and referrer are changed in a transaction, so nothing else they change is lost, and a referral is
+		// only awarded once
+		referee := &User{}
+		var referrer *User
+		awarded := false
+		if _, err := updateXTx("User", key.ID, 0, referee, nil, func(tx datastorer) (interface{}, error) {
+			referrer, awarded = nil, false
+			if referee.Referral == nil || referee.Referral.Status != "Pending" {
+				return nil, nil
+			}
+			if referee.ReferredByUserID != 0 {
+				referrer = &User{}
+				if err := tx.Get(apiContext, idKey("User", referee.ReferredByUserID), referrer); err != nil {
+					return nil, err
+				}
+				referrer.ID = referee.ReferredByUserID
+				if samePaymentMethod(referrer, referee) {
+					referrer = nil
+					referee.Referral.Status = "Rejected"
+					referee.Referral.Reason = "SamePaymentMethod"
+					return referee, nil
+				}
+			}
+			referee.Referral.Status = "Awarded"
+			referee.Referral.Awarded = now()
+			addRewards(referee, UserReward{Points: refereePoints, Reason: "Referred", DealID: dealID})
+			if referrer != nil {
+				addRewards(referrer, UserReward{Points: referrerPoints, Reason: "Referral", UserID: key.ID})
+				if err := putXTx(tx, idKey("User", referrer.ID), referrer); err != nil {
+					return nil, err
+				}
+			}
+			awarded = true
+			return referee, nil
+		}); err != nil {
+			return count, err
+		}
+		if referrer != nil {
+			publish(publicationOf(idKey("User", referrer.ID), referrer))
+		}
+		if awarded {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// completedRental gets the first of a user's booked rentals that has ended and was paid for, or 0 if none has
+func completedRental(userID int64) (int64, error) {
+	var deals []*Deal
+	keys, err := getAllDeals(map[string]interface{}{"UserID=": userID}, &deals)
+	if err != nil {
+		return 0, err
+	}
+	for index, key := range keys {
+		if rental := deals[index].Rental; rental != nil && rental.Status == "Booked" && rental.End != nil && rental.End.Before(*now()) {
+			paid, err := capturedPayment(key.ID)
+			if err != nil {
+				return 0, err
+			}
+			if paid {
+				return key.ID, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// capturedPayment finds out if a deal has a Rental payment that was approved
+func capturedPayment(dealID int64) (bool, error) {
+	var events []*Event
+	if _, err := getAllEvents(map[string]interface{}{"DealID=": dealID}, &events); err != nil {
+		return false, err
+	}
+	for _, event := range events {
+		if payment := event.Payment; payment != nil && payment.Purpose == "Rental" && payment.Amount > 0 && payment.Approval != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// samePaymentMethod finds out if two users have a credit card in common
+func samePaymentMethod(a, b *User) bool {
+	for _, cardA := range a.CreditCards {
+		for _, cardB := range b.CreditCards {
+			if cardA.Token != "" && cardA.Token == cardB.Token ||
+				cardA.Last4 != "" && cardA.Last4 == cardB.Last4 && sameTime(cardA.ExpirationDate, cardB.ExpirationDate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addRewards adds reward to user's RewardPoints and its ledger
+func addRewards(user *User, reward UserReward) {
+	reward.Date = now()
+	user.RewardPoints += reward.Points
+	user.Rewards = append(user.Rewards, reward)
+}
+
+// redeemRewards keeps the renter's ledger in step with a rental's RewardPoints, in the deal's transaction, tx: they're
+// redeemed while it's Requested or Booked, only from the renter when they're the one setting it, and what the ledger
+// shows was redeemed for it is refunded once it isn't. Its RewardPoints and RewardsDiscount can't change once it's
+// Booked, or by anyone but the renter, and its RewardsDiscount is what its RewardPoints are worth. It returns the
+// renter if they were put, or nil.
+func redeemRewards(tx datastorer, req *Request, oldDeal *Deal) (*User, error) {
+	deal := req.Deal
+	rental := deal.Rental
+	if rental == nil {
+		return nil, nil
+	}
+	oldRental := oldDeal.Rental
+	if oldRental == nil {
+		oldRental = &EventRental{}
+	}
+	renterID := oldDeal.UserID
+	if deal.ID == 0 {
+		renterID = deal.UserID
+		if renterID == 0 {
+			renterID = req.Session.UserID
+		}
+	}
+	if oldRental.Status == "Booked" || renterID != req.Session.UserID {
+		rental.RewardPoints = oldRental.RewardPoints
+		rental.RewardsDiscount = oldRental.RewardsDiscount
+	} else {
+		// the discount is what the points are worth, not what the client says
+		asked := rental.RewardsDiscount
+		discount, points := redeemedRewards(rental.RewardPoints, rental.Currency, float64(rental.Price))
+		rental.RewardsDiscount, rental.RewardPoints = float32(discount), points
+		if rental.RewardsDiscount != asked && rental.Start != nil {
+			setRentalTotal(rental)
+		}
+	}
+	points := heldRewards(rental)
+	if points == heldRewards(oldRental) || renterID == 0 {
+		return nil, nil
+	}
+	renter := &User{}
+	key := idKey("User", renterID)
+	if err := tx.Get(apiContext, key, renter); err != nil {
+		return nil, err
+	}
+	renter.ID = renterID
+	redeemed := 0
+	for _, reward := range renter.Rewards {
+		if reward.DealID == deal.ID {
+			redeemed -= reward.Points
+		}
+	}
+	switch {
+	case points > redeemed:
+		if renterID != req.Session.UserID {
+			return nil, errors.New("AccessDenied")
+		}
+		if renter.RewardPoints < points-redeemed {
+			return nil, Err("NotEnoughRewards", map[string]string{"RewardPoints": strconv.Itoa(renter.RewardPoints)})
+		}
+		addRewards(renter, UserReward{Points: redeemed - points, Reason: "Redeemed", DealID: deal.ID})
+	case points < redeemed:
+		addRewards(renter, UserReward{Points: redeemed - points, Reason: "Refunded", DealID: deal.ID})
+	default:
+		return nil, nil
+	}
+	if err := putXTx(tx, key, renter); err != nil {
+		return nil, err
+	}
+	return renter, nil
+}
+
+// heldRewards is how many RewardPoints a rental holds from the renter, while it's Requested or Booked
+func heldRewards(rental *EventRental) int {
+	if rental.Status == "Requested" || rental.Status == "Booked" {
+		return rental.RewardPoints
+	}
+	return 0
+}
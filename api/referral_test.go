@@ -0,0 +1,247 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestGetReferral(t *testing.T) {
+	session := &Session{UserID: 123, OrgID: 8, Verified: true}
+	testAPI(t, session, nil, "GetReferral", `{"OrgID":9}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	testAPI(t, session, nil, "GetReferral", `{}`, `{"Referral":{"Code":"U3F","URL":/".*ref=U3F"/,"Referred":2,"Awarded":1}}`, []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("User", map[string]interface{}{"ReferredByUserID=": 123}),
+			dst:        []*User{{Referral: &UserReferral{Status: "Awarded"}}, {Referral: &UserReferral{Status: "Pending"}}},
+			keysResult: []*datastore.Key{idKey("User", 456), idKey("User", 789)},
+		},
+	})
+	testAPI(t, session, nil, "GetReferral", `{"OrgID":8}`, `{"Referral":{"Code":"O8","URL":/".*ref=O8"/}}`, []mockDataStoreCall{
+		{
+			name: "GetAll",
+			q:    newQuery("User", map[string]interface{}{"ReferredByOrgID=": 8}),
+			dst:  []*User{},
+		},
+	})
+}
+
+func TestSignUpReferral(t *testing.T) {
+	testAPI(t, &Session{IP: "10.0.0.1"}, nil, "SetUser", `{"User":{"GivenName":"Ann"},"ReferralCode":"X3F"}`, `{"ErrorCode":"BadReferralCode","ErrorDetails":{"Code":"X3F"}}`, nil)
+	// a referred user can't award themselves
+	testAPI(t, &Session{IP: "10.0.0.1"}, nil, "SetUser", `{"User":{"GivenName":"Ann","RewardPoints":5000},"ReferralCode":"u3f"}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 123), dst: User{GivenName: "Tom"}},
+		{
+			name: "GetAll",
+			q:    newQuery("User", map[string]interface{}{"Referral.IP=": "10.0.0.1"}),
+			dst:  []*User{},
+		},
+		{
+			name:      "Put",
+			key:       idKey("User", 0),
+			src:       []*User{},
+			srcJSON:   `{"ReferredByUserID":123,"Referral":{"Code":"U3F","Status":"Pending","IP":"10.0.0.1","Referred":"2020-05-05T05:05:05Z"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Ann"}}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// another user referred by the same code signed up from the same IP
+	testAPI(t, &Session{IP: "10.0.0.1"}, nil, "SetUser", `{"User":{"GivenName":"Ann"},"ReferralCode":"U3F"}`, `{"ID":457,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 123), dst: User{GivenName: "Tom"}},
+		{
+			name:       "GetAll",
+			q:          newQuery("User", map[string]interface{}{"Referral.IP=": "10.0.0.1"}),
+			dst:        []*User{{ReferredByUserID: 123, Referral: &UserReferral{Code: "U3F", Status: "Pending", IP: "10.0.0.1"}}},
+			keysResult: []*datastore.Key{idKey("User", 456)},
+		},
+		{
+			name:      "Put",
+			key:       idKey("User", 0),
+			src:       []*User{},
+			srcJSON:   `{"ReferredByUserID":123,"Referral":{"Code":"U3F","Status":"Rejected","Reason":"SameIP","IP":"10.0.0.1","Referred":"2020-05-05T05:05:05Z"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Ann"}}}`,
+			keyResult: idKey("User", 457),
+		},
+	})
+}
+
+func TestAwardReferrals(t *testing.T) {
+	testAPI(t, &Session{UserID: 123}, nil, "AwardReferrals", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	card := CreditCard{Last4: "4242", ExpirationDate: DateTime(2024, 1, 31, 0, 0, 0)}
+	testAPI(t, staff, nil, "AwardReferrals", `{}`, `{}`, []mockDataStoreCall{
+		{
+			name: "GetAll",
+			q:    newQuery("User", map[string]interface{}{"Referral.Status=": "Pending"}),
+			dst: []*User{
+				{GivenName: "Ann", ReferredByUserID: 123, Referral: &UserReferral{Code: "U3F", Status: "Pending"}},
+				{GivenName: "Bob", ReferredByUserID: 123, Referral: &UserReferral{Code: "U3F", Status: "Pending"}},
+				{GivenName: "Cat", ReferredByUserID: 123, CreditCards: []CreditCard{card}, Referral: &UserReferral{Code: "U3F", Status: "Pending"}},
+			},
+			keysResult: []*datastore.Key{idKey("User", 456), idKey("User", 457), idKey("User", 458)},
+		},
+		// Ann's rental is over
+		{
+			name: "GetAll",
+			q:    newQuery("Deal", map[string]interface{}{"UserID=": 456}),
+			dst: []*Deal{
+				{BoatID: 7, UserID: 456, Rental: &EventRental{Status: "Canceled", End: DateTime(2020, 4, 1, 0, 0, 0)}},
+				{BoatID: 7, UserID: 456, Rental: &EventRental{Status: "Booked", End: DateTime(2020, 5, 1, 0, 0, 0)}},
+			},
+			keysResult: []*datastore.Key{idKey("Deal", 40), idKey("Deal", 41)},
+		},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"DealID=": int64(41)}),
+			dst:        []*Event{{DealID: 41, Payment: &EventPayment{Purpose: "Rental", Amount: 300, Approval: "A1"}}},
+			keysResult: []*datastore.Key{idKey("Event", 50)},
+		},
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann", ReferredByUserID: 123, Referral: &UserReferral{Code: "U3F", Status: "Pending"}}},
+		{name: "Get", key: idKey("User", 123), dst: User{GivenName: "Tom", RewardPoints: 100}},
+		{
+			name:      "Put",
+			key:       idKey("User", 123),
+			src:       []*User{},
+			srcJSON:   `{"ID":123,"GivenName":"Tom","RewardPoints":2600,"Rewards":[{"Date":"2020-05-05T05:05:05Z","Points":2500,"Reason":"Referral","UserID":456}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 123),
+		},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"ReferredByUserID":123,"GivenName":"Ann","RewardPoints":1000,"Rewards":[{"Date":"2020-05-05T05:05:05Z","Points":1000,"Reason":"Referred","DealID":41}],"Referral":{"Code":"U3F","Status":"Awarded","Awarded":"2020-05-05T05:05:05Z"},"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		// Bob's first rental wasn't paid for, and his second hasn't ended yet
+		{
+			name: "GetAll",
+			q:    newQuery("Deal", map[string]interface{}{"UserID=": 457}),
+			dst: []*Deal{
+				{BoatID: 7, UserID: 457, Rental: &EventRental{Status: "Booked", End: DateTime(2020, 5, 1, 0, 0, 0)}},
+				{BoatID: 7, UserID: 457, Rental: &EventRental{Status: "Booked", End: DateTime(2020, 6, 1, 0, 0, 0)}},
+			},
+			keysResult: []*datastore.Key{idKey("Deal", 44), idKey("Deal", 42)},
+		},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"DealID=": int64(44)}),
+			dst:        []*Event{{DealID: 44, Payment: &EventPayment{Purpose: "Rental", Amount: 300}}},
+			keysResult: []*datastore.Key{idKey("Event", 51)},
+		},
+		// Cat pays with Tom's card
+		{
+			name:       "GetAll",
+			q:          newQuery("Deal", map[string]interface{}{"UserID=": 458}),
+			dst:        []*Deal{{BoatID: 7, UserID: 458, Rental: &EventRental{Status: "Booked", End: DateTime(2020, 5, 1, 0, 0, 0)}}},
+			keysResult: []*datastore.Key{idKey("Deal", 43)},
+		},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"DealID=": int64(43)}),
+			dst:        []*Event{{DealID: 43, Payment: &EventPayment{Purpose: "Rental", Amount: 300, Approval: "A2"}}},
+			keysResult: []*datastore.Key{idKey("Event", 52)},
+		},
+		{name: "Get", key: idKey("User", 458), dst: User{GivenName: "Cat", ReferredByUserID: 123, CreditCards: []CreditCard{card}, Referral: &UserReferral{Code: "U3F", Status: "Pending"}}},
+		{name: "Get", key: idKey("User", 123), dst: User{GivenName: "Tom", CreditCards: []CreditCard{card}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 458),
+			src:       []*User{},
+			srcJSON:   `{"ID":458,"ReferredByUserID":123,"GivenName":"Cat","Referral":{"Code":"U3F","Status":"Rejected","Reason":"SamePaymentMethod"},"CreditCards":[{"Last4":"4242","ExpirationDate":"2024-01-31T00:00:00Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 458),
+		},
+	})
+}
+
+func TestRedeemRewards(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	booked := `{"Deal":{"BoatID":7,"Rental":{"Price":600,"Status":"Booked","RewardsDiscount":30,"RewardPoints":3000}}}`
+	interested := `{"BoatID":7,"UserID":456,"Rental":{"Price":600,"RewardsDiscount":30,"RewardPoints":3000,"Status":"Interested"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`
+	// a new deal is put first, so its ID is in the ledger
+	testAPI(t, session, nil, "SetDeal", booked, `{"ErrorCode":"NotEnoughRewards","ErrorDetails":{"RewardPoints":"1000"}}`, []mockDataStoreCall{
+		{name: "Put", key: idKey("Deal", 0), src: []*Deal{}, srcJSON: interested, keyResult: idKey("Deal", 41)},
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Price: 600, Status: "Interested", RewardsDiscount: 30, RewardPoints: 3000}, Audit: &Audit{Created: DateTime(2020, 5, 5, 5, 5, 5), Version: 1}}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("User", 456), dst: User{RewardPoints: 1000}},
+	})
+	testAPI(t, session, nil, "SetDeal", booked, `{"ID":41,"Version":2}`, []mockDataStoreCall{
+		{name: "Put", key: idKey("Deal", 0), src: []*Deal{}, srcJSON: interested, keyResult: idKey("Deal", 41)},
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Price: 600, Status: "Interested", RewardsDiscount: 30, RewardPoints: 3000}, Audit: &Audit{Created: DateTime(2020, 5, 5, 5, 5, 5), Version: 1}}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{name: "Get", key: idKey("User", 456), dst: User{RewardPoints: 3500}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"RewardPoints":500,"Rewards":[{"Date":"2020-05-05T05:05:05Z","Points":-3000,"Reason":"Redeemed","DealID":41}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Rental: &BoatRental{}}},
+		{name: "GetAll", q: newQuery("Deal", map[string]interface{}{"BoatID=": int64(7)}), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+		{name: "Put", key: idKey("Boat", 7), src: []*Boat{}, srcJSON: `{"ID":7,"UserID":123,"Trailer":{},"Rental":{},"Audit":{"Version":1}}`, keyResult: idKey("Boat", 7)},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"RewardsDiscount":30,"RewardPoints":3000,"Status":"Booked"},"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","Version":2}}`,
+			keyResult: idKey("Deal", 41),
+		},
+	})
+	// RewardPoints and RewardsDiscount can't change once it's booked
+	testAPI(t, session, nil, "SetDeal", `{"Deal":{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"Status":"Booked","RewardsDiscount":90,"RewardPoints":9000}}}`, `{"ID":41,"Version":2}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Price: 600, Status: "Booked", RewardsDiscount: 30, RewardPoints: 3000}, Audit: &Audit{Created: DateTime(2020, 5, 5, 5, 5, 5), Version: 1}}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"RewardsDiscount":30,"RewardPoints":3000,"Status":"Booked"},"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","Version":2}}`,
+			keyResult: idKey("Deal", 41),
+		},
+	})
+	// nobody else can redeem the renter's RewardPoints
+	testAPI(t, &Session{UserID: 789, Verified: true}, nil, "SetDeal", `{"Deal":{"ID":42,"BoatID":7,"UserID":456,"Rental":{"Status":"Requested","RewardsDiscount":30,"RewardPoints":3000}}}`, `{"ID":42,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 42), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Status: "Requested"}}},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 42),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":42,"BoatID":7,"UserID":456,"Rental":{"Status":"Requested"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 42),
+		},
+	})
+	// canceling refunds what the ledger shows was redeemed for it
+	testAPI(t, session, nil, "SetDeal", `{"Deal":{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"Status":"Canceled","RewardsDiscount":30,"RewardPoints":3000}}}`, `{"ID":41,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Price: 600, Status: "Booked", RewardsDiscount: 30, RewardPoints: 3000}}},
+		{name: "Get", key: idKey("User", 456), dst: User{RewardPoints: 500, Rewards: []UserReward{
+			{Date: DateTime(2020, 5, 1, 0, 0, 0), Points: -3000, Reason: "Redeemed", DealID: 41},
+			{Date: DateTime(2020, 5, 2, 0, 0, 0), Points: 1000, Reason: "Refunded", DealID: 41},
+		}}},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"RewardPoints":2500,"Rewards":[{"Date":"2020-05-01T00:00:00Z","Points":-3000,"Reason":"Redeemed","DealID":41},{"Date":"2020-05-02T00:00:00Z","Points":1000,"Reason":"Refunded","DealID":41},{"Date":"2020-05-05T05:05:05Z","Points":2000,"Reason":"Refunded","DealID":41}],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Rental: &BoatRental{}}},
+		{name: "GetAll", q: newQuery("Deal", map[string]interface{}{"BoatID=": int64(7)}), dst: []*Deal{}, keysResult: []*datastore.Key{}},
+		{name: "Put", key: idKey("Boat", 7), src: []*Boat{}, srcJSON: `{"ID":7,"UserID":123,"Trailer":{},"Rental":{},"Audit":{"Version":1}}`, keyResult: idKey("Boat", 7)},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"RewardsDiscount":30,"RewardPoints":3000,"Status":"Canceled"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+	}) // the discount is what the points are worth, whatever the client says
+	testAPI(t, session, nil, "SetDeal", `{"Deal":{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"Status":"Interested","RewardsDiscount":90,"RewardPoints":3000}}}`, `{"ID":41,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: Deal{BoatID: 7, UserID: 456, Rental: &EventRental{Price: 600, Status: "Interested"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			src:       []*Deal{},
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":456,"Rental":{"Price":600,"RewardsDiscount":30,"RewardPoints":3000,"Status":"Interested"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+	})
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+)
+
+func init() {
+	addEnumsFor(EventSale{})
+	apiHandlers["MakeOffer"] = MakeOffer
+	apiHandlers["CounterOffer"] = CounterOffer
+	apiHandlers["AcceptOffer"] = AcceptOffer
+	apiHandlers["WithdrawOffer"] = WithdrawOffer
+}
+
+// MakeOffer is when a buyer offers to buy BoatID, or a Fraction of it, for Offer's Price, with Text as notes
+func MakeOffer(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	if req.Offer == nil {
+		return &Response{ErrorCode: "NeedOffer"}
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if isMine(req, boat) {
+		return &Response{ErrorCode: "OwnBoat"}
+	}
+	if err := checkOffer(boat, req.Offer); err != nil {
+		return errResponse(err)
+	}
+	// a buyer negotiates one offer at a time per boat
+	offers, err := getOpenOffers(boat.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	for _, offer := range offers {
+		if offer.UserID == req.Session.UserID {
+			return &Response{ErrorCode: "OfferOpen", ErrorDetails: map[string]string{"EventID": strconv.FormatInt(offer.ID, 10)}}
+		}
+	}
+	event := &Event{
+		BoatID:      boat.ID,
+		UserID:      req.Session.UserID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: []int64{boat.UserID},
+		Sale: &EventSale{
+			Status:       "Open",
+			Fraction:     req.Offer.Fraction,
+			Price:        req.Offer.Price,
+			Currency:     boat.Currency,
+			SellerUserID: boat.UserID,
+			Notes:        req.Text,
+		},
+		Audit: &Audit{Created: now()},
+	}
+	key, err := putEvent(event)
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// CounterOffer is when the buyer or seller answers open offer EventID with a new Price (and maybe Fraction) in Offer
+func CounterOffer(req *Request, pub *Publication) *Response {
+	if req.Offer == nil {
+		return &Response{ErrorCode: "NeedOffer"}
+	}
+	event, boat, err := getOffer(req, true)
+	if err != nil {
+		return errResponse(err)
+	}
+	if req.Offer.Fraction == 0 {
+		req.Offer.Fraction = event.Sale.Fraction
+	}
+	if err := checkOffer(boat, req.Offer); err != nil {
+		return errResponse(err)
+	}
+	event.Sale.Status = "Countered"
+	if _, err := putEvent(event); err != nil {
+		return errResponse(err)
+	}
+	counter := &Event{
+		BoatID:      event.BoatID,
+		UserID:      event.UserID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: []int64{event.FromUserID},
+		Sale: &EventSale{
+			Status:       "Open",
+			Fraction:     req.Offer.Fraction,
+			Price:        req.Offer.Price,
+			Currency:     event.Sale.Currency,
+			SellerUserID: event.Sale.SellerUserID,
+			PrevEventID:  event.ID,
+			Notes:        req.Text,
+		},
+		Audit: &Audit{Created: now()},
+	}
+	key, err := putEvent(counter)
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// AcceptOffer is when the buyer or seller accepts open offer EventID, which sells the boat (or the fraction), closes competing
+// offers, and makes a Deal for the buyer and seller
+func AcceptOffer(req *Request, pub *Publication) *Response {
+	event, boat, err := getOffer(req, true)
+	if err != nil {
+		return errResponse(err)
+	}
+	// the offer and the boat are changed together, so what's sold is only sold once
+	if _, err := updateXTx("Boat", boat.ID, 0, boat, nil, func(tx datastorer) (interface{}, error) {
+		event = &Event{}
+		if err := tx.Get(apiContext, idKey("Event", req.EventID), event); err != nil {
+			return nil, err
+		}
+		event.ID = req.EventID
+		if event.Sale == nil || event.Sale.Status != "Open" {
+			return nil, errors.New("OfferNotOpen")
+		}
+		if err := checkOffer(boat, event.Sale); err != nil {
+			return nil, err
+		}
+		event.Sale.Status = "Accepted"
+		event.UnreadByIDs = []int64{event.FromUserID}
+		if err := putXTx(tx, idKey("Event", event.ID), event); err != nil {
+			return nil, err
+		}
+		// mark the boat or fraction sold; the boat is sold once all its fractions are
+		if isWholeBoat(event.Sale.Fraction) {
+			boat.Sale.SoldDate = now()
+		} else {
+			marked, soldAll := false, true
+			for i := range boat.Sale.Fractions {
+				fraction := &boat.Sale.Fractions[i]
+				if !marked && fraction.SoldDate == nil && fraction.Fraction == event.Sale.Fraction {
+					fraction.SoldDate = now()
+					marked = true
+				}
+				soldAll = soldAll && fraction.SoldDate != nil
+			}
+			if soldAll {
+				boat.Sale.SoldDate = now()
+			}
+		}
+		// a sold boat's listing is no longer live
+		if boat.Sale.SoldDate != nil {
+			boat.Sale.ListingStatus = "Archived"
+		}
+		return boat, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	// the deal links the buyer (UserID) and seller (Sale.SellerUserID); it's new, so it's put once the sale is done
+	deal := &Deal{
+		BoatID: boat.ID,
+		UserID: event.UserID,
+		Sale:   event.Sale,
+		Audit:  &Audit{Created: now()},
+	}
+	dealKey, err := putDeal(deal)
+	if err != nil {
+		return errResponse(err)
+	}
+	accepted := &Event{}
+	if _, err := updateX("Event", event.ID, 0, accepted, nil, func() (interface{}, error) {
+		accepted.DealID = dealKey.ID
+		return accepted, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	// close offers that can no longer be accepted
+	offers, err := getOpenOffers(boat.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	for _, offer := range offers {
+		if offer.ID == event.ID || checkOffer(boat, offer.Sale) == nil {
+			continue
+		}
+		closed := &Event{}
+		if _, err := updateX("Event", offer.ID, 0, closed, nil, func() (interface{}, error) {
+			if closed.Sale == nil || closed.Sale.Status != "Open" {
+				return nil, nil
+			}
+			closed.Sale.Status = "Closed"
+			closed.UnreadByIDs = []int64{closed.UserID}
+			return closed, nil
+		}); err != nil {
+			return errResponse(err)
+		}
+	}
+	return &Response{ID: dealKey.ID}
+}
+
+// WithdrawOffer is when the buyer or seller ends the negotiation of open offer EventID
+func WithdrawOffer(req *Request, pub *Publication) *Response {
+	event, _, err := getOffer(req, false)
+	if err != nil {
+		return errResponse(err)
+	}
+	event.Sale.Status = "Withdrawn"
+	event.UnreadByIDs = []int64{event.UserID, event.Sale.SellerUserID}
+	key, err := putEvent(event)
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// getOffer gets open offer EventID and its boat, if the session's user is the buyer or the seller; answering
+// means the user must be the one the offer was made to
+func getOffer(req *Request, answering bool) (*Event, *Boat, error) {
+	if !isVerifiedUser(req) {
+		return nil, nil, errors.New("MustVerify")
+	}
+	if req.EventID == 0 {
+		return nil, nil, errors.New("NeedEventID")
+	}
+	event, err := getEvent(req.EventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if event.Sale == nil {
+		return nil, nil, errors.New("NeedOffer")
+	}
+	boat, err := getBoat(event.BoatID)
+	if err != nil {
+		return nil, nil, err
+	}
+	buyer := event.UserID == req.Session.UserID
+	seller := isMine(req, boat) && !lacksOrgAccess(req, "SetBoat", boat)
+	if !buyer && !seller {
+		return nil, nil, errors.New("AccessDenied")
+	}
+	if event.Sale.Status != "Open" {
+		return nil, nil, errors.New("OfferNotOpen")
+	}
+	if answering && (buyer && event.FromUserID == event.UserID || seller && event.FromUserID != event.UserID) {
+		return nil, nil, errors.New("NotYourTurn")
+	}
+	return event, boat, nil
+}
+
+// getOpenOffers gets a boat's open offers
+func getOpenOffers(boatID int64) ([]*Event, error) {
+	var events []*Event
+	keys, err := getAllEvents(map[string]interface{}{"BoatID=": boatID}, &events)
+	if err != nil {
+		return nil, err
+	}
+	offers := []*Event{}
+	for index, key := range keys {
+		if event := events[index]; event.Sale != nil && event.Sale.Status == "Open" {
+			event.ID = key.ID
+			offers = append(offers, event)
+		}
+	}
+	return offers, nil
+}
+
+// isBuyer finds out if the session's user bought boatID, or a fraction of it, through an accepted offer
+func isBuyer(req *Request, boatID int64) (bool, error) {
+	var deals []*Deal
+	if _, err := getAllDeals(map[string]interface{}{"BoatID=": boatID}, &deals); err != nil {
+		return false, err
+	}
+	for _, deal := range deals {
+		if deal.UserID == req.Session.UserID && deal.Sale != nil && deal.Sale.Status == "Accepted" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkOffer makes sure a boat is still for sale and an offer is for the whole boat or one of its unsold fractions
+func checkOffer(boat *Boat, offer *EventSale) error {
+	sale := boat.Sale
+	if listingStatus(boat, "Sale") != "Published" {
+		return errors.New("NotForSale")
+	}
+	if sale.SoldDate != nil {
+		return errors.New("Sold")
+	}
+	if sale.CloseDate != nil && now().After(*sale.CloseDate) {
+		return errors.New("SaleClosed")
+	}
+	if offer.Price <= 0 {
+		return errors.New("NeedPrice")
+	}
+	if isWholeBoat(offer.Fraction) {
+		for _, fraction := range sale.Fractions {
+			if fraction.SoldDate != nil {
+				return errors.New("FractionsSold")
+			}
+		}
+		return nil
+	}
+	for _, fraction := range sale.Fractions {
+		if fraction.Fraction == offer.Fraction && fraction.SoldDate == nil {
+			return nil
+		}
+	}
+	return errors.New("BadFraction")
+}
+
+func isWholeBoat(fraction float32) bool {
+	return fraction == 0 || fraction == 1
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestCheckOffer(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	test := func(boat Boat, offer EventSale, expect string) {
+		actual := ""
+		if err := checkOffer(&boat, &offer); err != nil {
+			actual = err.Error()
+		}
+		if actual != expect {
+			t.Errorf("Wrong checkOffer result %q, expect %q", actual, expect)
+		}
+	}
+	test(Boat{}, EventSale{Price: 1}, "NotForSale")
+	test(newSaleBoat(), EventSale{}, "NeedPrice")
+	test(newSaleBoat(), EventSale{Price: 90000}, "")
+	test(newSaleBoat(), EventSale{Fraction: 1, Price: 90000}, "")
+	test(newSaleBoat(), EventSale{Fraction: 0.5, Price: 50000}, "")
+	test(newSaleBoat(), EventSale{Fraction: 0.1, Price: 9000}, "BadFraction")
+	boat := newSaleBoat()
+	boat.Sale.CloseDate = DateTime(2020, 5, 1, 0, 0, 0)
+	test(boat, EventSale{Price: 90000}, "SaleClosed")
+	boat = newSaleBoat()
+	boat.Sale.Fractions[2].SoldDate = DateTime(2020, 5, 1, 0, 0, 0)
+	test(boat, EventSale{Price: 90000}, "FractionsSold")
+	test(boat, EventSale{Fraction: 0.5, Price: 50000}, "BadFraction")
+	test(boat, EventSale{Fraction: 0.25, Price: 25000}, "")
+	boat.Sale.SoldDate = DateTime(2020, 5, 1, 0, 0, 0)
+	test(boat, EventSale{Fraction: 0.25, Price: 25000}, "Sold")
+}
+
+func TestMakeOffer(t *testing.T) {
+	session := &Session{UserID: 456, Verified: true}
+	testAPI(t, &Session{UserID: 456}, nil, "MakeOffer", `{"BoatID":7}`, `{"ErrorCode":"MustVerify"}`, nil)
+	testAPI(t, session, nil, "MakeOffer", `{"BoatID":7}`, `{"ErrorCode":"NeedOffer"}`, nil)
+	testAPI(t, &Session{UserID: 123, Verified: true}, nil, "MakeOffer", `{"BoatID":7,"Offer":{"Price":90000}}`, `{"ErrorCode":"OwnBoat"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+	})
+	// nobody can make an offer for a deleted boat
+	testAPI(t, session, nil, "MakeOffer", `{"BoatID":7,"Offer":{"Price":90000}}`, `{"ErrorCode":"NotFound"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: func() Boat { b := newSaleBoat(); b.Audit = &Audit{Deleted: DateTime(2020, 5, 1, 0, 0, 0)}; return b }()},
+	})
+	testAPI(t, session, nil, "MakeOffer", `{"BoatID":7,"Offer":{"Fraction":0.1,"Price":9000}}`, `{"ErrorCode":"BadFraction"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+	})
+	testAPI(t, session, nil, "MakeOffer", `{"BoatID":7,"Offer":{"Price":90000}}`, `{"ErrorCode":"OfferOpen","ErrorDetails":{"EventID":"51"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"BoatID=": 7}),
+			dst:        []*Event{func() *Event { e := newOffer(456, 123, 0, 95000); return &e }()},
+			keysResult: []*datastore.Key{idKey("Event", 51)},
+		},
+	})
+	testAPI(t, session, nil, "MakeOffer", `{"BoatID":7,"Offer":{"Fraction":0.5,"Price":50000},"Text":"Cash"}`, `{"ID":52}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"BoatID=": 7}),
+			dst:        []*Event{func() *Event { e := newOffer(789, 789, 0, 80000); return &e }()},
+			keysResult: []*datastore.Key{idKey("Event", 51)},
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":456,"FromUserID":456,"UnreadByIDs":[123],"Sale":{"Status":"Open","Fraction":0.5,"Price":50000,"Currency":"USD","SellerUserID":123,"Notes":"Cash"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+	})
+}
+
+func TestCounterOffer(t *testing.T) {
+	seller := &Session{UserID: 123, Verified: true}
+	testAPI(t, &Session{UserID: 789, Verified: true}, nil, "CounterOffer", `{"EventID":51,"Offer":{"Price":95000}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+	})
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "CounterOffer", `{"EventID":51,"Offer":{"Price":95000}}`, `{"ErrorCode":"NotYourTurn"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+	})
+	testAPI(t, seller, nil, "CounterOffer", `{"EventID":51,"Offer":{"Price":95000}}`, `{"ID":52}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"BoatID":7,"UserID":456,"FromUserID":456,"Sale":{"Status":"Countered","Price":90000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":456,"FromUserID":123,"UnreadByIDs":[456],"Sale":{"Status":"Open","Price":95000,"Currency":"USD","SellerUserID":123,"PrevEventID":51},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+	})
+}
+
+func TestAcceptOffer(t *testing.T) {
+	seller := &Session{UserID: 123, Verified: true}
+	testAPI(t, seller, nil, "AcceptOffer", `{"EventID":51}`, `{"ErrorCode":"OfferNotOpen"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: func() Event { e := newOffer(456, 456, 0.5, 50000); e.Sale.Status = "Withdrawn"; return e }()},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+	})
+	// selling the half closes the offers for it and for the whole boat, but not those for a quarter
+	testAPI(t, seller, nil, "AcceptOffer", `{"EventID":51}`, `{"ID":41}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0.5, 50000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0.5, 50000)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"BoatID":7,"UserID":456,"FromUserID":456,"UnreadByIDs":[456],"Sale":{"Status":"Accepted","Fraction":0.5,"Price":50000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Currency":"USD","Trailer":{},"Sale":{"ListingStatus":"Published","Price":100000,"Fractions":[{"Fraction":0.25,"Price":30000},{"Fraction":0.25,"Price":30000},{"Fraction":0.5,"Price":55000,"SoldDate":"2020-05-05T05:05:05Z"}]},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":456,"Sale":{"Status":"Accepted","Fraction":0.5,"Price":50000,"Currency":"USD","SellerUserID":123},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{name: "Get", key: idKey("Event", 51), dst: func() Event {
+			e := newOffer(456, 456, 0.5, 50000)
+			e.Sale.Status = "Accepted"
+			e.UnreadByIDs = []int64{456}
+			e.Audit = &Audit{Version: 1}
+			return e
+		}()},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"DealID":41,"BoatID":7,"UserID":456,"FromUserID":456,"UnreadByIDs":[456],"Sale":{"Status":"Accepted","Fraction":0.5,"Price":50000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":2}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name: "GetAll",
+			q:    newQuery("Event", map[string]interface{}{"BoatID=": 7}),
+			dst: []*Event{
+				func() *Event { e := newOffer(789, 789, 0.5, 48000); return &e }(),
+				func() *Event { e := newOffer(790, 790, 0.25, 25000); return &e }(),
+				func() *Event { e := newOffer(791, 123, 0, 95000); return &e }(),
+			},
+			keysResult: []*datastore.Key{idKey("Event", 52), idKey("Event", 53), idKey("Event", 54)},
+		},
+		{name: "Get", key: idKey("Event", 52), dst: newOffer(789, 789, 0.5, 48000)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 52),
+			srcJSON:   `{"ID":52,"BoatID":7,"UserID":789,"FromUserID":789,"UnreadByIDs":[789],"Sale":{"Status":"Closed","Fraction":0.5,"Price":48000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+		{name: "Get", key: idKey("Event", 54), dst: newOffer(791, 123, 0, 95000)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 54),
+			srcJSON:   `{"ID":54,"BoatID":7,"UserID":791,"FromUserID":123,"UnreadByIDs":[791],"Sale":{"Status":"Closed","Price":95000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 54),
+		},
+	})
+	// selling the whole boat archives its listing
+	testAPI(t, seller, nil, "AcceptOffer", `{"EventID":51}`, `{"ID":41}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"BoatID":7,"UserID":456,"FromUserID":456,"UnreadByIDs":[456],"Sale":{"Status":"Accepted","Price":90000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Currency":"USD","Trailer":{},"Sale":{"ListingStatus":"Archived","Price":100000,"Fractions":[{"Fraction":0.25,"Price":30000},{"Fraction":0.25,"Price":30000},{"Fraction":0.5,"Price":55000}],"SoldDate":"2020-05-05T05:05:05Z"},"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":456,"Sale":{"Status":"Accepted","Price":90000,"Currency":"USD","SellerUserID":123},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{name: "Get", key: idKey("Event", 51), dst: func() Event {
+			e := newOffer(456, 456, 0, 90000)
+			e.Sale.Status = "Accepted"
+			e.UnreadByIDs = []int64{456}
+			e.Audit = &Audit{Version: 1}
+			return e
+		}()},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"DealID":41,"BoatID":7,"UserID":456,"FromUserID":456,"UnreadByIDs":[456],"Sale":{"Status":"Accepted","Price":90000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":2}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"BoatID=": 7}),
+			dst:        []*Event{},
+			keysResult: []*datastore.Key{},
+		},
+	})
+	// another buyer's offer for the whole boat was accepted in the meantime
+	sold := newSaleBoat()
+	sold.Sale.SoldDate = DateTime(2020, 5, 5, 5, 0, 0)
+	sold.Sale.ListingStatus = "Archived"
+	testAPI(t, seller, nil, "AcceptOffer", `{"EventID":51}`, `{"ErrorCode":"NotForSale"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{name: "Get", key: idKey("Boat", 7), dst: sold},
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+	})
+}
+
+func TestWithdrawOffer(t *testing.T) {
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "WithdrawOffer", `{"EventID":51}`, `{"ID":51}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 51), dst: newOffer(456, 456, 0, 90000)},
+		{name: "Get", key: idKey("Boat", 7), dst: newSaleBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Event", 51),
+			srcJSON:   `{"ID":51,"BoatID":7,"UserID":456,"FromUserID":456,"UnreadByIDs":[456,123],"Sale":{"Status":"Withdrawn","Price":90000,"Currency":"USD","SellerUserID":123},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
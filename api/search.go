@@ -0,0 +1,330 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+// UserSearch is a renter's saved GetBoats search; boats published or updated to match it are queued in Matches until
+// they're sent in the user's daily digest, then remembered in Notified so they're only sent once
+type UserSearch struct {
+	Name          string              `json:",omitempty" datastore:",omitempty,noindex"`
+	Location      *appengine.GeoPoint `json:",omitempty" datastore:",omitempty,noindex"`
+	KMRadius      int                 `json:",omitempty" datastore:",omitempty,noindex"`
+	Loc100KM      []int               `json:",omitempty" datastore:",omitempty"` // geoSquares within KMRadius of Location
+	StartDate     *time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
+	EndDate       *time.Time          `json:",omitempty" datastore:",omitempty,noindex"`
+	MakeID        int                 `json:",omitempty" datastore:",omitempty,noindex"`
+	MinYear       int                 `json:",omitempty" datastore:",omitempty,noindex"`
+	MinPassengers int                 `json:",omitempty" datastore:",omitempty,noindex"`
+	MaxDailyPrice float32             `json:",omitempty" datastore:",omitempty,noindex"`
+	Currency      string              `json:",omitempty" datastore:",omitempty,noindex"` // of MaxDailyPrice
+	Matches       []int64             `json:",omitempty" datastore:",omitempty"`
+	Notified      []int64             `json:",omitempty" datastore:",omitempty,noindex"`
+}
+
+// maxSearchKMRadius is the widest saved search, the same as GetBoats' widest
+const maxSearchKMRadius = 150
+
+// maxSearchNotified is how many boats a saved search remembers having sent
+const maxSearchNotified = 200
+
+// searchMatches queues the IDs of boats put, to be matched against saved searches; it's nil until startSearchMatcher
+var searchMatches chan int64
+
+func init() {
+	apiHandlers["SetSearch"] = SetSearch
+	apiHandlers["RemoveSearch"] = RemoveSearch
+	apiHandlers["SendSearchDigests"] = SendSearchDigests
+}
+
+// startSearchMatcher matches boats against saved searches as they're put, and sends search digests once a day, on one instance
+func startSearchMatcher() {
+	searchMatches = make(chan int64, 1000)
+	go func() {
+		for boatID := range searchMatches {
+			if count, err := matchSearches(boatID); err != nil {
+				log.Printf("matchSearches(%d) => %s", boatID, err.Error())
+			} else if count > 0 {
+				log.Printf("matchSearches(%d) matched %d", boatID, count)
+			}
+		}
+	}()
+	startDailyJob(searchDigestsJob, "sendSearchDigests", "sent", sendSearchDigests)
+}
+
+// queueSearchMatch queues a boat to be matched against saved searches, without waiting if the queue is full
+func queueSearchMatch(boatID int64) {
+	if searchMatches == nil {
+		return
+	}
+	select {
+	case searchMatches <- boatID:
+	default:
+		log.Printf("queueSearchMatch(%d) dropped, queue is full", boatID)
+	}
+}
+
+// SetSearch saves Search as one of my searches, replacing the one with the same Name
+func SetSearch(req *Request, pub *Publication) *Response {
+	if req.Session.UserID == 0 {
+		return accessDenied()
+	}
+	search := req.Search
+	if search == nil || strings.TrimSpace(search.Name) == "" {
+		return &Response{ErrorCode: "NeedSearch"}
+	}
+	search.Name = strings.TrimSpace(search.Name)
+	if search.Location == nil {
+		return &Response{ErrorCode: "NeedLocation"}
+	}
+	if (search.StartDate == nil) != (search.EndDate == nil) || search.StartDate != nil && !search.EndDate.After(*search.StartDate) {
+		return &Response{ErrorCode: "BadDates"}
+	}
+	if search.KMRadius <= 0 {
+		search.KMRadius = 50
+	}
+	if search.KMRadius > maxSearchKMRadius {
+		search.KMRadius = maxSearchKMRadius
+	}
+	if search.Currency == "" {
+		search.Currency = "USD"
+	}
+	if _, err := exchangeRate(search.Currency, "USD"); err != nil {
+		return errResponse(err)
+	}
+	loc, err := geoSquare(search.Location.Lat, search.Location.Lng, 100, float64(search.KMRadius))
+	if err != nil {
+		return errResponse(err)
+	}
+	search.Loc100KM = loc
+	user := &User{}
+	key, err := updateX("User", req.Session.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		// boats already matched or sent stay that way, so changing a search doesn't send them again
+		saved := *search
+		saved.Matches = nil
+		saved.Notified = nil
+		if old := findSearch(user, saved.Name); old != nil {
+			saved.Matches = old.Matches
+			saved.Notified = old.Notified
+			*old = saved
+		} else {
+			user.Searches = append(user.Searches, saved)
+		}
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: user.Audit.Version,
+	}
+}
+
+// RemoveSearch removes my saved search named Search.Name
+func RemoveSearch(req *Request, pub *Publication) *Response {
+	if req.Session.UserID == 0 {
+		return accessDenied()
+	}
+	if req.Search == nil || strings.TrimSpace(req.Search.Name) == "" {
+		return &Response{ErrorCode: "NeedSearch"}
+	}
+	name := strings.TrimSpace(req.Search.Name)
+	user := &User{}
+	key, err := updateX("User", req.Session.UserID, req.IfMatch, user, nil, func() (interface{}, error) {
+		searches := []UserSearch{}
+		for _, search := range user.Searches {
+			if search.Name != name {
+				searches = append(searches, search)
+			}
+		}
+		if len(searches) == len(user.Searches) {
+			return nil, errors.New("NoSearch")
+		}
+		user.Searches = searches
+		return user, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: user.Audit.Version,
+	}
+}
+
+// SendSearchDigests lets staff send search digests now, instead of waiting for the daily run
+func SendSearchDigests(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if _, err := sendSearchDigests(); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+// matchSearches adds a boat to the Matches of saved searches near it that it matches and hasn't matched before,
+// returning how many users had a new match
+func matchSearches(boatID int64) (int, error) {
+	boat, err := getBoat(boatID)
+	if err != nil {
+		return 0, err
+	}
+	if !isAvailable(boat, nil, nil) || boat.Location == nil || boat.Location.Location == nil {
+		return 0, nil
+	}
+	loc, err := geoSquare(boat.Location.Location.Lat, boat.Location.Location.Lng, 100, 0)
+	if err != nil {
+		return 0, err
+	}
+	var users []*User
+	keys, err := getAllUsers(map[string]interface{}{"Searches.Loc100KM=": loc[0]}, &users)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for index, key := range keys {
+		// the user is changed in a transaction, so nothing else they change is lost, if it matches what was gotten
+		if key.ID == boat.UserID || !addSearchMatches(users[index], boat) {
+			continue
+		}
+		user := &User{}
+		updated, err := updateX("User", key.ID, 0, user, nil, func() (interface{}, error) {
+			if !addSearchMatches(user, boat) {
+				return nil, nil
+			}
+			return user, nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if updated != nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// addSearchMatches adds a boat to the Matches of a user's saved searches that it matches and hasn't matched before,
+// finding out if it was added to any
+func addSearchMatches(user *User, boat *Boat) bool {
+	matched := false
+	for i := range user.Searches {
+		search := &user.Searches[i]
+		if int64InArray(boat.ID, search.Matches) || int64InArray(boat.ID, search.Notified) || !searchMatch(search, boat) {
+			continue
+		}
+		search.Matches = append(search.Matches, boat.ID)
+		matched = true
+	}
+	return matched
+}
+
+// searchMatch finds out if a published boat matches a saved search
+func searchMatch(search *UserSearch, boat *Boat) bool {
+	if search.Location == nil || kmBetween(search.Location, boat.Location.Location) > float64(search.KMRadius) {
+		return false
+	}
+	if search.EndDate != nil && search.EndDate.Before(*now()) || !isAvailable(boat, search.StartDate, search.EndDate) {
+		return false
+	}
+	if search.MakeID != 0 && boat.MakeID != search.MakeID || boat.Year < search.MinYear || boat.Passengers < search.MinPassengers {
+		return false
+	}
+	if search.MaxDailyPrice > 0 {
+		price := lowestDailyPrice(boat)
+		rate, err := exchangeRate(boat.Currency, search.Currency)
+		if price == 0 || err != nil || float64(price)*rate > float64(search.MaxDailyPrice) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendSearchDigests sends each user with new saved search matches one notification of them, at most once a day, if
+// they want Special Offers or News; either way the matches are then moved to Notified
+func sendSearchDigests() (int, error) {
+	var users []*User
+	keys, err := getAllUsers(map[string]interface{}{"Searches.Matches>": int64(0)}, &users)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for index, key := range keys {
+		if digestedToday(users[index]) {
+			continue
+		}
+		// the user is changed in a transaction, so nothing else they change is lost, and the notification is only
+		// made once they are
+		user := &User{}
+		var lines []string
+		notify := false
+		if _, err := updateX("User", key.ID, 0, user, nil, func() (interface{}, error) {
+			lines, notify = nil, false
+			if digestedToday(user) {
+				return nil, nil
+			}
+			for i := range user.Searches {
+				search := &user.Searches[i]
+				if len(search.Matches) == 0 {
+					continue
+				}
+				lines = append(lines, search.Name+" ("+strconv.Itoa(len(search.Matches))+")")
+				search.Notified = append(search.Notified, search.Matches...)
+				if len(search.Notified) > maxSearchNotified {
+					search.Notified = search.Notified[len(search.Notified)-maxSearchNotified:]
+				}
+				search.Matches = nil
+			}
+			if lines == nil {
+				return nil, nil
+			}
+			if notify = wantsSearchDigest(user); notify {
+				user.SearchDigested = now()
+			}
+			return user, nil
+		}); err != nil {
+			return count, err
+		}
+		if !notify {
+			continue
+		}
+		if _, err := putEvent(&Event{
+			UserID:       key.ID,
+			UnreadByIDs:  []int64{key.ID},
+			Notification: &EventNotification{Text: "New boats match your saved searches: " + strings.Join(lines, ", ") + "."},
+			Audit:        &Audit{Created: now()},
+		}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// digestedToday finds out if a user already got today's search digest
+func digestedToday(user *User) bool {
+	return user.SearchDigested != nil && user.SearchDigested.Format("2006-01-02") == now().Format("2006-01-02")
+}
+
+// wantsSearchDigest finds out if a user wants Special Offers or News, which search digests are sent for
+func wantsSearchDigest(user *User) bool {
+	return StringInArray("SpecialOffers", user.Notifications) || StringInArray("News", user.Notifications)
+}
+
+// findSearch finds a user's saved search by name
+func findSearch(user *User, name string) *UserSearch {
+	for i := range user.Searches {
+		if user.Searches[i].Name == name {
+			return &user.Searches[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestSetSearch(t *testing.T) {
+	session := &Session{UserID: 456}
+	testAPI(t, &Session{}, nil, "SetSearch", `{"Search":{"Name":"Miami"}}`, `{"ErrorCode":"AccessDenied"}`, nil)
+	testAPI(t, session, nil, "SetSearch", `{"Search":{"Name":" "}}`, `{"ErrorCode":"NeedSearch"}`, nil)
+	testAPI(t, session, nil, "SetSearch", `{"Search":{"Name":"Miami"}}`, `{"ErrorCode":"NeedLocation"}`, nil)
+	testAPI(t, session, nil, "SetSearch", `{"Search":{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"StartDate":"2020-06-10T00:00:00Z"}}`, `{"ErrorCode":"BadDates"}`, nil)
+	// a new search
+	testAPI(t, session, nil, "SetSearch", `{"Search":{"Name":"Keys","Location":{"Lat":24.5551,"Lng":-81.78},"KMRadius":500,"MinPassengers":6,"Matches":[9]}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newSearchUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","Notified":[6]},{"Name":"Miami cheap","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"MaxDailyPrice":300,"Currency":"USD"},{"Name":"Keys","Location":{"Lat":24.5551,"Lng":-81.78},"KMRadius":150,"Loc100KM":[10124,10125,10126,10127,10524,10525,10526,10527,10925,10926,10927,10928,11325,11326,11327,11328],"MinPassengers":6,"Currency":"USD"}],"Notifications":["News"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// changing a search keeps what it already matched
+	testAPI(t, session, nil, "SetSearch", `{"Search":{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z"}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newSearchUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"StartDate":"2020-06-10T00:00:00Z","EndDate":"2020-06-12T00:00:00Z","Currency":"USD","Notified":[6]},{"Name":"Miami cheap","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"MaxDailyPrice":300,"Currency":"USD"}],"Notifications":["News"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestRemoveSearch(t *testing.T) {
+	session := &Session{UserID: 456}
+	testAPI(t, session, nil, "RemoveSearch", `{"Search":{"Name":"Keys"}}`, `{"ErrorCode":"NoSearch"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newSearchUser()},
+	})
+	testAPI(t, session, nil, "RemoveSearch", `{"Search":{"Name":"Miami cheap"}}`, `{"ID":456,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("User", 456), dst: newSearchUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","Notified":[6]}],"Notifications":["News"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+}
+
+func TestMatchSearches(t *testing.T) {
+	testTime = DateTime(2020, 5, 5, 5, 5, 5)
+	test := func(boatID int64, expect int, calls []mockDataStoreCall) {
+		mockDataStoreClient = &mockDataStore{t: t, calls: calls}
+		count, err := matchSearches(boatID)
+		mockDataStoreClient.(*mockDataStore).Done()
+		if count != expect || err != nil {
+			t.Errorf("matchSearches(%d) => %d, %v, expected %d", boatID, count, err, expect)
+		}
+	}
+	nearby := func(users ...*User) mockDataStoreCall {
+		keys := []*datastore.Key{}
+		for _, user := range users {
+			keys = append(keys, idKey("User", user.ID))
+		}
+		return mockDataStoreCall{
+			name:       "GetAll",
+			q:          newQuery("User", map[string]interface{}{"Searches.Loc100KM=": 11328}),
+			dst:        users,
+			keysResult: keys,
+		}
+	}
+	// unpublished boats don't match
+	unpublished := newSearchBoat(250)
+	unpublished.Rental.ListingStatus = "Draft"
+	test(7, 0, []mockDataStoreCall{{name: "Get", key: idKey("Boat", 7), dst: unpublished}})
+	// a boat matches both of Ann's searches, but not the owner's own
+	test(7, 1, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newSearchBoat(250)},
+		nearby(func() *User { u := newSearchUser(); u.ID = 456; return &u }(), func() *User { u := newSearchUser(); u.ID = 123; return &u }()),
+		{name: "Get", key: idKey("User", 456), dst: newSearchUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","Matches":[7],"Notified":[6]},{"Name":"Miami cheap","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"MaxDailyPrice":300,"Currency":"USD","Matches":[7]}],"Notifications":["News"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// nor if the user's searches changed since they were gotten
+	test(7, 0, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newSearchBoat(250)},
+		nearby(func() *User { u := newSearchUser(); u.ID = 456; return &u }()),
+		{name: "Get", key: idKey("User", 456), dst: User{GivenName: "Ann"}},
+	})
+	// one that's too expensive only matches the first, and one already notified doesn't match again
+	test(6, 0, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 6), dst: newSearchBoat(350)},
+		nearby(func() *User { u := newSearchUser(); u.ID = 456; return &u }()),
+	})
+	test(8, 1, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 8), dst: newSearchBoat(350)},
+		nearby(func() *User { u := newSearchUser(); u.ID = 456; return &u }()),
+		{name: "Get", key: idKey("User", 456), dst: newSearchUser()},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","Matches":[8],"Notified":[6]},{"Name":"Miami cheap","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"MaxDailyPrice":300,"Currency":"USD"}],"Notifications":["News"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+	})
+	// putting a boat, new or not, queues it for matching once the matcher is started
+	searchMatches = make(chan int64, 2)
+	defer func() { searchMatches = nil }()
+	mockDataStoreClient = &mockDataStore{t: t, calls: []mockDataStoreCall{
+		{name: "Put", key: idKey("Boat", 9), src: []*Boat{}, srcJSON: `{"ID":9,"Name":"Sea Breeze","Trailer":{},"Audit":{"Version":1}}`, keyResult: idKey("Boat", 9)},
+		{name: "Put", key: idKey("Boat", 0), src: []*Boat{}, srcJSON: `{"Name":"Sea Spray","Trailer":{},"Audit":{"Version":1}}`, keyResult: idKey("Boat", 10)},
+	}}
+	if _, err := putBoat(&Boat{ID: 9, Name: "Sea Breeze"}); err != nil {
+		t.Errorf("putBoat => %v", err)
+	}
+	if _, err := updateX("Boat", 0, 0, &Boat{}, nil, func() (interface{}, error) { return &Boat{Name: "Sea Spray"}, nil }); err != nil {
+		t.Errorf("updateX => %v", err)
+	}
+	mockDataStoreClient.(*mockDataStore).Done()
+	for _, expect := range []int64{9, 10} {
+		select {
+		case boatID := <-searchMatches:
+			if boatID != expect {
+				t.Errorf("Put queued %d, expected %d", boatID, expect)
+			}
+		default:
+			t.Errorf("Put didn't queue a search match for %d", expect)
+		}
+	}
+}
+
+func TestSendSearchDigests(t *testing.T) {
+	testAPI(t, &Session{UserID: 123}, nil, "SendSearchDigests", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	staff := &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}
+	ann := newSearchUser()
+	ann.Searches[0].Matches = []int64{7, 8}
+	ann.Searches[1].Matches = []int64{7}
+	// Bob doesn't want notifications, and Cat already got today's digest
+	bob := newSearchUser()
+	bob.GivenName = "Bob"
+	bob.Notifications = []string{"Tips"}
+	bob.Searches[0].Matches = []int64{7}
+	cat := newSearchUser()
+	cat.GivenName = "Cat"
+	cat.SearchDigested = DateTime(2020, 5, 5, 1, 0, 0)
+	cat.Searches[0].Matches = []int64{7}
+	testAPI(t, staff, nil, "SendSearchDigests", `{}`, `{}`, []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("User", map[string]interface{}{"Searches.Matches>": int64(0)}),
+			dst:        []*User{&ann, &bob, &cat},
+			keysResult: []*datastore.Key{idKey("User", 456), idKey("User", 457), idKey("User", 458)},
+		},
+		{name: "Get", key: idKey("User", 456), dst: ann},
+		{
+			name:      "Put",
+			key:       idKey("User", 456),
+			src:       []*User{},
+			srcJSON:   `{"ID":456,"GivenName":"Ann","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","Notified":[6,7,8]},{"Name":"Miami cheap","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"MaxDailyPrice":300,"Currency":"USD","Notified":[7]}],"SearchDigested":"2020-05-05T05:05:05Z","Notifications":["News"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 456),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			src:       []*Event{},
+			srcJSON:   `{"UserID":456,"UnreadByIDs":[456],"Notification":{"Text":"New boats match your saved searches: Miami (2), Miami cheap (1)."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+		{name: "Get", key: idKey("User", 457), dst: bob},
+		{
+			name:      "Put",
+			key:       idKey("User", 457),
+			src:       []*User{},
+			srcJSON:   `{"ID":457,"GivenName":"Bob","Searches":[{"Name":"Miami","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"Currency":"USD","Notified":[6,7]},{"Name":"Miami cheap","Location":{"Lat":25.7467903,"Lng":-80.2113866},"KMRadius":50,"Loc100KM":[11328,11329,11728,11729],"MaxDailyPrice":300,"Currency":"USD"}],"Notifications":["Tips"],"Audit":{"Version":1}}`,
+			keyResult: idKey("User", 457),
+		},
+	})
+}
@@ -0,0 +1,465 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceReminderDays and serviceReminderHours are how long before Maintenance is due the owner is reminded
+const (
+	serviceReminderDays  = 14
+	serviceReminderHours = 10
+)
+
+func init() {
+	addEnumsFor(EventService{})
+	apiHandlers["SetWorkOrder"] = SetWorkOrder
+	apiHandlers["GetWorkOrders"] = GetWorkOrders
+	apiHandlers["ExportServiceHistory"] = ExportServiceHistory
+	apiHandlers["SetMaintenance"] = SetMaintenance
+	apiHandlers["SendServiceReminders"] = SendServiceReminders
+}
+
+// startServiceReminders sends maintenance reminders once a day, on one instance
+func startServiceReminders() {
+	startDailyJob(serviceRemindersJob, "sendServiceReminders", "sent", sendServiceReminders)
+}
+
+// SetWorkOrder creates a work order Deal for BoatID, or changes work order DealID, with Service's parts, labor, engine
+// hours, photos, and invoices; the owner creates one for themselves or for Servicer OrgID, which may then work on it.
+// Only the owner completes it, which records EngineHours on the boat and resets the Maintenance in Tasks
+func SetWorkOrder(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.Service == nil {
+		return &Response{ErrorCode: "NeedService"}
+	}
+	if err := validate(req.Service); err != nil {
+		return errResponse(err)
+	}
+	if err := checkWorkOrder(req.Service); err != nil {
+		return errResponse(err)
+	}
+	if req.DealID == 0 && req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	staff := isStaff(req)
+	deal := &Deal{}
+	var boat *Boat
+	var service EventService
+	completing := false
+	key, err := updateX("Deal", req.DealID, req.IfMatch, deal, nil, func() (interface{}, error) {
+		boatID := req.BoatID
+		if req.DealID != 0 {
+			if deal.Service == nil {
+				return nil, errors.New("NeedServiceDeal")
+			}
+			if deal.UserID != req.Session.UserID && (deal.OrgID == 0 || deal.OrgID != req.Session.OrgID) && !staff ||
+				lacksOrgAccess(req, "SetDeal", deal) {
+				return nil, errors.New("AccessDenied")
+			}
+			if (deal.Service.Status == "Completed" || deal.Service.Status == "Canceled") && !staff {
+				return nil, errors.New("WorkOrderClosed")
+			}
+			boatID = deal.BoatID
+		}
+		var err error
+		if boat, err = getBoat(boatID); err != nil {
+			return nil, err
+		}
+		owner := (isMine(req, boat) || staff) && !lacksOrgAccess(req, "SetBoat", boat)
+		if req.DealID == 0 {
+			// only the owner opens a work order, and picks the servicer
+			if !owner {
+				return nil, errors.New("AccessDenied")
+			}
+			orgID := req.OrgID
+			if orgID != 0 {
+				org, err := getOrg(orgID)
+				if err != nil {
+					return nil, err
+				}
+				if !StringInArray("Servicer", org.Types) {
+					return nil, errors.New("NotServicer")
+				}
+			}
+			*deal = Deal{BoatID: boat.ID, UserID: boat.UserID, OrgID: orgID, Service: &EventService{Status: "Open"}, Audit: &Audit{Created: now()}}
+		} else {
+			auditOf(deal).Updated = now()
+		}
+		for _, task := range req.Service.Tasks {
+			found := false
+			for _, maintenance := range boat.Maintenance {
+				found = found || maintenance.Task == task
+			}
+			if !found {
+				return nil, Err("BadTask", map[string]string{"Task": task})
+			}
+		}
+		service = *req.Service
+		if service.Status == "" {
+			service.Status = deal.Service.Status
+		}
+		if service.Currency == "" {
+			service.Currency = boat.Currency
+		}
+		service.Completed = deal.Service.Completed
+		completing = service.Status == "Completed" && service.Completed == nil
+		if completing {
+			// completing changes the boat, so it's up to the owner
+			if !owner {
+				return nil, errors.New("AccessDenied")
+			}
+			service.Completed = now()
+		}
+		setWorkOrderTotals(&service)
+		deal.Service = &service
+		return deal, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	// let the other side know
+	event := &Event{
+		DealID:     key.ID,
+		BoatID:     deal.BoatID,
+		UserID:     deal.UserID,
+		OrgID:      deal.OrgID,
+		FromUserID: req.Session.UserID,
+		Service:    &EventService{Status: service.Status, Title: service.Title, Currency: service.Currency, Total: service.Total},
+		Audit:      &Audit{Created: now()},
+	}
+	if deal.UserID != req.Session.UserID {
+		event.UnreadByIDs = []int64{deal.UserID}
+	}
+	if deal.OrgID != 0 {
+		event.OrgIDs = []int64{deal.OrgID}
+	}
+	if _, err := putEvent(event); err != nil {
+		return errResponse(err)
+	}
+	if completing {
+		// the reminders are put once the boat is changed
+		oldBoat := &Boat{}
+		var reminders []*Event
+		if _, err := updateX("Boat", boat.ID, 0, oldBoat, nil, func() (interface{}, error) {
+			completeMaintenance(oldBoat, &service)
+			reminders = remindMaintenance(oldBoat)
+			return oldBoat, nil
+		}); err != nil {
+			return errResponse(err)
+		}
+		if err := putEvents(reminders); err != nil {
+			return errResponse(err)
+		}
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: deal.Audit.Version,
+	}
+}
+
+// GetWorkOrders gets BoatID's work orders; the owner and staff get all of them, and a servicer gets its own
+func GetWorkOrders(req *Request, pub *Publication) *Response {
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	all := isMine(req, boat) || isStaff(req)
+	if !all && req.Session.OrgID == 0 {
+		return accessDenied()
+	}
+	deals, err := getWorkOrders(boat.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	dependOnIDs(req, "Boat", boat.ID)
+	dependOn(req, Dependency{Kind: "Deal", BoatIDs: []int64{boat.ID}})
+	resp := &Response{SubscriptionID: -1, Deals: map[int64]*Deal{}}
+	for _, deal := range deals {
+		if all || deal.OrgID == req.Session.OrgID {
+			resp.Deals[deal.ID] = deal
+		}
+	}
+	return resp
+}
+
+// ExportServiceHistory gets BoatID's completed work orders, each with its servicer, and its engine hours and maintenance
+// schedule, for the owner, staff, or a buyer whose offer was accepted
+func ExportServiceHistory(req *Request, pub *Publication) *Response {
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if !isMine(req, boat) && !isStaff(req) {
+		buyer, err := isBuyer(req, boat.ID)
+		if err != nil {
+			return errResponse(err)
+		}
+		if !buyer {
+			return accessDenied()
+		}
+	}
+	deals, err := getWorkOrders(boat.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	resp := &Response{
+		Boats: map[int64]*Boat{boat.ID: {ID: boat.ID, EngineHours: boat.EngineHours, Maintenance: boat.Maintenance}},
+		Deals: map[int64]*Deal{},
+	}
+	for _, deal := range deals {
+		if deal.Service.Status == "Completed" {
+			deal.Org = getPublicOrg(deal.OrgID)
+			resp.Deals[deal.ID] = deal
+		}
+	}
+	return resp
+}
+
+// SetMaintenance sets BoatID's recurring Maintenance schedule; each task keeps when it was last done unless LastHours or
+// LastDate are given, and new tasks start from now
+func SetMaintenance(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	tasks := []string{}
+	for _, maintenance := range req.Maintenance {
+		switch {
+		case maintenance.Task == "":
+			return &Response{ErrorCode: "NeedTask"}
+		case StringInArray(maintenance.Task, tasks):
+			return errResponse(Err("DuplicateTask", map[string]string{"Task": maintenance.Task}))
+		case maintenance.EveryHours < 0 || maintenance.EveryMonths < 0 || maintenance.LastHours < 0:
+			return errResponse(Err("BadInterval", map[string]string{"Task": maintenance.Task}))
+		case maintenance.EveryHours == 0 && maintenance.EveryMonths == 0:
+			return errResponse(Err("NeedInterval", map[string]string{"Task": maintenance.Task}))
+		}
+		tasks = append(tasks, maintenance.Task)
+	}
+	// the reminders are put once the boat is changed
+	boat := &Boat{}
+	var reminders []*Event
+	key, err := updateX("Boat", req.BoatID, req.IfMatch, boat, nil, func() (interface{}, error) {
+		if !isMine(req, boat) && !isStaff(req) || lacksOrgAccess(req, "SetBoat", boat) {
+			return nil, errors.New("AccessDenied")
+		}
+		schedule := []BoatMaintenance{}
+		for _, maintenance := range req.Maintenance {
+			var old *BoatMaintenance
+			for i := range boat.Maintenance {
+				if boat.Maintenance[i].Task == maintenance.Task {
+					old = &boat.Maintenance[i]
+				}
+			}
+			if old != nil && maintenance.LastHours == 0 {
+				maintenance.LastHours = old.LastHours
+			}
+			if old != nil && maintenance.LastDate == nil {
+				maintenance.LastDate = old.LastDate
+			}
+			if maintenance.LastHours == 0 {
+				maintenance.LastHours = boat.EngineHours
+			}
+			if maintenance.LastDate == nil {
+				maintenance.LastDate = now()
+			}
+			setMaintenanceDue(&maintenance)
+			// the reminder stands if it's still due at the same time
+			maintenance.Reminded = nil
+			if old != nil && old.DueHours == maintenance.DueHours && sameTime(old.DueDate, maintenance.DueDate) {
+				maintenance.Reminded = old.Reminded
+			}
+			schedule = append(schedule, maintenance)
+		}
+		boat.Maintenance = schedule
+		reminders = remindMaintenance(boat)
+		return boat, nil
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	if err := putEvents(reminders); err != nil {
+		return errResponse(err)
+	}
+	return &Response{
+		ID:      key.ID,
+		Version: boat.Audit.Version,
+	}
+}
+
+// SendServiceReminders lets staff send maintenance reminders now, instead of waiting for the daily run
+func SendServiceReminders(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	if _, err := sendServiceReminders(); err != nil {
+		return errResponse(err)
+	}
+	return &Response{}
+}
+
+// sendServiceReminders reminds owners of Maintenance due within serviceReminderDays; Maintenance due by engine hours is
+// reminded when the hours are recorded
+func sendServiceReminders() (int, error) {
+	cutOff := now().AddDate(0, 0, serviceReminderDays)
+	var boats []*Boat
+	keys, err := getAllBoats(map[string]interface{}{"Maintenance.DueDate<": cutOff}, &boats)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for index, key := range keys {
+		// the boat is changed in a transaction, so nothing else that changes it is lost, if what was gotten needs it;
+		// the reminders are only made once it is
+		boats[index].ID = key.ID
+		if len(remindMaintenance(boats[index])) == 0 {
+			continue
+		}
+		boat := &Boat{}
+		var reminders []*Event
+		if _, err := updateX("Boat", key.ID, 0, boat, nil, func() (interface{}, error) {
+			if reminders = remindMaintenance(boat); len(reminders) == 0 {
+				return nil, nil
+			}
+			return boat, nil
+		}); err != nil {
+			return count, err
+		}
+		if err := putEvents(reminders); err != nil {
+			return count, err
+		}
+		count += len(reminders)
+	}
+	return count, nil
+}
+
+// remindMaintenance makes a notification for a boat's owner, once, of each Maintenance task that's almost due, marking
+// it Reminded; the caller puts the boat, then the notifications
+func remindMaintenance(boat *Boat) []*Event {
+	cutOff := now().AddDate(0, 0, serviceReminderDays)
+	reminders := []*Event{}
+	for i := range boat.Maintenance {
+		maintenance := &boat.Maintenance[i]
+		if maintenance.Reminded != nil {
+			continue
+		}
+		var due []string
+		if maintenance.DueHours > 0 && boat.EngineHours >= maintenance.DueHours-serviceReminderHours {
+			due = append(due, "at "+strconv.FormatFloat(float64(maintenance.DueHours), 'f', -1, 32)+" engine hours")
+		}
+		if maintenance.DueDate != nil && maintenance.DueDate.Before(cutOff) {
+			due = append(due, "by "+maintenance.DueDate.Format("January 2, 2006"))
+		}
+		if due == nil {
+			continue
+		}
+		reminders = append(reminders, &Event{
+			BoatID:       boat.ID,
+			UserID:       boat.UserID,
+			UnreadByIDs:  []int64{boat.UserID},
+			Notification: &EventNotification{Text: "Your boat's " + maintenance.Task + " is due " + strings.Join(due, " or ") + "."},
+			Audit:        &Audit{Created: now()},
+		})
+		maintenance.Reminded = now()
+	}
+	return reminders
+}
+
+// completeMaintenance records a completed work order's engine hours on its boat and resets the Maintenance in its Tasks
+func completeMaintenance(boat *Boat, service *EventService) {
+	if service.EngineHours > boat.EngineHours {
+		boat.EngineHours = service.EngineHours
+	}
+	for i := range boat.Maintenance {
+		maintenance := &boat.Maintenance[i]
+		if !StringInArray(maintenance.Task, service.Tasks) {
+			continue
+		}
+		maintenance.LastHours = service.EngineHours
+		if maintenance.LastHours == 0 {
+			maintenance.LastHours = boat.EngineHours
+		}
+		maintenance.LastDate = service.Completed
+		maintenance.Reminded = nil
+		setMaintenanceDue(maintenance)
+	}
+}
+
+// setMaintenanceDue sets DueHours and DueDate from when a task was last done
+func setMaintenanceDue(maintenance *BoatMaintenance) {
+	maintenance.DueHours = 0
+	if maintenance.EveryHours > 0 {
+		maintenance.DueHours = maintenance.LastHours + maintenance.EveryHours
+	}
+	maintenance.DueDate = nil
+	if maintenance.EveryMonths > 0 && maintenance.LastDate != nil {
+		dueDate := maintenance.LastDate.AddDate(0, maintenance.EveryMonths, 0)
+		maintenance.DueDate = &dueDate
+	}
+}
+
+// checkWorkOrder makes sure a work order's amounts aren't negative
+func checkWorkOrder(service *EventService) error {
+	if service.EngineHours < 0 {
+		return Err("BadAmount", map[string]string{"Field": "EngineHours"})
+	}
+	for i, part := range service.Parts {
+		if part.Quantity < 0 || part.Price < 0 {
+			return Err("BadAmount", map[string]string{"Field": "Parts." + strconv.Itoa(i)})
+		}
+	}
+	for i, labor := range service.Labor {
+		if labor.Hours < 0 || labor.Rate < 0 {
+			return Err("BadAmount", map[string]string{"Field": "Labor." + strconv.Itoa(i)})
+		}
+	}
+	return nil
+}
+
+// setWorkOrderTotals sets PartsTotal, LaborTotal, and Total from Parts and Labor
+func setWorkOrderTotals(service *EventService) {
+	parts, labor := 0.0, 0.0
+	for _, part := range service.Parts {
+		parts += float64(part.Quantity) * float64(part.Price)
+	}
+	for _, work := range service.Labor {
+		labor += float64(work.Hours) * float64(work.Rate)
+	}
+	service.PartsTotal = roundCents(parts)
+	service.LaborTotal = roundCents(labor)
+	service.Total = roundCents(parts + labor)
+}
+
+// getWorkOrders gets a boat's work orders
+func getWorkOrders(boatID int64) ([]*Deal, error) {
+	var deals []*Deal
+	keys, err := getAllDeals(map[string]interface{}{"BoatID=": boatID}, &deals)
+	if err != nil {
+		return nil, err
+	}
+	orders := []*Deal{}
+	for index, key := range keys {
+		if deal := deals[index]; deal.Service != nil {
+			deal.ID = key.ID
+			orders = append(orders, deal)
+		}
+	}
+	return orders, nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	return a == nil && b == nil || a != nil && b != nil && a.Equal(*b)
+}
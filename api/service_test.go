@@ -0,0 +1,197 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestSetWorkOrder(t *testing.T) {
+	servicer := &Session{UserID: 900, OrgID: 9, OrgAccess: []string{"SetDeal"}, Verified: true}
+	owner := &Session{UserID: 123, Verified: true}
+	testAPI(t, servicer, nil, "SetWorkOrder", `{"BoatID":7,"Service":{"Parts":[{"Quantity":-1}]}}`, `{"ErrorCode":"BadAmount","ErrorDetails":{"Field":"Parts.0"}}`, nil)
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "SetWorkOrder", `{"BoatID":7,"Service":{}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+	})
+	// only the owner opens a work order, and picks the servicer
+	testAPI(t, servicer, nil, "SetWorkOrder", `{"BoatID":7,"Service":{}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+	})
+	testAPI(t, owner, nil, "SetWorkOrder", `{"BoatID":7,"OrgID":10,"Service":{}}`, `{"ErrorCode":"NotServicer"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+		{name: "Get", key: idKey("Org", 10), dst: Org{Types: []string{"Insurer"}}},
+	})
+	testAPI(t, owner, nil, "SetWorkOrder", `{"BoatID":7,"OrgID":9,"Service":{"Tasks":["Bottom Paint"]}}`, `{"ErrorCode":"BadTask","ErrorDetails":{"Task":"Bottom Paint"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Servicer"}}},
+	})
+	testAPI(t, owner, nil, "SetWorkOrder", `{"BoatID":7,"OrgID":9,"Service":{"Title":"Oil change","Tasks":["Oil Change"]}}`, `{"ID":41,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Servicer"}}},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"OrgID":9,"Service":{"Status":"Open","Title":"Oil change","Tasks":["Oil Change"],"Currency":"USD"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":123,"OrgIDs":[9],"Service":{"Status":"Open","Title":"Oil change","Currency":"USD"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+	// the servicer adds the parts and labor
+	testAPI(t, servicer, nil, "SetWorkOrder", `{"DealID":41,"Service":{"Status":"InProgress","Title":"Oil change","Tasks":["Oil Change"],"Parts":[{"Name":"Oil filter","Number":"35-877761Q4","Quantity":1,"Price":12.99},{"Name":"Oil","Quantity":6,"Price":8.5}],"Labor":[{"Description":"Change oil","Hours":1.5,"Rate":95}]}}`, `{"ID":41,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newWorkOrder("Open")},
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Service":{"Status":"InProgress","Title":"Oil change","Tasks":["Oil Change"],"Parts":[{"Name":"Oil filter","Number":"35-877761Q4","Quantity":1,"Price":12.99},{"Name":"Oil","Quantity":6,"Price":8.5}],"Labor":[{"Description":"Change oil","Hours":1.5,"Rate":95}],"Currency":"USD","PartsTotal":63.99,"LaborTotal":142.5,"Total":206.49},"Audit":{"Created":"2020-05-01T00:00:00Z","Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":900,"UnreadByIDs":[123],"OrgIDs":[9],"Service":{"Status":"InProgress","Title":"Oil change","Currency":"USD","Total":206.49},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 52),
+		},
+	})
+	// but completing it changes the boat, so it's up to the owner
+	testAPI(t, servicer, nil, "SetWorkOrder", `{"DealID":41,"Service":{"Status":"Completed","EngineHours":900}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newWorkOrder("InProgress")},
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+	})
+	// the owner completes it, which resets the oil change and reminds the owner the impeller is due
+	testAPI(t, owner, nil, "SetWorkOrder", `{"DealID":41,"Service":{"Status":"Completed","Title":"Oil change","Tasks":["Oil Change"],"EngineHours":185,"Invoices":[{"URL":"https://example.com/invoice.pdf"}]}}`, `{"ID":41,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newWorkOrder("InProgress")},
+		{name: "Get", key: idKey("Boat", 7), dst: newImpellerDueBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Service":{"Status":"Completed","Title":"Oil change","Tasks":["Oil Change"],"EngineHours":185,"Invoices":[{"URL":"https://example.com/invoice.pdf"}],"Currency":"USD","Completed":"2020-05-05T05:05:05Z"},"Audit":{"Created":"2020-05-01T00:00:00Z","Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":123,"OrgIDs":[9],"Service":{"Status":"Completed","Title":"Oil change","Currency":"USD"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 53),
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: newImpellerDueBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Currency":"USD","EngineHours":185,"Trailer":{},"Maintenance":[{"Task":"Oil Change","EveryHours":100,"EveryMonths":12,"LastHours":185,"LastDate":"2020-05-05T05:05:05Z","DueHours":285,"DueDate":"2021-05-05T05:05:05Z"},{"Task":"Impeller","EveryMonths":24,"LastHours":50,"LastDate":"2018-06-01T00:00:00Z","DueDate":"2020-05-15T00:00:00Z","Reminded":"2020-05-05T05:05:05Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"UnreadByIDs":[123],"Notification":{"Text":"Your boat's Impeller is due by May 15, 2020."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 54),
+		},
+	})
+	testAPI(t, owner, nil, "SetWorkOrder", `{"DealID":41,"Service":{}}`, `{"ErrorCode":"WorkOrderClosed"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newWorkOrder("Completed")},
+	})
+}
+
+func TestGetWorkOrders(t *testing.T) {
+	workOrders := []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+		{
+			name: "GetAll",
+			q:    newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+			dst: []*Deal{
+				func() *Deal { d := newWorkOrder("Completed"); return &d }(),
+				func() *Deal { d := newWorkOrder("Open"); d.OrgID = 10; return &d }(),
+				{BoatID: 7, UserID: 456, Rental: &EventRental{Status: "Booked"}},
+			},
+			keysResult: []*datastore.Key{idKey("Deal", 41), idKey("Deal", 42), idKey("Deal", 43)},
+		},
+	}
+	testAPI(t, &Session{UserID: 456}, nil, "GetWorkOrders", `{"BoatID":7}`, `{"ErrorCode":"AccessDenied"}`, workOrders[:1])
+	testAPI(t, &Session{UserID: 900, OrgID: 9}, nil, "GetWorkOrders", `{"BoatID":7}`, `{"SubscriptionID":-1,"Deals":{"41":{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Service":{"Status":"Completed","Title":"Oil change","Currency":"USD"},"Audit":{"Created":"2020-05-01T00:00:00Z"}}}}`, workOrders)
+	testAPI(t, &Session{UserID: 123}, nil, "GetWorkOrders", `{"BoatID":7}`, `{"SubscriptionID":-1,"Deals":{"41":{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Service":{"Status":"Completed","Title":"Oil change","Currency":"USD"},"Audit":{"Created":"2020-05-01T00:00:00Z"}},"42":{"ID":42,"BoatID":7,"UserID":123,"OrgID":10,"Service":{"Status":"Open","Title":"Oil change","Currency":"USD"},"Audit":{"Created":"2020-05-01T00:00:00Z"}}}}`, workOrders)
+}
+
+func TestExportServiceHistory(t *testing.T) {
+	history := func(buyer string) []mockDataStoreCall {
+		return []mockDataStoreCall{
+			{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+			{
+				name:       "GetAll",
+				q:          newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+				dst:        []*Deal{{BoatID: 7, UserID: 456, Sale: &EventSale{Status: buyer}}},
+				keysResult: []*datastore.Key{idKey("Deal", 40)},
+			},
+			{
+				name: "GetAll",
+				q:    newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+				dst: []*Deal{
+					func() *Deal { d := newWorkOrder("Completed"); return &d }(),
+					func() *Deal { d := newWorkOrder("Open"); return &d }(),
+				},
+				keysResult: []*datastore.Key{idKey("Deal", 41), idKey("Deal", 42)},
+			},
+			{name: "Get", key: idKey("Org", 9), dst: Org{Name: "Marine Max", Types: []string{"Servicer"}, EIN: "secret"}},
+		}
+	}
+	testAPI(t, &Session{UserID: 456}, nil, "ExportServiceHistory", `{"BoatID":7}`, `{"ErrorCode":"AccessDenied"}`, history("Open")[:2])
+	testAPI(t, &Session{UserID: 456}, nil, "ExportServiceHistory", `{"BoatID":7}`, `{"Boats":{"7":{"ID":7,"EngineHours":180,"Trailer":{},"Maintenance":[{"Task":"Oil Change","EveryHours":100,"EveryMonths":12,"LastHours":100,"LastDate":"2019-08-01T00:00:00Z","DueHours":200,"DueDate":"2020-08-01T00:00:00Z"},{"Task":"Impeller","EveryMonths":24,"LastHours":50,"LastDate":"2018-06-01T00:00:00Z","DueDate":"2020-06-01T00:00:00Z","Reminded":"2020-05-20T00:00:00Z"}]}},"Deals":{"41":{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Org":{"Types":["Servicer"],"Name":"Marine Max"},"Service":{"Status":"Completed","Title":"Oil change","Currency":"USD"},"Audit":{"Created":"2020-05-01T00:00:00Z"}}}}`, history("Accepted"))
+}
+
+func TestSetMaintenance(t *testing.T) {
+	owner := &Session{UserID: 123, Verified: true}
+	testAPI(t, owner, nil, "SetMaintenance", `{"BoatID":7,"Maintenance":[{"Task":"Oil Change"}]}`, `{"ErrorCode":"NeedInterval","ErrorDetails":{"Task":"Oil Change"}}`, nil)
+	testAPI(t, owner, nil, "SetMaintenance", `{"BoatID":7,"Maintenance":[{"Task":"Oil Change","EveryHours":100},{"Task":"Oil Change","EveryMonths":6}]}`, `{"ErrorCode":"DuplicateTask","ErrorDetails":{"Task":"Oil Change"}}`, nil)
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "SetMaintenance", `{"BoatID":7,"Maintenance":[]}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+	})
+	// oil change now every 50 hours is due soon, the impeller keeps its reminder, and winterizing is new
+	testAPI(t, owner, nil, "SetMaintenance", `{"BoatID":7,"Maintenance":[{"Task":"Oil Change","EveryHours":50,"EveryMonths":12},{"Task":"Impeller","EveryMonths":24},{"Task":"Winterize","EveryMonths":12,"LastDate":"2019-11-01T00:00:00Z"}]}`, `{"ID":7,"Version":1}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newServiceBoat()},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Currency":"USD","EngineHours":180,"Trailer":{},"Maintenance":[{"Task":"Oil Change","EveryHours":50,"EveryMonths":12,"LastHours":100,"LastDate":"2019-08-01T00:00:00Z","DueHours":150,"DueDate":"2020-08-01T00:00:00Z","Reminded":"2020-05-05T05:05:05Z"},{"Task":"Impeller","EveryMonths":24,"LastHours":50,"LastDate":"2018-06-01T00:00:00Z","DueDate":"2020-06-01T00:00:00Z","Reminded":"2020-05-20T00:00:00Z"},{"Task":"Winterize","EveryMonths":12,"LastHours":180,"LastDate":"2019-11-01T00:00:00Z","DueDate":"2020-11-01T00:00:00Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"UnreadByIDs":[123],"Notification":{"Text":"Your boat's Oil Change is due at 150 engine hours."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
+
+func TestSendServiceReminders(t *testing.T) {
+	testAPI(t, &Session{UserID: 123}, nil, "SendServiceReminders", `{}`, `{"ErrorCode":"StaffOnly"}`, nil)
+	testAPI(t, &Session{UserID: 2, OrgTypes: []string{"Marketplace"}}, nil, "SendServiceReminders", `{}`, `{}`, []mockDataStoreCall{
+		{
+			name: "GetAll",
+			q:    newQuery("Boat", map[string]interface{}{"Maintenance.DueDate<": DateTime(2020, 5, 19, 5, 5, 5).UTC()}),
+			dst: []*Boat{
+				{UserID: 123, Maintenance: []BoatMaintenance{{Task: "Impeller", EveryMonths: 24, DueDate: DateTime(2020, 5, 15, 0, 0, 0)}, {Task: "Winterize", EveryMonths: 12, DueDate: DateTime(2020, 11, 1, 0, 0, 0)}}},
+				{UserID: 456, Maintenance: []BoatMaintenance{{Task: "Impeller", EveryMonths: 24, DueDate: DateTime(2020, 5, 15, 0, 0, 0), Reminded: DateTime(2020, 5, 1, 0, 0, 0)}}},
+			},
+			keysResult: []*datastore.Key{idKey("Boat", 7), idKey("Boat", 8)},
+		},
+		{name: "Get", key: idKey("Boat", 7), dst: Boat{UserID: 123, Maintenance: []BoatMaintenance{{Task: "Impeller", EveryMonths: 24, DueDate: DateTime(2020, 5, 15, 0, 0, 0)}, {Task: "Winterize", EveryMonths: 12, DueDate: DateTime(2020, 11, 1, 0, 0, 0)}}}},
+		{
+			name:      "Put",
+			key:       idKey("Boat", 7),
+			srcJSON:   `{"ID":7,"UserID":123,"Trailer":{},"Maintenance":[{"Task":"Impeller","EveryMonths":24,"DueDate":"2020-05-15T00:00:00Z","Reminded":"2020-05-05T05:05:05Z"},{"Task":"Winterize","EveryMonths":12,"DueDate":"2020-11-01T00:00:00Z"}],"Audit":{"Version":1}}`,
+			keyResult: idKey("Boat", 7),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"UnreadByIDs":[123],"Notification":{"Text":"Your boat's Impeller is due by May 15, 2020."},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 51),
+		},
+	})
+}
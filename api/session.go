@@ -37,7 +37,10 @@ type Session struct {
 	SubscriptionsMutex sync.RWMutex            `json:",omitempty" datastore:",omitempty"`
 	Subscriptions      map[int64]*subscription `json:"-" datastore:"-"`
 	LastSubscriptionID int64                   `json:"-" datastore:"-"`
-	SSEConnection      chan *Publication       `json:"-" datastore:"-"`
+	SSEConnection      *sseConnection          `json:"-" datastore:"-"`
+	SSEMutex           sync.Mutex              `json:"-" datastore:"-"`
+	LastEventID        int64                   `json:"-" datastore:"-"` // of the last SSE event, unique across subscriptions
+	SSEReplay          []sseEvent              `json:"-" datastore:"-"` // the last maxSSEReplay events, to replay on reconnect
 }
 
 type facebookOAuth2 struct {
@@ -266,21 +269,18 @@ func SignIn(req *Request, pub *Publication) *Response {
 		}
 		user := matchingUsers[0]
 		session.UserID = user.ID
-		session.OrgID = user.OrgID
-		if user.OrgID != 0 {
-			org, err := getOrg(user.OrgID)
-			if err != nil {
-				return errResponse(err)
-			}
-			session.OrgTypes = org.Types
+		if session.OrgID, session.OrgTypes, err = sessionOrg(user); err != nil {
+			return errResponse(err)
+		}
+		if session.OrgID != 0 {
+			session.OrgAccess = user.OrgAccess
 		}
-		session.OrgAccess = user.OrgAccess
 		session.Verified = isUserVerified(user)
 		// expireSeconds = 24 * 3600
 	}
 	if session.ID != 0 {
 		sessionLog(req, "Info", "now user %d IP %s on %q", session.UserID, req.Session.IP, req.Session.UserAgent)
-		sseSink <- &Publication{SetLevel: 0}
+		sse.publish(&Publication{Kind: "Session", ID: session.ID})
 		return &Response{ID: session.UserID}
 	}
 	// finish building new session and register it
@@ -332,6 +332,84 @@ func SignOut(req *Request, pub *Publication) *Response {
 	return &Response{}
 }
 
+// refreshSessions gives this instance's sessions of a published user, or of the members of a published org, their
+// current OrgID, OrgTypes, and OrgAccess, so a change of org membership takes effect without signing in again; the
+// sessions of a deleted user are signed out
+func refreshSessions(pub *Publication) {
+	if pub.Kind != "User" && pub.Kind != "Org" {
+		return
+	}
+	mine := map[int64][]*Session{}
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		if pub.Kind == "User" && session.UserID == pub.ID || pub.Kind == "Org" && session.UserID != 0 && session.OrgID == pub.ID {
+			mine[session.UserID] = append(mine[session.UserID], session)
+		}
+	}
+	sessionsMutex.Unlock()
+	for userID, userSessions := range mine {
+		user, err := getUser(userID)
+		if err != nil && err.Error() == "NotFound" {
+			// the user was deleted
+			signOutSessions(userSessions)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error: refreshSessions getUser(%d) => %s", userID, err.Error())
+			continue
+		}
+		orgID, orgTypes, err := sessionOrg(user)
+		if err != nil {
+			log.Printf("Error: refreshSessions getOrg(%d) => %s", user.OrgID, err.Error())
+			continue
+		}
+		// the sessions' requests may be running, so they're changed under the lock
+		sessionsMutex.Lock()
+		for _, session := range userSessions {
+			session.OrgID = orgID
+			session.OrgTypes = orgTypes
+			session.OrgAccess = nil
+			if orgID != 0 {
+				session.OrgAccess = user.OrgAccess
+			}
+		}
+		sessionsMutex.Unlock()
+	}
+}
+
+// sessionOrg gets the OrgID and OrgTypes of a user's sessions, which have no org if the user's org was deleted
+func sessionOrg(user *User) (int64, []string, error) {
+	if user.OrgID == 0 {
+		return 0, nil, nil
+	}
+	org, err := getOrg(user.OrgID)
+	if err != nil && err.Error() == "NotFound" {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return user.OrgID, org.Types, nil
+}
+
+// signOutSessions signs out sessions of a deleted user, and has their connections re-run their subscriptions as
+// anonymous
+func signOutSessions(userSessions []*Session) {
+	sessionsMutex.Lock()
+	for _, session := range userSessions {
+		delete(sessions, session.ID)
+		session.UserID = 0
+		session.OrgID = 0
+		session.OrgTypes = nil
+		session.OrgAccess = nil
+		session.Verified = false
+	}
+	sessionsMutex.Unlock()
+	for _, session := range userSessions {
+		sse.publish(&Publication{Kind: "Session", ID: session.ID})
+	}
+}
+
 func isUserVerified(user *User) bool {
 	verifiedEmail := false
 	verifiedPhone := false
@@ -79,7 +79,7 @@ func TestSignIn(t *testing.T) {
 			name:      "Put",
 			key:       idKey("User", 123),
 			src:       []*User{},
-			srcJSON:   `{"ID":123,"TOTP":"12345678","TOTPSent":"2020-05-05T05:05:05Z","GivenName":"Dave"}`,
+			srcJSON:   `{"ID":123,"TOTP":"12345678","TOTPSent":"2020-05-05T05:05:05Z","GivenName":"Dave","Audit":{"Version":1}}`,
 			keyResult: idKey("User", 1),
 		},
 	})
@@ -111,7 +111,7 @@ func TestSignIn(t *testing.T) {
 			name:      "Put",
 			key:       idKey("User", 123),
 			src:       []*User{},
-			srcJSON:   `{"ID":123,"GivenName":"Dave"}`,
+			srcJSON:   `{"ID":123,"GivenName":"Dave","Audit":{"Version":1}}`,
 			keyResult: idKey("User", 1),
 		},
 	})
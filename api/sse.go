@@ -3,47 +3,75 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"time"
+
+	"cloud.google.com/go/datastore"
 )
 
 // a request may have a subscription on it if it's long-lived and will use Server-Sent Events (SSE) to send inserts, updates, and deletes
 type subscription struct {
-	ID          int64
-	Req         *Request
-	Handler     func(req *Request, pub *Publication) *Response
-	LastResp    *Response
-	Started     *time.Time
-	LastEventID int64
+	ID           int64
+	Req          *Request
+	Handler      func(req *Request, pub *Publication) *Response
+	LastResp     *Response
+	Started      *time.Time
+	Dependencies []Dependency      // from the handler's last response; nil if it didn't declare any, so it depends on everything
+	Connection   chan *Publication // the /api/WS it was made on, which its deltas are sent to; nil for /api/SSE
+}
+
+// sseEvent is an event sent via SSE, kept so it can be replayed if the client reconnects without having received it
+type sseEvent struct {
+	ID   int64
+	Data []byte
 }
 
-// publication is sent to sseSink when the API detects an org, user, boat, or event has changed
-// Server-Sent Event (SSE) channels (assumes only one SSE per Session)
-var sseSink = make(chan *Publication, 1)
-var sseOpening = make(chan *Session)
-var sseClosing = make(chan *Session)
-var sseActive = make(map[chan *Publication]*Session)
+// maxSSEReplay is how many of a session's last SSE events are kept to replay
+const maxSSEReplay = 100
 
-// Publication is what may or may not trigger any changes in subscription data that is then sent via Server-Sent Events (SSE)
+// Publication is what may or may not trigger any changes in subscription data that is then sent via Server-Sent Events (SSE);
+// it's the Kind and ID of what was put, and the users, orgs, boats, and deals it affects
 type Publication struct {
-	// TODO
-	Ping     bool
-	SetLevel int // 1=Org, 2=User, 3=Boat, 4=Deal, 5=Event
+	Ping    bool
+	Resync  bool   `json:",omitempty"` // from this instance's own bus, once it may have missed some publications
+	Kind    string // Org, User, Boat, Deal, Event, or Session
+	ID      int64
+	UserIDs []int64
+	OrgIDs  []int64
+	BoatIDs []int64
+	DealIDs []int64
+}
+
+// Dependency is a Kind of record a subscription depends on; a publication of that Kind matches it if its ID is in IDs
+// and it affects any of UserIDs, any of OrgIDs, etc., where an empty list matches anything
+type Dependency struct {
+	Kind    string
+	IDs     []int64
+	UserIDs []int64
+	OrgIDs  []int64
+	BoatIDs []int64
+	DealIDs []int64
 }
 
 // subscribe is called by DispatchToAPIHandler to register a new subscription in a Session
-func subscribe(req *Request, handler func(req *Request, pub *Publication) *Response, resp *Response) {
+// with the WebSocket connection it was made on, if any
+func subscribe(req *Request, handler func(req *Request, pub *Publication) *Response, resp *Response, connection chan *Publication) {
 	req.Session.LastSubscriptionID++
 	subscriptionID := req.Session.LastSubscriptionID
 	resp.SubscriptionID = subscriptionID
 	subscription := &subscription{
-		ID:       subscriptionID,
-		Req:      req,
-		Handler:  handler,
-		LastResp: resp,
-		Started:  now(),
+		ID:           subscriptionID,
+		Req:          req,
+		Handler:      handler,
+		LastResp:     resp,
+		Started:      now(),
+		Dependencies: req.Dependencies,
+		Connection:   connection,
 	}
 	req.Session.SubscriptionsMutex.Lock()
 	req.Session.Subscriptions[subscriptionID] = subscription
@@ -56,36 +84,6 @@ func subscribe(req *Request, handler func(req *Request, pub *Publication) *Respo
 
 func init() {
 	apiHandlers["Unsubscribe"] = unsubscribe
-	go func() {
-		for {
-			select {
-			case session := <-sseOpening:
-				sseActive[session.SSEConnection] = session
-				sessionLog(&Request{Session: session}, "Info", "opened connection")
-			case session := <-sseClosing:
-				sessionLog(&Request{Session: session}, "Info", "closed connection")
-				delete(sseActive, session.SSEConnection)
-				session.SSEConnection = nil
-			case pub := <-sseSink:
-				for _, session := range sseActive {
-					select {
-					case session.SSEConnection <- pub:
-					case <-time.After(10 * time.Second):
-						sessionLog(&Request{Session: session}, "Info", "lost connection")
-						delete(sseActive, session.SSEConnection)
-						session.SSEConnection = nil
-					}
-				}
-			}
-		}
-	}()
-	// we ping every minute to clean up disconnected sessions
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			sseSink <- &Publication{Ping: true}
-		}
-	}()
 }
 
 func handleSSE(w http.ResponseWriter, r *http.Request, session *Session) {
@@ -95,183 +93,326 @@ func handleSSE(w http.ResponseWriter, r *http.Request, session *Session) {
 		http.Error(w, "Streaming not supported", http.StatusUnsupportedMediaType)
 		return
 	}
+	conn := &sseConnection{Session: session, Publications: make(chan *Publication, sseQueueSize), Policy: ssePolicy(r)}
+	session.SSEMutex.Lock()
 	if session.SSEConnection != nil {
+		session.SSEMutex.Unlock()
 		http.Error(w, "SSE called more than once", http.StatusTooManyRequests)
 		return
 	}
+	session.SSEConnection = conn
+	session.SSEMutex.Unlock()
+	defer func() {
+		session.SSEMutex.Lock()
+		session.SSEConnection = nil
+		session.SSEMutex.Unlock()
+	}()
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	session.SSEConnection = make(chan *Publication) // if there was a previous /api/SSE, it will no longer receive any publications
-	// tell the event loop in init() that we're opening a new SSE on a session
-	sseOpening <- session
-	// when we end this response, tell the event loop in the init()
-	defer func() {
-		sseClosing <- session
-	}()
+	// tell the hub that we're opening a new SSE on a session, and when we end this response, that we're closing it
+	if !sse.open(conn) {
+		http.Error(w, "Server is stopping", http.StatusServiceUnavailable)
+		return
+	}
+	defer sse.close(conn)
 	// listen to connection close
 	// done := w.(http.CloseNotifier).CloseNotify()
 	done := r.Context().Done()
 	// send initial {} just so SSE knows it's working
 	json.NewEncoder(w).Encode(Response{})
 	flusher.Flush()
+	send := func(sub *subscription, deltaResp *Response) {
+		deltaRespJSON, _ := json.Marshal(deltaResp)
+		writeSSEEvent(w, recordSSEEvent(session, deltaRespJSON))
+		flusher.Flush()
+	}
+	// if reconnecting, send what the client missed
+	if lastEventID, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		resumeSSE(w, session, lastEventID)
+		flusher.Flush()
+		// and what changed while it was disconnected
+		updateSubscriptions(session, &Publication{Kind: "Session", ID: session.ID}, nil, send)
+	}
 	// process any publications, possibly outputting JSON, until connection is done
-	for {
-		select {
-		case <-done:
-			sessionLog(&Request{Session: session}, "Info", "SSE done")
-			return
-		default:
-			pub := <-session.SSEConnection
-			if !pub.Ping {
-				// get snapshot of subscriptions to avoid contention
-				session.SubscriptionsMutex.RLock()
-				subs := make([]*subscription, 0, len(session.Subscriptions))
-				for _, sub := range session.Subscriptions {
-					subs = append(subs, sub)
-				}
-				session.SubscriptionsMutex.RUnlock()
-				// handle each subcription
-				for _, sub := range subs {
-					resp := sub.Handler(sub.Req, pub)
-					deltaResp := delta(resp, sub.LastResp)
-					sub.LastResp = resp
-					if deltaResp != nil {
-						deltaResp.SubscriptionID = sub.ID
-						deltaRespJSON, _ := json.Marshal(deltaResp)
-						sub.LastEventID++
-						fmt.Fprintf(w, "id:%d\ndata: %s\n\n", sub.LastEventID, deltaRespJSON)
-						flusher.Flush()
-					}
-				}
-			}
-		}
+	for pub := conn.next(done); pub != nil; pub = conn.next(done) {
+		updateSubscriptions(session, pub, nil, send)
 	}
+	sessionLog(&Request{Session: session}, "Info", "SSE done")
 }
 
-func delta(nextResp *Response, lastResp *Response) *Response {
-	deltaResp := Response{}
-	hasDelta := false
-	// check delta of Orgs
-	if nextResp.Orgs != nil && lastResp.Orgs != nil {
-		deltaResp.Orgs = map[int64]*Org{}
-		for key, lastValue := range lastResp.Orgs {
-			if nextValue, ok := nextResp.Orgs[key]; ok {
-				// a lastResp item was also in nextResp, so if they differ, update!
-				if !reflect.DeepEqual(nextValue, lastValue) {
-					deltaResp.Orgs[key] = nextValue
-					hasDelta = true
-				}
-			} else {
-				// a lastResp item wasn't in nextResp, so delete!
-				deltaResp.Orgs[key] = nil
-				hasDelta = true
+// ssePolicy is the policy a client asks for with ?policy=Drop, or else sseCoalesce
+func ssePolicy(r *http.Request) string {
+	if r.URL.Query().Get("policy") == sseDrop {
+		return sseDrop
+	}
+	return sseCoalesce
+}
+
+// resumeSSE replays a session's events after lastEventID, or if some of them are no longer kept, sends a Resync event
+// followed by each subscription's full last response
+func resumeSSE(w io.Writer, session *Session, lastEventID int64) {
+	events, ok := replaySSEEvents(session, lastEventID)
+	if !ok {
+		sessionLog(&Request{Session: session}, "Info", "SSE resync after %d", lastEventID)
+		resyncJSON, _ := json.Marshal(Response{Resync: true})
+		events = []sseEvent{recordSSEEvent(session, resyncJSON)}
+		session.SubscriptionsMutex.RLock()
+		subs := make([]*subscription, 0, len(session.Subscriptions))
+		for _, sub := range session.Subscriptions {
+			if sub.Connection == nil {
+				subs = append(subs, sub)
 			}
 		}
-		for key, nextValue := range nextResp.Orgs {
-			if _, ok := lastResp.Orgs[key]; !ok {
-				// a nextResp item wasn't in lastResp, so insert!
-				deltaResp.Orgs[key] = nextValue
-				hasDelta = true
-			}
+		session.SubscriptionsMutex.RUnlock()
+		sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+		for _, sub := range subs {
+			resp := *sub.LastResp
+			resp.SubscriptionID = sub.ID
+			respJSON, _ := json.Marshal(resp)
+			events = append(events, recordSSEEvent(session, respJSON))
 		}
 	}
-	// check delta of Users
-	if nextResp.Users != nil && lastResp.Users != nil {
-		deltaResp.Users = map[int64]*User{}
-		for key, lastValue := range lastResp.Users {
-			if nextValue, ok := nextResp.Users[key]; ok {
-				// a lastResp item was also in nextResp, so if they differ, update!
-				if !reflect.DeepEqual(nextValue, lastValue) {
-					deltaResp.Users[key] = nextValue
-					hasDelta = true
-				}
-			} else {
-				// a lastResp item wasn't in nextResp, so delete!
-				deltaResp.Users[key] = nil
-				hasDelta = true
-			}
+	for _, event := range events {
+		writeSSEEvent(w, event)
+	}
+}
+
+// recordSSEEvent gives an event's data the session's next event ID, and keeps it to replay
+func recordSSEEvent(session *Session, data []byte) sseEvent {
+	session.SSEMutex.Lock()
+	defer session.SSEMutex.Unlock()
+	session.LastEventID++
+	event := sseEvent{ID: session.LastEventID, Data: data}
+	session.SSEReplay = append(session.SSEReplay, event)
+	if len(session.SSEReplay) > maxSSEReplay {
+		session.SSEReplay = append([]sseEvent{}, session.SSEReplay[len(session.SSEReplay)-maxSSEReplay:]...)
+	}
+	return event
+}
+
+// replaySSEEvents gets a session's events after lastEventID, or false if some of them are no longer kept or
+// lastEventID isn't one of the session's
+func replaySSEEvents(session *Session, lastEventID int64) ([]sseEvent, bool) {
+	session.SSEMutex.Lock()
+	defer session.SSEMutex.Unlock()
+	if lastEventID < 0 || lastEventID > session.LastEventID {
+		return nil, false
+	}
+	if lastEventID == session.LastEventID {
+		return nil, true
+	}
+	if len(session.SSEReplay) == 0 || session.SSEReplay[0].ID > lastEventID+1 {
+		return nil, false
+	}
+	events := []sseEvent{}
+	for _, event := range session.SSEReplay {
+		if event.ID > lastEventID {
+			events = append(events, event)
 		}
-		for key, nextValue := range nextResp.Users {
-			if _, ok := lastResp.Users[key]; !ok {
-				// a nextResp item wasn't in lastResp, so insert!
-				deltaResp.Users[key] = nextValue
-				hasDelta = true
-			}
+	}
+	return events, true
+}
+
+func writeSSEEvent(w io.Writer, event sseEvent) {
+	fmt.Fprintf(w, "id:%d\ndata: %s\n\n", event.ID, event.Data)
+}
+
+// updateSubscriptions re-runs the handlers of a session's subscriptions made on connection that depend on pub, and
+// sends each delta
+func updateSubscriptions(session *Session, pub *Publication, connection chan *Publication, send func(sub *subscription, deltaResp *Response)) {
+	// get snapshot of subscriptions to avoid contention
+	session.SubscriptionsMutex.RLock()
+	subs := make([]*subscription, 0, len(session.Subscriptions))
+	for _, sub := range session.Subscriptions {
+		subs = append(subs, sub)
+	}
+	session.SubscriptionsMutex.RUnlock()
+	// handle each subcription
+	for _, sub := range subs {
+		if sub.Connection != connection || !dependsOn(session, sub, pub) {
+			continue
+		}
+		sub.Req.Dependencies = nil
+		resp := sub.Handler(sub.Req, pub)
+		deltaResp := delta(resp, sub.LastResp)
+		if deltaResp != nil && sub.Req.Delta != "" {
+			deltaResp = patchDelta(sub.Req.Delta, deltaResp, sub.LastResp)
+		}
+		sub.LastResp = resp
+		sub.Dependencies = sub.Req.Dependencies
+		if deltaResp != nil {
+			deltaResp.SubscriptionID = sub.ID
+			send(sub, deltaResp)
 		}
 	}
-	// check delta of Boats
-	if nextResp.Boats != nil && lastResp.Boats != nil {
-		deltaResp.Boats = map[int64]*Boat{}
-		for key, lastValue := range lastResp.Boats {
-			if nextValue, ok := nextResp.Boats[key]; ok {
-				// a lastResp item was also in nextResp, so if they differ, update!
-				if !reflect.DeepEqual(nextValue, lastValue) {
-					deltaResp.Boats[key] = nextValue
-					hasDelta = true
-				}
-			} else {
-				// a lastResp item wasn't in nextResp, so delete!
-				deltaResp.Boats[key] = nil
-				hasDelta = true
-			}
+}
+
+// publicationOf makes the publication of a record that was put, with the users, orgs, boats, and deals it affects
+func publicationOf(key *datastore.Key, src interface{}) *Publication {
+	pub := &Publication{Kind: key.Kind, ID: key.ID}
+	switch src := src.(type) {
+	case *Org:
+		pub.OrgIDs = []int64{key.ID}
+	case *User:
+		pub.UserIDs = []int64{key.ID}
+		pub.OrgIDs = nonZeroIDs(src.OrgID)
+	case *Boat:
+		pub.UserIDs = nonZeroIDs(src.UserID)
+		pub.OrgIDs = nonZeroIDs(src.OrgID)
+		pub.BoatIDs = []int64{key.ID}
+	case *Deal:
+		pub.UserIDs = nonZeroIDs(src.UserID)
+		pub.OrgIDs = nonZeroIDs(src.OrgID)
+		pub.BoatIDs = nonZeroIDs(src.BoatID)
+		pub.DealIDs = []int64{key.ID}
+	case *Event:
+		pub.UserIDs = append(append(nonZeroIDs(src.UserID, src.FromUserID), src.UnreadByIDs...), src.UserIDs...)
+		pub.OrgIDs = append(nonZeroIDs(src.OrgID), src.OrgIDs...)
+		pub.BoatIDs = nonZeroIDs(src.BoatID)
+		pub.DealIDs = nonZeroIDs(src.DealID)
+	}
+	return pub
+}
+
+// dependOn is called by a subscribable handler to declare what its response depends on, so its subscriptions are only
+// re-run for publications that match; a handler that declares nothing is re-run for every publication
+func dependOn(req *Request, deps ...Dependency) {
+	req.Dependencies = append(req.Dependencies, deps...)
+}
+
+// dependOnIDs declares that a response depends on the records of kind with ids, ignoring 0s
+func dependOnIDs(req *Request, kind string, ids ...int64) {
+	if ids = nonZeroIDs(ids...); len(ids) > 0 {
+		dependOn(req, Dependency{Kind: kind, IDs: ids})
+	}
+}
+
+// dependOnQuery declares that a response depends on the records of kind a query got, and on any record of kind that
+// may be put to match its filters; only equality filters on ID, UserID, OrgID, BoatID, DealID, and UnreadByIDs narrow
+// that, since other filters only make the query narrower still
+func dependOnQuery(req *Request, kind string, filters map[string]interface{}, keys []*datastore.Key) {
+	ids := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.ID)
+	}
+	dependOnIDs(req, kind, ids...)
+	dependOn(req, filterDependencies(kind, filters)...)
+}
+
+// filterDependencies gets the dependencies of a query's filters, one for each of its "or" filters
+func filterDependencies(kind string, filters map[string]interface{}) []Dependency {
+	if or, ok := filters["or"].([]map[string]interface{}); ok {
+		deps := []Dependency{}
+		for _, orFilters := range or {
+			deps = append(deps, filterDependencies(kind, orFilters)...)
 		}
-		for key, nextValue := range nextResp.Boats {
-			if _, ok := lastResp.Boats[key]; !ok {
-				// a nextResp item wasn't in lastResp, so insert!
-				deltaResp.Boats[key] = nextValue
-				hasDelta = true
-			}
+		return deps
+	}
+	dep := Dependency{Kind: kind}
+	for filter, value := range filters {
+		var ids []int64
+		switch value := value.(type) {
+		case int64:
+			ids = []int64{value}
+		case int:
+			ids = []int64{int64(value)}
+		case []int64:
+			ids = value
+		default:
+			continue
+		}
+		switch filter {
+		case "ID=":
+			dep.IDs = ids
+		case "UserID=", "UnreadByIDs=":
+			dep.UserIDs = ids
+		case "OrgID=":
+			dep.OrgIDs = ids
+		case "BoatID=":
+			dep.BoatIDs = ids
+		case "DealID=":
+			dep.DealIDs = ids
 		}
 	}
-	// check delta of Deals
-	if nextResp.Deals != nil && lastResp.Deals != nil {
-		deltaResp.Deals = map[int64]*Deal{}
-		for key, lastValue := range lastResp.Deals {
-			if nextValue, ok := nextResp.Deals[key]; ok {
-				// a lastResp item was also in nextResp, so if they differ, update!
-				if !reflect.DeepEqual(nextValue, lastValue) {
-					deltaResp.Deals[key] = nextValue
-					hasDelta = true
-				}
-			} else {
-				// a lastResp item wasn't in nextResp, so delete!
-				deltaResp.Deals[key] = nil
-				hasDelta = true
-			}
+	return []Dependency{dep}
+}
+
+// dependsOn finds out if a subscription of a session must be re-run for a publication
+func dependsOn(session *Session, sub *subscription, pub *Publication) bool {
+	if pub.Kind == "Session" {
+		return pub.ID == session.ID
+	}
+	if sub.Dependencies == nil {
+		return true
+	}
+	for _, dep := range sub.Dependencies {
+		if dep.Kind == pub.Kind && (len(dep.IDs) == 0 || int64InArray(pub.ID, dep.IDs)) && anyIDInArray(pub.UserIDs, dep.UserIDs) &&
+			anyIDInArray(pub.OrgIDs, dep.OrgIDs) && anyIDInArray(pub.BoatIDs, dep.BoatIDs) && anyIDInArray(pub.DealIDs, dep.DealIDs) {
+			return true
 		}
-		for key, nextValue := range nextResp.Deals {
-			if _, ok := lastResp.Deals[key]; !ok {
-				// a nextResp item wasn't in lastResp, so insert!
-				deltaResp.Deals[key] = nextValue
-				hasDelta = true
-			}
+	}
+	return false
+}
+
+// anyIDInArray finds out if any of ids is in array, or array is empty
+func anyIDInArray(ids, array []int64) bool {
+	if len(array) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		if int64InArray(id, array) {
+			return true
 		}
 	}
-	// check delta of Events
-	if nextResp.Events != nil && lastResp.Events != nil {
-		deltaResp.Events = map[int64]*Event{}
-		for key, lastValue := range lastResp.Events {
-			if nextValue, ok := nextResp.Events[key]; ok {
+	return false
+}
+
+// nonZeroIDs gets the IDs that aren't 0
+func nonZeroIDs(ids ...int64) []int64 {
+	result := []int64{}
+	for _, id := range ids {
+		if id != 0 {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// deltaFields are the maps of records in a Response that delta compares
+var deltaFields = []string{"Orgs", "Users", "Boats", "Deals", "Events"}
+
+func delta(nextResp *Response, lastResp *Response) *Response {
+	deltaResp := Response{}
+	hasDelta := false
+	next, last, deltaValue := reflect.ValueOf(nextResp).Elem(), reflect.ValueOf(lastResp).Elem(), reflect.ValueOf(&deltaResp).Elem()
+	for _, field := range deltaFields {
+		nextMap, lastMap := next.FieldByName(field), last.FieldByName(field)
+		if nextMap.IsNil() || lastMap.IsNil() {
+			continue
+		}
+		deltaMap := reflect.MakeMap(nextMap.Type())
+		deleted := reflect.Zero(nextMap.Type().Elem())
+		for _, key := range lastMap.MapKeys() {
+			if nextValue := nextMap.MapIndex(key); nextValue.IsValid() {
 				// a lastResp item was also in nextResp, so if they differ, update!
-				if !reflect.DeepEqual(nextValue, lastValue) {
-					deltaResp.Events[key] = nextValue
-					hasDelta = true
+				if !reflect.DeepEqual(nextValue.Interface(), lastMap.MapIndex(key).Interface()) {
+					deltaMap.SetMapIndex(key, nextValue)
 				}
 			} else {
 				// a lastResp item wasn't in nextResp, so delete!
-				deltaResp.Events[key] = nil
-				hasDelta = true
+				deltaMap.SetMapIndex(key, deleted)
 			}
 		}
-		for key, nextValue := range nextResp.Events {
-			if _, ok := lastResp.Events[key]; !ok {
+		for _, key := range nextMap.MapKeys() {
+			if !lastMap.MapIndex(key).IsValid() {
 				// a nextResp item wasn't in lastResp, so insert!
-				deltaResp.Events[key] = nextValue
-				hasDelta = true
+				deltaMap.SetMapIndex(key, nextMap.MapIndex(key))
 			}
 		}
+		deltaValue.FieldByName(field).Set(deltaMap)
+		hasDelta = hasDelta || deltaMap.Len() > 0
 	}
 	if hasDelta {
 		return &deltaResp
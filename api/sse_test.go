@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestPublicationOf(t *testing.T) {
+	test := func(key *datastore.Key, src interface{}, expect string) {
+		actualJSON, _ := json.Marshal(publicationOf(key, src))
+		if string(actualJSON) != expect {
+			t.Errorf("publicationOf(%s) wrong result\n  actual:%s\n  expect:%s\n", key, actualJSON, expect)
+		}
+	}
+	test(idKey("Org", 8), &Org{Name: "Fuji"}, `{"Ping":false,"Kind":"Org","ID":8,"UserIDs":null,"OrgIDs":[8],"BoatIDs":null,"DealIDs":null}`)
+	test(idKey("Boat", 7), &Boat{UserID: 123}, `{"Ping":false,"Kind":"Boat","ID":7,"UserIDs":[123],"OrgIDs":[],"BoatIDs":[7],"DealIDs":null}`)
+	test(idKey("Event", 51), &Event{DealID: 41, BoatID: 7, UserID: 123, FromUserID: 456, UnreadByIDs: []int64{123}, OrgIDs: []int64{8}},
+		`{"Ping":false,"Kind":"Event","ID":51,"UserIDs":[123,456,123],"OrgIDs":[8],"BoatIDs":[7],"DealIDs":[41]}`)
+}
+
+func TestDependsOn(t *testing.T) {
+	session := &Session{ID: 3, UserID: 123}
+	boatPub := &Publication{Kind: "Boat", ID: 7, UserIDs: []int64{123}, OrgIDs: []int64{8}, BoatIDs: []int64{7}}
+	test := func(deps []Dependency, pub *Publication, expect bool) {
+		if actual := dependsOn(session, &subscription{Dependencies: deps}, pub); actual != expect {
+			t.Errorf("dependsOn(%+v, %+v) => %v, expected %v", deps, pub, actual, expect)
+		}
+	}
+	// subscriptions that declare nothing depend on everything, and every subscription depends on its session
+	test(nil, boatPub, true)
+	test([]Dependency{{Kind: "Boat", IDs: []int64{9}}}, &Publication{Kind: "Session", ID: 3}, true)
+	test(nil, &Publication{Kind: "Session", ID: 4}, false)
+	// a dependency's lists must all match
+	test([]Dependency{{Kind: "Boat"}}, boatPub, true)
+	test([]Dependency{{Kind: "User"}}, boatPub, false)
+	test([]Dependency{{Kind: "Boat", IDs: []int64{6, 7}}}, boatPub, true)
+	test([]Dependency{{Kind: "Boat", IDs: []int64{6}}}, boatPub, false)
+	test([]Dependency{{Kind: "Boat", UserIDs: []int64{123}, OrgIDs: []int64{8}}}, boatPub, true)
+	test([]Dependency{{Kind: "Boat", UserIDs: []int64{123}, OrgIDs: []int64{9}}}, boatPub, false)
+	// any of the dependencies may match
+	test([]Dependency{{Kind: "Boat", IDs: []int64{6}}, {Kind: "Boat", UserIDs: []int64{123}}}, boatPub, true)
+}
+
+func TestFilterDependencies(t *testing.T) {
+	test := func(filters map[string]interface{}, expect []Dependency) {
+		if actual := filterDependencies("Boat", filters); !reflect.DeepEqual(actual, expect) {
+			t.Errorf("filterDependencies(%v) => %+v, expected %+v", filters, actual, expect)
+		}
+	}
+	test(map[string]interface{}{"Location.Loc100KM=": 11328}, []Dependency{{Kind: "Boat"}})
+	test(map[string]interface{}{"UserID=": int64(123), "Audit.QANeeded>": 0}, []Dependency{{Kind: "Boat", UserIDs: []int64{123}}})
+	test(map[string]interface{}{"or": []map[string]interface{}{
+		{"UserID=": int64(123)},
+		{"ID=": []int64{7, 8}},
+	}}, []Dependency{{Kind: "Boat", UserIDs: []int64{123}}, {Kind: "Boat", IDs: []int64{7, 8}}})
+}
+
+func TestGetEventsDependencies(t *testing.T) {
+	mockDataStoreClient = &mockDataStore{t: t, calls: []mockDataStoreCall{
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"UserID=": int64(456)}),
+			dst:        []*Event{{UnreadByIDs: []int64{456}}},
+			keysResult: []*datastore.Key{idKey("Event", 51)},
+		},
+	}}
+	req := &Request{Session: &Session{UserID: 456}}
+	GetEvents(req, nil)
+	mockDataStoreClient.(*mockDataStore).Done()
+	expect := []Dependency{{Kind: "Event", IDs: []int64{51}}, {Kind: "Event", UserIDs: []int64{456}}}
+	if !reflect.DeepEqual(req.Dependencies, expect) {
+		t.Errorf("GetEvents dependencies => %+v, expected %+v", req.Dependencies, expect)
+	}
+}
+
+func TestUpdateSubscriptions(t *testing.T) {
+	session, runs := newSubscribedSession(123, true)
+	var sent []int64
+	send := func(sub *subscription, deltaResp *Response) {
+		sent = append(sent, deltaResp.SubscriptionID)
+	}
+	// another user's boat doesn't re-run anything
+	updateSubscriptions(session, &Publication{Kind: "Boat", ID: 9, UserIDs: []int64{456}, BoatIDs: []int64{9}}, nil, send)
+	if *runs != 0 || sent != nil {
+		t.Errorf("updateSubscriptions ran %d and sent %v for another user's boat", *runs, sent)
+	}
+	// my boat re-runs them all, and they each send their change
+	updateSubscriptions(session, &Publication{Kind: "Boat", ID: 12301, UserIDs: []int64{123}, BoatIDs: []int64{12301}}, nil, send)
+	if *runs != 3 || len(sent) != 3 {
+		t.Errorf("updateSubscriptions ran %d and sent %v for my boat", *runs, sent)
+	}
+}
+
+// newSubscribedSession makes a session of userID with 3 subscriptions to a handler that gets 20 of the user's boats, and
+// declares that it depends on them if declare; runs counts how many times it's run after subscribing
+func newSubscribedSession(userID int64, declare bool) (*Session, *int) {
+	runs := -3
+	handler := func(req *Request, pub *Publication) *Response {
+		runs++
+		resp := &Response{SubscriptionID: -1, Boats: map[int64]*Boat{}}
+		for id := userID * 100; id < userID*100+20; id++ {
+			resp.Boats[id] = &Boat{UserID: userID, Name: "Sea Breeze", Rental: &BoatRental{ListingTitle: "Sea Breeze", ListingStatus: "Published"}}
+		}
+		if runs > 0 {
+			resp.Boats[userID*100+1].Name = "Sea Breeze " + strconv.Itoa(runs)
+		}
+		if declare {
+			dependOn(req, Dependency{Kind: "Boat", UserIDs: []int64{userID}})
+		}
+		return resp
+	}
+	session := &Session{ID: userID, UserID: userID, Subscriptions: map[int64]*subscription{}}
+	for id := int64(1); id <= 3; id++ {
+		req := &Request{Session: session}
+		session.Subscriptions[id] = &subscription{ID: id, Req: req, Handler: handler, LastResp: handler(req, nil), Dependencies: req.Dependencies}
+	}
+	return session, &runs
+}
+
+// benchmarkUpdateSubscriptions publishes a change to one user's boat to 1000 sessions with 3 subscriptions each
+func benchmarkUpdateSubscriptions(b *testing.B, declare bool) {
+	sessions := []*Session{}
+	for userID := int64(1); userID <= 1000; userID++ {
+		session, _ := newSubscribedSession(userID, declare)
+		sessions = append(sessions, session)
+	}
+	pub := &Publication{Kind: "Boat", ID: 50001, UserIDs: []int64{500}, BoatIDs: []int64{50001}}
+	send := func(sub *subscription, deltaResp *Response) {}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, session := range sessions {
+			updateSubscriptions(session, pub, nil, send)
+		}
+	}
+}
+
+// BenchmarkUpdateSubscriptionsAll is how it was before subscriptions declared dependencies: every one is re-run
+func BenchmarkUpdateSubscriptionsAll(b *testing.B) {
+	benchmarkUpdateSubscriptions(b, false)
+}
+
+// BenchmarkUpdateSubscriptionsTargeted only re-runs the subscriptions of the user whose boat changed
+func BenchmarkUpdateSubscriptionsTargeted(b *testing.B) {
+	benchmarkUpdateSubscriptions(b, true)
+}
+
+func TestResumeSSE(t *testing.T) {
+	session, _ := newSubscribedSession(123, true)
+	session.ID = 0
+	for i := 1; i <= maxSSEReplay+2; i++ {
+		recordSSEEvent(session, []byte(`{"SubscriptionID":1,"Boats":{"12301":{"Name":"Sea Breeze `+strconv.Itoa(i)+`"}}}`))
+	}
+	if len(session.SSEReplay) != maxSSEReplay || session.SSEReplay[0].ID != 3 {
+		t.Errorf("SSEReplay should keep events 3 to %d, got %d from %d", maxSSEReplay+2, len(session.SSEReplay), session.SSEReplay[0].ID)
+	}
+	test := func(lastEventID int64, expect string) {
+		w := &bytes.Buffer{}
+		resumeSSE(w, session, lastEventID)
+		if !matchString(w.String(), expect) {
+			t.Errorf("resumeSSE(%d) wrong result\n  actual:%s\n  expect:%s\n", lastEventID, w.String(), expect)
+		}
+	}
+	// nothing was missed
+	test(102, ``)
+	// the last two were missed
+	test(100, "id:101\ndata: {\"SubscriptionID\":1,\"Boats\":{\"12301\":{\"Name\":\"Sea Breeze 101\"}}}\n\nid:102\ndata: {\"SubscriptionID\":1,\"Boats\":{\"12301\":{\"Name\":\"Sea Breeze 102\"}}}\n\n")
+	// event 2 is no longer kept, so it's a resync with each subscription's full response, with new event IDs
+	test(1, "id:103\ndata: {\"Resync\":true}\n\nid:104\ndata: {\"SubscriptionID\":1,\"Boats\":{/.*/}}\n\nid:105\ndata: {\"SubscriptionID\":2,/.*/}\n\nid:106\ndata: {\"SubscriptionID\":3,/.*/}\n\n")
+	// or an event ID that isn't the session's, like from before a restart
+	test(500, "id:107\ndata: {\"Resync\":true}\n\nid:108\ndata: {\"SubscriptionID\":1,/.*/}\n\nid:109\ndata: {\"SubscriptionID\":2,/.*/}\n\nid:110\ndata: {\"SubscriptionID\":3,/.*/}\n\n")
+}
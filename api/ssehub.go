@@ -0,0 +1,258 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sseQueueSize is how many publications a connection may fall behind before its policy applies
+const sseQueueSize = 64
+
+// sseSinkSize is how many publications may wait for the event loop before publish drops them
+const sseSinkSize = 1000
+
+// the policies for publications that don't fit in a connection's queue
+const (
+	sseCoalesce = "Coalesce" // they're replaced by one refresh of all the connection's subscriptions once it catches up
+	sseDrop     = "Drop"     // they're dropped, for clients that only want updates while they keep up
+)
+
+// sseConnection is an /api/SSE or /api/WS connection of a session, and the queue it gets publications on
+type sseConnection struct {
+	Session      *Session
+	Publications chan *Publication
+	Policy       string // sseCoalesce or sseDrop
+	missed       int32  // set atomically when publications were coalesced, until the connection catches up
+}
+
+// SSEStats is how the SSE fan-out is keeping up
+type SSEStats struct {
+	Connections   int   `json:",omitempty"`
+	SinkDepth     int   `json:",omitempty"` // publications waiting for the event loop
+	QueueDepth    int   `json:",omitempty"` // publications waiting in all connections' queues
+	MaxQueueDepth int   `json:",omitempty"` // of any one connection
+	Published     int64 `json:",omitempty"`
+	Dropped       int64 `json:",omitempty"` // because the sink or a Drop connection's queue was full
+	Coalesced     int64 `json:",omitempty"` // into a refresh because a Coalesce connection's queue was full
+}
+
+// sseHub fans publications out to every open connection without ever waiting on one, so a slow client only falls
+// behind itself; only its event loop touches active
+type sseHub struct {
+	sink      chan *Publication
+	opening   chan *sseConnection
+	closing   chan *sseConnection
+	statting  chan chan *SSEStats
+	stopping  chan bool // closed by stop
+	stopped   chan bool // closed by the event loop once it has closed every connection's queue
+	stopOnce  sync.Once
+	active    map[*sseConnection]bool
+	published int64 // the counters are atomic
+	dropped   int64
+	coalesced int64
+}
+
+// sse is the hub of all the connections to this server
+var sse = newSSEHub()
+
+func init() {
+	apiHandlers["GetSSEStats"] = GetSSEStats
+	go sse.run()
+	// we ping every minute so connections notice if their client is gone
+	go func() {
+		for {
+			select {
+			case <-sse.stopped:
+				return
+			case <-time.After(time.Minute):
+				sse.publish(&Publication{Ping: true})
+			}
+		}
+	}()
+}
+
+func newSSEHub() *sseHub {
+	return &sseHub{
+		sink:     make(chan *Publication, sseSinkSize),
+		opening:  make(chan *sseConnection),
+		closing:  make(chan *sseConnection),
+		statting: make(chan chan *SSEStats),
+		stopping: make(chan bool),
+		stopped:  make(chan bool),
+		active:   map[*sseConnection]bool{},
+	}
+}
+
+// publish queues a publication for every connection, without waiting if the sink is full
+func (hub *sseHub) publish(pub *Publication) {
+	select {
+	case hub.sink <- pub:
+		if !pub.Ping {
+			atomic.AddInt64(&hub.published, 1)
+		}
+	default:
+		if !pub.Ping {
+			atomic.AddInt64(&hub.dropped, 1)
+			log.Printf("publish %s %d dropped, sink is full", pub.Kind, pub.ID)
+		}
+	}
+}
+
+// open starts sending publications to a new connection, or returns false if the hub has stopped
+func (hub *sseHub) open(conn *sseConnection) bool {
+	select {
+	case hub.opening <- conn:
+		return true
+	case <-hub.stopped:
+		return false
+	}
+}
+
+// close stops sending publications to a connection
+func (hub *sseHub) close(conn *sseConnection) {
+	select {
+	case hub.closing <- conn:
+	case <-hub.stopped:
+	}
+}
+
+// stats gets how the hub is keeping up, or nil if it has stopped
+func (hub *sseHub) stats() *SSEStats {
+	statsChan := make(chan *SSEStats, 1)
+	select {
+	case hub.statting <- statsChan:
+		return <-statsChan
+	case <-hub.stopped:
+		return nil
+	}
+}
+
+// stop closes every connection's queue, so they end, and waits for the event loop to finish
+func (hub *sseHub) stop() {
+	hub.stopOnce.Do(func() {
+		close(hub.stopping)
+	})
+	<-hub.stopped
+}
+
+func (hub *sseHub) run() {
+	for {
+		select {
+		case conn := <-hub.opening:
+			hub.active[conn] = true
+			sessionLog(&Request{Session: conn.Session}, "Info", "opened connection")
+		case conn := <-hub.closing:
+			if hub.active[conn] {
+				sessionLog(&Request{Session: conn.Session}, "Info", "closed connection")
+				delete(hub.active, conn)
+			}
+		case pub := <-hub.sink:
+			for conn := range hub.active {
+				if pub.Resync {
+					// like coalescing, so the connection refreshes all its subscriptions once it gets this
+					atomic.StoreInt32(&conn.missed, 1)
+				}
+				hub.enqueue(conn, pub)
+			}
+		case statsChan := <-hub.statting:
+			stats := &SSEStats{
+				Connections: len(hub.active),
+				SinkDepth:   len(hub.sink),
+				Published:   atomic.LoadInt64(&hub.published),
+				Dropped:     atomic.LoadInt64(&hub.dropped),
+				Coalesced:   atomic.LoadInt64(&hub.coalesced),
+			}
+			for conn := range hub.active {
+				depth := len(conn.Publications)
+				stats.QueueDepth += depth
+				if depth > stats.MaxQueueDepth {
+					stats.MaxQueueDepth = depth
+				}
+			}
+			statsChan <- stats
+		case <-hub.stopping:
+			// only the event loop sends to the queues, so it's safe to close them here
+			for conn := range hub.active {
+				close(conn.Publications)
+				delete(hub.active, conn)
+			}
+			close(hub.stopped)
+			return
+		}
+	}
+}
+
+// enqueue adds a publication to a connection's queue, or if it's full, applies the connection's policy
+func (hub *sseHub) enqueue(conn *sseConnection, pub *Publication) {
+	select {
+	case conn.Publications <- pub:
+		return
+	default:
+	}
+	if pub.Ping || pub.Resync {
+		// a full queue is proof enough the connection is still being pinged, or will notice it missed some
+		return
+	}
+	if conn.Policy == sseDrop {
+		atomic.AddInt64(&hub.dropped, 1)
+		return
+	}
+	// set missed before trying again, so the connection is sure to receive something after it and notice
+	atomic.StoreInt32(&conn.missed, 1)
+	select {
+	case conn.Publications <- pub:
+	default:
+		atomic.AddInt64(&hub.coalesced, 1)
+	}
+}
+
+// next waits for the next publication a connection should handle, which is a refresh of all the session's
+// subscriptions if any were coalesced; it returns nil when done or the hub has stopped
+func (conn *sseConnection) next(done <-chan struct{}) *Publication {
+	for {
+		// done comes first, even with publications still queued
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		select {
+		case <-done:
+			return nil
+		case pub, ok := <-conn.Publications:
+			if !ok {
+				return nil
+			}
+			if atomic.SwapInt32(&conn.missed, 0) == 1 {
+				// whatever is still queued is covered by the refresh
+				for len(conn.Publications) > 0 {
+					if _, ok := <-conn.Publications; !ok {
+						return nil
+					}
+				}
+				return &Publication{Kind: "Session", ID: conn.Session.ID}
+			}
+			if !pub.Ping && !pub.Resync {
+				return pub
+			}
+		}
+	}
+}
+
+// GetSSEStats gets how the SSE fan-out is keeping up, for staff
+func GetSSEStats(req *Request, pub *Publication) *Response {
+	if !isStaff(req) {
+		return staffOnly()
+	}
+	return &Response{SSEStats: sse.stats()}
+}
+
+// Stop ends every /api/SSE and /api/WS connection, and the bus's connections, when the server is shutting down
+func Stop() {
+	if err := bus.Close(); err != nil {
+		log.Printf("bus.Close => %s", err.Error())
+	}
+	sse.stop()
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSSEConnectionNext(t *testing.T) {
+	conn := &sseConnection{Session: &Session{ID: 3}, Publications: make(chan *Publication, 4), Policy: sseCoalesce}
+	done := make(chan struct{})
+	// pings are skipped
+	conn.Publications <- &Publication{Ping: true}
+	conn.Publications <- &Publication{Kind: "Boat", ID: 7}
+	if pub := conn.next(done); pub == nil || pub.Kind != "Boat" || pub.ID != 7 {
+		t.Errorf("next() => %+v, expected Boat 7", pub)
+	}
+	// when publications were coalesced, whatever is queued becomes one refresh of the session
+	hub := newSSEHub()
+	for id := int64(1); id <= 6; id++ {
+		hub.enqueue(conn, &Publication{Kind: "Boat", ID: id})
+	}
+	if atomic.LoadInt64(&hub.coalesced) != 2 {
+		t.Errorf("enqueue coalesced %d, expected 2", hub.coalesced)
+	}
+	if pub := conn.next(done); pub == nil || pub.Kind != "Session" || pub.ID != 3 || len(conn.Publications) != 0 {
+		t.Errorf("next() => %+v with %d queued, expected Session 3 with none", pub, len(conn.Publications))
+	}
+	// a Drop connection just drops them
+	conn.Policy = sseDrop
+	for id := int64(1); id <= 6; id++ {
+		hub.enqueue(conn, &Publication{Kind: "Boat", ID: id})
+	}
+	if atomic.LoadInt64(&hub.dropped) != 2 {
+		t.Errorf("enqueue dropped %d, expected 2", hub.dropped)
+	}
+	if pub := conn.next(done); pub == nil || pub.Kind != "Boat" || pub.ID != 1 {
+		t.Errorf("next() => %+v, expected Boat 1", pub)
+	}
+	close(done)
+	if pub := conn.next(done); pub != nil {
+		t.Errorf("next() after done => %+v, expected nil", pub)
+	}
+}
+
+// TestSSEHubResync makes sure a Resync refreshes all of every connection's subscriptions
+func TestSSEHubResync(t *testing.T) {
+	hub := newSSEHub()
+	go hub.run()
+	defer hub.stop()
+	conn := &sseConnection{Session: &Session{ID: 3}, Publications: make(chan *Publication, 4), Policy: sseDrop}
+	hub.open(conn)
+	hub.publish(&Publication{Resync: true})
+	done := make(chan struct{})
+	if pub := conn.next(done); pub == nil || pub.Kind != "Session" || pub.ID != 3 {
+		t.Errorf("next() => %+v, expected Session 3", pub)
+	}
+}
+
+// TestSSEHubLoad publishes to many clients, some of which are stuck, and makes sure publishers never wait on them,
+// the clients that keep up get them, and stopping ends them all
+func TestSSEHubLoad(t *testing.T) {
+	const clients, stuck, publications = 1000, 100, 500
+	hub := newSSEHub()
+	go hub.run()
+	var wg sync.WaitGroup
+	received := make([]int64, clients)
+	conns := make([]*sseConnection, clients)
+	for i := range conns {
+		conns[i] = &sseConnection{Session: &Session{}, Publications: make(chan *Publication, sseQueueSize), Policy: sseCoalesce}
+		if !hub.open(conns[i]) {
+			t.Fatal("open() => false before stop")
+		}
+		if i < stuck {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for pub := conns[i].next(nil); pub != nil; pub = conns[i].next(nil) {
+				atomic.AddInt64(&received[i], 1)
+			}
+		}(i)
+	}
+	started := time.Now()
+	for id := int64(1); id <= publications; id++ {
+		hub.publish(&Publication{Kind: "Boat", ID: id})
+		if id%sseQueueSize == 0 {
+			// give the event loop a chance, so the sink doesn't fill up
+			for hub.stats().SinkDepth > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("publishing %d to %d clients took %s", publications, clients, elapsed)
+	}
+	stats := hub.stats()
+	for stats.SinkDepth > 0 || stats.QueueDepth > stuck*sseQueueSize {
+		time.Sleep(time.Millisecond)
+		stats = hub.stats()
+	}
+	if stats.Connections != clients || stats.Published != publications || stats.Dropped != 0 {
+		t.Errorf("stats() => %+v, expected %d connections, %d published, none dropped", stats, clients, publications)
+	}
+	if stats.MaxQueueDepth != sseQueueSize || stats.Coalesced < stuck*(publications-sseQueueSize) {
+		t.Errorf("stats() => %+v, expected the stuck clients' queues to be full and the rest coalesced", stats)
+	}
+	// stopping closes every queue, so the clients that keep up get the rest of theirs and end
+	hub.stop()
+	finished := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("clients didn't end after stop()")
+	}
+	for i := stuck; i < clients; i++ {
+		if received[i] == 0 || received[i] > publications {
+			t.Errorf("client %d received %d of %d", i, received[i], publications)
+			break
+		}
+	}
+	if hub.open(&sseConnection{Publications: make(chan *Publication, 1)}) || hub.stats() != nil {
+		t.Error("open() or stats() after stop() still work")
+	}
+	hub.publish(&Publication{Kind: "Boat", ID: 1})
+	hub.stop()
+}
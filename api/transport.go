@@ -0,0 +1,412 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// transporterStatuses has the Status changes a transporter may make on a transport deal; customers may only cancel
+var transporterStatuses = map[string][]string{
+	"Accepted":  {"PickedUp", "Canceled"},
+	"PickedUp":  {"InTransit", "Delivered"},
+	"InTransit": {"Delivered"},
+}
+
+func init() {
+	addEnumsFor(EventTransport{})
+	apiHandlers["PostTransport"] = PostTransport
+	apiHandlers["GetTransportJobs"] = GetTransportJobs
+	apiHandlers["BidTransport"] = BidTransport
+	apiHandlers["AcceptTransportBid"] = AcceptTransportBid
+	apiHandlers["UpdateTransport"] = UpdateTransport
+}
+
+// PostTransport is when BoatID's owner or buyer posts a job to move it to Transport's Destination, with its Types,
+// pick up and delivery windows, and Notes; the boat's Location is where it's picked up
+func PostTransport(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.BoatID == 0 {
+		return &Response{ErrorCode: "NeedBoatID"}
+	}
+	job := req.Transport
+	if job == nil || job.Destination == nil {
+		return &Response{ErrorCode: "NeedDestination"}
+	}
+	if err := validate(job); err != nil {
+		return errResponse(err)
+	}
+	if err := checkTransportWindows(job); err != nil {
+		return errResponse(err)
+	}
+	boat, err := getBoat(req.BoatID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if !isMine(req, boat) && !isStaff(req) || lacksOrgAccess(req, "SetBoat", boat) {
+		// a buyer may move the boat once their offer is accepted
+		buyer, err := isBuyer(req, boat.ID)
+		if err != nil {
+			return errResponse(err)
+		}
+		if !buyer {
+			return accessDenied()
+		}
+	}
+	if boat.Location == nil || boat.Location.Location == nil {
+		return &Response{ErrorCode: "NeedBoatLocation"}
+	}
+	pickUp := *boat.Location
+	pickUp.Loc100KM = nil
+	pickUp.Loc300KM = nil
+	loc, err := geoSquare(pickUp.Location.Lat, pickUp.Location.Lng, 100, 50)
+	if err != nil {
+		return errResponse(err)
+	}
+	key, err := putEvent(&Event{
+		BoatID:     boat.ID,
+		UserID:     req.Session.UserID,
+		FromUserID: req.Session.UserID,
+		Transport: &EventTransport{
+			Status:        "Open",
+			Types:         job.Types,
+			PickUp:        &pickUp,
+			Loc100KM:      loc,
+			PickUpAfter:   job.PickUpAfter,
+			PickUpBefore:  job.PickUpBefore,
+			DeliverAfter:  job.DeliverAfter,
+			DeliverBefore: job.DeliverBefore,
+			Destination:   job.Destination,
+			Currency:      boat.Currency,
+			Notes:         job.Notes,
+		},
+		Audit: &Audit{Created: now()},
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// GetTransportJobs gets open transport jobs picked up near Location, or near my Transporter org's address
+func GetTransportJobs(req *Request, pub *Publication) *Response {
+	org, err := getTransporter(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	location := req.Location
+	for _, contact := range org.Contacts {
+		if location == nil && contact.Type == "Address" && contact.Location != nil {
+			location = contact.Location
+		}
+	}
+	if location == nil {
+		return &Response{ErrorCode: "NeedLocation"}
+	}
+	loc, err := geoSquare(location.Lat, location.Lng, 100, 0)
+	if err != nil {
+		return errResponse(err)
+	}
+	var events []*Event
+	filters := map[string]interface{}{"Transport.Loc100KM=": loc[0]}
+	keys, err := getAllEvents(filters, &events)
+	if err != nil {
+		return errResponse(err)
+	}
+	dependOnQuery(req, "Event", filters, keys)
+	dependOnIDs(req, "Org", org.ID)
+	resp := &Response{SubscriptionID: -1, Events: map[int64]*Event{}}
+	for index, key := range keys {
+		event := events[index]
+		job := event.Transport
+		if job == nil || job.Status != "Open" || job.PickUpBefore != nil && job.PickUpBefore.Before(*now()) {
+			continue
+		}
+		event.ID = key.ID
+		event.UnreadByIDs = nil
+		resp.Events[key.ID] = event
+	}
+	return resp
+}
+
+// BidTransport is when my Transporter org bids Transport's Price on open job EventID, maybe with its own Types,
+// windows, and Notes
+func BidTransport(req *Request, pub *Publication) *Response {
+	org, err := getTransporter(req)
+	if err != nil {
+		return errResponse(err)
+	}
+	if req.EventID == 0 {
+		return &Response{ErrorCode: "NeedEventID"}
+	}
+	bid := req.Transport
+	if bid == nil || bid.Price <= 0 {
+		return &Response{ErrorCode: "NeedPrice"}
+	}
+	if err := validate(bid); err != nil {
+		return errResponse(err)
+	}
+	job, err := getEvent(req.EventID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if job.Transport == nil || job.Transport.Status != "Open" {
+		return &Response{ErrorCode: "JobNotOpen"}
+	}
+	// a transporter has one bid at a time per job
+	bids, err := getTransportBids(job.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	for _, other := range bids {
+		if other.OrgID == org.ID && other.Transport.Status == "Bid" {
+			return &Response{ErrorCode: "BidOpen", ErrorDetails: map[string]string{"EventID": strconv.FormatInt(other.ID, 10)}}
+		}
+	}
+	// the bid has the job's terms unless the transporter changes them
+	terms := *job.Transport
+	terms.Status = "Bid"
+	terms.JobEventID = job.ID
+	terms.Loc100KM = nil
+	terms.Price = bid.Price
+	terms.Notes = bid.Notes
+	if bid.Types != nil {
+		terms.Types = bid.Types
+	}
+	if bid.Currency != "" {
+		terms.Currency = bid.Currency
+	}
+	for _, window := range []struct{ bid, terms **time.Time }{
+		{&bid.PickUpAfter, &terms.PickUpAfter},
+		{&bid.PickUpBefore, &terms.PickUpBefore},
+		{&bid.DeliverAfter, &terms.DeliverAfter},
+		{&bid.DeliverBefore, &terms.DeliverBefore},
+	} {
+		if *window.bid != nil {
+			*window.terms = *window.bid
+		}
+	}
+	if err := checkTransportWindows(&terms); err != nil {
+		return errResponse(err)
+	}
+	key, err := putEvent(&Event{
+		BoatID:      job.BoatID,
+		UserID:      job.UserID,
+		OrgID:       org.ID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: []int64{job.UserID},
+		OrgIDs:      []int64{org.ID},
+		Transport:   &terms,
+		Audit:       &Audit{Created: now()},
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// AcceptTransportBid is when the customer accepts bid EventID, which adds sales tax, makes a Deal with the transporter,
+// and declines the job's other bids
+func AcceptTransportBid(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.EventID == 0 {
+		return &Response{ErrorCode: "NeedEventID"}
+	}
+	bid, err := getEvent(req.EventID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if bid.Transport == nil || bid.Transport.JobEventID == 0 {
+		return &Response{ErrorCode: "NeedBid"}
+	}
+	if bid.Transport.Status != "Bid" {
+		return &Response{ErrorCode: "BidNotOpen"}
+	}
+	job, err := getEvent(bid.Transport.JobEventID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if !isMine(req, job) && !isStaff(req) || lacksOrgAccess(req, "SetDeal", job) {
+		return accessDenied()
+	}
+	// the job and the bid are accepted together, so a job only becomes one deal
+	var transport EventTransport
+	if _, err := updateXTx("Event", job.ID, 0, job, nil, func(tx datastorer) (interface{}, error) {
+		if job.Transport == nil || job.Transport.Status != "Open" {
+			return nil, errors.New("JobNotOpen")
+		}
+		bid = &Event{}
+		if err := tx.Get(apiContext, idKey("Event", req.EventID), bid); err != nil {
+			return nil, err
+		}
+		bid.ID = req.EventID
+		if bid.Transport == nil || bid.Transport.Status != "Bid" {
+			return nil, errors.New("BidNotOpen")
+		}
+		transport = *bid.Transport
+		// the transporter sees its bid accepted
+		bid.Transport.Status = "Accepted"
+		bid.UnreadByIDs = nil
+		if err := putXTx(tx, idKey("Event", bid.ID), bid); err != nil {
+			return nil, err
+		}
+		// the job comes off the board
+		job.Transport.Status = "Accepted"
+		job.Transport.Loc100KM = nil
+		return job, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	transport.Status = "Accepted"
+	transport.TransportOrgID = int(bid.OrgID)
+	transport.SalesTax = salesTax(transport.Price)
+	transport.Total = transport.Price + transport.SalesTax
+	deal := &Deal{BoatID: job.BoatID, UserID: job.UserID, OrgID: bid.OrgID, Transport: &transport, Audit: &Audit{Created: now()}}
+	dealKey, err := putDeal(deal)
+	if err != nil {
+		return errResponse(err)
+	}
+	// the deal is new, so the job and bid are linked to it once they're accepted
+	for _, eventID := range []int64{job.ID, bid.ID} {
+		accepted := &Event{}
+		if _, err := updateX("Event", eventID, 0, accepted, nil, func() (interface{}, error) {
+			accepted.DealID = dealKey.ID
+			return accepted, nil
+		}); err != nil {
+			return errResponse(err)
+		}
+	}
+	bids, err := getTransportBids(job.ID)
+	if err != nil {
+		return errResponse(err)
+	}
+	for _, other := range bids {
+		if other.ID == bid.ID || other.Transport.Status != "Bid" {
+			continue
+		}
+		declined := &Event{}
+		if _, err := updateX("Event", other.ID, 0, declined, nil, func() (interface{}, error) {
+			if declined.Transport == nil || declined.Transport.Status != "Bid" {
+				return nil, nil
+			}
+			declined.Transport.Status = "Declined"
+			declined.UnreadByIDs = nil
+			return declined, nil
+		}); err != nil {
+			return errResponse(err)
+		}
+	}
+	return &Response{ID: dealKey.ID}
+}
+
+// UpdateTransport is when the transporter moves transport DealID's Status along from pick up through delivery, or either
+// side cancels it before pick up; the other side gets the update, with Transport.Notes, as an event
+func UpdateTransport(req *Request, pub *Publication) *Response {
+	if !isVerifiedUser(req) {
+		return mustVerifyResp()
+	}
+	if req.DealID == 0 {
+		return &Response{ErrorCode: "NeedDealID"}
+	}
+	if req.Transport == nil {
+		return &Response{ErrorCode: "NeedTransport"}
+	}
+	if err := validate(req.Transport); err != nil {
+		return errResponse(err)
+	}
+	deal, err := getDeal(req.DealID)
+	if err != nil {
+		return errResponse(err)
+	}
+	if deal.Transport == nil {
+		return &Response{ErrorCode: "NeedTransportDeal"}
+	}
+	customer := deal.UserID == req.Session.UserID
+	transporter := deal.OrgID != 0 && deal.OrgID == req.Session.OrgID && !lacksOrgAccess(req, "SetDeal", deal) || isStaff(req)
+	if !customer && !transporter {
+		return accessDenied()
+	}
+	status := req.Transport.Status
+	if _, err := updateX("Deal", deal.ID, 0, deal, nil, func() (interface{}, error) {
+		// from the status it has now, not when it was read above
+		old := deal.Transport.Status
+		switch {
+		case status == "Canceled" && customer && old == "Accepted":
+		case transporter && StringInArray(status, transporterStatuses[old]):
+		default:
+			return nil, Err("BadStatus", map[string]string{"From": old, "To": status})
+		}
+		deal.Transport.Status = status
+		auditOf(deal).Updated = now()
+		return deal, nil
+	}); err != nil {
+		return errResponse(err)
+	}
+	unreadByIDs := []int64{deal.UserID}
+	if customer {
+		unreadByIDs = nil
+	}
+	key, err := putEvent(&Event{
+		DealID:      deal.ID,
+		BoatID:      deal.BoatID,
+		UserID:      deal.UserID,
+		OrgID:       deal.OrgID,
+		FromUserID:  req.Session.UserID,
+		UnreadByIDs: unreadByIDs,
+		OrgIDs:      []int64{deal.OrgID},
+		Transport:   &EventTransport{Status: status, Notes: req.Transport.Notes},
+		Audit:       &Audit{Created: now()},
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return &Response{ID: key.ID}
+}
+
+// getTransporter gets the session's org, if it's a Transporter
+func getTransporter(req *Request) (*Org, error) {
+	if !isVerifiedUser(req) {
+		return nil, errors.New("MustVerify")
+	}
+	if req.Session.OrgID == 0 {
+		return nil, errors.New("NeedOrgID")
+	}
+	org, err := getOrg(req.Session.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	if !StringInArray("Transporter", org.Types) {
+		return nil, errors.New("NotTransporter")
+	}
+	return org, nil
+}
+
+// getTransportBids gets the bids on a transport job
+func getTransportBids(jobEventID int64) ([]*Event, error) {
+	var events []*Event
+	keys, err := getAllEvents(map[string]interface{}{"Transport.JobEventID=": jobEventID}, &events)
+	if err != nil {
+		return nil, err
+	}
+	for index, key := range keys {
+		events[index].ID = key.ID
+	}
+	return events, nil
+}
+
+// checkTransportWindows makes sure each window's start is before its end and delivery isn't before pick up
+func checkTransportWindows(transport *EventTransport) error {
+	switch {
+	case transport.PickUpAfter != nil && transport.PickUpBefore != nil && !transport.PickUpAfter.Before(*transport.PickUpBefore):
+		return Err("BadWindow", map[string]string{"Field": "PickUpBefore"})
+	case transport.DeliverAfter != nil && transport.DeliverBefore != nil && !transport.DeliverAfter.Before(*transport.DeliverBefore):
+		return Err("BadWindow", map[string]string{"Field": "DeliverBefore"})
+	case transport.PickUpAfter != nil && transport.DeliverBefore != nil && !transport.PickUpAfter.Before(*transport.DeliverBefore):
+		return Err("BadWindow", map[string]string{"Field": "DeliverBefore"})
+	}
+	return nil
+}
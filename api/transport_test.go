@@ -0,0 +1,219 @@
+package api
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine"
+)
+
+func TestPostTransport(t *testing.T) {
+	owner := &Session{UserID: 123, Verified: true}
+	testAPI(t, owner, nil, "PostTransport", `{"BoatID":7,"Transport":{}}`, `{"ErrorCode":"NeedDestination"}`, nil)
+	testAPI(t, owner, nil, "PostTransport", `{"BoatID":7,"Transport":{"Destination":{},"PickUpAfter":"2020-05-20T00:00:00Z","DeliverBefore":"2020-05-10T00:00:00Z"}}`, `{"ErrorCode":"BadWindow","ErrorDetails":{"Field":"DeliverBefore"}}`, nil)
+	// only the owner, or a buyer whose offer was accepted
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "PostTransport", `{"BoatID":7,"Transport":{"Destination":{"City":"Tampa"}}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newTransportBoat()},
+		{
+			name:       "GetAll",
+			q:          newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+			dst:        []*Deal{{BoatID: 7, UserID: 456, Sale: &EventSale{Status: "Withdrawn"}}},
+			keysResult: []*datastore.Key{idKey("Deal", 41)},
+		},
+	})
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "PostTransport", `{"BoatID":7,"Transport":{"Types":["OpenTransport"],"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US"}}}`, `{"ID":61}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Boat", 7), dst: newTransportBoat()},
+		{
+			name:       "GetAll",
+			q:          newQuery("Deal", map[string]interface{}{"BoatID=": 7}),
+			dst:        []*Deal{{BoatID: 7, UserID: 456, Sale: &EventSale{Status: "Accepted"}}},
+			keysResult: []*datastore.Key{idKey("Deal", 41)},
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":456,"FromUserID":456,"Transport":{"Status":"Open","Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{},"Location":{"Lat":25.7467903,"Lng":-80.2113866}},"Loc100KM":[11328,11329,11728,11729],"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 61),
+		},
+	})
+}
+
+func TestGetTransportJobs(t *testing.T) {
+	transporter := &Session{UserID: 900, OrgID: 9, Verified: true}
+	testAPI(t, &Session{UserID: 901, OrgID: 10, Verified: true}, nil, "GetTransportJobs", `{}`, `{"ErrorCode":"NotTransporter"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 10), dst: Org{Types: []string{"Insurer"}}},
+	})
+	testAPI(t, transporter, nil, "GetTransportJobs", `{}`, `{"ErrorCode":"NeedLocation"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Transporter"}}},
+	})
+	loc, _ := geoSquare(25.7617, -80.1918, 100, 0)
+	testAPI(t, transporter, nil, "GetTransportJobs", `{}`, `{"SubscriptionID":-1,"Events":{"61":{"ID":61,"BoatID":7,"UserID":123,"FromUserID":123,"Transport":{"Status":"Open","Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"Loc100KM":[11328,11329,11728,11729],"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD"}}}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Transporter"}, Contacts: []Contact{{Type: "Email", Email: "jobs@haul.com"}, {Type: "Address", Location: &appengine.GeoPoint{Lat: 25.7617, Lng: -80.1918}}}}},
+		{
+			name: "GetAll",
+			q:    newQuery("Event", map[string]interface{}{"Transport.Loc100KM=": loc[0]}),
+			dst: []*Event{
+				func() *Event { e := newTransportJob("Open"); return &e }(),
+				func() *Event { e := newTransportJob("Accepted"); return &e }(),
+				func() *Event {
+					e := newTransportJob("Open")
+					e.Transport.PickUpBefore = DateTime(2020, 5, 1, 0, 0, 0)
+					return &e
+				}(),
+			},
+			keysResult: []*datastore.Key{idKey("Event", 61), idKey("Event", 62), idKey("Event", 63)},
+		},
+	})
+}
+
+func TestBidTransport(t *testing.T) {
+	transporter := &Session{UserID: 900, OrgID: 9, Verified: true}
+	testAPI(t, transporter, nil, "BidTransport", `{"EventID":61,"Transport":{}}`, `{"ErrorCode":"NeedPrice"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Transporter"}}},
+	})
+	testAPI(t, transporter, nil, "BidTransport", `{"EventID":61,"Transport":{"Price":1200}}`, `{"ErrorCode":"JobNotOpen"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Transporter"}}},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Accepted")},
+	})
+	testAPI(t, transporter, nil, "BidTransport", `{"EventID":61,"Transport":{"Price":1200}}`, `{"ErrorCode":"BidOpen","ErrorDetails":{"EventID":"71"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Transporter"}}},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Open")},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"Transport.JobEventID=": 61}),
+			dst:        []*Event{func() *Event { e := newTransportBid("Bid", 9); return &e }()},
+			keysResult: []*datastore.Key{idKey("Event", 71)},
+		},
+	})
+	testAPI(t, transporter, nil, "BidTransport", `{"EventID":61,"Transport":{"Price":1200,"PickUpAfter":"2020-05-20T00:00:00Z","Notes":"Two day trip"}}`, `{"ID":72}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Org", 9), dst: Org{Types: []string{"Transporter"}}},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Open")},
+		{
+			name:       "GetAll",
+			q:          newQuery("Event", map[string]interface{}{"Transport.JobEventID=": 61}),
+			dst:        []*Event{func() *Event { e := newTransportBid("Bid", 10); return &e }()},
+			keysResult: []*datastore.Key{idKey("Event", 71)},
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":900,"UnreadByIDs":[123],"OrgIDs":[9],"Transport":{"Status":"Bid","JobEventID":61,"Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"PickUpAfter":"2020-05-20T00:00:00Z","DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Notes":"Two day trip","Currency":"USD","Price":1200},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 72),
+		},
+	})
+}
+
+func TestAcceptTransportBid(t *testing.T) {
+	owner := &Session{UserID: 123, Verified: true}
+	testAPI(t, &Session{UserID: 456, Verified: true}, nil, "AcceptTransportBid", `{"EventID":71}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 71), dst: newTransportBid("Bid", 9)},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Open")},
+	})
+	testAPI(t, owner, nil, "AcceptTransportBid", `{"EventID":71}`, `{"ErrorCode":"BidNotOpen"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 71), dst: newTransportBid("Declined", 9)},
+	})
+	// another bid was accepted in the meantime
+	testAPI(t, owner, nil, "AcceptTransportBid", `{"EventID":71}`, `{"ErrorCode":"JobNotOpen"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 71), dst: newTransportBid("Bid", 9)},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Open")},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Accepted")},
+	})
+	testAPI(t, owner, nil, "AcceptTransportBid", `{"EventID":71}`, `{"ID":41}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Event", 71), dst: newTransportBid("Bid", 9)},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Open")},
+		{name: "Get", key: idKey("Event", 61), dst: newTransportJob("Open")},
+		{name: "Get", key: idKey("Event", 71), dst: newTransportBid("Bid", 9)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 71),
+			srcJSON:   `{"ID":71,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":900,"OrgIDs":[9],"Transport":{"Status":"Accepted","JobEventID":61,"Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD","Price":1200},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 71),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 61),
+			srcJSON:   `{"ID":61,"BoatID":7,"UserID":123,"FromUserID":123,"Transport":{"Status":"Accepted","Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD"},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 61),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 0),
+			srcJSON:   `{"BoatID":7,"UserID":123,"OrgID":9,"Transport":{"Status":"Accepted","JobEventID":61,"Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"TransportOrgID":9,"Currency":"USD","Price":1200,"SalesTax":84,"Total":1284},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{name: "Get", key: idKey("Event", 61), dst: func() Event {
+			e := newTransportJob("Accepted")
+			e.Transport.Loc100KM = nil
+			e.Audit = &Audit{Version: 1}
+			return e
+		}()},
+		{
+			name:      "Put",
+			key:       idKey("Event", 61),
+			srcJSON:   `{"ID":61,"DealID":41,"BoatID":7,"UserID":123,"FromUserID":123,"Transport":{"Status":"Accepted","Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD"},"Audit":{"Version":2}}`,
+			keyResult: idKey("Event", 61),
+		},
+		{name: "Get", key: idKey("Event", 71), dst: func() Event {
+			e := newTransportBid("Accepted", 9)
+			e.Audit = &Audit{Version: 1}
+			return e
+		}()},
+		{
+			name:      "Put",
+			key:       idKey("Event", 71),
+			srcJSON:   `{"ID":71,"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":900,"OrgIDs":[9],"Transport":{"Status":"Accepted","JobEventID":61,"Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD","Price":1200},"Audit":{"Version":2}}`,
+			keyResult: idKey("Event", 71),
+		},
+		{
+			name: "GetAll",
+			q:    newQuery("Event", map[string]interface{}{"Transport.JobEventID=": 61}),
+			dst: []*Event{
+				func() *Event { e := newTransportBid("Accepted", 9); return &e }(),
+				func() *Event { e := newTransportBid("Bid", 10); return &e }(),
+			},
+			keysResult: []*datastore.Key{idKey("Event", 71), idKey("Event", 72)},
+		},
+		{name: "Get", key: idKey("Event", 72), dst: newTransportBid("Bid", 10)},
+		{
+			name:      "Put",
+			key:       idKey("Event", 72),
+			srcJSON:   `{"ID":72,"BoatID":7,"UserID":123,"OrgID":10,"FromUserID":900,"OrgIDs":[10],"Transport":{"Status":"Declined","JobEventID":61,"Types":["OpenTransport"],"PickUp":{"Type":"Address","City":"Miami","State":"FL","Country":"US","Residence":{}},"DeliverBefore":"2020-06-01T00:00:00Z","Destination":{"Type":"Address","City":"Tampa","State":"FL","Country":"US","Residence":{}},"Currency":"USD","Price":1200},"Audit":{"Version":1}}`,
+			keyResult: idKey("Event", 72),
+		},
+	})
+}
+
+func TestUpdateTransport(t *testing.T) {
+	transporter := &Session{UserID: 900, OrgID: 9, OrgAccess: []string{"SetDeal"}, Verified: true}
+	newTransportDeal := func(status string) Deal {
+		return Deal{BoatID: 7, UserID: 123, OrgID: 9, Transport: &EventTransport{Status: status, JobEventID: 61, TransportOrgID: 9, Price: 1200, SalesTax: 84, Total: 1284}}
+	}
+	testAPI(t, &Session{UserID: 123, Verified: true}, nil, "UpdateTransport", `{"DealID":41,"Transport":{"Status":"Delivered"}}`, `{"ErrorCode":"BadStatus","ErrorDetails":{"From":"PickedUp","To":"Delivered"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("PickedUp")},
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("PickedUp")},
+	})
+	// the transporter's members need SetDeal OrgAccess
+	testAPI(t, &Session{UserID: 901, OrgID: 9, Verified: true}, nil, "UpdateTransport", `{"DealID":41,"Transport":{"Status":"PickedUp"}}`, `{"ErrorCode":"AccessDenied"}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("Accepted")},
+	})
+	testAPI(t, transporter, nil, "UpdateTransport", `{"DealID":41,"Transport":{"Status":"InTransit"}}`, `{"ErrorCode":"BadStatus","ErrorDetails":{"From":"Accepted","To":"InTransit"}}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("Accepted")},
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("Accepted")},
+	})
+	testAPI(t, transporter, nil, "UpdateTransport", `{"DealID":41,"Transport":{"Status":"PickedUp","Notes":"On the trailer"}}`, `{"ID":81}`, []mockDataStoreCall{
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("Accepted")},
+		{name: "Get", key: idKey("Deal", 41), dst: newTransportDeal("Accepted")},
+		{
+			name:      "Put",
+			key:       idKey("Deal", 41),
+			srcJSON:   `{"ID":41,"BoatID":7,"UserID":123,"OrgID":9,"Transport":{"Status":"PickedUp","JobEventID":61,"TransportOrgID":9,"Price":1200,"SalesTax":84,"Total":1284},"Audit":{"Updated":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Deal", 41),
+		},
+		{
+			name:      "Put",
+			key:       idKey("Event", 0),
+			srcJSON:   `{"DealID":41,"BoatID":7,"UserID":123,"OrgID":9,"FromUserID":900,"UnreadByIDs":[123],"OrgIDs":[9],"Transport":{"Status":"PickedUp","Notes":"On the trailer"},"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
+			keyResult: idKey("Event", 81),
+		},
+	})
+}
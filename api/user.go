@@ -1,7 +1,7 @@
 package api
 
 import (
-	"log"
+	"errors"
 	"strconv"
 	"time"
 
@@ -38,13 +38,19 @@ type User struct {
 	Images            []Image        `json:",omitempty" datastore:",omitempty,noindex" qa:"-"`
 	Contacts          []Contact      `json:",omitempty" datastore:",omitempty"`
 	UserApprovals     []UserApproval `json:",omitempty" datastore:",omitempty"`
-	Favorites         []int64        `json:",omitempty" datastore:",omitempty,noindex"`
+	Favorites         []int64        `json:",omitempty" datastore:",omitempty"`
+	Wishlists         []UserWishlist `json:",omitempty" datastore:",omitempty"`
+	Searches          []UserSearch   `json:",omitempty" datastore:",omitempty"`
+	SearchDigested    *time.Time     `json:",omitempty" datastore:",omitempty,noindex"`
 	Notifications     []string       `json:",omitempty" datastore:",omitempty,noindex" enum:"Rental Start / End, Message Received, Special Offers, News, Tips, Upcoming Rentals, User Reviews, Review Reminder, Booking Expired"`
 	RewardPoints      int            `json:",omitempty" datastore:",omitempty,noindex"`
+	Rewards           []UserReward   `json:",omitempty" datastore:",omitempty,noindex"`
+	Referral          *UserReferral  `json:",omitempty" datastore:",omitempty"`
 	Currency          string         `json:",omitempty" datastore:",omitempty,noindex" enum:"CAD, EUR, USD"`
 	BankAccounts      []BankAccount  `json:",omitempty" datastore:",omitempty,noindex"`
 	CreditCards       []CreditCard   `json:",omitempty" datastore:",omitempty,noindex"`
 	W9s               []W9           `json:",omitempty" datastore:",omitempty,noindex"`
+	Crew              *UserCrew      `json:",omitempty" datastore:",omitempty"`
 	RequestCount      int            `json:",omitempty" datastore:",omitempty,noindex"`
 	ResponseCount     int            `json:",omitempty" datastore:",omitempty,noindex"`
 	ResponseSecSum    int            `json:",omitempty" datastore:",omitempty,noindex"`
@@ -116,6 +122,9 @@ type UserJob struct {
 
 // UserVerification is a response to a UserApproval
 type UserVerification struct {
+	Status      string     `json:",omitempty" datastore:",omitempty" enum:"Pending, Approved, Denied"`
+	Reviewed    *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
+	ReviewerID  int64      `json:",omitempty" datastore:",omitempty,noindex"`
 	Name        string     `json:",omitempty" datastore:",omitempty,noindex"`
 	Citizenship string     `json:",omitempty" datastore:",omitempty,noindex"`
 	IssueDate   *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
@@ -132,7 +141,8 @@ type InsuranceClaim struct {
 
 // Violation is a moving violation in the past that affects a user's approval
 type Violation struct {
-	Type string `json:",omitempty" datastore:",omitempty,noindex" enum:"Suspended License, Speeding Over 20, Speeding Under 20, DUI, Reckless Driving, At Fault Accident"`
+	Type string     `json:",omitempty" datastore:",omitempty,noindex" enum:"Suspended License, Speeding Over 20, Speeding Under 20, DUI, Reckless Driving, At Fault Accident"`
+	Date *time.Time `json:",omitempty" datastore:",omitempty,noindex"`
 }
 
 // Visit tracks when a user signs in and out
@@ -148,6 +158,7 @@ func init() {
 	addEnumsFor(BankAccount{})
 	addEnumsFor(W9{})
 	addEnumsFor(UserApproval{})
+	addEnumsFor(UserVerification{})
 	addEnumsFor(InsuranceClaim{})
 	addEnumsFor(Violation{})
 	apiHandlers["GetUsers"] = GetUsers
@@ -155,14 +166,12 @@ func init() {
 }
 
 func getPublicUser(userID int64) *User {
-	if userID == 0 {
-		return nil
-	}
-	user, err := getUser(userID)
-	if err != nil {
-		log.Printf("getUser(%d) => %s", userID, err.Error())
-		return nil
-	}
+	user, _ := getPublicX("User", userID).(*User)
+	return user
+}
+
+// publicUser makes the projection of a user that anyone may see
+func publicUser(user *User) *User {
 	return &User{
 		GivenName:      user.GivenName,
 		Description:    user.Description,
@@ -171,7 +180,7 @@ func getPublicUser(userID int64) *User {
 		ResponseCount:  user.ResponseCount,
 		ResponseSecSum: user.ResponseSecSum,
 		Audit: &Audit{
-			Created: user.Audit.Created,
+			Created: auditOf(user).Created,
 		},
 	}
 }
@@ -263,12 +272,18 @@ func GetUsers(req *Request, pub *Publication) *Response {
 			user.Contacts = nil
 			user.UserApprovals = nil
 			user.Favorites = nil
+			user.Wishlists = nil
+			user.Searches = nil
+			user.SearchDigested = nil
 			user.Notifications = nil
 			user.RewardPoints = 0
+			user.Rewards = nil
+			user.Referral = nil
 			user.Currency = ""
 			user.BankAccounts = nil
 			user.CreditCards = nil
 			user.W9s = nil
+			user.Crew = nil
 		}
 	}
 	resp.SubscriptionID = -1
@@ -284,39 +299,84 @@ func SetUser(req *Request, pub *Publication) *Response {
 		return errResponse(err)
 	}
 	staff := isStaff(req)
-	// can only add new User if I'm staff or I have no User yet; can only edit User if I'm staff or it's my User
-	// TODO: handle OrgAccess and editing other users in same org
+	// can only add new User if I'm staff or I have no User yet; can only edit User if I'm staff, it's my User, or it's
+	// in my org and I have its SetUser OrgAccess
 	addMyNewUser := req.User.ID == 0 && req.Session.UserID == 0
-	if !(staff || req.User.ID == req.Session.UserID || addMyNewUser) {
+	orgAdmin := !staff && req.User.ID != 0 && req.User.ID != req.Session.UserID && isOrgAdmin(req, req.Session.OrgID)
+	if !(staff || req.User.ID == req.Session.UserID || addMyNewUser || orgAdmin) {
 		return accessDenied()
 	}
 	// OrgID can only be 0 or my OrgID, unless I'm staff
 	if !(staff || req.User.OrgID == req.Session.OrgID || req.User.OrgID == 0) {
 		return &Response{ErrorCode: "BadOrgID"}
 	}
-	oldUser, err := getUser(req.User.ID)
-	if err != nil {
-		return errResponse(err)
-	}
-	req.User.Org = nil
-	// TODO: check OrgAccess, ReferredByUser, and ReferredByOrg
-	// if password changing, bcrypt it, since we don't even want to store the original MD5 hash of the password
-	if req.User.PasswordHash != "" {
-		bytes, err := bcrypt.GenerateFromPassword([]byte(req.User.PasswordHash), 13)
-		if err != nil {
-			return errResponse(err)
+	oldUser := &User{}
+	key, err := updateX("User", req.User.ID, req.IfMatch, oldUser, req.User, func() (interface{}, error) {
+		if orgAdmin && oldUser.OrgID != req.Session.OrgID {
+			return nil, errors.New("AccessDenied")
 		}
-		req.User.PasswordHashCrypt = string(bytes)
-		req.User.PasswordHash = ""
-	} else if oldUser != nil {
-		req.User.PasswordHashCrypt = oldUser.PasswordHashCrypt
-	}
-	// finalize and save
-	setAudit(staff, req.User, oldUser)
-	if err := setContacts(req.User.Contacts, oldUser.Contacts, req); err != nil {
-		return errResponse(err)
-	}
-	key, err := putUser(req.User)
+		req.User.Org = nil
+		// OrgAccess is only changed by SetOrg, SetOrgAccess, AcceptOrgInvite, and RemoveOrgMember, unless I'm staff
+		if !staff {
+			req.User.OrgAccess = oldUser.OrgAccess
+		}
+		// referrals and RewardPoints are only changed by a ReferralCode when signing up, AwardReferrals, and SetDeal, unless
+		// I'm staff
+		if !staff {
+			req.User.ReferredByUserID = oldUser.ReferredByUserID
+			req.User.ReferredByOrgID = oldUser.ReferredByOrgID
+			req.User.Referral = oldUser.Referral
+			req.User.RewardPoints = oldUser.RewardPoints
+			req.User.Rewards = oldUser.Rewards
+		}
+		// Favorites and Wishlists are only changed by AddFavorite, RemoveFavorite, SetWishlist, and RemoveWishlist, and
+		// Searches by SetSearch and RemoveSearch, unless I'm staff
+		if !staff {
+			req.User.Favorites = oldUser.Favorites
+			req.User.Wishlists = oldUser.Wishlists
+			req.User.Searches = oldUser.Searches
+			req.User.SearchDigested = oldUser.SearchDigested
+		}
+		if addMyNewUser && req.ReferralCode != "" {
+			if err := setReferral(req, req.User, req.ReferralCode); err != nil {
+				return nil, err
+			}
+		}
+		// an org admin can't change another member's contacts, credentials, or payment details, which they don't see
+		if orgAdmin {
+			req.User.Contacts = oldUser.Contacts
+			req.User.UserName = oldUser.UserName
+			req.User.PasswordHash = ""
+			req.User.TOTP = oldUser.TOTP
+			req.User.TOTPSent = oldUser.TOTPSent
+			req.User.BankAccounts = oldUser.BankAccounts
+			req.User.CreditCards = oldUser.CreditCards
+			req.User.W9s = oldUser.W9s
+		}
+		// if password changing, bcrypt it, since we don't even want to store the original MD5 hash of the password
+		if req.User.PasswordHash != "" {
+			bytes, err := bcrypt.GenerateFromPassword([]byte(req.User.PasswordHash), 13)
+			if err != nil {
+				return nil, err
+			}
+			req.User.PasswordHashCrypt = string(bytes)
+			req.User.PasswordHash = ""
+		} else if oldUser != nil {
+			req.User.PasswordHashCrypt = oldUser.PasswordHashCrypt
+		}
+		// Crew is only changed by SetCrew and AcceptCrew
+		req.User.Crew = oldUser.Crew
+		// UserApprovals are only changed by SetApproval and ReviewApproval, unless I'm staff
+		if !staff {
+			req.User.UserApprovals = oldUser.UserApprovals
+		}
+		// finalize and save
+		setAudit(staff, req.User, oldUser)
+		if err := setContacts(req.User.Contacts, oldUser.Contacts, req); err != nil {
+			return nil, err
+		}
+		return req.User, nil
+	})
 	if err != nil {
 		return errResponse(err)
 	}
@@ -328,6 +388,7 @@ func SetUser(req *Request, pub *Publication) *Response {
 		req.Session.Verified = isUserVerified(req.User)
 	}
 	return &Response{
-		ID: key.ID,
+		ID:      key.ID,
+		Version: req.User.Audit.Version,
 	}
 }
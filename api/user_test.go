@@ -7,12 +7,12 @@ import (
 func TestSetUser(t *testing.T) {
 	session := &Session{}
 	testAPI(t, session, nil, "SetUser", `{}`, `{"ErrorCode":"NeedUser"}`, nil)
-	testAPI(t, session, nil, "SetUser", `{"User":{"PasswordHash":"...","GivenName":"Dave","Contacts":[{"Type":"Email","Email":"johndoe@example.org"}]}}`, `{"ID":123}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "SetUser", `{"User":{"PasswordHash":"...","GivenName":"Dave","Contacts":[{"Type":"Email","Email":"johndoe@example.org"}]}}`, `{"ID":123,"Version":1}`, []mockDataStoreCall{
 		{
 			name:      "Put",
 			key:       idKey("User", 0),
 			src:       []*User{},
-			srcJSON:   `{"PasswordHashCrypt":"REDACTED","Contacts":[{"Type":"Email","Email":"johndoe@example.org"}],"Audit":{"Created":"2020-05-05T05:05:05Z","QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Dave"}}}`,
+			srcJSON:   `{"PasswordHashCrypt":"REDACTED","Contacts":[{"Type":"Email","Email":"johndoe@example.org"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Dave"}}}`,
 			keyResult: idKey("User", 123),
 		},
 	})
@@ -20,7 +20,7 @@ func TestSetUser(t *testing.T) {
 		t.Error("session.Verified should be false")
 	}
 	testVerifyCode = "1234"
-	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"GivenName":"Dave","Contacts":[{"Type":"Email","Email":"johndoe@example.org","VerifyCode":"SEND"}]}}`, `{"ID":123}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"GivenName":"Dave","Contacts":[{"Type":"Email","Email":"johndoe@example.org","VerifyCode":"SEND"}]}}`, `{"ID":123,"Version":1}`, []mockDataStoreCall{
 		{
 			name: "Get",
 			key:  idKey("User", 123),
@@ -30,14 +30,14 @@ func TestSetUser(t *testing.T) {
 			name:      "Put",
 			key:       idKey("User", 123),
 			src:       []*User{},
-			srcJSON:   `{"ID":123,"PasswordHashCrypt":"REDACTED","Contacts":[{"Type":"Email","Email":"johndoe@example.org","VerifyCode":"1234","Verifying":"2020-05-05T05:05:05Z"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Dave"}}}`,
+			srcJSON:   `{"ID":123,"PasswordHashCrypt":"REDACTED","Contacts":[{"Type":"Email","Email":"johndoe@example.org","VerifyCode":"1234","Verifying":"2020-05-05T05:05:05Z"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Dave"}}}`,
 			keyResult: idKey("User", 123),
 		},
 	})
 	if session.Verified != false {
 		t.Error("session.Verified should be false")
 	}
-	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"GivenName":"Dave","Contacts":[{"Type":"Email","Email":"johndoe@example.org","VerifyCode":"1234"},{"Type":"Phone","Phone":"407-555-1212","VerifyCode":"5678"}]}}`, `{"ID":123}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"GivenName":"Dave","Contacts":[{"Type":"Email","Email":"johndoe@example.org","VerifyCode":"1234"},{"Type":"Phone","Phone":"407-555-1212","VerifyCode":"5678"}]}}`, `{"ID":123,"Version":1}`, []mockDataStoreCall{
 		{
 			name: "Get",
 			key:  idKey("User", 123),
@@ -47,7 +47,7 @@ func TestSetUser(t *testing.T) {
 			name:      "Put",
 			key:       idKey("User", 123),
 			src:       []*User{},
-			srcJSON:   `{"ID":123,"PasswordHashCrypt":"REDACTED","Contacts":[{"Type":"Email","Email":"johndoe@example.org","Verified":"2020-05-05T05:05:05Z"},{"Type":"Phone","Phone":"407-555-1212","Verified":"2020-05-05T05:05:05Z"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Dave"}}}`,
+			srcJSON:   `{"ID":123,"PasswordHashCrypt":"REDACTED","Contacts":[{"Type":"Email","Email":"johndoe@example.org","Verified":"2020-05-05T05:05:05Z"},{"Type":"Phone","Phone":"407-555-1212","Verified":"2020-05-05T05:05:05Z"}],"Audit":{"Created":"2020-05-05T05:05:05Z","Updated":"2020-05-05T05:05:05Z","Version":1,"QANeeded":"2020-05-05T05:05:05Z","QAFields":["User.GivenName"],"User":{"GivenName":"Dave"}}}`,
 			keyResult: idKey("User", 123),
 		},
 	})
@@ -56,7 +56,7 @@ func TestSetUser(t *testing.T) {
 	}
 	session.OrgID = 124
 	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"OrgID":125}}`, `{"ErrorCode":"BadOrgID"}`, nil)
-	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"OrgID":124}}`, `{"ID":123}`, []mockDataStoreCall{
+	testAPI(t, session, nil, "SetUser", `{"User":{"ID":123,"OrgID":124}}`, `{"ID":123,"Version":1}`, []mockDataStoreCall{
 		{
 			name: "Get",
 			key:  idKey("User", 123),
@@ -66,7 +66,7 @@ func TestSetUser(t *testing.T) {
 			name:      "Put",
 			key:       idKey("User", 123),
 			src:       []*User{},
-			srcJSON:   `{"ID":123,"OrgID":124,"Audit":{"Created":"2020-05-05T05:05:05Z"}}`,
+			srcJSON:   `{"ID":123,"OrgID":124,"Audit":{"Created":"2020-05-05T05:05:05Z","Version":1}}`,
 			keyResult: idKey("User", 123),
 		},
 	})
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/websocket"
+)
+
+// handleWS serves /api/WS, a WebSocket that takes Request frames, each naming its APIName, and sends back each one's
+// Response along with the deltas of the subscriptions made on it, like /api/SSE does; a session may have any number of
+// them, and their subscriptions end when they close
+func handleWS(w http.ResponseWriter, r *http.Request, session *Session, ip string) {
+	// there's no Handshake, so like the rest of the API, any Origin may connect
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		serveWS(ws, session, ip)
+	}}.ServeHTTP(w, r)
+}
+
+func serveWS(ws *websocket.Conn, session *Session, ip string) {
+	conn := &sseConnection{Session: session, Publications: make(chan *Publication, sseQueueSize), Policy: ssePolicy(ws.Request())}
+	// tell the hub that we're opening a new connection on a session
+	if !sse.open(conn) {
+		return
+	}
+	done := make(chan struct{})
+	defer func() {
+		sse.close(conn)
+		close(done)
+		unsubscribeConnection(session, conn.Publications)
+		sessionLog(&Request{Session: session}, "Info", "WS done")
+	}()
+	// process any publications, sending the deltas of this connection's subscriptions; if the hub stops, so does the
+	// connection
+	go func() {
+		for pub := conn.next(done); pub != nil; pub = conn.next(done) {
+			updateSubscriptions(session, pub, conn.Publications, func(sub *subscription, deltaResp *Response) {
+				websocket.JSON.Send(ws, deltaResp)
+			})
+		}
+		ws.Close()
+	}()
+	for {
+		req := &Request{}
+		var resp *Response
+		if err := websocket.JSON.Receive(ws, req); err == io.EOF {
+			return
+		} else if se, ok := err.(*json.SyntaxError); ok {
+			resp = &Response{ErrorCode: "BadJSON", ErrorDetails: map[string]string{
+				"Offset": strconv.FormatInt(se.Offset, 10),
+				"Error":  se.Error(),
+			}}
+		} else if ute, ok := err.(*json.UnmarshalTypeError); ok {
+			resp = &Response{ErrorCode: "BadJSON", ErrorDetails: map[string]string{
+				"Offset": strconv.FormatInt(ute.Offset, 10),
+				"Field":  ute.Field,
+				"Value":  ute.Value,
+				"Type":   ute.Type.Name(),
+			}}
+		} else if err != nil {
+			return
+		} else if req.APIName == "" {
+			resp = &Response{ErrorCode: "NeedAPIName"}
+		} else if handler, ok := apiHandlers[req.APIName]; !ok {
+			resp = &Response{ErrorCode: "BadAPIName", ErrorDetails: map[string]string{
+				"Name": req.APIName,
+			}}
+		} else {
+			throttleAPI(ip, req.APIName)
+			req.Session = session
+			resp = callAPIHandler(req, handler, conn.Publications)
+		}
+		resp.Seq = req.Seq
+		if err := websocket.JSON.Send(ws, resp); err != nil {
+			return
+		}
+	}
+}
+
+// unsubscribeConnection removes the subscriptions made on a connection that's closed
+func unsubscribeConnection(session *Session, connection chan *Publication) {
+	session.SubscriptionsMutex.Lock()
+	defer session.SubscriptionsMutex.Unlock()
+	for id, sub := range session.Subscriptions {
+		if sub.Connection == connection {
+			delete(session.Subscriptions, id)
+		}
+	}
+}
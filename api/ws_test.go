@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWS(t *testing.T) {
+	runs := 0
+	apiHandlers["TestWS"] = func(req *Request, pub *Publication) *Response {
+		runs++
+		dependOn(req, Dependency{Kind: "Boat", UserIDs: []int64{req.Session.UserID}})
+		return &Response{SubscriptionID: -1, Boats: map[int64]*Boat{12301: {Name: "Sea Breeze " + strconv.Itoa(runs)}}}
+	}
+	defer delete(apiHandlers, "TestWS")
+	session := &Session{UserID: 123, Subscriptions: map[int64]*subscription{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleWS(w, r, session, "127.0.0.1")
+	}))
+	defer server.Close()
+	dial := func() *websocket.Conn {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+		if err != nil {
+			t.Fatalf("websocket.Dial() => %s", err.Error())
+		}
+		return ws
+	}
+	test := func(ws *websocket.Conn, reqJSON string, expect string) {
+		if reqJSON != "" {
+			if err := websocket.Message.Send(ws, reqJSON); err != nil {
+				t.Fatalf("Send(%s) => %s", reqJSON, err.Error())
+			}
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var actual string
+		if err := websocket.Message.Receive(ws, &actual); err != nil {
+			t.Fatalf("Receive() after %s => %s", reqJSON, err.Error())
+		}
+		if actual != expect {
+			t.Errorf("WS %s wrong result\n  actual:%s\n  expect:%s\n", reqJSON, actual, expect)
+		}
+	}
+	ws1 := dial()
+	ws2 := dial()
+	defer ws2.Close()
+	test(ws1, `{"Seq":1}`, `{"Seq":1,"ErrorCode":"NeedAPIName"}`)
+	test(ws1, `{"APIName":"GetNothing","Seq":2}`, `{"Seq":2,"ErrorCode":"BadAPIName","ErrorDetails":{"Name":"GetNothing"}}`)
+	test(ws1, `{"APIName":"TestWS","Seq":3,"Subscribe":true}`, `{"Seq":3,"SubscriptionID":1,"Boats":{"12301":{"Name":"Sea Breeze 1","Trailer":{}}}}`)
+	// a change to my boat re-runs the subscription, and its delta is only sent on the connection it was made on
+	sse.publish(&Publication{Kind: "Boat", ID: 12301, UserIDs: []int64{123}, BoatIDs: []int64{12301}})
+	test(ws1, ``, `{"SubscriptionID":1,"Boats":{"12301":{"Name":"Sea Breeze 2","Trailer":{}}}}`)
+	test(ws2, `{"APIName":"TestWS","Seq":1}`, `{"Seq":1,"Boats":{"12301":{"Name":"Sea Breeze 3","Trailer":{}}}}`)
+	// closing a connection ends its subscriptions
+	ws1.Close()
+	count := func() int {
+		session.SubscriptionsMutex.RLock()
+		defer session.SubscriptionsMutex.RUnlock()
+		return len(session.Subscriptions)
+	}
+	for i := 0; i < 50 && count() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := count(); count != 0 {
+		t.Errorf("closing WS left %d subscriptions", count)
+	}
+	test(ws2, `{"APIName":"Unsubscribe","SubscriptionID":1,"Seq":2}`, `{"Seq":2,"ErrorCode":"BadSubscriptionID"}`)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"boatfuji.com/api"
@@ -20,32 +22,46 @@ func main() {
 			notifyAdmin("Panic")
 		}
 	}()
-	// notify admin on shutdown
-	go func() {
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch)
-		_ = <-ch
-		notifyAdmin("Stopped")
-	}()
 	api.Start()
 	sites.Start()
 	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("www"))))
 	http.HandleFunc("/api/", api.DispatchToAPIHandler)
 	http.HandleFunc("/help/", helpHandler)
 	// addr.txt will have content like boatfuji.com:8168,66.226.72.106:443
-	if addrFile, err := ioutil.ReadFile("addr.txt"); err != nil {
+	addrFile, err := ioutil.ReadFile("addr.txt")
+	if err != nil {
 		panic(err)
-	} else {
-		addrs := strings.Split(string(addrFile), ",")
-		for i, addr := range addrs {
-			// wait only on the last addr, since we don't want to block, nor do we want to exit
-			if i == len(addrs)-1 {
-				listenAndServe(addr)
-			} else {
-				go listenAndServe(addr)
+	}
+	servers := []*http.Server{}
+	for _, addr := range strings.Split(string(addrFile), ",") {
+		servers = append(servers, &http.Server{Addr: addr})
+	}
+	// on shutdown, end SSE and WebSocket connections, let requests finish, and notify admin before exiting
+	stopped := make(chan struct{})
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		api.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown(%s) => %s", server.Addr, err.Error())
 			}
 		}
+		notifyAdmin("Stopped")
+		close(stopped)
+	}()
+	for i, server := range servers {
+		// wait only on the last server, since we don't want to block, nor do we want to exit until it's stopped
+		if i == len(servers)-1 {
+			listenAndServe(server)
+		} else {
+			go listenAndServe(server)
+		}
 	}
+	<-stopped
 }
 
 func notifyAdmin(body string) {
@@ -73,11 +89,15 @@ func helpHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func listenAndServe(addr string) {
-	log.Println("Listening at " + addr)
-	if strings.HasSuffix(addr, ":443") {
-		log.Fatal(http.ListenAndServeTLS(addr, "certs/www_boatfuji_com.crt", "certs/server.key", nil))
+func listenAndServe(server *http.Server) {
+	log.Println("Listening at " + server.Addr)
+	var err error
+	if strings.HasSuffix(server.Addr, ":443") {
+		err = server.ListenAndServeTLS("certs/www_boatfuji_com.crt", "certs/server.key")
 	} else {
-		log.Fatal(http.ListenAndServe(addr, nil))
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
 }